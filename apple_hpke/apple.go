@@ -1,9 +1,12 @@
 package apple_hpke
 
 import (
-	"bytes"
 	"crypto/ecdh"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/fxamacker/cbor/v2"
 	"github.com/kokukuma/identity-credential-api-demo/mdoc"
@@ -12,6 +15,56 @@ import (
 
 // https://developer.apple.com/documentation/passkit_apple_pay_and_wallet/wallet/verifying_wallet_identity_requests
 
+const APPLE_HPKE_V1 = "APPLE-HPKE-v1"
+
+// TopicIdentity is the topic of the plaintext holding the DeviceResponse.
+const TopicIdentity = "identity"
+
+var (
+	ErrUnsupportedAlgorithm   = errors.New("unsupported algorithm")
+	ErrNoMatchingRecipientKey = fmt.Errorf("no matching %w", protocol.ErrRecipientKeyMismatch)
+	ErrRecipientKeyMismatch   = protocol.ErrRecipientKeyMismatch
+	ErrDeviceAuth             = errors.New("device authentication failed")
+	ErrMissingTopic           = errors.New("missing topic")
+	// ErrDeviceMacUnsupported is returned for a document authenticated with deviceMac: the
+	// EMacKey needs a reader key, which the Apple flow has none of.
+	ErrDeviceMacUnsupported = fmt.Errorf("%w: deviceMac is not supported", ErrDeviceAuth)
+
+	// algorithms maps the envelope algorithms we know how to decrypt to their HPKE suite.
+	algorithmsMu sync.RWMutex
+	algorithms   = map[string]protocol.HPKESuite{
+		APPLE_HPKE_V1: protocol.DefaultHPKESuite, // DHKEM(P-256, HKDF-SHA256), HKDF-SHA256, AES-128-GCM
+	}
+)
+
+// RegisterAlgorithm accepts envelopes of alg and decrypts them with suite, e.g. for a
+// suite Apple introduces before this package knows it. It replaces any earlier registration.
+// suite is registered with protocol.RegisterHPKESuite, whose error is returned for a suite
+// that cannot decrypt.
+func RegisterAlgorithm(alg string, suite protocol.HPKESuite) error {
+	if err := protocol.RegisterHPKESuite(suite); err != nil {
+		return err
+	}
+	algorithmsMu.Lock()
+	defer algorithmsMu.Unlock()
+	algorithms[alg] = suite
+	return nil
+}
+
+// UnsupportedAlgorithmError is returned for an envelope whose algorithm is not registered.
+type UnsupportedAlgorithmError struct {
+	Algorithm string
+	Supported []string
+}
+
+func (e *UnsupportedAlgorithmError) Error() string {
+	return fmt.Sprintf("%v: %q, supported: %s", ErrUnsupportedAlgorithm, e.Algorithm, strings.Join(e.Supported, ", "))
+}
+
+func (e *UnsupportedAlgorithmError) Unwrap() error {
+	return ErrUnsupportedAlgorithm
+}
+
 type HPKEEnvelope struct {
 	Algorithm string     `json:"algorithm"`
 	Params    HPKEParams `json:"params"`
@@ -25,67 +78,235 @@ type HPKEParams struct {
 	InfoHash []byte `json:"infoHash"`
 }
 
+// KeyResolver picks the merchant encryption key an envelope was encrypted to.
+type KeyResolver interface {
+	// ResolveKey returns the key whose public key hashes to pkRHash, or an error wrapping
+	// ErrNoMatchingRecipientKey. It can be an *ecdh.PrivateKey or a key held by an HSM or KMS.
+	ResolveKey(pkRHash []byte) (protocol.KeyAgreement, error)
+}
+
+// RecipientKeys resolves among a fixed set of keys, e.g. the old and new key during rotation.
+type RecipientKeys []protocol.KeyAgreement
+
+func (k RecipientKeys) ResolveKey(pkRHash []byte) (protocol.KeyAgreement, error) {
+	for _, key := range k {
+		if protocol.Equal(recipientKeyHash(key), pkRHash) {
+			return key, nil
+		}
+	}
+	protocol.Log.Debug("no recipient key for pkRHash", "pkRHash", fmt.Sprintf("%x", pkRHash))
+	return nil, ErrNoMatchingRecipientKey
+}
+
+// RecipientKey resolves to key only, like ParseDeviceResponse does.
+func RecipientKey(key protocol.KeyAgreement) KeyResolver {
+	return recipientKey{key}
+}
+
+// recipientKey is a single configured key. A mismatch there is a misconfiguration rather
+// than an unknown key, so both hashes are logged.
+type recipientKey struct {
+	key protocol.KeyAgreement
+}
+
+func (k recipientKey) ResolveKey(pkRHash []byte) (protocol.KeyAgreement, error) {
+	if hash := recipientKeyHash(k.key); !protocol.Equal(hash, pkRHash) {
+		protocol.Log.Warn("recipient key mismatch", "requesterIDHash", fmt.Sprintf("%x", hash), "pkRHash", fmt.Sprintf("%x", pkRHash))
+		return nil, ErrRecipientKeyMismatch
+	}
+	return k.key, nil
+}
+
+func recipientKeyHash(key protocol.KeyAgreement) []byte {
+	return protocol.DigestSHA256(key.PublicKey().Bytes())
+}
+
 func ParseDeviceResponse(
 	data []byte,
 	merchantID, temaID string,
 	privateKey *ecdh.PrivateKey,
 	nonceByte []byte) (*mdoc.DeviceResponse, []byte, error) {
+	return ParseDeviceResponseWithResolver(data, merchantID, temaID, recipientKey{privateKey}, nonceByte)
+}
+
+// ParseDeviceResponseWithResolver is ParseDeviceResponse with the private key chosen by
+// the pkRHash of the envelope, so only the matching key is ever tried.
+func ParseDeviceResponseWithResolver(
+	data []byte,
+	merchantID, temaID string,
+	resolver KeyResolver,
+	nonceByte []byte) (*mdoc.DeviceResponse, []byte, error) {
+	result, err := Parse(data, merchantID, temaID, resolver, nonceByte)
+	if err != nil {
+		return nil, nil, err
+	}
+	return result.DeviceResponse, result.SessionTranscript, nil
+}
+
+// Result is a decrypted envelope together with how it was decrypted.
+type Result struct {
+	DeviceResponse    *mdoc.DeviceResponse
+	SessionTranscript []byte
+	// Transcript is what SessionTranscript encodes, for logging what the envelope was bound to.
+	Transcript *AppleSessionTranscript
+	HPKE       protocol.HPKEInfo
+	// Topics are all topics of the plaintext, undecoded, including TopicIdentity.
+	Topics map[string]cbor.RawMessage
+}
+
+// Parse decrypts an Apple envelope and reports the HPKE suite and recipient key used.
+func Parse(
+	data []byte,
+	merchantID, temaID string,
+	resolver KeyResolver,
+	nonceByte []byte) (*Result, error) {
 
 	var claims HPKEEnvelope
-	if err := cbor.Unmarshal(data, &claims); err != nil {
-		return nil, nil, fmt.Errorf("Error unmarshal cbor string: %v", err)
+	if err := protocol.DecMode.Unmarshal(data, &claims); err != nil {
+		return nil, fmt.Errorf("Error unmarshal cbor string: %v", err)
 	}
 
-	// Decrypt the ciphertext
-	info, err := generateAppleSessionTranscript(merchantID, temaID, nonceByte, protocol.Digest(privateKey.PublicKey().Bytes(), "SHA-256"))
+	suite, err := checkAlgorithm(claims.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := resolver.ResolveKey(claims.Params.PkRHash)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create aad: %v", err)
+		return nil, err
 	}
 
-	if !bytes.Equal(protocol.Digest(info, "SHA-256"), claims.Params.InfoHash) {
-		return nil, nil, fmt.Errorf("infoHash is not match: %v != %v", protocol.Digest(info, "SHA-256"), claims.Params.InfoHash)
+	// Decrypt the ciphertext
+	transcript := NewAppleSessionTranscript(merchantID, temaID, nonceByte, recipientKeyHash(privateKey))
+	info, err := transcript.Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aad: %v", err)
 	}
 
-	if !bytes.Equal(protocol.Digest(privateKey.PublicKey().Bytes(), "SHA-256"), claims.Params.PkRHash) {
-		return nil, nil, fmt.Errorf("PkRHash is not match")
+	if !protocol.Equal(protocol.DigestSHA256(info), claims.Params.InfoHash) {
+		protocol.Log.Warn("infoHash mismatch", "computed", fmt.Sprintf("%x", protocol.DigestSHA256(info)), "envelope", fmt.Sprintf("%x", claims.Params.InfoHash))
+		return nil, protocol.ErrInfoHashMismatch
 	}
+	protocol.Log.Debug("infoHash match")
 
-	plaintext, err := protocol.DecryptHPKE(claims.Data, claims.Params.PkEM, info, privateKey)
+	// The ciphertext was copied out of the envelope while decoding, it is ours to overwrite.
+	plaintext, err := protocol.DecryptHPKEInPlace(suite, claims.Data, claims.Params.PkEM, info, privateKey)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Error DecryptHPKE: %v", err)
+		return nil, fmt.Errorf("Error DecryptHPKE: %w", err)
 	}
 
-	topics := struct {
-		Identity mdoc.DeviceResponse `json:"identity"`
-	}{}
+	topics := map[string]cbor.RawMessage{}
+	if err := protocol.DecMode.Unmarshal(plaintext, &topics); err != nil {
+		return nil, protocol.DiagnosticError(fmt.Errorf("Error unmarshal cbor string: %v", err), plaintext)
+	}
+
+	identity, ok := topics[TopicIdentity]
+	if !ok {
+		names := make([]string, 0, len(topics))
+		for name := range topics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("%w: %q, got %s", ErrMissingTopic, TopicIdentity, strings.Join(names, ", "))
+	}
+	var deviceResponse mdoc.DeviceResponse
+	if err := protocol.DecMode.Unmarshal(identity, &deviceResponse); err != nil {
+		return nil, protocol.DiagnosticError(fmt.Errorf("Error unmarshal %s topic: %v", TopicIdentity, err), identity)
+	}
 
-	if err := cbor.Unmarshal(plaintext, &topics); err != nil {
-		return nil, nil, fmt.Errorf("Error unmarshal cbor string: %v", err)
+	if err := deviceResponse.CheckDocuments(); err != nil {
+		return nil, err
 	}
 
-	return &topics.Identity, info, nil
+	return &Result{
+		DeviceResponse:    &deviceResponse,
+		SessionTranscript: info,
+		Transcript:        transcript,
+		HPKE:              protocol.NewHPKEInfo(suite, privateKey),
+		Topics:            topics,
+	}, nil
 }
 
-const APPLE_HANDOVER_V1 = "AppleIdentityPresentment_1.0"
+// VerifyDeviceAuth checks that every document was signed by its MSO deviceKey for the
+// SessionTranscript of this envelope. It does not authenticate the issuer, mdoc.VerifyDocument does.
+// A document with a deviceMac instead fails with ErrDeviceMacUnsupported.
+func (r *Result) VerifyDeviceAuth() error {
+	for _, doc := range r.DeviceResponse.Documents {
+		if len(doc.DeviceSigned.DeviceAuth.DeviceMac) > 0 && doc.DeviceSigned.DeviceAuth.DeviceSignature.Signature == nil {
+			return fmt.Errorf("%w: %s", ErrDeviceMacUnsupported, doc.DocType)
+		}
+		mso, err := doc.IssuerSigned.MobileSecurityObject()
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrDeviceAuth, doc.DocType, err)
+		}
+		if err := mdoc.VerifyDeviceSigned(mso, doc, r.SessionTranscript); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrDeviceAuth, doc.DocType, err)
+		}
+	}
+	return nil
+}
+
+// checkAlgorithm returns the suite registered for alg, or an *UnsupportedAlgorithmError.
+func checkAlgorithm(alg string) (protocol.HPKESuite, error) {
+	algorithmsMu.RLock()
+	defer algorithmsMu.RUnlock()
+	if suite, ok := algorithms[alg]; ok {
+		return suite, nil
+	}
 
-func generateAppleSessionTranscript(merchantID, temaID string, nonce, requesterIdHash []byte) ([]byte, error) {
-	// Create the final CBOR array
-	appleHandover := []interface{}{
-		nil, // DeviceEngagementBytes
-		nil, // EReaderKeyBytes
-		[]interface{}{ // AppleHandover
-			APPLE_HANDOVER_V1,
-			nonce,
-			merchantID,
-			temaID,
-			requesterIdHash,
-		},
+	var supported []string
+	for a := range algorithms {
+		supported = append(supported, a)
 	}
+	sort.Strings(supported)
+	return protocol.HPKESuite{}, &UnsupportedAlgorithmError{Algorithm: alg, Supported: supported}
+}
 
-	transcript, err := cbor.Marshal(appleHandover)
+// VerifyInfoHash builds the Apple handover from the given inputs and reports whether its
+// hash matches expectedInfoHash, without touching HPKE.
+// It lets integrators check their merchant/team/nonce wiring independently of decryption.
+func VerifyInfoHash(merchantID, teamID string, nonce, recipientPubHash, expectedInfoHash []byte) (bool, []byte, error) {
+	info, err := generateAppleSessionTranscript(merchantID, teamID, nonce, recipientPubHash)
 	if err != nil {
-		return nil, fmt.Errorf("error encoding transcript: %v", err)
+		return false, nil, fmt.Errorf("failed to create aad: %v", err)
+	}
+
+	computed := protocol.DigestSHA256(info)
+	return protocol.Equal(computed, expectedInfoHash), computed, nil
+}
+
+// EnvelopeInfo is what an envelope tells without decrypting it.
+type EnvelopeInfo struct {
+	Algorithm  string
+	Mode       uint
+	PkEMLength int
+	PkRHash    []byte
+	InfoHash   []byte
+	DataLength int
+	// RecipientKeyHash is the SHA-256 of the given key, RecipientKeyMatch is set
+	// when it equals PkRHash, i.e. the envelope was encrypted to that key.
+	RecipientKeyHash  []byte
+	RecipientKeyMatch bool
+}
+
+// InspectEnvelope parses the envelope parameters and checks pkRHash against priv,
+// without the handover and without decrypting. It tells integrators which key an envelope
+// was encrypted to before their merchant/team/nonce wiring is right, see VerifyInfoHash.
+func InspectEnvelope(data []byte, priv *ecdh.PrivateKey) (*EnvelopeInfo, error) {
+	var claims HPKEEnvelope
+	if err := protocol.DecMode.Unmarshal(data, &claims); err != nil {
+		return nil, fmt.Errorf("Error unmarshal cbor string: %v", err)
 	}
 
-	return transcript, nil
+	keyHash := recipientKeyHash(priv)
+	return &EnvelopeInfo{
+		Algorithm:         claims.Algorithm,
+		Mode:              claims.Params.Mode,
+		PkEMLength:        len(claims.Params.PkEM),
+		PkRHash:           claims.Params.PkRHash,
+		InfoHash:          claims.Params.InfoHash,
+		DataLength:        len(claims.Data),
+		RecipientKeyHash:  keyHash,
+		RecipientKeyMatch: protocol.Equal(keyHash, claims.Params.PkRHash),
+	}, nil
 }
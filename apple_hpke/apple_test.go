@@ -3,16 +3,21 @@ package apple_hpke
 import (
 	"bytes"
 	"crypto/ecdh"
+	"crypto/rand"
 	"crypto/x509"
 	"encoding/hex"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/cisco/go-hpke"
 	"github.com/davecgh/go-spew/spew"
+	"github.com/fxamacker/cbor/v2"
 	"github.com/kokukuma/identity-credential-api-demo/protocol"
 )
 
@@ -109,6 +114,274 @@ func TestParseDeviceResponse(t *testing.T) {
 			t.Fatalf("different version: %v != 1.0", deviceResp.Version)
 		}
 	})
+
+	t.Run("RecipientKeyMismatch", func(t *testing.T) {
+		otherKey, err := ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := ParseDeviceResponse(sampleHpkeEnvelope, merchantID, teamID, otherKey, nonceByte); !errors.Is(err, ErrRecipientKeyMismatch) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("DeviceAuth", func(t *testing.T) {
+		result, err := Parse(sampleHpkeEnvelope, merchantID, teamID, RecipientKeys{privKey}, nonceByte)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := result.VerifyDeviceAuth(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// A response replayed into another session is not bound to its transcript.
+		result.SessionTranscript, err = generateAppleSessionTranscript(merchantID, teamID, []byte("other nonce"), recipientKeyHash(privKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := result.VerifyDeviceAuth(); !errors.Is(err, ErrDeviceAuth) {
+			t.Fatalf("expected ErrDeviceAuth, got %v", err)
+		}
+	})
+
+	t.Run("HPKEInfo", func(t *testing.T) {
+		result, err := Parse(sampleHpkeEnvelope, merchantID, teamID, RecipientKeys{privKey}, nonceByte)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := result.HPKE.Suite.String(); got != "P-256/HKDF-SHA256/AES-128-GCM" {
+			t.Fatalf("unexpected suite: %s", got)
+		}
+		if result.HPKE.RecipientCurve != "P-256" {
+			t.Fatalf("unexpected recipient curve: %s", result.HPKE.RecipientCurve)
+		}
+	})
+
+	t.Run("UnsupportedAlgorithm", func(t *testing.T) {
+		var envelope HPKEEnvelope
+		if err := cbor.Unmarshal(sampleHpkeEnvelope, &envelope); err != nil {
+			t.Fatal(err)
+		}
+		envelope.Algorithm = "APPLE-HPKE-v2"
+		data, err := cbor.Marshal(envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = ParseDeviceResponse(data, merchantID, teamID, privKey, nonceByte)
+		var algErr *UnsupportedAlgorithmError
+		if !errors.Is(err, ErrUnsupportedAlgorithm) || !errors.As(err, &algErr) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if algErr.Algorithm != "APPLE-HPKE-v2" || len(algErr.Supported) != 1 || algErr.Supported[0] != APPLE_HPKE_V1 {
+			t.Fatalf("unexpected error: %+v", algErr)
+		}
+
+		if err := RegisterAlgorithm("APPLE-HPKE-v2", protocol.DefaultHPKESuite); err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			algorithmsMu.Lock()
+			delete(algorithms, "APPLE-HPKE-v2")
+			algorithmsMu.Unlock()
+		}()
+		if _, _, err := ParseDeviceResponse(data, merchantID, teamID, privKey, nonceByte); err != nil {
+			t.Fatalf("unexpected error after registering: %v", err)
+		}
+	})
+
+	t.Run("KeyRotation", func(t *testing.T) {
+		otherKey, err := ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		deviceResp, _, err := ParseDeviceResponseWithResolver(sampleHpkeEnvelope, merchantID, teamID, RecipientKeys{otherKey, privKey}, nonceByte)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if deviceResp.Version != "1.0" {
+			t.Fatalf("different version: %v != 1.0", deviceResp.Version)
+		}
+
+		_, _, err = ParseDeviceResponseWithResolver(sampleHpkeEnvelope, merchantID, teamID, RecipientKeys{otherKey}, nonceByte)
+		if !errors.Is(err, ErrNoMatchingRecipientKey) || !errors.Is(err, protocol.ErrRecipientKeyMismatch) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// The hashes are logged, not returned.
+		if strings.Contains(err.Error(), fmt.Sprintf("%x", recipientKeyHash(privKey))) {
+			t.Fatalf("error leaks pkRHash: %v", err)
+		}
+	})
+
+	t.Run("MalformedPkEM", func(t *testing.T) {
+		var envelope HPKEEnvelope
+		if err := cbor.Unmarshal(sampleHpkeEnvelope, &envelope); err != nil {
+			t.Fatal(err)
+		}
+		pkEM := envelope.Params.PkEM
+		for name, malformed := range map[string][]byte{
+			"Empty":      nil,
+			"Truncated":  pkEM[:len(pkEM)-1],
+			"Compressed": append([]byte{0x02 | pkEM[64]&1}, pkEM[1:33]...),
+			"OffCurve":   append(append([]byte{}, pkEM[:64]...), pkEM[64]^0x01),
+		} {
+			t.Run(name, func(t *testing.T) {
+				envelope.Params.PkEM = malformed
+				data, err := cbor.Marshal(envelope)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := Parse(data, merchantID, teamID, RecipientKeys{privKey}, nonceByte); !errors.Is(err, protocol.ErrInvalidEncapsulatedKey) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			})
+		}
+	})
+
+	t.Run("KeyAgreement", func(t *testing.T) {
+		result, err := Parse(sampleHpkeEnvelope, merchantID, teamID, RecipientKeys{hsmKey{privKey}}, nonceByte)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if result.DeviceResponse.Version != "1.0" || result.HPKE.RecipientCurve != "P-256" {
+			t.Fatalf("unexpected result: %+v", result.HPKE)
+		}
+	})
+
+	t.Run("RegisteredSuite", func(t *testing.T) {
+		result, err := Parse(sampleHpkeEnvelope, merchantID, teamID, RecipientKeys{privKey}, nonceByte)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := protocol.EncMode.Marshal(map[string]interface{}{"identity": result.DeviceResponse})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		suite := protocol.HPKESuite{KEM: hpke.DHKEM_X25519, KDF: hpke.KDF_HKDF_SHA256, AEAD: hpke.AEAD_CHACHA20POLY1305}
+		if err := RegisterAlgorithm("TEST-HPKE-X25519", suite); err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			algorithmsMu.Lock()
+			delete(algorithms, "TEST-HPKE-X25519")
+			algorithmsMu.Unlock()
+		}()
+
+		x25519, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := sealEnvelope(t, "TEST-HPKE-X25519", suite, x25519, plaintext)
+
+		result, err = Parse(data, merchantID, teamID, RecipientKeys{privKey, x25519}, nonceByte)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if result.HPKE.Suite != suite || result.HPKE.RecipientCurve != "X25519" {
+			t.Fatalf("unexpected HPKE info: %+v", result.HPKE)
+		}
+
+		// An envelope of the P-256 algorithm must not be opened with the X25519 key.
+		envelope := HPKEEnvelope{}
+		if err := cbor.Unmarshal(data, &envelope); err != nil {
+			t.Fatal(err)
+		}
+		envelope.Algorithm = APPLE_HPKE_V1
+		if data, err = cbor.Marshal(envelope); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Parse(data, merchantID, teamID, RecipientKeys{x25519}, nonceByte); !errors.Is(err, protocol.ErrInvalidEncapsulatedKey) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("UnsupportedSuite", func(t *testing.T) {
+		suite := protocol.HPKESuite{KEM: hpke.DHKEM_X448, KDF: hpke.KDF_HKDF_SHA512, AEAD: hpke.AEAD_AESGCM256}
+		if err := RegisterAlgorithm("TEST-HPKE-X448", suite); !errors.Is(err, protocol.ErrUnsupportedHPKESuite) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		algorithmsMu.RLock()
+		_, ok := algorithms["TEST-HPKE-X448"]
+		algorithmsMu.RUnlock()
+		if ok {
+			t.Fatal("registered an algorithm with an unsupported suite")
+		}
+	})
+
+	t.Run("Topics", func(t *testing.T) {
+		result, err := Parse(sampleHpkeEnvelope, merchantID, teamID, RecipientKeys{privKey}, nonceByte)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Topics) != 1 || result.Topics[TopicIdentity] == nil {
+			t.Fatalf("unexpected topics: %v", result.Topics)
+		}
+
+		plaintext, err := protocol.EncMode.Marshal(map[string]interface{}{
+			TopicIdentity: result.DeviceResponse,
+			"payment":     map[string]string{"amount": "1.00"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err = Parse(sealEnvelope(t, APPLE_HPKE_V1, protocol.DefaultHPKESuite, privKey, plaintext), merchantID, teamID, RecipientKeys{privKey}, nonceByte)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(result.Topics) != 2 || result.Topics["payment"] == nil || len(result.DeviceResponse.Documents) == 0 {
+			t.Fatalf("unexpected topics: %v", result.Topics)
+		}
+
+		plaintext, err = protocol.EncMode.Marshal(map[string]interface{}{"payment": "1.00"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = Parse(sealEnvelope(t, APPLE_HPKE_V1, protocol.DefaultHPKESuite, privKey, plaintext), merchantID, teamID, RecipientKeys{privKey}, nonceByte)
+		if !errors.Is(err, ErrMissingTopic) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// hsmKey exposes only the key agreement of a key, like a key held by an HSM.
+type hsmKey struct {
+	key *ecdh.PrivateKey
+}
+
+func (k hsmKey) PublicKey() *ecdh.PublicKey {
+	return k.key.PublicKey()
+}
+
+func (k hsmKey) ECDH(remote *ecdh.PublicKey) ([]byte, error) {
+	return k.key.ECDH(remote)
+}
+
+// sealEnvelope encrypts plaintext to key as an envelope of alg for the test session.
+func sealEnvelope(t *testing.T, alg string, suite protocol.HPKESuite, key *ecdh.PrivateKey, plaintext []byte) []byte {
+	t.Helper()
+	info, err := generateAppleSessionTranscript(merchantID, teamID, nonceByte, recipientKeyHash(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, pkEM, err := protocol.EncryptHPKE(suite, plaintext, info, key.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := cbor.Marshal(HPKEEnvelope{
+		Algorithm: alg,
+		Params: HPKEParams{
+			PkEM:     pkEM,
+			PkRHash:  recipientKeyHash(key),
+			InfoHash: protocol.DigestSHA256(info),
+		},
+		Data: ciphertext,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
 }
 
 func TestGenerateAppleSessionTranscript(t *testing.T) {
@@ -122,15 +395,49 @@ func TestGenerateAppleSessionTranscript(t *testing.T) {
 	publicKeyByte := privKey.PublicKey().Bytes()
 
 	t.Run("generateAppleSessionTranscript", func(t *testing.T) {
-		actual, err := generateAppleSessionTranscript(merchantID, teamID, nonceByte, protocol.Digest(publicKeyByte, "SHA-256"))
+		actual, err := generateAppleSessionTranscript(merchantID, teamID, nonceByte, protocol.DigestSHA256(publicKeyByte))
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
 		if sessionTranscript != hex.EncodeToString(actual) {
 			t.Fatalf("info is unmatched: %v != %v", sessionTranscript, string(actual))
 		}
-		if !bytes.Equal(infoHashByte, protocol.Digest(actual, "SHA-256")) {
-			t.Fatalf("infohash is unmatched: %v != %v", infoHashByte, protocol.Digest(actual, "SHA-256"))
+		if !bytes.Equal(infoHashByte, protocol.DigestSHA256(actual)) {
+			t.Fatalf("infohash is unmatched: %v != %v", infoHashByte, protocol.DigestSHA256(actual))
+		}
+	})
+
+	t.Run("ParseResult", func(t *testing.T) {
+		dataPath, err := getPath("hpke_envelope.cbor")
+		if err != nil {
+			t.Fatal(err)
+		}
+		hexString, err := os.ReadFile(dataPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		envelope, err := hex.DecodeString(string(hexString))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := Parse(envelope, merchantID, teamID, RecipientKeys{privKey}, nonceByte)
+		if err != nil {
+			t.Fatal(err)
+		}
+		transcript := result.Transcript
+		if transcript.HandoverType != APPLE_HANDOVER_V1 || transcript.MerchantID != merchantID || transcript.TeamID != teamID {
+			t.Fatalf("unexpected transcript: %+v", transcript)
+		}
+		if !bytes.Equal(transcript.Nonce, nonceByte) || !bytes.Equal(transcript.RequesterIDHash, protocol.DigestSHA256(publicKeyByte)) {
+			t.Fatalf("unexpected transcript: %+v", transcript)
+		}
+		encoded, err := transcript.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(encoded, result.SessionTranscript) || hex.EncodeToString(encoded) != sessionTranscript {
+			t.Fatalf("encoding differs: %x", encoded)
 		}
 	})
 }
@@ -146,7 +453,88 @@ func TestPublickey(t *testing.T) {
 	publicKeyByte := privKey.PublicKey().Bytes()
 
 	pubByteSample, _ := hex.DecodeString("b2c00f06b2df645691174f1331ade35141f17e19b3021d07560b4a71fc61818c")
-	if !bytes.Equal(pubByteSample, protocol.Digest(publicKeyByte, "SHA-256")) {
+	if !bytes.Equal(pubByteSample, protocol.DigestSHA256(publicKeyByte)) {
 		t.Fatalf("info is unmatched")
 	}
 }
+
+func TestVerifyInfoHash(t *testing.T) {
+	setup()
+
+	privKey, err := loadPrivateKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	pubHash := protocol.DigestSHA256(privKey.PublicKey().Bytes())
+
+	t.Run("Match", func(t *testing.T) {
+		ok, computed, err := VerifyInfoHash(merchantID, teamID, nonceByte, pubHash, infoHashByte)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !ok || !bytes.Equal(computed, infoHashByte) {
+			t.Fatalf("infohash is unmatched: %x != %x", computed, infoHashByte)
+		}
+	})
+
+	t.Run("WrongTeamID", func(t *testing.T) {
+		ok, _, err := VerifyInfoHash(merchantID, "teamID", nonceByte, pubHash, infoHashByte)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ok {
+			t.Fatalf("infohash matched with a wrong teamID")
+		}
+	})
+}
+
+func TestInspectEnvelope(t *testing.T) {
+	setup()
+
+	dataPath, err := getPath("hpke_envelope.cbor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hexString, err := os.ReadFile(dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sampleHpkeEnvelope, err := hex.DecodeString(string(hexString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	privKey, err := loadPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Match", func(t *testing.T) {
+		info, err := InspectEnvelope(sampleHpkeEnvelope, privKey)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if info.Algorithm != APPLE_HPKE_V1 || info.PkEMLength != 65 {
+			t.Fatalf("unexpected params: %+v", info)
+		}
+		if !info.RecipientKeyMatch {
+			t.Fatalf("pkRHash %x does not match %x", info.PkRHash, info.RecipientKeyHash)
+		}
+		if !bytes.Equal(info.InfoHash, infoHashByte) {
+			t.Fatalf("unexpected infoHash: %x", info.InfoHash)
+		}
+	})
+
+	t.Run("OtherKey", func(t *testing.T) {
+		otherKey, err := ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := InspectEnvelope(sampleHpkeEnvelope, otherKey)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if info.RecipientKeyMatch {
+			t.Fatal("pkRHash matched another key")
+		}
+	})
+}
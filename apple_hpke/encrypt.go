@@ -0,0 +1,45 @@
+package apple_hpke
+
+import (
+	"crypto/ecdh"
+	"fmt"
+
+	"github.com/kokukuma/identity-credential-api-demo/mdoc"
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+)
+
+// EncryptDeviceResponse is the wallet side of Parse: it seals resp as the identity topic
+// of an APPLE-HPKE-v1 envelope to the merchant key, for tests and wallet simulators.
+// The DeviceAuth of resp must already be bound to the SessionTranscript of these inputs,
+// see NewAppleSessionTranscript.
+func EncryptDeviceResponse(resp *mdoc.DeviceResponse, merchantID, teamID string, merchantKey *ecdh.PublicKey, nonce []byte) ([]byte, error) {
+	plaintext, err := protocol.EncMode.Marshal(map[string]interface{}{TopicIdentity: resp})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal topics: %v", err)
+	}
+
+	pkRHash := protocol.DigestSHA256(merchantKey.Bytes())
+	info, err := NewAppleSessionTranscript(merchantID, teamID, nonce, pkRHash).Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aad: %v", err)
+	}
+
+	suite, err := checkAlgorithm(APPLE_HPKE_V1)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, pkEM, err := protocol.EncryptHPKE(suite, plaintext, info, merchantKey)
+	if err != nil {
+		return nil, fmt.Errorf("Error EncryptHPKE: %w", err)
+	}
+
+	return protocol.EncMode.Marshal(HPKEEnvelope{
+		Algorithm: APPLE_HPKE_V1,
+		Params: HPKEParams{
+			PkEM:     pkEM,
+			PkRHash:  pkRHash,
+			InfoHash: protocol.DigestSHA256(info),
+		},
+		Data: ciphertext,
+	})
+}
@@ -0,0 +1,77 @@
+package apple_hpke
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestEncryptDeviceResponse(t *testing.T) {
+	setup()
+
+	dataPath, err := getPath("hpke_envelope.cbor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hexString, err := os.ReadFile(dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := hex.DecodeString(string(hexString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	privKey, err := loadPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sample, err := Parse(envelope, merchantID, teamID, RecipientKeys{privKey}, nonceByte)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same merchant key and nonce, so the DeviceAuth of the sample still verifies.
+	data, err := EncryptDeviceResponse(sample.DeviceResponse, merchantID, teamID, privKey.PublicKey(), nonceByte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := InspectEnvelope(data, privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Algorithm != APPLE_HPKE_V1 || !info.RecipientKeyMatch {
+		t.Fatalf("unexpected envelope: %+v", info)
+	}
+
+	result, err := Parse(data, merchantID, teamID, RecipientKeys{privKey}, nonceByte)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(result.SessionTranscript, sample.SessionTranscript) {
+		t.Fatal("unexpected session transcript")
+	}
+	if err := result.VerifyDeviceAuth(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	t.Run("OtherMerchant", func(t *testing.T) {
+		otherKey, err := ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := EncryptDeviceResponse(sample.DeviceResponse, merchantID, teamID, otherKey.PublicKey(), nonceByte)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Parse(data, merchantID, teamID, RecipientKeys{privKey}, nonceByte); !errors.Is(err, ErrNoMatchingRecipientKey) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := Parse(data, "other merchant", teamID, RecipientKeys{otherKey}, nonceByte); err == nil {
+			t.Fatal("parsed an envelope for another merchant ID")
+		}
+	})
+}
@@ -0,0 +1,36 @@
+package apple_hpke
+
+import (
+	"encoding/hex"
+	"os"
+	"testing"
+)
+
+func FuzzParseHPKEEnvelope(f *testing.F) {
+	setup()
+
+	dataPath, err := getPath("hpke_envelope.cbor")
+	if err != nil {
+		f.Fatal(err)
+	}
+	hexString, err := os.ReadFile(dataPath)
+	if err != nil {
+		f.Fatal(err)
+	}
+	seed, err := hex.DecodeString(string(hexString))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(seed)
+	f.Add([]byte{0xa0})
+
+	privKey, err := loadPrivateKey()
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Any input must come back as a result or an error, never a panic.
+		Parse(data, merchantID, teamID, RecipientKeys{privKey}, nonceByte)
+	})
+}
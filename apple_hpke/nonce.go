@@ -0,0 +1,132 @@
+package apple_hpke
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kokukuma/identity-credential-api-demo/mdoc"
+)
+
+// ErrNonceNotIssued is returned for a nonce that was never issued, has expired or was
+// already consumed, i.e. an envelope that is replayed or arrives too late.
+var ErrNonceNotIssued = errors.New("nonce not issued, expired or already used")
+
+// NonceStore tracks the nonces of outstanding requests so that each response is accepted once.
+type NonceStore interface {
+	// Issue records nonce as outstanding for ttl.
+	Issue(ctx context.Context, nonce []byte, ttl time.Duration) error
+	// Consume removes nonce, or returns ErrNonceNotIssued when it is not outstanding.
+	// It must be atomic, two concurrent calls for one nonce must not both succeed.
+	Consume(ctx context.Context, nonce []byte) error
+}
+
+// MemoryNonceStore is a NonceStore for a single server process.
+type MemoryNonceStore struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time
+	now    func() time.Time
+}
+
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{
+		nonces: map[string]time.Time{},
+		now:    time.Now,
+	}
+}
+
+func (s *MemoryNonceStore) Issue(ctx context.Context, nonce []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	// Nonces that are never answered would pile up otherwise.
+	for key, expiry := range s.nonces {
+		if !now.Before(expiry) {
+			delete(s.nonces, key)
+		}
+	}
+	s.nonces[string(nonce)] = now.Add(ttl)
+	return nil
+}
+
+func (s *MemoryNonceStore) Consume(ctx context.Context, nonce []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expiry, ok := s.nonces[string(nonce)]
+	if !ok {
+		return ErrNonceNotIssued
+	}
+	delete(s.nonces, string(nonce))
+	if !s.now().Before(expiry) {
+		return fmt.Errorf("%w: expired at %s", ErrNonceNotIssued, expiry.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// RedisClient is the part of a Redis client RedisNonceStore needs, so that any client
+// library can be adapted to it.
+type RedisClient interface {
+	// Set is SET key value PX ttl.
+	Set(ctx context.Context, key, value string, ttl time.Duration) error
+	// Del is DEL key, returning the number of keys removed.
+	Del(ctx context.Context, key string) (int64, error)
+}
+
+// RedisNonceStore is a NonceStore shared by several servers. Redis expires the nonces,
+// and DEL removes a nonce atomically, so only one of concurrent Consume calls sees it.
+type RedisNonceStore struct {
+	Client RedisClient
+	// Prefix namespaces the keys, "apple_hpke:nonce:" by default.
+	Prefix string
+}
+
+func NewRedisNonceStore(client RedisClient) *RedisNonceStore {
+	return &RedisNonceStore{Client: client, Prefix: "apple_hpke:nonce:"}
+}
+
+func (s *RedisNonceStore) key(nonce []byte) string {
+	return s.Prefix + hex.EncodeToString(nonce)
+}
+
+func (s *RedisNonceStore) Issue(ctx context.Context, nonce []byte, ttl time.Duration) error {
+	if err := s.Client.Set(ctx, s.key(nonce), "1", ttl); err != nil {
+		return fmt.Errorf("failed to store nonce: %v", err)
+	}
+	return nil
+}
+
+func (s *RedisNonceStore) Consume(ctx context.Context, nonce []byte) error {
+	n, err := s.Client.Del(ctx, s.key(nonce))
+	if err != nil {
+		return fmt.Errorf("failed to consume nonce: %v", err)
+	}
+	if n == 0 {
+		return ErrNonceNotIssued
+	}
+	return nil
+}
+
+// ParseDeviceResponseWithNonceStore is ParseDeviceResponseWithResolver that also consumes
+// nonceByte from store. The nonce is consumed only once the envelope decrypted, so a
+// forged envelope cannot use up the nonce of the genuine response.
+func ParseDeviceResponseWithNonceStore(
+	ctx context.Context,
+	data []byte,
+	merchantID, temaID string,
+	resolver KeyResolver,
+	store NonceStore,
+	nonceByte []byte) (*mdoc.DeviceResponse, []byte, error) {
+	result, err := Parse(data, merchantID, temaID, resolver, nonceByte)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := store.Consume(ctx, nonceByte); err != nil {
+		return nil, nil, err
+	}
+	return result.DeviceResponse, result.SessionTranscript, nil
+}
@@ -0,0 +1,124 @@
+package apple_hpke
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis implements RedisClient with the semantics of SET PX and DEL.
+type fakeRedis struct {
+	mu   sync.Mutex
+	keys map[string]time.Time
+	now  time.Time
+}
+
+func (r *fakeRedis) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys[key] = r.now.Add(ttl)
+	return nil
+}
+
+func (r *fakeRedis) Del(ctx context.Context, key string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	expiry, ok := r.keys[key]
+	delete(r.keys, key)
+	if !ok || !r.now.Before(expiry) {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+func TestNonceStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	memory := NewMemoryNonceStore()
+	memory.now = func() time.Time { return now }
+	redis := &fakeRedis{keys: map[string]time.Time{}, now: now}
+
+	for name, store := range map[string]NonceStore{
+		"Memory": memory,
+		"Redis":  NewRedisNonceStore(redis),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := store.Issue(ctx, []byte("nonce"), time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Consume(ctx, []byte("nonce")); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := store.Consume(ctx, []byte("nonce")); !errors.Is(err, ErrNonceNotIssued) {
+				t.Fatalf("replay: unexpected error: %v", err)
+			}
+			if err := store.Consume(ctx, []byte("other")); !errors.Is(err, ErrNonceNotIssued) {
+				t.Fatalf("unknown: unexpected error: %v", err)
+			}
+
+			if err := store.Issue(ctx, []byte("late"), time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			now = now.Add(time.Minute)
+			redis.now = now
+			if err := store.Consume(ctx, []byte("late")); !errors.Is(err, ErrNonceNotIssued) {
+				t.Fatalf("expired: unexpected error: %v", err)
+			}
+		})
+	}
+
+	t.Run("Prefix", func(t *testing.T) {
+		store := NewRedisNonceStore(redis)
+		if err := store.Issue(ctx, []byte{0x01, 0x02}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := redis.keys["apple_hpke:nonce:0102"]; !ok {
+			t.Fatalf("unexpected keys: %v", redis.keys)
+		}
+	})
+}
+
+func TestParseDeviceResponseWithNonceStore(t *testing.T) {
+	setup()
+	ctx := context.Background()
+
+	dataPath, err := getPath("hpke_envelope.cbor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hexString, err := os.ReadFile(dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := hex.DecodeString(string(hexString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	privKey, err := loadPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewMemoryNonceStore()
+	// The sample envelope dates from long ago, only the clock of the store matters.
+	if err := store.Issue(ctx, nonceByte, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// A forged envelope must not use up the nonce.
+	if _, _, err := ParseDeviceResponseWithNonceStore(ctx, envelope[:len(envelope)-1], merchantID, teamID, RecipientKey(privKey), store, nonceByte); err == nil {
+		t.Fatal("parsed a truncated envelope")
+	}
+
+	if _, _, err := ParseDeviceResponseWithNonceStore(ctx, envelope, merchantID, teamID, RecipientKey(privKey), store, nonceByte); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := ParseDeviceResponseWithNonceStore(ctx, envelope, merchantID, teamID, RecipientKey(privKey), store, nonceByte); !errors.Is(err, ErrNonceNotIssued) {
+		t.Fatalf("replay: unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package apple_hpke
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/kokukuma/identity-credential-api-demo/mdoc"
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+)
+
+var ErrEmptyRequest = errors.New("no elements requested")
+
+// IdentityRequest is the request descriptor the frontend passes to the Verify with Wallet API.
+// It is built from the DeviceRequest the response is later checked against, so both sides
+// agree on the requested elements.
+type IdentityRequest struct {
+	MerchantID string            `json:"merchantIdentifier"`
+	TeamID     string            `json:"teamIdentifier"`
+	Nonce      string            `json:"nonce"`
+	Documents  []RequestDocument `json:"documents"`
+}
+
+type RequestDocument struct {
+	DocType  mdoc.DocType     `json:"docType"`
+	Elements []RequestElement `json:"elements"`
+}
+
+type RequestElement struct {
+	NameSpace      mdoc.NameSpace             `json:"namespace"`
+	Identifier     mdoc.DataElementIdentifier `json:"identifier"`
+	IntentToRetain bool                       `json:"intentToRetain"`
+}
+
+// NewIdentityRequest describes req for merchantID and teamID. Documents keep the order of
+// req, elements are sorted by namespace and identifier.
+func NewIdentityRequest(merchantID, teamID string, nonce protocol.Nonce, req *mdoc.DeviceRequest) (*IdentityRequest, error) {
+	idReq := &IdentityRequest{
+		MerchantID: merchantID,
+		TeamID:     teamID,
+		Nonce:      nonce.String(),
+		Documents:  []RequestDocument{},
+	}
+	for _, docRequest := range req.DocRequests {
+		itemsRequest := docRequest.ItemsRequest
+		doc := RequestDocument{DocType: itemsRequest.DocType, Elements: []RequestElement{}}
+		for ns, elements := range itemsRequest.NameSpaces {
+			for id, intentToRetain := range elements {
+				doc.Elements = append(doc.Elements, RequestElement{
+					NameSpace:      ns,
+					Identifier:     id,
+					IntentToRetain: intentToRetain,
+				})
+			}
+		}
+		if len(doc.Elements) == 0 {
+			return nil, fmt.Errorf("%s: %w", itemsRequest.DocType, ErrEmptyRequest)
+		}
+		sort.Slice(doc.Elements, func(i, j int) bool {
+			if doc.Elements[i].NameSpace != doc.Elements[j].NameSpace {
+				return doc.Elements[i].NameSpace < doc.Elements[j].NameSpace
+			}
+			return doc.Elements[i].Identifier < doc.Elements[j].Identifier
+		})
+		idReq.Documents = append(idReq.Documents, doc)
+	}
+	if len(idReq.Documents) == 0 {
+		return nil, ErrEmptyRequest
+	}
+	return idReq, nil
+}
+
+// BeginIdentityRequest creates the nonce and key of a new session and the descriptor of req.
+func BeginIdentityRequest(merchantID, teamID string, req *mdoc.DeviceRequest) (*IdentityRequest, *protocol.SessionData, error) {
+	nonce, err := protocol.CreateNonce()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create nonce: %v", err)
+	}
+	privKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+	idReq, err := NewIdentityRequest(merchantID, teamID, nonce, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return idReq, &protocol.SessionData{
+		Nonce:      nonce,
+		PrivateKey: privKey,
+	}, nil
+}
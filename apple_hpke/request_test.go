@@ -0,0 +1,76 @@
+package apple_hpke
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/kokukuma/identity-credential-api-demo/mdoc"
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+)
+
+func TestBeginIdentityRequest(t *testing.T) {
+	req := mdoc.NewDeviceRequest().
+		AddElements(mdoc.DocTypeMDL, false, mdoc.GivenName, mdoc.FamilyName).
+		AddElements(mdoc.DocTypeMDL, true, mdoc.BirthDate)
+
+	idReq, session, err := BeginIdentityRequest(merchantID, teamID, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idReq.Nonce != session.Nonce.String() || session.PrivateKey == nil {
+		t.Fatalf("session does not match the request: %v", idReq.Nonce)
+	}
+
+	data, err := json.Marshal(idReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var descriptor struct {
+		MerchantID string `json:"merchantIdentifier"`
+		TeamID     string `json:"teamIdentifier"`
+		Documents  []struct {
+			DocType  string `json:"docType"`
+			Elements []struct {
+				NameSpace      string `json:"namespace"`
+				Identifier     string `json:"identifier"`
+				IntentToRetain bool   `json:"intentToRetain"`
+			} `json:"elements"`
+		} `json:"documents"`
+	}
+	if err := json.Unmarshal(data, &descriptor); err != nil {
+		t.Fatal(err)
+	}
+	if descriptor.MerchantID != merchantID || descriptor.TeamID != teamID {
+		t.Fatalf("unexpected identifiers: %s", data)
+	}
+	if len(descriptor.Documents) != 1 || descriptor.Documents[0].DocType != string(mdoc.DocTypeMDL) {
+		t.Fatalf("unexpected documents: %s", data)
+	}
+	elements := descriptor.Documents[0].Elements
+	if len(elements) != 3 {
+		t.Fatalf("unexpected elements: %s", data)
+	}
+	for i, want := range []mdoc.Element{mdoc.BirthDate, mdoc.FamilyName, mdoc.GivenName} {
+		if elements[i].NameSpace != want.Namespace || elements[i].Identifier != want.Name {
+			t.Fatalf("element %d: got %s %s", i, elements[i].NameSpace, elements[i].Identifier)
+		}
+		if elements[i].IntentToRetain != (want == mdoc.BirthDate) {
+			t.Fatalf("%s: unexpected intentToRetain", want.Name)
+		}
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		nonce, err := protocol.CreateNonce()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewIdentityRequest(merchantID, teamID, nonce, mdoc.NewDeviceRequest()); !errors.Is(err, ErrEmptyRequest) {
+			t.Fatalf("expected ErrEmptyRequest, got %v", err)
+		}
+		req := mdoc.NewDeviceRequest().Add(mdoc.DocTypeMDL, mdoc.NameSpace(mdoc.GivenName.Namespace), false)
+		if _, err := NewIdentityRequest(merchantID, teamID, nonce, req); !errors.Is(err, ErrEmptyRequest) {
+			t.Fatalf("expected ErrEmptyRequest, got %v", err)
+		}
+	})
+}
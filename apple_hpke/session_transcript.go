@@ -0,0 +1,57 @@
+package apple_hpke
+
+import (
+	"fmt"
+
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+)
+
+const APPLE_HANDOVER_V1 = "AppleIdentityPresentment_1.0"
+
+// AppleSessionTranscript is the SessionTranscript of an Apple presentation, and the HPKE
+// info of its envelope:
+//
+//	[null, null, [HandoverType, Nonce, MerchantID, TeamID, RequesterIDHash]]
+type AppleSessionTranscript struct {
+	HandoverType string `json:"handoverType"`
+	Nonce        []byte `json:"nonce"`
+	MerchantID   string `json:"merchantID"`
+	TeamID       string `json:"teamID"`
+	// RequesterIDHash is the SHA-256 of the recipient public key.
+	RequesterIDHash []byte `json:"requesterIDHash"`
+}
+
+func NewAppleSessionTranscript(merchantID, teamID string, nonce, requesterIDHash []byte) *AppleSessionTranscript {
+	return &AppleSessionTranscript{
+		HandoverType:    APPLE_HANDOVER_V1,
+		Nonce:           nonce,
+		MerchantID:      merchantID,
+		TeamID:          teamID,
+		RequesterIDHash: requesterIDHash,
+	}
+}
+
+// Bytes returns the canonical CBOR encoding of t.
+func (t *AppleSessionTranscript) Bytes() ([]byte, error) {
+	transcript := []interface{}{
+		nil, // DeviceEngagementBytes
+		nil, // EReaderKeyBytes
+		[]interface{}{ // AppleHandover
+			t.HandoverType,
+			t.Nonce,
+			t.MerchantID,
+			t.TeamID,
+			t.RequesterIDHash,
+		},
+	}
+
+	b, err := protocol.EncMode.Marshal(transcript)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding transcript: %v", err)
+	}
+	return b, nil
+}
+
+func generateAppleSessionTranscript(merchantID, temaID string, nonce, requesterIdHash []byte) ([]byte, error) {
+	return NewAppleSessionTranscript(merchantID, temaID, nonce, requesterIdHash).Bytes()
+}
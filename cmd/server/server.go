@@ -22,6 +22,7 @@ func main() {
 
 	r.HandleFunc("/getIdentityRequest", srv.GetIdentityRequest).Methods("POST", "OPTIONS")
 	r.HandleFunc("/verifyIdentityResponse", srv.VerifyIdentityResponse).Methods("POST", "OPTIONS")
+	r.HandleFunc("/request_object", srv.RequestObject).Methods("GET", "POST")
 
 	serverAddress := ":8080"
 	log.Println("starting fido server at", serverAddress)
@@ -1,6 +1,6 @@
 module github.com/kokukuma/identity-credential-api-demo
 
-go 1.17
+go 1.18
 
 require (
 	github.com/cisco/go-hpke v0.0.0-20230407100446-246075f83609
@@ -11,6 +11,7 @@ require (
 	github.com/gorilla/mux v1.8.0
 	github.com/joho/godotenv v1.5.1
 	github.com/veraison/go-cose v1.1.0
+	golang.org/x/crypto v0.21.0
 )
 
 require (
@@ -19,7 +20,6 @@ require (
 	github.com/felixge/httpsnoop v1.0.1 // indirect
 	github.com/stretchr/testify v1.9.0 // indirect
 	github.com/x448/float16 v0.8.4 // indirect
-	golang.org/x/crypto v0.21.0 // indirect
 )
 
 require golang.org/x/sys v0.18.0 // indirect
@@ -1,7 +1,6 @@
 package server
 
 import (
-	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -10,6 +9,7 @@ import (
 	"net/http"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/kokukuma/identity-credential-api-demo/apple_hpke"
@@ -20,11 +20,37 @@ import (
 )
 
 var (
-	roots *x509.CertPool
-	b64   = base64.URLEncoding.WithPadding(base64.StdPadding)
+	trustStore *mdoc.TrustStore
+	b64        = base64.URLEncoding.WithPadding(base64.StdPadding)
 
 	merchantID = "merchantID"
 	teamID     = "teamID"
+
+	// appleNonceTTL is how long the user has to answer the Wallet sheet.
+	appleNonceTTL = 5 * time.Minute
+
+	openid4vpClientID = "digital-credentials.dev"
+	// externalBaseURL is where wallets reach this server. The request_uri is built from it,
+	// never from the Host or X-Forwarded-* headers of a request, which a client controls.
+	externalBaseURL = "https://" + openid4vpClientID
+	// requestObjectTTL is how long a wallet has to fetch the request_uri.
+	requestObjectTTL = 5 * time.Minute
+
+	// appleRequest is requested from Wallet and checked against its response.
+	appleRequest = mdoc.NewDeviceRequest().AddElements(mdoc.DocTypeMDL, false,
+		mdoc.FamilyName,
+		mdoc.GivenName,
+		mdoc.DocumentNumber,
+		mdoc.BirthDate,
+		mdoc.IssueDate,
+		mdoc.IssuingCountry,
+	)
+
+	// openid4vpRequest is requested with the presentation_definition of OpenID4VP.
+	openid4vpRequest = mdoc.NewDeviceRequest().AddElements(mdoc.DocTypeMDL, false,
+		mdoc.FamilyName,
+		mdoc.GivenName,
+	)
 )
 
 func NewServer() *Server {
@@ -32,18 +58,28 @@ func NewServer() *Server {
 	if err != nil {
 		panic("failed to load rootCerts: " + err.Error())
 	}
-	roots, err = mdoc.GetRootCertificates(filepath.Join(dir, "internal", "server", "pems"))
+	trustStore, err = mdoc.NewTrustStoreFromDir(filepath.Join(dir, "internal", "server", "pems"))
 	if err != nil {
 		panic("failed to load rootCerts: " + err.Error())
 	}
+	verifierKey, verifierChain, err := newVerifierCertificate(openid4vpClientID)
+	if err != nil {
+		panic("failed to create verifier certificate: " + err.Error())
+	}
 	return &Server{
-		sessions: NewSessions(),
+		sessions:       NewSessions(),
+		nonces:         apple_hpke.NewMemoryNonceStore(),
+		requestObjects: openid4vp.NewRequestObjects(verifierKey, verifierChain, requestObjectTTL),
 	}
 }
 
 type Server struct {
 	mu       sync.RWMutex
 	sessions *Sessions
+	// nonces makes each Apple response verify once.
+	nonces apple_hpke.NonceStore
+	// requestObjects are the signed requests of openid4vp_request_uri, until fetched.
+	requestObjects *openid4vp.RequestObjects
 }
 
 type GetRequest struct {
@@ -64,12 +100,17 @@ type VerifyRequest struct {
 
 type VerifyResponse struct {
 	Elements []Element `json:"elements"`
+	// Documents are the verified documents rendered by mdoc.Document.ToJSON.
+	Documents []json.RawMessage `json:"documents"`
 }
 
 type Element struct {
-	NameSpace  mdoc.NameSpace             `json:"namespace"`
-	Identifier mdoc.DataElementIdentifier `json:"identifier"`
-	Value      mdoc.DataElementValue      `json:"value"`
+	DocType      mdoc.DocType               `json:"doctype"`
+	NameSpace    mdoc.NameSpace             `json:"namespace"`
+	Identifier   mdoc.DataElementIdentifier `json:"identifier"`
+	Value        mdoc.DataElementValue      `json:"value"`
+	SelfAttested bool                       `json:"self_attested"`
+	MIMEType     string                     `json:"mime_type,omitempty"`
 }
 
 func (s *Server) GetIdentityRequest(w http.ResponseWriter, r *http.Request) {
@@ -105,12 +146,34 @@ func (s *Server) GetIdentityRequest(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	case "openid4vp":
-		// TODO: optinoal function for openid4vp
-		idReq, sessionData, err = openid4vp.BeginIdentityRequest("digital-credentials.dev")
+		idReq, sessionData, err = openid4vp.BeginIdentityRequest(openid4vpClientID, openid4vpRequest)
 		if err != nil {
 			jsonErrorResponse(w, fmt.Errorf("failed to get BeginIdentityRequest: openid4vp: %v", err), http.StatusBadRequest)
 			return
 		}
+	case "openid4vp_request_uri":
+		var openid4vpReq *openid4vp.IdentityRequestOpenID4VP
+		openid4vpReq, sessionData, err = openid4vp.BeginIdentityRequest(openid4vp.ClientIDSchemeX509SANDNS+":"+openid4vpClientID, openid4vpRequest)
+		if err != nil {
+			jsonErrorResponse(w, fmt.Errorf("failed to get BeginIdentityRequest: openid4vp_request_uri: %v", err), http.StatusBadRequest)
+			return
+		}
+		// With post, the wallet sends its metadata and wallet_nonce when fetching the request.
+		idReq, err = s.requestObjects.Store(openid4vpReq, requestObjectURI(), openid4vp.RequestURIMethodPost)
+		if err != nil {
+			jsonErrorResponse(w, fmt.Errorf("failed to store request object: %v", err), http.StatusInternalServerError)
+			return
+		}
+	case "apple":
+		idReq, sessionData, err = apple_hpke.BeginIdentityRequest(merchantID, teamID, appleRequest)
+		if err != nil {
+			jsonErrorResponse(w, fmt.Errorf("failed to get BeginIdentityRequest: apple: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := s.nonces.Issue(r.Context(), sessionData.GetNonceByte(), appleNonceTTL); err != nil {
+			jsonErrorResponse(w, fmt.Errorf("failed to issue nonce: %v", err), http.StatusInternalServerError)
+			return
+		}
 	}
 
 	id, err := s.sessions.SaveIdentitySession(sessionData)
@@ -145,50 +208,90 @@ func (s *Server) VerifyIdentityResponse(w http.ResponseWriter, r *http.Request)
 
 	var devResp *mdoc.DeviceResponse
 	var sessTrans []byte
+	verifierOptions := []mdoc.VerifierOption{mdoc.AllowSelfSignedIACA()}
 
 	switch req.Protocol {
-	case "openid4vp":
-		devResp, sessTrans, err = openid4vp.ParseDeviceResponse(req.Data, req.Origin, "digital-credentials.dev", session.GetNonceByte())
+	case "openid4vp", "openid4vp_request_uri":
+		clientID := openid4vpClientID
+		if req.Protocol == "openid4vp_request_uri" {
+			clientID = openid4vp.ClientIDSchemeX509SANDNS + ":" + openid4vpClientID
+		}
+		var result *openid4vp.Result
+		result, err = openid4vp.Parse(req.Data, openid4vp.Expectation{
+			Origin:   req.Origin,
+			ClientID: clientID,
+			Handover: openid4vp.BROWSER_HANDOVER_V1,
+			Session:  session,
+		})
+		if err == nil {
+			devResp, sessTrans = result.DeviceResponse, result.SessionTranscript
+		}
 	case "preview":
 		devResp, sessTrans, err = preview_hpke.ParseDeviceResponse(req.Data, req.Origin, session.GetPrivateKey(), session.GetNonceByte())
 	case "apple":
-		devResp, sessTrans, err = apple_hpke.ParseDeviceResponse([]byte(req.Data), merchantID, teamID, session.GetPrivateKey(), session.GetNonceByte())
+		devResp, sessTrans, err = apple_hpke.ParseDeviceResponseWithNonceStore(r.Context(), []byte(req.Data), merchantID, teamID, apple_hpke.RecipientKey(session.GetPrivateKey()), s.nonces, session.GetNonceByte())
+		verifierOptions = append(verifierOptions, mdoc.WithRequest(appleRequest, false))
 	}
 	if err != nil {
-		jsonErrorResponse(w, fmt.Errorf("failed to ParseDeviceResponse: %v", err), http.StatusBadRequest)
+		protocol.Log.Warn("response rejected", "protocol", req.Protocol, "error", err.Error())
+		jsonErrorResponse(w, fmt.Errorf("failed to ParseDeviceResponse: %s", protocol.PublicMessage(err)), http.StatusBadRequest)
 		return
 	}
 	spew.Dump(devResp)
 
+	results := mdoc.NewVerifier(trustStore.CertPool(), verifierOptions...).VerifyResponse(r.Context(), devResp, sessTrans)
+
 	var resp VerifyResponse
-	for _, doc := range devResp.Documents {
-		if err := mdoc.Verify(doc, sessTrans, roots, true); err != nil {
+	for i, doc := range devResp.Documents {
+		if err := results[i].Err; err != nil {
 			spew.Dump(err)
-			jsonErrorResponse(w, fmt.Errorf("failed to verify mdoc: %v", err), http.StatusBadRequest)
+			jsonErrorResponse(w, fmt.Errorf("failed to verify mdoc %s: %s", doc.DocType, protocol.PublicMessage(err)), http.StatusBadRequest)
+			return
+		}
+
+		docJSON, err := doc.ToJSON()
+		if err != nil {
+			jsonErrorResponse(w, fmt.Errorf("failed to render mdoc %s: %v", doc.DocType, err), http.StatusBadRequest)
 			return
 		}
+		resp.Documents = append(resp.Documents, docJSON)
 
-		itemsmap, err := doc.IssuerSigned.IssuerSignedItems()
+		elements, err := doc.DisclosedElements()
 		if err != nil {
 			spew.Dump(err)
-			jsonErrorResponse(w, fmt.Errorf("failed to get IssuerSignedItems: %v", err), http.StatusBadRequest)
+			jsonErrorResponse(w, fmt.Errorf("failed to get DisclosedElements: %v", err), http.StatusBadRequest)
 			return
 		}
 
-		for ns, items := range itemsmap {
-			for _, item := range items {
-				resp.Elements = append(resp.Elements, Element{
-					NameSpace:  ns,
-					Identifier: item.ElementIdentifier,
-					Value:      item.ElementValue,
-				})
+		for _, elem := range elements {
+			e := Element{
+				DocType:      doc.DocType,
+				NameSpace:    elem.NameSpace,
+				Identifier:   elem.Identifier,
+				Value:        elem.Value,
+				SelfAttested: elem.SelfAttested,
 			}
+			// Lets the frontend render the portrait as a data URL.
+			if b, ok := elem.Value.([]byte); ok {
+				e.MIMEType = mdoc.ImageMIMEType(b)
+			}
+			resp.Elements = append(resp.Elements, e)
 		}
 	}
 
 	jsonResponse(w, resp, http.StatusOK)
 }
 
+// RequestObject serves the request_uri of openid4vp_request_uri requests.
+func (s *Server) RequestObject(w http.ResponseWriter, r *http.Request) {
+	s.requestObjects.ServeHTTP(w, r)
+}
+
+// requestObjectURI is the URL of RequestObject.
+func requestObjectURI() string {
+	return externalBaseURL + "/request_object"
+}
+
 func parseJSON(r *http.Request, v interface{}) error {
 	if r == nil || r.Body == nil {
 		return errors.New("No request given")
@@ -0,0 +1,120 @@
+package mdoc
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+)
+
+// AuditRecord is a byte-stable record of a presentation, for storing what a verifier was shown.
+type AuditRecord struct {
+	// DeviceResponse is the canonical CBOR of EncodeCanonical.
+	DeviceResponse []byte
+	// SHA256 is the SHA-256 of DeviceResponse.
+	SHA256 []byte
+}
+
+// AuditRecord returns the canonical encoding of r, or of its documents of docTypes only,
+// together with its hash.
+func (r *DeviceResponse) AuditRecord(docTypes ...DocType) (*AuditRecord, error) {
+	data, err := r.EncodeCanonical(docTypes...)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	return &AuditRecord{DeviceResponse: data, SHA256: sum[:]}, nil
+}
+
+// EncodeCanonical re-encodes r as a DeviceResponse in canonical CBOR, keeping only the
+// documents of docTypes when any are given. Whatever is signed, the IssuerSignedItems,
+// IssuerAuth and DeviceNameSpaces, is kept byte for byte, so the result still verifies.
+func (r *DeviceResponse) EncodeCanonical(docTypes ...DocType) ([]byte, error) {
+	keep := map[DocType]bool{}
+	for _, docType := range docTypes {
+		keep[docType] = true
+	}
+
+	documents := []interface{}{}
+	for _, doc := range r.Documents {
+		if len(keep) > 0 && !keep[doc.DocType] {
+			continue
+		}
+		encoded, err := doc.canonical()
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode document %s: %v", doc.DocType, err)
+		}
+		documents = append(documents, encoded)
+	}
+
+	response := map[string]interface{}{
+		"version":   r.Version,
+		"documents": documents,
+		"status":    r.Status,
+	}
+	if len(r.DocumentErrors) > 0 {
+		response["documentErrors"] = r.DocumentErrors
+	}
+	return protocol.EncMode.Marshal(response)
+}
+
+func (d *Document) canonical() (map[string]interface{}, error) {
+	nameSpaces := map[NameSpace][]cbor.Tag{}
+	for ns, items := range d.IssuerSigned.NameSpaces {
+		for _, item := range items {
+			nameSpaces[ns] = append(nameSpaces[ns], cbor.Tag{Number: 24, Content: []byte(item)})
+		}
+	}
+	issuerAuth, err := reencode(d.IssuerSigned.IssuerAuth.MarshalCBOR)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode issuerAuth: %v", err)
+	}
+
+	deviceAuth := map[string]interface{}{}
+	if d.DeviceSigned.DeviceAuth.DeviceSignature.Signature != nil {
+		if deviceAuth["deviceSignature"], err = reencode(d.DeviceSigned.DeviceAuth.DeviceSignature.MarshalCBOR); err != nil {
+			return nil, fmt.Errorf("failed to encode deviceSignature: %v", err)
+		}
+	}
+	if len(d.DeviceSigned.DeviceAuth.DeviceMac) > 0 {
+		if deviceAuth["deviceMac"], err = reencode(func() ([]byte, error) { return d.DeviceSigned.DeviceAuth.DeviceMac, nil }); err != nil {
+			return nil, fmt.Errorf("failed to encode deviceMac: %v", err)
+		}
+	}
+
+	deviceNameSpaces := []byte(d.DeviceSigned.NameSpaces)
+	if len(deviceNameSpaces) == 0 {
+		deviceNameSpaces = []byte{0xa0}
+	}
+
+	encoded := map[string]interface{}{
+		"docType": d.DocType,
+		"issuerSigned": map[string]interface{}{
+			"nameSpaces": nameSpaces,
+			"issuerAuth": issuerAuth,
+		},
+		"deviceSigned": map[string]interface{}{
+			"nameSpaces": cbor.Tag{Number: 24, Content: deviceNameSpaces},
+			"deviceAuth": deviceAuth,
+		},
+	}
+	if len(d.Errors) > 0 {
+		encoded["errors"] = d.Errors
+	}
+	return encoded, nil
+}
+
+// reencode decodes what marshal returns, so that EncMode re-encodes its structure canonically.
+// Byte strings, and with them the signed COSE parts, are left as they are.
+func reencode(marshal func() ([]byte, error)) (interface{}, error) {
+	data, err := marshal()
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := protocol.DecMode.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
@@ -0,0 +1,92 @@
+package mdoc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+)
+
+func TestAuditRecord(t *testing.T) {
+	devResp, sessionTranscript, err := getDeviceResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := devResp.AuditRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.CheckCanonical(record.DeviceResponse); err != nil {
+		t.Fatalf("not canonical: %v", err)
+	}
+	if sum := sha256.Sum256(record.DeviceResponse); !bytes.Equal(sum[:], record.SHA256) {
+		t.Fatalf("unexpected hash: %x", record.SHA256)
+	}
+
+	t.Run("Stable", func(t *testing.T) {
+		again, err := devResp.AuditRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(again.DeviceResponse, record.DeviceResponse) {
+			t.Fatal("encoding differs between calls")
+		}
+
+		var decoded DeviceResponse
+		if err := protocol.DecMode.Unmarshal(record.DeviceResponse, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		reencoded, err := decoded.AuditRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(reencoded.SHA256, record.SHA256) {
+			t.Fatal("encoding differs after a round trip")
+		}
+	})
+
+	t.Run("StillVerifies", func(t *testing.T) {
+		var decoded DeviceResponse
+		if err := protocol.DecMode.Unmarshal(record.DeviceResponse, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		doc := decoded.Documents[0]
+		mso, err := doc.IssuerSigned.MobileSecurityObject()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyIssuerAuth(doc.IssuerSigned); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := VerifyDigests(doc.IssuerSigned, mso); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := VerifyDeviceSigned(mso, doc, sessionTranscript); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("SelectedDocuments", func(t *testing.T) {
+		data, err := devResp.EncodeCanonical("org.example.other")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded DeviceResponse
+		if err := protocol.DecMode.Unmarshal(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if len(decoded.Documents) != 0 {
+			t.Fatalf("expected no documents, got %d", len(decoded.Documents))
+		}
+
+		selected, err := devResp.EncodeCanonical(devResp.Documents[0].DocType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(selected, record.DeviceResponse) {
+			t.Fatal("selecting the only document changed the encoding")
+		}
+	})
+}
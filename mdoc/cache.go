@@ -0,0 +1,89 @@
+package mdoc
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+)
+
+// IssuerCache is an LRU of verification reports keyed by a hash of IssuerSigned.
+// A credential presented again within TTL skips the chain, IssuerAuth and digest checks.
+type IssuerCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type issuerCacheEntry struct {
+	key     string
+	report  *VerificationReport
+	checks  []CheckResult
+	expires time.Time
+}
+
+func NewIssuerCache(size int, ttl time.Duration) *IssuerCache {
+	return &IssuerCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+func issuerCacheKey(issuerSigned IssuerSigned) (string, error) {
+	data, err := protocol.EncMode.Marshal(issuerSigned)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal IssuerSigned: %v", err)
+	}
+	return string(protocol.DigestSHA256(data)), nil
+}
+
+func (c *IssuerCache) get(key string, now time.Time) (*VerificationReport, []CheckResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, nil, false
+	}
+	entry := elem.Value.(*issuerCacheEntry)
+	if !now.Before(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.report, entry.checks, true
+}
+
+func (c *IssuerCache) add(key string, report *VerificationReport, checks []CheckResult, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+	}
+	// Store a copy, the caller goes on to fill in the per-presentation fields.
+	r := *report
+	checks = append([]CheckResult{}, checks...)
+	c.entries[key] = c.order.PushFront(&issuerCacheEntry{key: key, report: &r, checks: checks, expires: now.Add(c.ttl)})
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*issuerCacheEntry).key)
+	}
+}
+
+// Len returns the number of cached reports, including expired ones not yet evicted.
+func (c *IssuerCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,39 @@
+package mdoc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIssuerCache(t *testing.T) {
+	now := time.Now()
+
+	t.Run("Evict", func(t *testing.T) {
+		c := NewIssuerCache(2, time.Minute)
+		c.add("a", &VerificationReport{DocType: "a"}, nil, now)
+		c.add("b", &VerificationReport{DocType: "b"}, nil, now)
+		c.get("a", now)
+		c.add("c", &VerificationReport{DocType: "c"}, nil, now)
+
+		if _, _, ok := c.get("b", now); ok {
+			t.Fatal("least recently used entry not evicted")
+		}
+		for _, key := range []string{"a", "c"} {
+			if _, _, ok := c.get(key, now); !ok {
+				t.Fatalf("%s evicted", key)
+			}
+		}
+	})
+
+	t.Run("Expire", func(t *testing.T) {
+		c := NewIssuerCache(2, time.Minute)
+		c.add("a", &VerificationReport{DocType: "a"}, nil, now)
+
+		if _, _, ok := c.get("a", now.Add(time.Minute)); ok {
+			t.Fatal("expired entry returned")
+		}
+		if c.Len() != 0 {
+			t.Fatalf("expired entry not removed: %d", c.Len())
+		}
+	})
+}
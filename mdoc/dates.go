@@ -0,0 +1,138 @@
+package mdoc
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+)
+
+// RFC 8943 / RFC 8949 3.4.1
+const (
+	tagTDate    = 0
+	tagFullDate = 1004
+)
+
+var (
+	ErrElementNotFound = errors.New("element not found")
+	ErrUnexpectedTag   = errors.New("unexpected CBOR tag")
+)
+
+// rawIssuerSignedItem keeps elementValue as encoded, so the tag on it can still be checked.
+// Decoding into DataElementValue turns tag 0 into a time.Time and an untagged string into a string,
+// which is exactly the difference a forged credential relies on us not noticing.
+type rawIssuerSignedItem struct {
+	ElementIdentifier DataElementIdentifier `json:"elementIdentifier"`
+	ElementValue      cbor.RawMessage       `json:"elementValue"`
+}
+
+// RawElementValue returns the issuer-signed value of elem as it was encoded.
+func (d *Document) RawElementValue(elem Element) (cbor.RawMessage, error) {
+	for _, itemBytes := range d.IssuerSigned.NameSpaces[NameSpace(elem.Namespace)] {
+		var item rawIssuerSignedItem
+		if err := d.decoder().Unmarshal(itemBytes, &item); err != nil {
+			return nil, err
+		}
+		if item.ElementIdentifier == DataElementIdentifier(elem.Name) {
+			return item.ElementValue, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s %s", ErrElementNotFound, elem.Namespace, elem.Name)
+}
+
+// FullDate returns a full-date element such as birth_date, which must be tag 1004 over "YYYY-MM-DD".
+func (d *Document) FullDate(elem Element) (time.Time, error) {
+	raw, err := d.RawElementValue(elem)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return DecodeFullDate(raw)
+}
+
+// TDate returns a tdate element such as portrait_capture_date, which must be tag 0 over an RFC 3339 string.
+func (d *Document) TDate(elem Element) (time.Time, error) {
+	raw, err := d.RawElementValue(elem)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return DecodeTDate(raw)
+}
+
+func DecodeFullDate(raw cbor.RawMessage) (time.Time, error) {
+	content, err := decodeTaggedString(raw, tagFullDate)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.Parse("2006-01-02", content)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid full-date: %v", err)
+	}
+	return t, nil
+}
+
+func DecodeTDate(raw cbor.RawMessage) (time.Time, error) {
+	content, err := decodeTaggedString(raw, tagTDate)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parseTDate("tdate", cbor.Tag{Number: tagTDate, Content: content})
+}
+
+// decodeDates replaces the tdate and full-date tags anywhere in a decoded value with
+// time.Time, e.g. the issue_date of each driving privilege.
+func decodeDates(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case cbor.Tag:
+		switch v.Number {
+		case tagTDate:
+			return parseTDate("tdate", v)
+		case tagFullDate:
+			s, ok := v.Content.(string)
+			if !ok {
+				return nil, fmt.Errorf("full-date: expected text, got %T", v.Content)
+			}
+			t, err := time.Parse("2006-01-02", s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid full-date: %v", err)
+			}
+			return t, nil
+		}
+		return v, nil
+	case []interface{}:
+		for i, e := range v {
+			d, err := decodeDates(e)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = d
+		}
+		return v, nil
+	case map[interface{}]interface{}:
+		for k, e := range v {
+			d, err := decodeDates(e)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = d
+		}
+		return v, nil
+	}
+	return v, nil
+}
+
+func decodeTaggedString(raw cbor.RawMessage, number uint64) (string, error) {
+	var tag cbor.RawTag
+	if err := protocol.DecMode.Unmarshal(raw, &tag); err != nil {
+		return "", fmt.Errorf("%w: want tag %d: %v", ErrUnexpectedTag, number, err)
+	}
+	if tag.Number != number {
+		return "", fmt.Errorf("%w: want tag %d, got tag %d", ErrUnexpectedTag, number, tag.Number)
+	}
+	var content string
+	if err := protocol.DecMode.Unmarshal(tag.Content, &content); err != nil {
+		return "", fmt.Errorf("tag %d content is not a text string: %v", number, err)
+	}
+	return content, nil
+}
@@ -0,0 +1,65 @@
+package mdoc
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestDates(t *testing.T) {
+	devResp, _, err := getDeviceResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := devResp.Documents[0]
+
+	t.Run("Tagged", func(t *testing.T) {
+		birthDate, err := doc.FullDate(BirthDate)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if birthDate.IsZero() || birthDate.Location() != time.UTC {
+			t.Fatalf("unexpected birth_date: %v", birthDate)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		if _, err := doc.FullDate(IssueDate); !errors.Is(err, ErrElementNotFound) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	for name, value := range map[string]interface{}{
+		"Untagged": "1990-01-01",
+		"TDateTag": cbor.Tag{Number: 0, Content: "1990-01-01T00:00:00Z"},
+		"EpochTag": cbor.Tag{Number: 1, Content: 631152000},
+	} {
+		t.Run(name, func(t *testing.T) {
+			raw, err := cbor.Marshal(value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := DecodeFullDate(raw); !errors.Is(err, ErrUnexpectedTag) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+
+	t.Run("TDate", func(t *testing.T) {
+		raw, _ := cbor.Marshal(cbor.Tag{Number: 0, Content: "2024-01-02T03:04:05Z"})
+		got, err := DecodeTDate(raw)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !got.Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)) {
+			t.Fatalf("unexpected tdate: %v", got)
+		}
+
+		untagged, _ := cbor.Marshal("2024-01-02T03:04:05Z")
+		if _, err := DecodeTDate(untagged); !errors.Is(err, ErrUnexpectedTag) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,114 @@
+package mdoc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// String renders the response as a readable audit line per document.
+func (d DeviceResponse) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "DeviceResponse version=%s status=%d documents=%d\n", d.Version, d.Status, len(d.Documents))
+	for _, doc := range d.Documents {
+		sb.WriteString(doc.Describe())
+	}
+	for _, docErr := range d.DocumentErrors {
+		for docType, code := range docErr {
+			fmt.Fprintf(&sb, "documentError %s: %d\n", docType, code)
+		}
+	}
+	return sb.String()
+}
+
+// Describe renders the docType, validity window and disclosed elements of the document.
+// Binary values are summarized by type and length, never dumped.
+func (d Document) Describe() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "docType: %s\n", d.DocType)
+
+	if mso, err := d.IssuerSigned.MobileSecurityObject(); err == nil {
+		v := mso.ValidityInfo
+		fmt.Fprintf(&sb, "validity: %s - %s (signed %s)\n",
+			v.ValidFrom.Format(time.RFC3339), v.ValidUntil.Format(time.RFC3339), v.Signed.Format(time.RFC3339))
+		if !v.ExpectedUpdate.IsZero() {
+			fmt.Fprintf(&sb, "expected update: %s\n", v.ExpectedUpdate.Format(time.RFC3339))
+		}
+	} else {
+		sb.WriteString("validity: unknown\n")
+	}
+
+	itemsmap, err := d.IssuerSigned.IssuerSignedItems()
+	if err != nil {
+		fmt.Fprintf(&sb, "failed to get IssuerSignedItems: %v\n", err)
+		return sb.String()
+	}
+
+	var namespaces []string
+	for ns := range itemsmap {
+		namespaces = append(namespaces, string(ns))
+	}
+	sort.Strings(namespaces)
+
+	for _, ns := range namespaces {
+		fmt.Fprintf(&sb, "%s:\n", ns)
+
+		items := itemsmap[NameSpace(ns)]
+		sort.Slice(items, func(i, j int) bool {
+			return items[i].ElementIdentifier < items[j].ElementIdentifier
+		})
+		for _, item := range items {
+			fmt.Fprintf(&sb, "  %s: %s\n", item.ElementIdentifier, describeValue(item.ElementValue))
+		}
+	}
+	return sb.String()
+}
+
+func describeValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		if v == "" {
+			return `""`
+		}
+		return v
+	case []byte:
+		return describeBytes(v)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case cbor.Tag:
+		switch v.Number {
+		case 0, 1004: // tdate, full-date
+			return describeValue(v.Content)
+		}
+		return fmt.Sprintf("tag(%d, %s)", v.Number, describeValue(v.Content))
+	case []interface{}:
+		var values []string
+		for _, e := range v {
+			values = append(values, describeValue(e))
+		}
+		return "[" + strings.Join(values, ", ") + "]"
+	case map[interface{}]interface{}:
+		var entries []string
+		for k, e := range v {
+			entries = append(entries, fmt.Sprintf("%v: %s", k, describeValue(e)))
+		}
+		sort.Strings(entries)
+		return "{" + strings.Join(entries, ", ") + "}"
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func describeBytes(b []byte) string {
+	switch ImageMIMEType(b) {
+	case MIMETypeJPEG:
+		return fmt.Sprintf("<JPEG %d bytes>", len(b))
+	case MIMETypeJPEG2000:
+		return fmt.Sprintf("<JPEG2000 %d bytes>", len(b))
+	}
+	return fmt.Sprintf("<bytes %d>", len(b))
+}
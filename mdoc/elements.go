@@ -4,6 +4,8 @@ import "fmt"
 
 // ISO_IEC_18013-5_2021(en).pdf
 
+const DocTypeMDL DocType = "org.iso.18013.5.1.mDL"
+
 type Element struct {
 	Namespace string
 	Name      string
@@ -173,11 +175,11 @@ var (
 
 // only 21 works now...why..
 func AgeOver(age int) (Element, error) {
-	if age < 0 && age > 99 {
+	if age < 0 || age > 99 {
 		return Element{}, fmt.Errorf("unsupported range of age: %v", age)
 	}
 	return Element{
 		Namespace: "org.iso.18013.5.1",
-		Name:      fmt.Sprintf("age_over_%d", age),
+		Name:      fmt.Sprintf("age_over_%02d", age),
 	}, nil
 }
@@ -0,0 +1,51 @@
+package mdoc
+
+import (
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+)
+
+func FuzzParseDeviceResponse(f *testing.F) {
+	plaintext, err := getPlaintext("plaintext_topics.cbor")
+	if err != nil {
+		f.Fatal(err)
+	}
+	sessionTranscript, err := getPlaintext("session_transcript.txt")
+	if err != nil {
+		f.Fatal(err)
+	}
+	topics := struct {
+		Identity cbor.RawMessage `json:"identity"`
+	}{}
+	if err := cbor.Unmarshal(plaintext, &topics); err != nil {
+		f.Fatal(err)
+	}
+	f.Add([]byte(topics.Identity))
+	f.Add([]byte{0xa0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var resp DeviceResponse
+		if err := protocol.DecMode.Unmarshal(data, &resp); err != nil {
+			return
+		}
+		// Everything below must fail with an error, never panic.
+		_ = resp.String()
+		for _, doc := range resp.Documents {
+			doc.DisclosedElements()
+			doc.TypedElements()
+			doc.IssuerSigned.Certificate()
+			VerifyIssuerAuth(doc.IssuerSigned)
+			VerifyCertificate(doc.IssuerSigned, nil, true)
+
+			mso, err := doc.IssuerSigned.MobileSecurityObject()
+			if err != nil {
+				continue
+			}
+			mso.DeviceKey()
+			VerifyDigests(doc.IssuerSigned, mso)
+			VerifyDeviceSigned(mso, doc, sessionTranscript)
+		}
+	})
+}
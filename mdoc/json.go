@@ -0,0 +1,142 @@
+package mdoc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// documentJSON is how ToJSON renders a Document.
+type documentJSON struct {
+	DocType    DocType                                             `json:"docType"`
+	NameSpaces map[NameSpace]map[DataElementIdentifier]interface{} `json:"nameSpaces"`
+	// DeviceSigned holds the self-attested elements, kept apart from the issuer-signed ones.
+	DeviceSigned map[NameSpace]map[DataElementIdentifier]interface{} `json:"deviceSigned,omitempty"`
+	Errors       Errors                                              `json:"errors,omitempty"`
+}
+
+type deviceResponseJSON struct {
+	Version        string          `json:"version"`
+	Documents      []*documentJSON `json:"documents"`
+	DocumentErrors []DocumentError `json:"documentErrors,omitempty"`
+	Status         uint            `json:"status"`
+}
+
+// ToJSON renders the elements of d for a web frontend. Byte strings become base64url
+// without padding, full-dates "YYYY-MM-DD", tdates RFC 3339 and other tags
+// {"tag": n, "value": v}. It does not verify anything, render verified documents only.
+func (d *Document) ToJSON() ([]byte, error) {
+	doc, err := d.toJSON()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// ToJSON renders every document of r like Document.ToJSON.
+func (r *DeviceResponse) ToJSON() ([]byte, error) {
+	resp := deviceResponseJSON{
+		Version:        r.Version,
+		Documents:      []*documentJSON{},
+		DocumentErrors: r.DocumentErrors,
+		Status:         r.Status,
+	}
+	for i := range r.Documents {
+		doc, err := r.Documents[i].toJSON()
+		if err != nil {
+			return nil, err
+		}
+		resp.Documents = append(resp.Documents, doc)
+	}
+	return json.Marshal(resp)
+}
+
+func (d *Document) toJSON() (*documentJSON, error) {
+	doc := &documentJSON{
+		DocType:    d.DocType,
+		NameSpaces: map[NameSpace]map[DataElementIdentifier]interface{}{},
+		Errors:     d.Errors,
+	}
+
+	itemsmap, err := d.IssuerSigned.issuerSignedItems(d.decoder())
+	if err != nil {
+		return nil, err
+	}
+	for ns, items := range itemsmap {
+		doc.NameSpaces[ns] = map[DataElementIdentifier]interface{}{}
+		for _, item := range items {
+			if doc.NameSpaces[ns][item.ElementIdentifier], err = jsonValue(item.ElementValue); err != nil {
+				return nil, fmt.Errorf("%s %s: %w", ns, item.ElementIdentifier, err)
+			}
+		}
+	}
+
+	deviceNameSpaces, err := d.DeviceSigned.deviceNameSpaces(d.decoder())
+	if err != nil {
+		return nil, err
+	}
+	for ns, items := range deviceNameSpaces {
+		if doc.DeviceSigned == nil {
+			doc.DeviceSigned = map[NameSpace]map[DataElementIdentifier]interface{}{}
+		}
+		doc.DeviceSigned[ns] = map[DataElementIdentifier]interface{}{}
+		for id, value := range items {
+			if doc.DeviceSigned[ns][id], err = jsonValue(value); err != nil {
+				return nil, fmt.Errorf("%s %s: %w", ns, id, err)
+			}
+		}
+	}
+	return doc, nil
+}
+
+// jsonValue converts a decoded CBOR value into one encoding/json renders faithfully.
+func jsonValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case []byte:
+		return base64.RawURLEncoding.EncodeToString(v), nil
+	case time.Time:
+		return v.Format(time.RFC3339), nil
+	case big.Int:
+		return v.String(), nil
+	case cbor.Tag:
+		switch v.Number {
+		case tagTDate, tagFullDate:
+			if s, ok := v.Content.(string); ok {
+				return s, nil
+			}
+		}
+		content, err := jsonValue(v.Content)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"tag": v.Number, "value": content}, nil
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, e := range v {
+			var err error
+			if values[i], err = jsonValue(e); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	case map[interface{}]interface{}:
+		// JSON object keys are strings, CBOR map keys usually are too.
+		values := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			key, ok := k.(string)
+			if !ok {
+				key = fmt.Sprint(k)
+			}
+			var err error
+			if values[key], err = jsonValue(e); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return v, nil
+}
@@ -0,0 +1,73 @@
+package mdoc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestToJSON(t *testing.T) {
+	devResp, _, err := getDeviceResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := devResp.Documents[0].ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		DocType    string                            `json:"docType"`
+		NameSpaces map[string]map[string]interface{} `json:"nameSpaces"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	mdl := doc.NameSpaces["org.iso.18013.5.1"]
+	if doc.DocType != string(DocTypeMDL) || mdl["family_name"] != "Doe" || mdl["birth_date"] != "1976-04-01" || mdl["age_in_years"] != float64(42) {
+		t.Fatalf("unexpected document: %s", data)
+	}
+	portrait, err := base64.RawURLEncoding.DecodeString(mdl["portrait"].(string))
+	if err != nil || ImageMIMEType(portrait) != MIMETypeJPEG {
+		t.Fatalf("unexpected portrait: %v", err)
+	}
+	privilege := mdl["driving_privileges"].([]interface{})[0].(map[string]interface{})
+	if privilege["issue_date"] != "2022-01-30" {
+		t.Fatalf("unexpected driving privilege: %v", privilege)
+	}
+
+	t.Run("DeviceResponse", func(t *testing.T) {
+		data, err := devResp.ToJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp struct {
+			Version   string            `json:"version"`
+			Documents []json.RawMessage `json:"documents"`
+		}
+		if err := json.Unmarshal(data, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Version != "1.0" || len(resp.Documents) != 1 {
+			t.Fatalf("unexpected response: %s", data)
+		}
+	})
+
+	t.Run("Tags", func(t *testing.T) {
+		ns := NameSpace("org.example.tags")
+		doc := Document{IssuerSigned: IssuerSigned{NameSpaces: IssuerNameSpaces{ns: {
+			issuerSignedItemBytes(t, "tagged", cbor.Tag{Number: 40000, Content: []byte{1, 2}}),
+			issuerSignedItemBytes(t, "keys", map[int]string{1: "one"}),
+		}}}}
+		data, err := doc.ToJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `{"docType":"","nameSpaces":{"org.example.tags":{"keys":{"1":"one"},"tagged":{"tag":40000,"value":"AQI"}}}}`
+		if string(data) != want {
+			t.Fatalf("unexpected JSON: %s", data)
+		}
+	})
+}
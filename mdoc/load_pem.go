@@ -2,11 +2,13 @@ package mdoc
 
 import (
 	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 func GetRootCertificates(path string) (*x509.CertPool, error) {
@@ -25,6 +27,86 @@ func GetRootCertificates(path string) (*x509.CertPool, error) {
 	return roots, nil
 }
 
+// TrustStore holds the IACA roots loaded from a directory.
+// Reload swaps in a freshly loaded pool, so verifications never observe a half-loaded one.
+type TrustStore struct {
+	path string
+
+	mu   sync.RWMutex
+	pool *x509.CertPool
+}
+
+// NewTrustStoreFromDir loads every .pem and .crt file in path.
+// Certificates that fail to parse are logged and skipped.
+func NewTrustStoreFromDir(path string) (*TrustStore, error) {
+	ts := &TrustStore{path: path}
+	if err := ts.Reload(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// Reload reads the directory again and replaces the pool once it is fully loaded.
+func (t *TrustStore) Reload() error {
+	files, err := loadCertificatesFromDirectory(t.path)
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	for name, data := range files {
+		certs, err := parseCertificates(data)
+		if err != nil {
+			log.Printf("failed to load certificate: %s, err: %v", name, err)
+			continue
+		}
+		for _, cert := range certs {
+			pool.AddCert(cert)
+		}
+	}
+
+	t.mu.Lock()
+	t.pool = pool
+	t.mu.Unlock()
+	return nil
+}
+
+// CertPool returns the current pool. It must not be modified.
+func (t *TrustStore) CertPool() *x509.CertPool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.pool
+}
+
+// parseCertificates accepts PEM with one or more certificates, or a single DER certificate.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) > 0 {
+		return certs, nil
+	}
+
+	cert, err := x509.ParseCertificate(data)
+	if err != nil {
+		return nil, err
+	}
+	return []*x509.Certificate{cert}, nil
+}
+
 func loadCertificatesFromDirectory(dirPath string) (map[string][]byte, error) {
 	pems := map[string][]byte{}
 
@@ -39,7 +121,7 @@ func loadCertificatesFromDirectory(dirPath string) (map[string][]byte, error) {
 		if file.IsDir() {
 			continue // skip directories
 		}
-		if strings.HasSuffix(file.Name(), ".pem") {
+		if strings.HasSuffix(file.Name(), ".pem") || strings.HasSuffix(file.Name(), ".crt") {
 			filePath := filepath.Join(dirPath, file.Name())
 			data, err := os.ReadFile(filePath)
 			if err != nil {
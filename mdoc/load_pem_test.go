@@ -0,0 +1,60 @@
+package mdoc
+
+import (
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTrustStore(t *testing.T) {
+	rootPath, err := getPath("issuer_root.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootPEM, err := os.ReadFile(rootPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingPath, err := getPath("issuer_signing.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingPEM, err := os.ReadFile(signingPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "root.pem"), rootPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "broken.crt"), []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ts, err := NewTrustStoreFromDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	before := ts.CertPool()
+	if n := len(before.Subjects()); n != 1 {
+		t.Fatalf("unexpected number of roots: %d", n)
+	}
+
+	// DER encoded .crt files are accepted as well.
+	block, _ := pem.Decode(signingPEM)
+	if err := os.WriteFile(filepath.Join(dir, "signing.crt"), block.Bytes, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Reload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if n := len(ts.CertPool().Subjects()); n != 2 {
+		t.Fatalf("unexpected number of roots after reload: %d", n)
+	}
+	if n := len(before.Subjects()); n != 1 {
+		t.Fatalf("pool handed out before reload was modified: %d", n)
+	}
+}
@@ -0,0 +1,208 @@
+package mdoc
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+)
+
+// MDL holds the org.iso.18013.5.1 elements of an mDL, ISO/IEC 18013-5 7.2.1.
+// Elements the holder did not disclose are left zero, AgeOver only has the disclosed ages.
+type MDL struct {
+	FamilyName           string
+	GivenName            string
+	BirthDate            time.Time
+	IssueDate            time.Time
+	ExpiryDate           time.Time
+	IssuingCountry       string
+	IssuingAuthority     string
+	DocumentNumber       string
+	Portrait             []byte
+	DrivingPrivileges    []DrivingPrivilege
+	UNDistinguishingSign string
+	AdministrativeNumber string
+	Sex                  uint64 // ISO/IEC 5218
+	Height               uint64 // cm
+	Weight               uint64 // kg
+	EyeColour            string
+	HairColour           string
+	BirthPlace           string
+	ResidentAddress      string
+	PortraitCaptureDate  time.Time
+	AgeInYears           uint64
+	AgeBirthYear         uint64
+	AgeOver              map[int]bool
+	IssuingJurisdiction  string
+	Nationality          string
+	ResidentCity         string
+	ResidentState        string
+	ResidentPostalCode   string
+	ResidentCountry      string
+}
+
+// DrivingPrivilege is one vehicle category of driving_privileges, ISO/IEC 18013-5 7.2.4.
+type DrivingPrivilege struct {
+	VehicleCategoryCode string
+	IssueDate           time.Time // zero when not given
+	ExpiryDate          time.Time // zero when not given
+	Codes               []DrivingPrivilegeCode
+}
+
+type DrivingPrivilegeCode struct {
+	Code  string `cbor:"code"`
+	Sign  string `cbor:"sign,omitempty"`
+	Value string `cbor:"value,omitempty"`
+}
+
+// UnmarshalCBOR requires issue_date and expiry_date to be full-dates.
+func (p *DrivingPrivilege) UnmarshalCBOR(data []byte) error {
+	var raw struct {
+		VehicleCategoryCode string                 `cbor:"vehicle_category_code"`
+		IssueDate           cbor.RawMessage        `cbor:"issue_date"`
+		ExpiryDate          cbor.RawMessage        `cbor:"expiry_date"`
+		Codes               []DrivingPrivilegeCode `cbor:"codes"`
+	}
+	if err := protocol.DecMode.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("failed to parse driving privilege: %w", err)
+	}
+	if raw.VehicleCategoryCode == "" {
+		return fmt.Errorf("%w: driving privilege without vehicle_category_code", ErrUnexpectedType)
+	}
+
+	*p = DrivingPrivilege{VehicleCategoryCode: raw.VehicleCategoryCode, Codes: raw.Codes}
+	var err error
+	if len(raw.IssueDate) > 0 {
+		if p.IssueDate, err = DecodeFullDate(raw.IssueDate); err != nil {
+			return err
+		}
+	}
+	if len(raw.ExpiryDate) > 0 {
+		if p.ExpiryDate, err = DecodeFullDate(raw.ExpiryDate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MDL returns the disclosed org.iso.18013.5.1 elements. It fails if one does not have
+// the type of MDLSchema.
+func (d *Document) MDL() (*MDL, error) {
+	m := MDL{AgeOver: map[int]bool{}}
+	var err error
+
+	for elem, dst := range map[Element]*string{
+		FamilyName:           &m.FamilyName,
+		GivenName:            &m.GivenName,
+		IssuingCountry:       &m.IssuingCountry,
+		IssuingAuthority:     &m.IssuingAuthority,
+		DocumentNumber:       &m.DocumentNumber,
+		UnDistinguishingSign: &m.UNDistinguishingSign,
+		AdministrativeNumber: &m.AdministrativeNumber,
+		EyeColour:            &m.EyeColour,
+		HairColour:           &m.HairColour,
+		BirthPlace:           &m.BirthPlace,
+		ResidentAddress:      &m.ResidentAddress,
+		IssuingJurisdiction:  &m.IssuingJurisdiction,
+		Nationality:          &m.Nationality,
+		ResidentCity:         &m.ResidentCity,
+		ResidentState:        &m.ResidentState,
+		ResidentPostalCode:   &m.ResidentPostalCode,
+		ResidentCountry:      &m.ResidentCountry,
+	} {
+		if *dst, err = disclosed(GetElement[string](d, elem)); err != nil {
+			return nil, err
+		}
+	}
+	for elem, dst := range map[Element]*time.Time{
+		BirthDate:           &m.BirthDate,
+		IssueDate:           &m.IssueDate,
+		ExpiryDate:          &m.ExpiryDate,
+		PortraitCaptureDate: &m.PortraitCaptureDate,
+	} {
+		if *dst, err = disclosed(GetElement[time.Time](d, elem)); err != nil {
+			return nil, err
+		}
+	}
+	for elem, dst := range map[Element]*uint64{
+		Sex:          &m.Sex,
+		Height:       &m.Height,
+		Weight:       &m.Weight,
+		AgeInYears:   &m.AgeInYears,
+		AgeBirthYear: &m.AgeBirthYear,
+	} {
+		if *dst, err = disclosed(GetElement[uint64](d, elem)); err != nil {
+			return nil, err
+		}
+	}
+
+	if m.Portrait, err = disclosed(GetElement[[]byte](d, Portrait)); err != nil {
+		return nil, err
+	}
+	if m.DrivingPrivileges, err = disclosed(GetElement[[]DrivingPrivilege](d, DrivingPrivileges)); err != nil {
+		return nil, err
+	}
+
+	for age := 0; age < 100; age++ {
+		elem, _ := AgeOver(age)
+		v, err := GetElement[bool](d, elem)
+		if errors.Is(err, ErrElementNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.AgeOver[age] = v
+	}
+	return &m, nil
+}
+
+// AgeOver tells whether the holder is at least n years old. Without age_over_n it follows
+// ISO/IEC 18013-5 7.2.5: a true age_over_NN with NN > n or a false one with NN < n also
+// answers it. Otherwise it is computed from birth_date, and when that is not disclosed
+// either the error wraps ErrElementNotFound.
+func (d *Document) AgeOver(n int) (bool, error) {
+	return d.AgeOverAt(n, time.Now())
+}
+
+// AgeOverAt is AgeOver with now as the current date for birth_date.
+func (d *Document) AgeOverAt(n int, now time.Time) (bool, error) {
+	elem, err := AgeOver(n)
+	if err != nil {
+		return false, err
+	}
+	if v, err := GetElement[bool](d, elem); !errors.Is(err, ErrElementNotFound) {
+		return v, err
+	}
+
+	// Statements closest to n first, as the mdoc picks them when it lacks age_over_n.
+	for i := 1; i < 100; i++ {
+		if above, err := AgeOver(n + i); err == nil {
+			v, err := GetElement[bool](d, above)
+			if err != nil && !errors.Is(err, ErrElementNotFound) {
+				return false, err
+			}
+			if err == nil && v {
+				return true, nil
+			}
+		}
+		if below, err := AgeOver(n - i); err == nil {
+			v, err := GetElement[bool](d, below)
+			if err != nil && !errors.Is(err, ErrElementNotFound) {
+				return false, err
+			}
+			if err == nil && !v {
+				return false, nil
+			}
+		}
+	}
+
+	birthDate, err := GetElement[time.Time](d, BirthDate)
+	if err != nil {
+		return false, fmt.Errorf("failed to evaluate age_over_%02d: %w", n, err)
+	}
+	y, m, day := now.Date()
+	return !time.Date(y-n, m, day, 0, 0, 0, 0, time.UTC).Before(birthDate.UTC()), nil
+}
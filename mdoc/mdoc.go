@@ -1,14 +1,15 @@
 package mdoc
 
 import (
-	// "crypto"
-
+	"crypto"
+	"crypto/ecdh"
 	"crypto/ecdsa"
-	"crypto/elliptic"
+	"crypto/ed25519"
 	"crypto/x509"
+	"errors"
 	"fmt"
-	"log"
-	"math/big"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/fxamacker/cbor/v2"
@@ -18,6 +19,14 @@ import (
 
 // ISO_IEC_18013-5_2021(en).pdf
 
+// msoDecMode rejects duplicate map keys, which canonical CBOR forbids and which
+// would otherwise let a later valueDigests entry silently replace an earlier one.
+var msoDecMode, _ = func() cbor.DecOptions {
+	opts := protocol.DecOptions
+	opts.DupMapKey = cbor.DupMapKeyEnforcedAPF
+	return opts
+}().DecMode()
+
 type DocType string
 
 type NameSpace string
@@ -33,11 +42,89 @@ type DeviceResponse struct {
 	Status         uint            `json:"status"`
 }
 
+var ErrNoDocumentsReturned = errors.New("no documents returned")
+
+// NoDocumentsError is returned for a DeviceResponse without documents.
+// DocumentErrors holds the holder's reason per docType. It is empty when the holder
+// gave none, e.g. because the whole request was cancelled.
+type NoDocumentsError struct {
+	Status         uint
+	DocumentErrors map[DocType]ErrorCode
+}
+
+func (e *NoDocumentsError) Error() string {
+	if len(e.DocumentErrors) == 0 {
+		return fmt.Sprintf("%v: status %d", ErrNoDocumentsReturned, e.Status)
+	}
+	var reasons []string
+	for docType, code := range e.DocumentErrors {
+		reasons = append(reasons, fmt.Sprintf("%s: %d", docType, code))
+	}
+	sort.Strings(reasons)
+	return fmt.Sprintf("%v: status %d, %s", ErrNoDocumentsReturned, e.Status, strings.Join(reasons, ", "))
+}
+
+func (e *NoDocumentsError) Unwrap() error {
+	return ErrNoDocumentsReturned
+}
+
+// CheckDocuments returns a *NoDocumentsError when r carries no documents, and an *ItemError
+// when the IssuerSignedItems of one are malformed, see IssuerSigned.ValidateItems.
+func (r *DeviceResponse) CheckDocuments() error {
+	if len(r.Documents) > 0 {
+		for _, doc := range r.Documents {
+			if err := doc.IssuerSigned.ValidateItems(); err != nil {
+				return fmt.Errorf("invalid document %s: %w", doc.DocType, err)
+			}
+		}
+		return nil
+	}
+	documentErrors := map[DocType]ErrorCode{}
+	for _, docErr := range r.DocumentErrors {
+		for docType, code := range docErr {
+			documentErrors[docType] = code
+		}
+	}
+	return &NoDocumentsError{Status: r.Status, DocumentErrors: documentErrors}
+}
+
+// Document returns the first document of docType.
+func (r *DeviceResponse) Document(docType DocType) (*Document, bool) {
+	for i := range r.Documents {
+		if r.Documents[i].DocType == docType {
+			return &r.Documents[i], true
+		}
+	}
+	return nil, false
+}
+
+// SetDecMode makes every document decode its element values with dm.
+func (r *DeviceResponse) SetDecMode(dm cbor.DecMode) {
+	for i := range r.Documents {
+		r.Documents[i].SetDecMode(dm)
+	}
+}
+
 type Document struct {
 	DocType      DocType      `json:"docType"`
 	IssuerSigned IssuerSigned `json:"issuerSigned"`
 	DeviceSigned DeviceSigned `json:"deviceSigned"`
 	Errors       Errors       `json:"errors"`
+
+	decMode cbor.DecMode
+}
+
+// SetDecMode makes d decode its element values with dm, typically built by protocol.NewDecMode
+// to turn vendor tags into structured values. The default is protocol.DecMode.
+func (d *Document) SetDecMode(dm cbor.DecMode) {
+	d.decMode = dm
+}
+
+func (d *Document) decoder() cbor.DecMode {
+	if d.decMode == nil {
+		return protocol.DecMode
+	}
+	return d.decMode
 }
 
 type IssuerSigned struct {
@@ -49,17 +136,18 @@ func (i *IssuerSigned) Alg() (cose.Algorithm, error) {
 	return i.IssuerAuth.Headers.Protected.Algorithm()
 }
 
-func (i *IssuerSigned) DocumentSigningKey() (*ecdsa.PublicKey, error) {
+// DocumentSigningKey returns the *ecdsa.PublicKey or ed25519.PublicKey of the document signer.
+func (i *IssuerSigned) DocumentSigningKey() (crypto.PublicKey, error) {
 	certificate, err := i.Certificate()
 	if err != nil {
 		return nil, fmt.Errorf("Failed to get X5CertificateChain: %v", err)
 	}
 
-	documentSigningKey, ok := certificate.PublicKey.(*ecdsa.PublicKey)
-	if !ok {
-		return nil, fmt.Errorf("Failed to parseCertificates: %v", err)
+	switch certificate.PublicKey.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+		return certificate.PublicKey, nil
 	}
-	return documentSigningKey, nil
+	return nil, fmt.Errorf("unsupported document signing key: %T", certificate.PublicKey)
 }
 
 func (i *IssuerSigned) Certificate() (*x509.Certificate, error) {
@@ -67,27 +155,77 @@ func (i *IssuerSigned) Certificate() (*x509.Certificate, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Failed to get X5CertificateChain: %v", err)
 	}
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("x5chain is empty")
+	}
 	return certificates[0], nil
 }
 
+var (
+	// MaxX5ChainCertificates and MaxX5ChainSize bound the attacker controlled x5chain.
+	// Real chains are a document signer and perhaps an intermediate, a few KB at most.
+	MaxX5ChainCertificates = 10
+	MaxX5ChainSize         = 64 << 10
+
+	ErrChainTooLong = errors.New("x5chain too long")
+)
+
+// X5CertificateChain returns the x5chain in transmitted order, the document signer first.
+// Repeated certificates are only returned once.
 func (i *IssuerSigned) X5CertificateChain() ([]*x509.Certificate, error) {
+	return x5Chain(i.IssuerAuth.Headers.Unprotected)
+}
 
-	rawX5Chain, ok := i.IssuerAuth.Headers.Unprotected[cose.HeaderLabelX5Chain]
+// x5Chain parses the x5chain header parameter within MaxX5ChainCertificates and MaxX5ChainSize.
+func x5Chain(h cose.UnprotectedHeader) ([]*x509.Certificate, error) {
+	rawX5Chain, ok := h[cose.HeaderLabelX5Chain]
 	if !ok {
 		return nil, fmt.Errorf("failed to get x5chain")
 	}
 
-	rawX5ChainBytes, ok := rawX5Chain.([][]byte)
-	if !ok {
-		rawX5ChainByte, ok := rawX5Chain.([]byte)
-		if !ok {
-			return nil, fmt.Errorf("failed to get x5chain")
+	// A single certificate is a bstr, several are an array of bstr.
+	var rawX5ChainBytes [][]byte
+	switch v := rawX5Chain.(type) {
+	case []byte:
+		rawX5ChainBytes = [][]byte{v}
+	case [][]byte:
+		rawX5ChainBytes = v
+	case []interface{}:
+		for _, item := range v {
+			certData, ok := item.([]byte)
+			if !ok {
+				return nil, fmt.Errorf("failed to get x5chain: %T in array", item)
+			}
+			rawX5ChainBytes = append(rawX5ChainBytes, certData)
 		}
-		rawX5ChainBytes = append(rawX5ChainBytes, rawX5ChainByte)
+	default:
+		return nil, fmt.Errorf("failed to get x5chain")
 	}
 
-	var certs []*x509.Certificate
+	if len(rawX5ChainBytes) > MaxX5ChainCertificates {
+		return nil, fmt.Errorf("%w: %d certificates", ErrChainTooLong, len(rawX5ChainBytes))
+	}
+	size := 0
 	for _, certData := range rawX5ChainBytes {
+		size += len(certData)
+	}
+	if size > MaxX5ChainSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrChainTooLong, size)
+	}
+
+	var certs []*x509.Certificate
+	seen := map[string]bool{}
+	for i, certData := range rawX5ChainBytes {
+		if seen[string(certData)] {
+			continue
+		}
+		seen[string(certData)] = true
+
+		// Parsing is the expensive part, so anything that is not even one DER SEQUENCE
+		// spanning exactly the bytes given is rejected before.
+		if !isDERSequence(certData) {
+			return nil, fmt.Errorf("error parsing certificate %d: not a DER SEQUENCE", i)
+		}
 		cert, err := x509.ParseCertificate(certData)
 		if err != nil {
 			return nil, fmt.Errorf("error parsing certificate: %v", err)
@@ -98,26 +236,122 @@ func (i *IssuerSigned) X5CertificateChain() ([]*x509.Certificate, error) {
 	return certs, nil
 }
 
+// verifyX5ChainSign1 verifies a tagged or untagged COSE_Sign1 with the key of the first
+// x5chain certificate, which must lead to one of roots at now, and returns the message.
+func verifyX5ChainSign1(data []byte, roots *x509.CertPool, now time.Time) (*cose.UntaggedSign1Message, error) {
+	var msg cose.UntaggedSign1Message
+	if len(data) > 0 && data[0] == 0xd2 { // tag 18
+		var tagged cose.Sign1Message
+		if err := tagged.UnmarshalCBOR(data); err != nil {
+			return nil, err
+		}
+		msg = cose.UntaggedSign1Message(tagged)
+	} else if err := msg.UnmarshalCBOR(data); err != nil {
+		return nil, err
+	}
+
+	certs, err := x5Chain(msg.Headers.Unprotected)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("x5chain is empty")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		CurrentTime:   now,
+	}); err != nil {
+		return nil, fmt.Errorf("failed to verify signer certificate: %v", err)
+	}
+
+	if err := protocol.CheckCOSEHeaders(msg.Headers); err != nil {
+		return nil, err
+	}
+	alg, err := msg.Headers.Protected.Algorithm()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get alg: %v", err)
+	}
+	if err := protocol.CheckKeyAlg(alg, certs[0].PublicKey); err != nil {
+		return nil, err
+	}
+	verifier, err := cose.NewVerifier(alg, certs[0].PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := msg.Verify(nil, verifier); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// isDERSequence reports whether data is a single DER SEQUENCE with a minimally encoded length.
+func isDERSequence(data []byte) bool {
+	if len(data) < 2 || data[0] != 0x30 {
+		return false
+	}
+	if data[1] < 0x80 {
+		return int(data[1]) == len(data)-2
+	}
+
+	n := int(data[1] & 0x7f)
+	if n == 0 || n > 4 || len(data) < 2+n || data[2] == 0 {
+		return false
+	}
+	length := 0
+	for _, b := range data[2 : 2+n] {
+		length = length<<8 | int(b)
+	}
+	return length >= 0x80 && length == len(data)-2-n
+}
+
 func (i *IssuerSigned) MobileSecurityObject() (*MobileSecurityObject, error) {
 	var topLevelData interface{}
-	err := cbor.Unmarshal(i.IssuerAuth.Payload, &topLevelData)
+	err := protocol.DecMode.Unmarshal(i.IssuerAuth.Payload, &topLevelData)
 	if err != nil {
 		return nil, fmt.Errorf("Error unmarshalling top level CBOR: %w", err)
 	}
 
+	tag, ok := topLevelData.(cbor.Tag)
+	if !ok || tag.Number != 24 {
+		return nil, fmt.Errorf("MobileSecurityObjectBytes is not tag 24")
+	}
+	content, ok := tag.Content.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("MobileSecurityObjectBytes is not a byte string")
+	}
+
 	var mso MobileSecurityObject
-	if err := cbor.Unmarshal(topLevelData.(cbor.Tag).Content.([]byte), &mso); err != nil {
+	if err := msoDecMode.Unmarshal(content, &mso); err != nil {
 		return nil, fmt.Errorf("Error unmarshal cbor string: %w", err)
 	}
 	return &mso, nil
 }
 
+// ValidityInfo returns the validity window the issuer signed into the MSO.
+func (d *Document) ValidityInfo() (*ValidityInfo, error) {
+	mso, err := d.IssuerSigned.MobileSecurityObject()
+	if err != nil {
+		return nil, err
+	}
+	return &mso.ValidityInfo, nil
+}
+
 func (i *IssuerSigned) IssuerSignedItems() (map[NameSpace][]IssuerSignedItem, error) {
+	return i.issuerSignedItems(protocol.DecMode)
+}
+
+func (i *IssuerSigned) issuerSignedItems(dm cbor.DecMode) (map[NameSpace][]IssuerSignedItem, error) {
 	items := map[NameSpace][]IssuerSignedItem{}
 
 	for ns, itemBytes := range i.NameSpaces {
 		for _, itemByte := range itemBytes {
-			item, err := itemByte.IssuerSignedItem()
+			item, err := itemByte.decode(dm)
 			if err != nil {
 				return nil, err
 			}
@@ -127,27 +361,144 @@ func (i *IssuerSigned) IssuerSignedItems() (map[NameSpace][]IssuerSignedItem, er
 	return items, nil
 }
 
+// MinRandomLength is the minimum length of the random salt of an IssuerSignedItem, ISO/IEC 18013-5 9.1.2.5.
+const MinRandomLength = 16
+
+var (
+	ErrShortRandom       = errors.New("random too short")
+	ErrMissingIdentifier = errors.New("missing elementIdentifier")
+)
+
+// ItemError is a malformed IssuerSignedItem, Index being its position in the namespace.
+type ItemError struct {
+	NameSpace         NameSpace
+	Index             int
+	ElementIdentifier DataElementIdentifier
+	Err               error
+}
+
+func (e *ItemError) Error() string {
+	return fmt.Sprintf("%s item %d (%s): %v", e.NameSpace, e.Index, e.ElementIdentifier, e.Err)
+}
+
+func (e *ItemError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateItems checks the structure ISO/IEC 18013-5 requires of the IssuerSignedItems:
+// digestIDs and elementIdentifiers unique per namespace and a random of at least
+// MinRandomLength bytes. It returns an *ItemError for the first violation.
+func (i *IssuerSigned) ValidateItems() error {
+	for ns, itemBytes := range i.NameSpaces {
+		// Two items sharing a digestID or an identifier could be used to spoof
+		// which value a digest vouches for.
+		seenDigestIDs := map[uint]bool{}
+		seenElements := map[DataElementIdentifier]bool{}
+
+		for idx, itemByte := range itemBytes {
+			item, err := itemByte.IssuerSignedItem()
+			if err != nil {
+				return &ItemError{NameSpace: ns, Index: idx, Err: err}
+			}
+			itemErr := func(err error) error {
+				return &ItemError{NameSpace: ns, Index: idx, ElementIdentifier: item.ElementIdentifier, Err: err}
+			}
+
+			switch {
+			case ns == "" || item.ElementIdentifier == "":
+				return itemErr(ErrMissingIdentifier)
+			case len(item.Random) < MinRandomLength:
+				return itemErr(fmt.Errorf("%w: %d bytes", ErrShortRandom, len(item.Random)))
+			case seenDigestIDs[item.DigestID]:
+				return itemErr(fmt.Errorf("%w: %v", ErrDuplicateDigestID, item.DigestID))
+			case seenElements[item.ElementIdentifier]:
+				return itemErr(ErrDuplicateElement)
+			}
+			seenDigestIDs[item.DigestID] = true
+			seenElements[item.ElementIdentifier] = true
+		}
+	}
+	return nil
+}
+
+// DisclosedElement is a single element of a document, either issuer-signed or
+// self-attested by the device.
+type DisclosedElement struct {
+	NameSpace    NameSpace
+	Identifier   DataElementIdentifier
+	Value        DataElementValue
+	SelfAttested bool
+}
+
+// DisclosedElements returns the issuer-signed elements followed by the device-signed ones.
+// Callers must not treat elements with SelfAttested set as authoritative.
+func (d *Document) DisclosedElements() ([]DisclosedElement, error) {
+	var elements []DisclosedElement
+
+	itemsmap, err := d.IssuerSigned.issuerSignedItems(d.decoder())
+	if err != nil {
+		return nil, err
+	}
+	for ns, items := range itemsmap {
+		for _, item := range items {
+			value, err := decodeDates(item.ElementValue)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", ns, item.ElementIdentifier, err)
+			}
+			elements = append(elements, DisclosedElement{
+				NameSpace:  ns,
+				Identifier: item.ElementIdentifier,
+				Value:      value,
+			})
+		}
+	}
+
+	deviceNameSpaces, err := d.DeviceSigned.deviceNameSpaces(d.decoder())
+	if err != nil {
+		return nil, err
+	}
+	for ns, items := range deviceNameSpaces {
+		for id, value := range items {
+			value, err := decodeDates(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", ns, id, err)
+			}
+			elements = append(elements, DisclosedElement{
+				NameSpace:    ns,
+				Identifier:   id,
+				Value:        value,
+				SelfAttested: true,
+			})
+		}
+	}
+	return elements, nil
+}
+
 type IssuerNameSpaces map[NameSpace][]IssuerSignedItemBytes
 
 type IssuerSignedItemBytes cbor.RawMessage
 
 func (i IssuerSignedItemBytes) IssuerSignedItem() (IssuerSignedItem, error) {
+	return i.decode(protocol.DecMode)
+}
+
+func (i IssuerSignedItemBytes) decode(dm cbor.DecMode) (IssuerSignedItem, error) {
 	var item IssuerSignedItem
-	if err := cbor.Unmarshal(i, &item); err != nil {
+	if err := dm.Unmarshal(i, &item); err != nil {
 		return IssuerSignedItem{}, err
 	}
 	return item, nil
 }
 
-func (i *IssuerSignedItemBytes) Digest(alg string) ([]byte, error) {
-	v, err := cbor.Marshal(cbor.Tag{
-		Number:  24,
-		Content: i,
-	})
+func (i *IssuerSignedItemBytes) Digest(alg protocol.DigestAlgorithm) ([]byte, error) {
+	if err := protocol.CheckDigestAlgorithm(alg); err != nil {
+		return nil, err
+	}
+	v, err := protocol.TagEncodedCBOR(*i)
 	if err != nil {
 		return nil, err
 	}
-	return protocol.Digest(v, alg), nil
+	return protocol.Digest(v, alg)
 }
 
 type IssuerSignedItem struct {
@@ -158,17 +509,32 @@ type IssuerSignedItem struct {
 }
 
 type MobileSecurityObject struct {
-	Version         string        `json:"version"`
-	DigestAlgorithm string        `json:"digestAlgorithm"`
-	ValueDigests    ValueDigests  `json:"valueDigests"`
-	DeviceKeyInfo   DeviceKeyInfo `json:"deviceKeyInfo"`
-	DocType         DocType       `json:"docType"`
-	ValidityInfo    ValidityInfo  `json:"validityInfo"`
+	Version         string                   `json:"version"`
+	DigestAlgorithm protocol.DigestAlgorithm `json:"digestAlgorithm"`
+	ValueDigests    ValueDigests             `json:"valueDigests"`
+	DeviceKeyInfo   DeviceKeyInfo            `json:"deviceKeyInfo"`
+	DocType         DocType                  `json:"docType"`
+	ValidityInfo    ValidityInfo             `json:"validityInfo"`
+	// Status is only carried by newer MSOs, see StatusListChecker.
+	Status *MSOStatus `json:"status,omitempty"`
+}
+
+// DeviceKey returns the *ecdsa.PublicKey or ed25519.PublicKey the DeviceSignature must verify with.
+func (m *MobileSecurityObject) DeviceKey() (crypto.PublicKey, error) {
+	data, err := protocol.EncMode.Marshal(m.DeviceKeyInfo.DeviceKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal deviceKey: %v", err)
+	}
+	return protocol.ParseCOSEKey(data)
 }
 
-func (m *MobileSecurityObject) DeviceKey() (*ecdsa.PublicKey, error) {
-	// TODO: algによって変えたほうが.
-	return parseECDSA(m.DeviceKeyInfo.DeviceKey)
+// DeviceKeyECDH returns the deviceKey for the key agreement of deviceMac.
+func (m *MobileSecurityObject) DeviceKeyECDH() (*ecdh.PublicKey, error) {
+	data, err := protocol.EncMode.Marshal(m.DeviceKeyInfo.DeviceKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal deviceKey: %v", err)
+	}
+	return protocol.ParseCOSEKeyECDH(data)
 }
 
 type DeviceKeyInfo struct {
@@ -194,6 +560,22 @@ type KeyAuthorizations struct {
 	DataElements map[string][]string `json:"dataElements,omitempty"`
 }
 
+// Authorized reports whether the deviceKey may sign element id of ns, either because all of
+// ns is authorized or the element is. Without keyAuthorizations it may sign nothing.
+func (k KeyAuthorizations) Authorized(ns NameSpace, id DataElementIdentifier) bool {
+	for _, n := range k.NameSpaces {
+		if n == string(ns) {
+			return true
+		}
+	}
+	for _, e := range k.DataElements[string(ns)] {
+		if e == string(id) {
+			return true
+		}
+	}
+	return false
+}
+
 type KeyInfo map[int]interface{}
 
 type ValueDigests map[NameSpace]DigestIDs
@@ -201,12 +583,65 @@ type ValueDigests map[NameSpace]DigestIDs
 type DigestIDs map[DigestID]Digest
 
 type ValidityInfo struct {
-	Signed         time.Time `json:"signed"`
-	ValidFrom      time.Time `json:"validFrom"`
-	ValidUntil     time.Time `json:"validUntil"`
+	Signed     time.Time `json:"signed"`
+	ValidFrom  time.Time `json:"validFrom"`
+	ValidUntil time.Time `json:"validUntil"`
+	// ExpectedUpdate is zero when the issuer did not say when it will reissue.
 	ExpectedUpdate time.Time `json:"expectedUpdate,omitempty"`
 }
 
+// UnmarshalCBOR requires every timestamp to be a tdate, i.e. tag 0 over an RFC 3339 string.
+func (v *ValidityInfo) UnmarshalCBOR(data []byte) error {
+	var raw struct {
+		Signed         cbor.Tag  `cbor:"signed"`
+		ValidFrom      cbor.Tag  `cbor:"validFrom"`
+		ValidUntil     cbor.Tag  `cbor:"validUntil"`
+		ExpectedUpdate *cbor.Tag `cbor:"expectedUpdate"`
+	}
+	if err := msoDecMode.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("failed to parse ValidityInfo: %w", err)
+	}
+
+	var err error
+	if v.Signed, err = parseTDate("signed", raw.Signed); err != nil {
+		return err
+	}
+	if v.ValidFrom, err = parseTDate("validFrom", raw.ValidFrom); err != nil {
+		return err
+	}
+	if v.ValidUntil, err = parseTDate("validUntil", raw.ValidUntil); err != nil {
+		return err
+	}
+	v.ExpectedUpdate = time.Time{}
+	if raw.ExpectedUpdate != nil {
+		if v.ExpectedUpdate, err = parseTDate("expectedUpdate", *raw.ExpectedUpdate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseTDate(name string, tag cbor.Tag) (time.Time, error) {
+	if tag.Number != 0 {
+		return time.Time{}, fmt.Errorf("%s: expected tag 0, got tag %d", name, tag.Number)
+	}
+	s, ok := tag.Content.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("%s: expected text date-time, got %T", name, tag.Content)
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s: %v", name, err)
+	}
+	return t, nil
+}
+
+// UpdateExpired reports whether the issuer expected to have reissued the credential by now.
+// The credential may still be valid, but the holder should be prompted to refresh it.
+func (v ValidityInfo) UpdateExpired(now time.Time) bool {
+	return !v.ExpectedUpdate.IsZero() && now.After(v.ExpectedUpdate)
+}
+
 type DigestID uint
 
 type Digest []byte
@@ -227,17 +662,42 @@ func (d *DeviceSigned) DeviceAuthenticationBytes(docType DocType, sessionTranscr
 		docType,
 		cbor.Tag{Number: 24, Content: d.NameSpaces},
 	}
-	da, err := cbor.Marshal(deviceAuthentication)
+	deviceAuthenticationByte, err := protocol.MarshalEncodedCBOR(deviceAuthentication)
 	if err != nil {
 		return nil, fmt.Errorf("error encoding transcript: %v", err)
 	}
-	deviceAuthenticationByte, err := cbor.Marshal(cbor.Tag{Number: 24, Content: da})
-	if err != nil {
-		return nil, fmt.Errorf("failed to Marshal cbor %w", err)
-	}
 	return deviceAuthenticationByte, nil
 }
 
+// DeviceNameSpaces decodes the holder-provided, self-attested elements.
+// They are covered by DeviceAuth but not by the MSO, so the issuer does not vouch for them.
+func (d *DeviceSigned) DeviceNameSpaces() (DeviceNameSpaces, error) {
+	return d.deviceNameSpaces(protocol.DecMode)
+}
+
+func (d *DeviceSigned) deviceNameSpaces(dm cbor.DecMode) (DeviceNameSpaces, error) {
+	nameSpaces := DeviceNameSpaces{}
+	if len(d.NameSpaces) == 0 {
+		return nameSpaces, nil
+	}
+	if err := dm.Unmarshal(d.NameSpaces, &nameSpaces); err != nil {
+		return nil, fmt.Errorf("failed to parse DeviceNameSpaces: %w", err)
+	}
+	return nameSpaces, nil
+}
+
+// rawDeviceNameSpaces is deviceNameSpaces with the values left encoded, for typed decoding.
+func (d *DeviceSigned) rawDeviceNameSpaces(dm cbor.DecMode) (map[NameSpace]map[DataElementIdentifier]cbor.RawMessage, error) {
+	nameSpaces := map[NameSpace]map[DataElementIdentifier]cbor.RawMessage{}
+	if len(d.NameSpaces) == 0 {
+		return nameSpaces, nil
+	}
+	if err := dm.Unmarshal(d.NameSpaces, &nameSpaces); err != nil {
+		return nil, fmt.Errorf("failed to parse DeviceNameSpaces: %w", err)
+	}
+	return nameSpaces, nil
+}
+
 type DeviceNameSpacesBytes cbor.RawMessage
 
 type DeviceNameSpaces map[NameSpace]DeviceSignedItems
@@ -246,7 +706,9 @@ type DeviceSignedItems map[DataElementIdentifier]DataElementValue
 
 type DeviceAuth struct {
 	DeviceSignature cose.UntaggedSign1Message `json:"deviceSignature"`
-	DeviceMac       cose.UntaggedSign1Message `json:"deviceMac"`
+	// DeviceMac is the COSE_Mac0 sent instead of DeviceSignature by wallets using MAC
+	// authentication, see VerifyDeviceMac.
+	DeviceMac cbor.RawMessage `json:"deviceMac"`
 }
 
 type DocumentError map[DocType]ErrorCode
@@ -257,40 +719,6 @@ type ErrorItems map[DataElementIdentifier]ErrorCode
 
 type ErrorCode int
 
-func parseECDSA(coseKey COSEKey) (*ecdsa.PublicKey, error) {
-	// Extract the curve
-	var crv int
-	if err := cbor.Unmarshal(coseKey.CrvOrNOrK, &crv); err != nil {
-		return nil, err
-	}
-
-	// Extract the X coordinate
-	var xBytes []byte
-	if err := cbor.Unmarshal(coseKey.XOrE, &xBytes); err != nil {
-		return nil, err
-	}
-
-	// Extract the Y coordinate
-	var yBytes []byte
-	if err := cbor.Unmarshal(coseKey.Y, &yBytes); err != nil {
-		return nil, err
-	}
-
-	// Convert to ecdsa.PublicKey
-	var pubKey ecdsa.PublicKey
-	switch crv {
-	case 1: // Assuming 1 means P-256 curve
-		pubKey.Curve = elliptic.P256()
-	case 2: // Assuming 2 means P-384 curve
-		pubKey.Curve = elliptic.P384()
-	case 3: // Assuming 3 means P-521 curve
-		pubKey.Curve = elliptic.P521()
-	default:
-		log.Fatalf("Unsupported curve: %v", crv)
-	}
-
-	pubKey.X = new(big.Int).SetBytes(xBytes)
-	pubKey.Y = new(big.Int).SetBytes(yBytes)
-
-	return &pubKey, nil
-}
+// ErrorCodeDataNotReturned is the generic reason of ISO/IEC 18013-5 8.3.2.1.2.3, other codes
+// are defined by the issuer.
+const ErrorCodeDataNotReturned ErrorCode = 0
@@ -1,15 +1,27 @@
 package mdoc
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/hex"
+	"errors"
 	"log"
+	"math/big"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/fxamacker/cbor/v2"
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+	"github.com/veraison/go-cose"
 )
 
 func getPath(fileName string) (string, error) {
@@ -73,13 +85,791 @@ func TestMdocVerifyIssuerAuth(t *testing.T) {
 	if err != nil {
 		log.Fatal("5", err)
 	}
-	Now = parsedTime
+	opts := VerifyOptions{
+		Roots: roots,
+		Clock: func() time.Time { return parsedTime },
+	}
 
 	t.Run("Verify", func(t *testing.T) {
 		for _, doc := range topics.Identity.Documents {
-			if err := Verify(doc, sessionTranscript, roots, false); err != nil {
+			if err := VerifyWithOptions(context.Background(), doc, sessionTranscript, opts); err != nil {
+				t.Fatalf("failed to Verify %v", err)
+			}
+		}
+	})
+
+	t.Run("Logger", func(t *testing.T) {
+		logger := &recordLogger{}
+		logged := opts
+		logged.Logger = logger
+		for _, doc := range topics.Identity.Documents {
+			if err := VerifyWithOptions(context.Background(), doc, sessionTranscript, logged); err != nil {
+				t.Fatalf("failed to Verify %v", err)
+			}
+		}
+		for _, want := range []string{"device auth ok", "certificate chain ok", "issuer auth ok", "digests ok", "verified"} {
+			if !logger.has(want) {
+				t.Fatalf("%q not logged: %v", want, logger.msgs)
+			}
+		}
+	})
+
+	t.Run("Cache", func(t *testing.T) {
+		cached := opts
+		cached.Cache = NewIssuerCache(10, time.Minute)
+		doc := topics.Identity.Documents[0]
+
+		for i, want := range []bool{false, true} {
+			report, err := VerifyDocument(context.Background(), doc, sessionTranscript, cached)
+			if err != nil {
 				t.Fatalf("failed to Verify %v", err)
 			}
+			if report.Cached != want {
+				t.Fatalf("verification %d: cached %v, want %v", i, report.Cached, want)
+			}
+		}
+
+		// A cached issuer never vouches for a different session.
+		otherSession := append([]byte{}, sessionTranscript...)
+		otherSession[len(otherSession)-1] ^= 0xff
+		if _, err := VerifyDocument(context.Background(), doc, otherSession, cached); err == nil {
+			t.Fatal("verified DeviceAuth of another session")
+		}
+	})
+
+	t.Run("CachedDocType", func(t *testing.T) {
+		cached := opts
+		cached.Cache = NewIssuerCache(10, time.Minute)
+		// Without DeviceAuth, which covers the docType too, only the MSO check is left.
+		cached.SkipDeviceAuth = true
+		doc := topics.Identity.Documents[0]
+		if _, err := VerifyDocument(context.Background(), doc, sessionTranscript, cached); err != nil {
+			t.Fatalf("failed to Verify %v", err)
+		}
+
+		other := doc
+		other.DocType = "org.example.other"
+		if _, err := VerifyDocument(context.Background(), other, sessionTranscript, cached); err == nil {
+			t.Fatal("verified the cached IssuerSigned under another docType")
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		expired := opts
+		expired.Clock = func() time.Time { return time.Date(2023, 3, 23, 0, 0, 0, 0, time.UTC) }
+		for _, doc := range topics.Identity.Documents {
+			err := VerifyWithOptions(context.Background(), doc, sessionTranscript, expired)
+			if err == nil || !strings.Contains(err.Error(), "failed to check validity") {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	})
+
+	t.Run("ClockSkew", func(t *testing.T) {
+		skewed := opts
+		skewed.Clock = func() time.Time { return time.Date(2023, 3, 22, 23, 0, 0, 0, time.UTC) }
+		skewed.ClockSkew = time.Hour
+		for _, doc := range topics.Identity.Documents {
+			if err := VerifyWithOptions(context.Background(), doc, sessionTranscript, skewed); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	})
+
+	t.Run("ExpiredGracePeriod", func(t *testing.T) {
+		expired := opts
+		expired.Clock = func() time.Time { return time.Date(2023, 3, 23, 0, 0, 0, 0, time.UTC) }
+		expired.ExpiredGracePeriod = 2 * 365 * 24 * time.Hour
+		for _, doc := range topics.Identity.Documents {
+			report, err := VerifyDocument(context.Background(), doc, sessionTranscript, expired)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// The sample also has non-canonical items, which warn as well.
+			var expiredWarnings int
+			for _, w := range report.Warnings {
+				if errors.Is(w, ErrExpired) {
+					expiredWarnings++
+				}
+			}
+			if expiredWarnings != 1 {
+				t.Fatalf("unexpected warnings: %v", report.Warnings)
+			}
+		}
+
+		// Signed too long ago.
+		expired.ExpiredGracePeriod = time.Hour
+		for _, doc := range topics.Identity.Documents {
+			err := VerifyWithOptions(context.Background(), doc, sessionTranscript, expired)
+			if !errors.Is(err, ErrExpired) {
+				t.Fatalf("expected ErrExpired, got %v", err)
+			}
+		}
+	})
+
+	t.Run("RequireCanonicalCBOR", func(t *testing.T) {
+		// The Apple test items keep the ISO field order instead of sorting their keys.
+		strict := opts
+		strict.RequireCanonicalCBOR = true
+		for _, doc := range topics.Identity.Documents {
+			err := VerifyWithOptions(context.Background(), doc, sessionTranscript, strict)
+			if !errors.Is(err, protocol.ErrNonCanonicalCBOR) {
+				t.Fatalf("expected ErrNonCanonicalCBOR, got %v", err)
+			}
+		}
+	})
+
+	t.Run("NotYetValid", func(t *testing.T) {
+		early := opts
+		early.Clock = func() time.Time { return time.Date(2022, 3, 31, 0, 0, 0, 0, time.UTC) }
+		for _, doc := range topics.Identity.Documents {
+			if err := VerifyWithOptions(context.Background(), doc, sessionTranscript, early); err == nil {
+				t.Fatal("verified before validFrom")
+			}
+		}
+	})
+}
+
+func getDeviceResponse() (*DeviceResponse, []byte, error) {
+	plaintextByte, err := getPlaintext("plaintext_topics.cbor")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sessionTranscript, err := getPlaintext("session_transcript.txt")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Apple's data format
+	topics := struct {
+		Identity DeviceResponse `json:"identity"`
+	}{}
+	if err := cbor.Unmarshal(plaintextByte, &topics); err != nil {
+		return nil, nil, err
+	}
+	return &topics.Identity, sessionTranscript, nil
+}
+
+func TestVerifyDeviceKeyMismatch(t *testing.T) {
+	devResp, sessionTranscript, err := getDeviceResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := devResp.Documents[0]
+
+	mso, err := doc.IssuerSigned.MobileSecurityObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Match", func(t *testing.T) {
+		if err := VerifyDeviceSigned(mso, doc, sessionTranscript); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("OtherCurve", func(t *testing.T) {
+		other, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		crv, _ := cbor.Marshal(2)
+		x, _ := cbor.Marshal(other.X.FillBytes(make([]byte, 48)))
+		y, _ := cbor.Marshal(other.Y.FillBytes(make([]byte, 48)))
+
+		swapped := *mso
+		swapped.DeviceKeyInfo.DeviceKey = COSEKey{Kty: 2, CrvOrNOrK: crv, XOrE: x, Y: y}
+
+		if err := VerifyDeviceSigned(&swapped, doc, sessionTranscript); !errors.Is(err, ErrDeviceKeyMismatch) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// The unprotected header is not signed, a kid can be added without breaking the signature.
+	withKid := doc
+	withKid.DeviceSigned.DeviceAuth.DeviceSignature.Headers.Unprotected = cose.UnprotectedHeader{cose.HeaderLabelKeyID: []byte("wallet key")}
+
+	t.Run("KidWithoutMSOKid", func(t *testing.T) {
+		if len(mso.DeviceKeyInfo.DeviceKey.Kid) != 0 {
+			t.Fatal("sample deviceKey has a kid")
+		}
+		if err := VerifyDeviceSigned(mso, withKid, sessionTranscript); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("KidMismatch", func(t *testing.T) {
+		named := *mso
+		named.DeviceKeyInfo.DeviceKey.Kid = []byte("other key")
+		if err := VerifyDeviceSigned(&named, withKid, sessionTranscript); !errors.Is(err, ErrDeviceKeyMismatch) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		named.DeviceKeyInfo.DeviceKey.Kid = []byte("wallet key")
+		if err := VerifyDeviceSigned(&named, withKid, sessionTranscript); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestDescribe(t *testing.T) {
+	devResp, _, err := getDeviceResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	desc := devResp.Documents[0].Describe()
+	for _, want := range []string{
+		"docType: org.iso.18013.5.1.mDL",
+		"validity: 2022-03-31T22:48:31Z - 2023-03-22T22:48:31Z",
+		"  portrait: <JPEG ",
+		"  birth_date: ",
+	} {
+		if !strings.Contains(desc, want) {
+			t.Fatalf("%q not found in:\n%s", want, desc)
+		}
+	}
+
+	if !strings.HasPrefix(devResp.String(), "DeviceResponse version=1.0 status=0 documents=1\n") {
+		t.Fatalf("unexpected String: %s", devResp.String())
+	}
+}
+
+func TestVerifyDigestsDuplicates(t *testing.T) {
+	devResp, _, err := getDeviceResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := devResp.Documents[0]
+
+	mso, err := doc.IssuerSigned.MobileSecurityObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ns := NameSpace("org.iso.18013.5.1")
+	items := doc.IssuerSigned.NameSpaces[ns]
+
+	t.Run("DuplicateDigestID", func(t *testing.T) {
+		issuerSigned := doc.IssuerSigned
+		issuerSigned.NameSpaces = IssuerNameSpaces{ns: append([]IssuerSignedItemBytes{items[0]}, items...)}
+
+		if err := VerifyDigests(issuerSigned, mso); !errors.Is(err, ErrDuplicateDigestID) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("DuplicateElement", func(t *testing.T) {
+		item, err := items[0].IssuerSignedItem()
+		if err != nil {
+			t.Fatal(err)
+		}
+		item.DigestID = 1000
+		dup, err := cbor.Marshal(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		issuerSigned := doc.IssuerSigned
+		issuerSigned.NameSpaces = IssuerNameSpaces{ns: append([]IssuerSignedItemBytes{items[0], dup}, items[1:]...)}
+
+		if err := VerifyDigests(issuerSigned, mso); !errors.Is(err, ErrDuplicateElement) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("DigestAlgorithm", func(t *testing.T) {
+		for _, alg := range []protocol.DigestAlgorithm{"SHA-1", "sha-256", ""} {
+			unsupported := *mso
+			unsupported.DigestAlgorithm = alg
+			if err := VerifyDigests(doc.IssuerSigned, &unsupported); !errors.Is(err, protocol.ErrUnsupportedDigestAlgorithm) {
+				t.Errorf("%q: unexpected error: %v", alg, err)
+			}
+			if err := VerifyDigests(IssuerSigned{}, &unsupported); !errors.Is(err, protocol.ErrUnsupportedDigestAlgorithm) {
+				t.Errorf("%q without items: unexpected error: %v", alg, err)
+			}
+		}
+
+		// The right algorithm for the digests matters, not just a supported one.
+		other := *mso
+		other.DigestAlgorithm = "SHA-384"
+		if err := VerifyDigests(doc.IssuerSigned, &other); err == nil {
+			t.Fatal("verified SHA-256 digests as SHA-384")
+		}
+	})
+
+	t.Run("ShortRandom", func(t *testing.T) {
+		item, err := items[0].IssuerSignedItem()
+		if err != nil {
+			t.Fatal(err)
+		}
+		item.Random = item.Random[:MinRandomLength-1]
+		short, err := cbor.Marshal(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		issuerSigned := doc.IssuerSigned
+		issuerSigned.NameSpaces = IssuerNameSpaces{ns: append([]IssuerSignedItemBytes{short}, items[1:]...)}
+
+		err = issuerSigned.ValidateItems()
+		var itemErr *ItemError
+		if !errors.As(err, &itemErr) || !errors.Is(err, ErrShortRandom) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if itemErr.NameSpace != ns || itemErr.Index != 0 || itemErr.ElementIdentifier != item.ElementIdentifier {
+			t.Fatalf("unexpected ItemError: %+v", itemErr)
+		}
+
+		resp := DeviceResponse{Documents: []Document{{DocType: doc.DocType, IssuerSigned: issuerSigned}}}
+		if err := resp.CheckDocuments(); !errors.Is(err, ErrShortRandom) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("DuplicateValueDigestsKey", func(t *testing.T) {
+		// {"valueDigests": {"ns": {0: h'00', 0: h'01'}}}
+		msoBytes, _ := hex.DecodeString("a16c76616c756544696765737473a1626e73a2004100004101")
+		payload, err := cbor.Marshal(cbor.Tag{Number: 24, Content: msoBytes})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		issuerSigned := IssuerSigned{}
+		issuerSigned.IssuerAuth.Payload = payload
+		var dupErr *cbor.DupMapKeyError
+		if _, err := issuerSigned.MobileSecurityObject(); !errors.As(err, &dupErr) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestDeviceNameSpaces(t *testing.T) {
+	devResp, sessionTranscript, err := getDeviceResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := devResp.Documents[0]
+
+	mso, err := doc.IssuerSigned.MobileSecurityObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selfAttested, err := cbor.Marshal(DeviceNameSpaces{
+		"org.iso.18013.5.1": DeviceSignedItems{"given_name": "Janet"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc.DeviceSigned.NameSpaces = selfAttested
+
+	t.Run("SelfAttested", func(t *testing.T) {
+		elements, err := doc.DisclosedElements()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found bool
+		for _, elem := range elements {
+			if elem.Identifier == "given_name" && elem.Value == "Janet" {
+				found = true
+				if !elem.SelfAttested {
+					t.Fatalf("device-signed element not flagged as self-attested")
+				}
+			}
+			if elem.Identifier == "given_name" && elem.Value == "Jane" && elem.SelfAttested {
+				t.Fatalf("issuer-signed element flagged as self-attested")
+			}
+		}
+		if !found {
+			t.Fatalf("device-signed element not found")
+		}
+	})
+
+	t.Run("Typed", func(t *testing.T) {
+		if v, err := GetDeviceElement[string](&doc, GivenName); err != nil || v != "Janet" {
+			t.Fatalf("unexpected device-signed given_name: %v, %v", v, err)
+		}
+		if v, err := GetElement[string](&doc, GivenName); err != nil || v != "Jane" {
+			t.Fatalf("unexpected issuer-signed given_name: %v, %v", v, err)
+		}
+		if _, err := GetDeviceElement[string](&doc, FamilyName); !errors.Is(err, ErrElementNotFound) {
+			t.Fatalf("expected ErrElementNotFound, got %v", err)
+		}
+		elements, err := doc.DeviceTypedElements()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(elements) != 1 || elements[GivenName] != "Janet" {
+			t.Fatalf("unexpected device-signed elements: %v", elements)
+		}
+	})
+
+	t.Run("CoveredByDeviceAuth", func(t *testing.T) {
+		authorized := *mso
+		authorized.DeviceKeyInfo.KeyAuthorizations = KeyAuthorizations{NameSpaces: []string{"org.iso.18013.5.1"}}
+		if err := VerifyDeviceSigned(&authorized, doc, sessionTranscript); err == nil || errors.Is(err, ErrUnauthorizedDeviceElement) {
+			t.Fatalf("DeviceAuth verified over injected self-attested elements: %v", err)
+		}
+	})
+
+	t.Run("KeyAuthorizations", func(t *testing.T) {
+		for _, tt := range []struct {
+			name string
+			auth KeyAuthorizations
+			ok   bool
+		}{
+			{"None", KeyAuthorizations{}, false},
+			{"NameSpace", KeyAuthorizations{NameSpaces: []string{"org.iso.18013.5.1"}}, true},
+			{"OtherNameSpace", KeyAuthorizations{NameSpaces: []string{"org.iso.18013.5.1.aamva"}}, false},
+			{"Element", KeyAuthorizations{DataElements: map[string][]string{"org.iso.18013.5.1": {"family_name", "given_name"}}}, true},
+			{"OtherElement", KeyAuthorizations{DataElements: map[string][]string{"org.iso.18013.5.1": {"family_name"}}}, false},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				m := *mso
+				m.DeviceKeyInfo.KeyAuthorizations = tt.auth
+				err := VerifyDeviceSigned(&m, doc, sessionTranscript)
+				if unauthorized := errors.Is(err, ErrUnauthorizedDeviceElement); unauthorized == tt.ok {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			})
+		}
+	})
+}
+
+// createEd25519IssuerSigned signs an MSO with an Ed25519 document signer, the way the EU PID test issuer does.
+func createEd25519IssuerSigned(t *testing.T) (IssuerSigned, ed25519.PublicKey) {
+	dsPub, dsKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Test Ed25519 DS"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, dsPub, dsKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devicePub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	mso, err := cbor.Marshal(map[string]interface{}{
+		"version":         "1.0",
+		"digestAlgorithm": "SHA-256",
+		"valueDigests":    map[string]interface{}{},
+		"deviceKeyInfo": map[string]interface{}{
+			"deviceKey": map[int]interface{}{1: 1, -1: 6, -2: []byte(devicePub)},
+		},
+		"docType": "eu.europa.ec.eudi.pid.1",
+		"validityInfo": map[string]interface{}{
+			"signed":     cbor.Tag{Number: 0, Content: now.Format(time.RFC3339)},
+			"validFrom":  cbor.Tag{Number: 0, Content: now.Format(time.RFC3339)},
+			"validUntil": cbor.Tag{Number: 0, Content: now.Add(time.Hour).Format(time.RFC3339)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := cbor.Marshal(cbor.Tag{Number: 24, Content: mso})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := cose.NewSigner(cose.AlgorithmEd25519, dsKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := cose.Sign1Message{
+		Headers: cose.Headers{
+			Protected:   cose.ProtectedHeader{cose.HeaderLabelAlgorithm: cose.AlgorithmEd25519},
+			Unprotected: cose.UnprotectedHeader{cose.HeaderLabelX5Chain: certDER},
+		},
+		Payload: payload,
+	}
+	if err := msg.Sign(rand.Reader, nil, signer); err != nil {
+		t.Fatal(err)
+	}
+	return IssuerSigned{IssuerAuth: cose.UntaggedSign1Message(msg)}, devicePub
+}
+
+func TestVerifyEd25519(t *testing.T) {
+	issuerSigned, devicePub := createEd25519IssuerSigned(t)
+
+	t.Run("IssuerAuth", func(t *testing.T) {
+		if err := VerifyIssuerAuth(issuerSigned); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("DeviceKey", func(t *testing.T) {
+		mso, err := issuerSigned.MobileSecurityObject()
+		if err != nil {
+			t.Fatal(err)
+		}
+		deviceKey, err := mso.DeviceKey()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !devicePub.Equal(deviceKey) {
+			t.Fatalf("unexpected device key: %v", deviceKey)
+		}
+		if err := protocol.CheckKeyAlg(cose.AlgorithmES256, deviceKey); err == nil {
+			t.Fatal("ES256 accepted for an Ed25519 deviceKey")
+		}
+	})
+
+	t.Run("AlgMismatch", func(t *testing.T) {
+		mismatched := issuerSigned
+		mismatched.IssuerAuth.Headers.Protected = cose.ProtectedHeader{cose.HeaderLabelAlgorithm: cose.AlgorithmES256}
+		err := VerifyIssuerAuth(mismatched)
+		if err == nil || !strings.Contains(err.Error(), "alg does not match") {
+			t.Fatalf("unexpected error: %v", err)
 		}
 	})
 }
+
+type recordLogger struct {
+	msgs []string
+}
+
+func (l *recordLogger) Debug(msg string, kv ...interface{}) { l.msgs = append(l.msgs, msg) }
+func (l *recordLogger) Info(msg string, kv ...interface{})  { l.msgs = append(l.msgs, msg) }
+func (l *recordLogger) Warn(msg string, kv ...interface{})  { l.msgs = append(l.msgs, msg) }
+
+func (l *recordLogger) has(msg string) bool {
+	for _, m := range l.msgs {
+		if m == msg {
+			return true
+		}
+	}
+	return false
+}
+
+func TestValidityInfo(t *testing.T) {
+	devResp, _, err := getDeviceResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Document", func(t *testing.T) {
+		v, err := devResp.Documents[0].ValidityInfo()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := v.ValidUntil.Format(time.RFC3339); got != "2023-03-22T22:48:31Z" {
+			t.Fatalf("unexpected validUntil: %s", got)
+		}
+	})
+
+	tdate := func(s string) cbor.Tag { return cbor.Tag{Number: 0, Content: s} }
+
+	t.Run("ExpectedUpdate", func(t *testing.T) {
+		data, _ := cbor.Marshal(map[string]interface{}{
+			"signed":         tdate("2024-01-01T00:00:00Z"),
+			"validFrom":      tdate("2024-01-01T00:00:00Z"),
+			"validUntil":     tdate("2025-01-01T00:00:00Z"),
+			"expectedUpdate": tdate("2024-06-01T00:00:00Z"),
+		})
+		var v ValidityInfo
+		if err := cbor.Unmarshal(data, &v); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !v.UpdateExpired(time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Fatalf("update not expired: %v", v.ExpectedUpdate)
+		}
+		if v.UpdateExpired(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Fatalf("update expired too early: %v", v.ExpectedUpdate)
+		}
+	})
+
+	t.Run("Untagged", func(t *testing.T) {
+		data, _ := cbor.Marshal(map[string]interface{}{
+			"signed":     "2024-01-01T00:00:00Z",
+			"validFrom":  tdate("2024-01-01T00:00:00Z"),
+			"validUntil": tdate("2025-01-01T00:00:00Z"),
+		})
+		var v ValidityInfo
+		if err := cbor.Unmarshal(data, &v); err == nil {
+			t.Fatal("accepted an untagged date")
+		}
+	})
+
+	t.Run("EpochTag", func(t *testing.T) {
+		data, _ := cbor.Marshal(map[string]interface{}{
+			"signed":     cbor.Tag{Number: 1, Content: 1704067200},
+			"validFrom":  tdate("2024-01-01T00:00:00Z"),
+			"validUntil": tdate("2025-01-01T00:00:00Z"),
+		})
+		var v ValidityInfo
+		if err := cbor.Unmarshal(data, &v); err == nil {
+			t.Fatal("accepted an epoch date")
+		}
+	})
+}
+
+func TestCheckDocuments(t *testing.T) {
+	t.Run("DocumentErrors", func(t *testing.T) {
+		data, _ := cbor.Marshal(map[string]interface{}{
+			"version":        "1.0",
+			"documentErrors": []interface{}{map[string]int{"org.iso.18013.5.1.mDL": 0}},
+			"status":         0,
+		})
+		var devResp DeviceResponse
+		if err := cbor.Unmarshal(data, &devResp); err != nil {
+			t.Fatal(err)
+		}
+
+		err := devResp.CheckDocuments()
+		if !errors.Is(err, ErrNoDocumentsReturned) {
+			t.Fatalf("expected ErrNoDocumentsReturned, got %v", err)
+		}
+		var noDocs *NoDocumentsError
+		if !errors.As(err, &noDocs) {
+			t.Fatalf("expected NoDocumentsError, got %T", err)
+		}
+		if code, ok := noDocs.DocumentErrors[DocTypeMDL]; !ok || code != 0 {
+			t.Fatalf("unexpected document errors: %v", noDocs.DocumentErrors)
+		}
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		devResp := DeviceResponse{Version: "1.0", Status: 0}
+		var noDocs *NoDocumentsError
+		if err := devResp.CheckDocuments(); !errors.As(err, &noDocs) || len(noDocs.DocumentErrors) != 0 {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Documents", func(t *testing.T) {
+		devResp, _, err := getDeviceResponse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := devResp.CheckDocuments(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestX5CertificateChain(t *testing.T) {
+	issuerSigned, _ := createEd25519IssuerSigned(t)
+	cert, err := issuerSigned.Certificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withChain := func(chain interface{}) IssuerSigned {
+		s := issuerSigned
+		s.IssuerAuth.Headers.Unprotected = cose.UnprotectedHeader{cose.HeaderLabelX5Chain: chain}
+		return s
+	}
+
+	t.Run("Duplicates", func(t *testing.T) {
+		s := withChain([][]byte{cert.Raw, cert.Raw})
+		certs, err := s.X5CertificateChain()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(certs) != 1 {
+			t.Fatalf("expected 1 certificate, got %d", len(certs))
+		}
+	})
+
+	t.Run("TooMany", func(t *testing.T) {
+		chain := make([][]byte, MaxX5ChainCertificates+1)
+		for i := range chain {
+			chain[i] = cert.Raw
+		}
+		s := withChain(chain)
+		if _, err := s.X5CertificateChain(); !errors.Is(err, ErrChainTooLong) {
+			t.Fatalf("expected ErrChainTooLong, got %v", err)
+		}
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		s := withChain(make([]byte, MaxX5ChainSize+1))
+		if _, err := s.X5CertificateChain(); !errors.Is(err, ErrChainTooLong) {
+			t.Fatalf("expected ErrChainTooLong, got %v", err)
+		}
+	})
+
+	t.Run("MalformedDER", func(t *testing.T) {
+		for _, der := range [][]byte{
+			{},
+			{0x31, 0x00},
+			{0x30, 0x05, 0x01},
+			append([]byte{}, cert.Raw[:len(cert.Raw)-1]...),
+			{0x30, 0x81, 0x01, 0x00}, // long form for a short length
+		} {
+			s := withChain([][]byte{der})
+			if _, err := s.X5CertificateChain(); err == nil {
+				t.Fatalf("accepted %x", der)
+			}
+		}
+	})
+}
+
+func TestX5ChainOrder(t *testing.T) {
+	_, root, rootKey := createRevocationCerts(t, "", "")
+	interKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:          big.NewInt(10),
+		Subject:               pkix.Name{CommonName: "Test Intermediate"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, root, &interKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inter, _ := x509.ParseCertificate(interDER)
+	ds := issueTestDS(t, inter, interKey, 11)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	issuerSigned, _ := createEd25519IssuerSigned(t)
+
+	for _, tt := range []struct {
+		name  string
+		chain interface{}
+		ok    bool
+	}{
+		{"Ordered", [][]byte{ds.Raw, inter.Raw}, true},
+		{"WithRoot", [][]byte{ds.Raw, inter.Raw, root.Raw}, true},
+		{"OutOfOrder", [][]byte{ds.Raw, root.Raw, inter.Raw}, true},
+		{"MissingIntermediate", ds.Raw, false},
+		{"SignerNotFirst", [][]byte{inter.Raw, ds.Raw}, false},
+		{"Unrelated", [][]byte{ds.Raw, inter.Raw, issueTestDS(t, root, rootKey, 12).Raw}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := issuerSigned
+			s.IssuerAuth.Headers.Unprotected = cose.UnprotectedHeader{cose.HeaderLabelX5Chain: tt.chain}
+			chains, err := verifyCertificateChains(s, roots, false, time.Now())
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("verified an invalid chain")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if chain := chains[0]; len(chain) != 3 || !chain[0].Equal(ds) || !chain[1].Equal(inter) || !chain[2].Equal(root) {
+				t.Fatalf("unexpected chain: %v", chain)
+			}
+		})
+	}
+}
@@ -0,0 +1,491 @@
+// Package mdoctest mints mdocs for tests: an IACA root and document signer, an MSO over
+// synthetic mDL data, a device-signed DeviceResponse and the Apple envelope around it.
+//
+// Everything is built from the wire format up, independently of the parsing code in mdoc,
+// so a round trip through the verifier actually exercises it.
+package mdoctest
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/kokukuma/identity-credential-api-demo/apple_hpke"
+	"github.com/kokukuma/identity-credential-api-demo/mdoc"
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+	"github.com/veraison/go-cose"
+)
+
+const (
+	DocTypeMDL                  = mdoc.DocTypeMDL
+	NameSpaceMDL mdoc.NameSpace = "org.iso.18013.5.1"
+)
+
+// Elements are the data elements of one namespace, by identifier.
+type Elements map[mdoc.DataElementIdentifier]interface{}
+
+// MDL returns synthetic mDL data. Dates are tagged the way ISO 18013-5 7.2.1 asks for.
+func MDL() map[mdoc.NameSpace]Elements {
+	return map[mdoc.NameSpace]Elements{
+		NameSpaceMDL: {
+			"family_name":     "Mustermann",
+			"given_name":      "Erika",
+			"birth_date":      cbor.Tag{Number: 1004, Content: "1971-09-01"},
+			"issue_date":      cbor.Tag{Number: 1004, Content: "2022-01-01"},
+			"expiry_date":     cbor.Tag{Number: 1004, Content: "2032-01-01"},
+			"issuing_country": "DE",
+			"document_number": "T22000129",
+			"age_over_18":     true,
+			"age_over_21":     true,
+		},
+	}
+}
+
+// Validity returns a ValidityInfo signed and valid from now, valid until now+d.
+func Validity(now time.Time, d time.Duration) mdoc.ValidityInfo {
+	now = now.UTC().Truncate(time.Second)
+	return mdoc.ValidityInfo{
+		Signed:     now,
+		ValidFrom:  now,
+		ValidUntil: now.Add(d),
+	}
+}
+
+// Issuer is an IACA root together with a document signer it issued.
+type Issuer struct {
+	Root      *x509.Certificate
+	RootKey   *ecdsa.PrivateKey
+	Signer    *x509.Certificate
+	SignerKey *ecdsa.PrivateKey
+	// DeviceCurve is the curve of the device keys Issue generates, P-256 if nil.
+	DeviceCurve elliptic.Curve
+	// DigestAlgorithm is the MSO digestAlgorithm, SHA-256 if empty.
+	DigestAlgorithm protocol.DigestAlgorithm
+	// AuthorizedNameSpaces are the keyAuthorizations nameSpaces, the device may sign elements of them.
+	AuthorizedNameSpaces []mdoc.NameSpace
+}
+
+// NewIssuer creates a P-256 IACA root and document signer, both valid for a year around now.
+func NewIssuer(now time.Time) (*Issuer, error) {
+	return NewIssuerCurve(now, elliptic.P256())
+}
+
+// NewIssuerCurve is NewIssuer with keys on curve. The MSO is signed with the matching
+// algorithm, ES384 for P-384 and ES512 for P-521.
+func NewIssuerCurve(now time.Time, curve elliptic.Curve) (*Issuer, error) {
+	rootKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	rootTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mdoctest IACA", Country: []string{"DE"}},
+		NotBefore:             now.Add(-24 * time.Hour),
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTmpl, rootTmpl, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create root certificate: %v", err)
+	}
+	root, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		return nil, err
+	}
+
+	signerKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signerTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "mdoctest DS", Country: []string{"DE"}},
+		NotBefore:    now.Add(-24 * time.Hour),
+		NotAfter:     now.Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	signerDER, err := x509.CreateCertificate(rand.Reader, signerTmpl, root, &signerKey.PublicKey, rootKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create document signer certificate: %v", err)
+	}
+	signer, err := x509.ParseCertificate(signerDER)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Issuer{
+		Root:      root,
+		RootKey:   rootKey,
+		Signer:    signer,
+		SignerKey: signerKey,
+	}, nil
+}
+
+// Roots returns a pool holding only the IACA root.
+func (i *Issuer) Roots() *x509.CertPool {
+	roots := x509.NewCertPool()
+	roots.AddCert(i.Root)
+	return roots
+}
+
+// Credential is an issued mdoc together with the device key it is bound to.
+type Credential struct {
+	DocType      mdoc.DocType
+	IssuerSigned mdoc.IssuerSigned
+	DeviceKey    *ecdsa.PrivateKey
+	// DeviceNameSpaces are the device-signed elements Present and PresentMac add.
+	DeviceNameSpaces map[mdoc.NameSpace]Elements
+}
+
+// Issue signs an MSO over nameSpaces for a fresh device key on DeviceCurve.
+func (i *Issuer) Issue(docType mdoc.DocType, nameSpaces map[mdoc.NameSpace]Elements, validity mdoc.ValidityInfo) (*Credential, error) {
+	curve := i.DeviceCurve
+	if curve == nil {
+		curve = elliptic.P256()
+	}
+	deviceKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	digestAlgorithm := i.DigestAlgorithm
+	if digestAlgorithm == "" {
+		digestAlgorithm = protocol.SHA256
+	}
+
+	issuerNameSpaces := mdoc.IssuerNameSpaces{}
+	valueDigests := map[mdoc.NameSpace]map[uint][]byte{}
+	var digestID uint
+	for ns, elements := range nameSpaces {
+		valueDigests[ns] = map[uint][]byte{}
+		for id, value := range elements {
+			item, err := issuerSignedItem(digestID, id, value)
+			if err != nil {
+				return nil, err
+			}
+			digest, err := item.Digest(digestAlgorithm)
+			if err != nil {
+				return nil, err
+			}
+			issuerNameSpaces[ns] = append(issuerNameSpaces[ns], item)
+			valueDigests[ns][digestID] = digest
+			digestID++
+		}
+	}
+
+	validityInfo := map[string]interface{}{
+		"signed":     tdate(validity.Signed),
+		"validFrom":  tdate(validity.ValidFrom),
+		"validUntil": tdate(validity.ValidUntil),
+	}
+	if !validity.ExpectedUpdate.IsZero() {
+		validityInfo["expectedUpdate"] = tdate(validity.ExpectedUpdate)
+	}
+
+	coseKey, err := protocol.MarshalCOSEKey(&deviceKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	deviceKeyInfo := map[string]interface{}{
+		"deviceKey": cbor.RawMessage(coseKey),
+	}
+	if len(i.AuthorizedNameSpaces) > 0 {
+		deviceKeyInfo["keyAuthorizations"] = map[string]interface{}{"nameSpaces": i.AuthorizedNameSpaces}
+	}
+
+	mso, err := protocol.EncMode.Marshal(map[string]interface{}{
+		"version":         "1.0",
+		"digestAlgorithm": digestAlgorithm,
+		"valueDigests":    valueDigests,
+		"deviceKeyInfo":   deviceKeyInfo,
+		"docType":         docType,
+		"validityInfo":    validityInfo,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal MSO: %v", err)
+	}
+	payload, err := protocol.TagEncodedCBOR(mso)
+	if err != nil {
+		return nil, err
+	}
+
+	alg, err := algorithm(&i.SignerKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := cose.NewSigner(alg, i.SignerKey)
+	if err != nil {
+		return nil, err
+	}
+	msg := cose.Sign1Message{
+		Headers: cose.Headers{
+			Protected:   cose.ProtectedHeader{cose.HeaderLabelAlgorithm: alg},
+			Unprotected: cose.UnprotectedHeader{cose.HeaderLabelX5Chain: i.Signer.Raw},
+		},
+		Payload: payload,
+	}
+	if err := msg.Sign(rand.Reader, nil, signer); err != nil {
+		return nil, fmt.Errorf("failed to sign MSO: %v", err)
+	}
+
+	return &Credential{
+		DocType: docType,
+		IssuerSigned: mdoc.IssuerSigned{
+			NameSpaces: issuerNameSpaces,
+			IssuerAuth: cose.UntaggedSign1Message(msg),
+		},
+		DeviceKey: deviceKey,
+	}, nil
+}
+
+// Disclose returns a copy of the credential with only the given elements of ns, the way a
+// wallet selectively discloses. The MSO still holds the digests of everything issued.
+func (c *Credential) Disclose(ns mdoc.NameSpace, ids ...mdoc.DataElementIdentifier) (*Credential, error) {
+	want := map[mdoc.DataElementIdentifier]bool{}
+	for _, id := range ids {
+		want[id] = true
+	}
+
+	var items []mdoc.IssuerSignedItemBytes
+	for _, itemBytes := range c.IssuerSigned.NameSpaces[ns] {
+		item, err := itemBytes.IssuerSignedItem()
+		if err != nil {
+			return nil, err
+		}
+		if want[item.ElementIdentifier] {
+			items = append(items, itemBytes)
+		}
+	}
+
+	disclosed := *c
+	disclosed.IssuerSigned.NameSpaces = mdoc.IssuerNameSpaces{ns: items}
+	return &disclosed, nil
+}
+
+// Present device-signs the credential for sessionTranscript. The DeviceAuthentication
+// payload is detached, as it is on the wire.
+func (c *Credential) Present(sessionTranscript []byte) (mdoc.Document, error) {
+	deviceSigned, deviceAuthentication, err := c.deviceSigned(sessionTranscript)
+	if err != nil {
+		return mdoc.Document{}, err
+	}
+
+	alg, err := algorithm(&c.DeviceKey.PublicKey)
+	if err != nil {
+		return mdoc.Document{}, err
+	}
+	signer, err := cose.NewSigner(alg, c.DeviceKey)
+	if err != nil {
+		return mdoc.Document{}, err
+	}
+	msg := cose.Sign1Message{
+		Headers: cose.Headers{
+			Protected: cose.ProtectedHeader{cose.HeaderLabelAlgorithm: alg},
+		},
+		Payload: deviceAuthentication,
+	}
+	if err := msg.Sign(rand.Reader, nil, signer); err != nil {
+		return mdoc.Document{}, fmt.Errorf("failed to sign DeviceAuthentication: %v", err)
+	}
+	msg.Payload = nil
+	deviceSigned.DeviceAuth.DeviceSignature = cose.UntaggedSign1Message(msg)
+	return c.document(deviceSigned), nil
+}
+
+// PresentMac authenticates the credential for sessionTranscript with a deviceMac keyed
+// for reader, the EReaderKey of the session.
+func (c *Credential) PresentMac(sessionTranscript []byte, reader *ecdh.PublicKey) (mdoc.Document, error) {
+	deviceSigned, deviceAuthentication, err := c.deviceSigned(sessionTranscript)
+	if err != nil {
+		return mdoc.Document{}, err
+	}
+
+	deviceKey, err := c.DeviceKey.ECDH()
+	if err != nil {
+		return mdoc.Document{}, err
+	}
+	eMacKey, err := protocol.DeriveEMacKey(deviceKey, reader, sessionTranscript)
+	if err != nil {
+		return mdoc.Document{}, err
+	}
+	deviceMac, err := protocol.CreateCOSEMac0(deviceAuthentication, eMacKey)
+	if err != nil {
+		return mdoc.Document{}, fmt.Errorf("failed to mac DeviceAuthentication: %v", err)
+	}
+	deviceSigned.DeviceAuth.DeviceMac = deviceMac
+	return c.document(deviceSigned), nil
+}
+
+// deviceSigned returns DeviceSigned with DeviceNameSpaces and the DeviceAuthentication to authenticate.
+func (c *Credential) deviceSigned(sessionTranscript []byte) (mdoc.DeviceSigned, []byte, error) {
+	deviceNameSpaces := c.DeviceNameSpaces
+	if deviceNameSpaces == nil {
+		deviceNameSpaces = map[mdoc.NameSpace]Elements{}
+	}
+	nameSpaces, err := protocol.EncMode.Marshal(deviceNameSpaces)
+	if err != nil {
+		return mdoc.DeviceSigned{}, nil, err
+	}
+	deviceSigned := mdoc.DeviceSigned{NameSpaces: mdoc.DeviceNameSpacesBytes(nameSpaces)}
+
+	deviceAuthentication, err := deviceSigned.DeviceAuthenticationBytes(c.DocType, sessionTranscript)
+	if err != nil {
+		return mdoc.DeviceSigned{}, nil, err
+	}
+	return deviceSigned, deviceAuthentication, nil
+}
+
+func (c *Credential) document(deviceSigned mdoc.DeviceSigned) mdoc.Document {
+	// Give every presentation its own unprotected header, so tampering with one does not
+	// leak into the credential.
+	issuerSigned := c.IssuerSigned
+	issuerSigned.IssuerAuth.Headers.Unprotected = cose.UnprotectedHeader{}
+	for k, v := range c.IssuerSigned.IssuerAuth.Headers.Unprotected {
+		issuerSigned.IssuerAuth.Headers.Unprotected[k] = v
+	}
+
+	return mdoc.Document{
+		DocType:      c.DocType,
+		IssuerSigned: issuerSigned,
+		DeviceSigned: deviceSigned,
+	}
+}
+
+// EncodeDeviceResponse encodes docs as a successful DeviceResponse.
+func EncodeDeviceResponse(docs ...mdoc.Document) ([]byte, error) {
+	documents := make([]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		documents = append(documents, encodeDocument(doc))
+	}
+	return protocol.EncMode.Marshal(map[string]interface{}{
+		"version":   "1.0",
+		"documents": documents,
+		"status":    0,
+	})
+}
+
+func encodeDocument(doc mdoc.Document) map[string]interface{} {
+	nameSpaces := map[mdoc.NameSpace][]cbor.Tag{}
+	for ns, items := range doc.IssuerSigned.NameSpaces {
+		for _, item := range items {
+			nameSpaces[ns] = append(nameSpaces[ns], cbor.Tag{Number: 24, Content: []byte(item)})
+		}
+	}
+	issuerAuth := doc.IssuerSigned.IssuerAuth
+	deviceAuth := map[string]interface{}{}
+	if len(doc.DeviceSigned.DeviceAuth.DeviceMac) > 0 {
+		deviceAuth["deviceMac"] = doc.DeviceSigned.DeviceAuth.DeviceMac
+	} else {
+		deviceSignature := doc.DeviceSigned.DeviceAuth.DeviceSignature
+		deviceAuth["deviceSignature"] = &deviceSignature
+	}
+
+	encoded := map[string]interface{}{
+		"docType": doc.DocType,
+		"issuerSigned": map[string]interface{}{
+			"nameSpaces": nameSpaces,
+			"issuerAuth": &issuerAuth,
+		},
+		"deviceSigned": map[string]interface{}{
+			"nameSpaces": cbor.Tag{Number: 24, Content: []byte(doc.DeviceSigned.NameSpaces)},
+			"deviceAuth": deviceAuth,
+		},
+	}
+	if len(doc.Errors) > 0 {
+		encoded["errors"] = doc.Errors
+	}
+	return encoded
+}
+
+// AppleSessionTranscript builds the SessionTranscript of an Apple presentment to recipient.
+func AppleSessionTranscript(merchantID, teamID string, nonce []byte, recipient *ecdh.PublicKey) ([]byte, error) {
+	requesterIDHash := sha256.Sum256(recipient.Bytes())
+	return protocol.EncMode.Marshal([]interface{}{
+		nil,
+		nil,
+		[]interface{}{
+			apple_hpke.APPLE_HANDOVER_V1,
+			nonce,
+			merchantID,
+			teamID,
+			requesterIDHash[:],
+		},
+	})
+}
+
+// EncryptApple wraps deviceResponse into an APPLE-HPKE-v1 envelope for recipient.
+func EncryptApple(deviceResponse []byte, merchantID, teamID string, nonce []byte, recipient *ecdh.PublicKey) ([]byte, error) {
+	info, err := AppleSessionTranscript(merchantID, teamID, nonce, recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := protocol.EncMode.Marshal(map[string]interface{}{
+		"identity": cbor.RawMessage(deviceResponse),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, pkEM, err := protocol.EncryptHPKE(protocol.DefaultHPKESuite, plaintext, info, recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	pkRHash := sha256.Sum256(recipient.Bytes())
+	infoHash := sha256.Sum256(info)
+	return protocol.EncMode.Marshal(apple_hpke.HPKEEnvelope{
+		Algorithm: apple_hpke.APPLE_HPKE_V1,
+		Params: apple_hpke.HPKEParams{
+			PkEM:     pkEM,
+			PkRHash:  pkRHash[:],
+			InfoHash: infoHash[:],
+		},
+		Data: ciphertext,
+	})
+}
+
+func issuerSignedItem(digestID uint, id mdoc.DataElementIdentifier, value interface{}) (mdoc.IssuerSignedItemBytes, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	item, err := protocol.EncMode.Marshal(map[string]interface{}{
+		"digestID":          digestID,
+		"random":            random,
+		"elementIdentifier": id,
+		"elementValue":      value,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal IssuerSignedItem: %v", err)
+	}
+	return mdoc.IssuerSignedItemBytes(item), nil
+}
+
+func tdate(t time.Time) cbor.Tag {
+	return cbor.Tag{Number: 0, Content: t.UTC().Format(time.RFC3339)}
+}
+
+// algorithm is the ECDSA algorithm for the curve of pub, RFC 9053 2.1.
+func algorithm(pub *ecdsa.PublicKey) (cose.Algorithm, error) {
+	switch pub.Curve {
+	case elliptic.P256():
+		return cose.AlgorithmES256, nil
+	case elliptic.P384():
+		return cose.AlgorithmES384, nil
+	case elliptic.P521():
+		return cose.AlgorithmES512, nil
+	}
+	return 0, fmt.Errorf("unsupported curve: %s", pub.Curve.Params().Name)
+}
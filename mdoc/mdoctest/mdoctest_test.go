@@ -0,0 +1,784 @@
+package mdoctest
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/kokukuma/identity-credential-api-demo/apple_hpke"
+	"github.com/kokukuma/identity-credential-api-demo/mdoc"
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+	"github.com/veraison/go-cose"
+)
+
+const (
+	merchantID = "PassKit_Identity_Test_Merchant_ID"
+	teamID     = "PassKit_Identity_Test_Team_ID"
+)
+
+type presentment struct {
+	issuer     *Issuer
+	credential *Credential
+	recipient  *ecdh.PrivateKey
+	nonce      []byte
+	now        time.Time
+}
+
+func newPresentment(t *testing.T) *presentment {
+	now := time.Now()
+	issuer, err := NewIssuer(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credential, err := issuer.Issue(DocTypeMDL, MDL(), Validity(now.Add(-time.Hour), 30*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+	return &presentment{
+		issuer:     issuer,
+		credential: credential,
+		recipient:  recipient,
+		nonce:      nonce,
+		now:        now,
+	}
+}
+
+// present device-signs the credential for this session and lets tamper modify the document
+// before it is encoded and encrypted.
+func (p *presentment) present(t *testing.T, tamper func(*mdoc.Document)) []byte {
+	sessTrans, err := AppleSessionTranscript(merchantID, teamID, p.nonce, p.recipient.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := p.credential.Present(sessTrans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tamper != nil {
+		tamper(&doc)
+	}
+	resp, err := EncodeDeviceResponse(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := EncryptApple(resp, merchantID, teamID, p.nonce, p.recipient.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return envelope
+}
+
+func (p *presentment) verify(t *testing.T, envelope []byte, opts mdoc.VerifyOptions) (*mdoc.VerificationReport, error) {
+	result, err := apple_hpke.Parse(envelope, merchantID, teamID, apple_hpke.RecipientKeys{p.recipient}, p.nonce)
+	if err != nil {
+		t.Fatalf("failed to decrypt: %v", err)
+	}
+	if len(result.DeviceResponse.Documents) != 1 {
+		t.Fatalf("expected 1 document, got %d", len(result.DeviceResponse.Documents))
+	}
+	if opts.Roots == nil {
+		opts.Roots = p.issuer.Roots()
+	}
+	if opts.Clock == nil {
+		opts.Clock = func() time.Time { return p.now }
+	}
+	return mdoc.VerifyDocument(context.Background(), result.DeviceResponse.Documents[0], result.SessionTranscript, opts)
+}
+
+func TestPipeline(t *testing.T) {
+	p := newPresentment(t)
+
+	t.Run("Clean", func(t *testing.T) {
+		report, err := p.verify(t, p.present(t, nil), mdoc.VerifyOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if report.DocType != DocTypeMDL {
+			t.Errorf("unexpected docType: %v", report.DocType)
+		}
+		if !report.DocumentSigner.Equal(p.issuer.Signer) {
+			t.Errorf("unexpected document signer: %v", report.DocumentSigner.Subject)
+		}
+	})
+
+	t.Run("RequireCanonicalCBOR", func(t *testing.T) {
+		if _, err := p.verify(t, p.present(t, nil), mdoc.VerifyOptions{RequireCanonicalCBOR: true}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("X5ChainWithRoot", func(t *testing.T) {
+		withRoot := func(doc *mdoc.Document) {
+			doc.IssuerSigned.IssuerAuth.Headers.Unprotected[cose.HeaderLabelX5Chain] = [][]byte{p.issuer.Signer.Raw, p.issuer.Root.Raw}
+		}
+		if _, err := p.verify(t, p.present(t, withRoot), mdoc.VerifyOptions{}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Elements", func(t *testing.T) {
+		envelope := p.present(t, nil)
+		result, err := apple_hpke.Parse(envelope, merchantID, teamID, apple_hpke.RecipientKeys{p.recipient}, p.nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc := result.DeviceResponse.Documents[0]
+		value, err := doc.TypedElement(mdoc.Element{Namespace: string(NameSpaceMDL), Name: "family_name"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if value != "Mustermann" {
+			t.Errorf("unexpected family_name: %v", value)
+		}
+	})
+
+	t.Run("Policies", func(t *testing.T) {
+		rules := []mdoc.PolicyRule{
+			mdoc.IssuingCountryMatchesSigner,
+			mdoc.IssuingJurisdictionMatchesCountry,
+			mdoc.RequireDocumentNumber,
+		}
+		report, err := p.verify(t, p.present(t, nil), mdoc.VerifyOptions{Policies: rules})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(report.PolicyErrors) != 0 {
+			t.Fatalf("unexpected policy errors: %v", report.PolicyErrors)
+		}
+
+		data := MDL()
+		data[NameSpaceMDL]["issuing_country"] = "FR"
+		delete(data[NameSpaceMDL], "document_number")
+		credential, err := p.issuer.Issue(DocTypeMDL, data, Validity(p.now.Add(-time.Hour), time.Hour*24))
+		if err != nil {
+			t.Fatal(err)
+		}
+		other := *p
+		other.credential = credential
+
+		// Policy failures are reported, they do not fail verification.
+		report, err = other.verify(t, other.present(t, nil), mdoc.VerifyOptions{Policies: rules})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(report.PolicyErrors) != 2 {
+			t.Fatalf("expected 2 policy errors, got %v", report.PolicyErrors)
+		}
+	})
+
+	t.Run("AgeOverOnly", func(t *testing.T) {
+		credential, err := p.credential.Disclose(NameSpaceMDL, "age_over_21")
+		if err != nil {
+			t.Fatal(err)
+		}
+		other := *p
+		other.credential = credential
+
+		envelope := other.present(t, nil)
+		if _, err := other.verify(t, envelope, mdoc.VerifyOptions{}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		result, err := apple_hpke.Parse(envelope, merchantID, teamID, apple_hpke.RecipientKeys{p.recipient}, p.nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		elements, err := result.DeviceResponse.Documents[0].TypedElements()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		ageOver21, _ := mdoc.AgeOver(21)
+		if len(elements) != 1 || elements[ageOver21] != true {
+			t.Fatalf("unexpected elements: %v", elements)
+		}
+	})
+
+	t.Run("DeviceMac", func(t *testing.T) {
+		reader, err := ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessTrans, err := AppleSessionTranscript(merchantID, teamID, p.nonce, p.recipient.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err := p.credential.PresentMac(sessTrans, reader.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := EncodeDeviceResponse(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		envelope, err := EncryptApple(resp, merchantID, teamID, p.nonce, p.recipient.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := p.verify(t, envelope, mdoc.VerifyOptions{ReaderKey: reader}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := p.verify(t, envelope, mdoc.VerifyOptions{}); !errors.Is(err, mdoc.ErrNoReaderKey) {
+			t.Fatalf("expected ErrNoReaderKey, got %v", err)
+		}
+		other, err := ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.verify(t, envelope, mdoc.VerifyOptions{ReaderKey: other}); !errors.Is(err, protocol.ErrMacMismatch) {
+			t.Fatalf("expected ErrMacMismatch, got %v", err)
+		}
+
+		result, err := apple_hpke.Parse(envelope, merchantID, teamID, apple_hpke.RecipientKeys{p.recipient}, p.nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := result.VerifyDeviceAuth(); !errors.Is(err, apple_hpke.ErrDeviceMacUnsupported) || !errors.Is(err, apple_hpke.ErrDeviceAuth) {
+			t.Fatalf("expected ErrDeviceMacUnsupported, got %v", err)
+		}
+	})
+
+	t.Run("NoDocuments", func(t *testing.T) {
+		resp, err := cbor.Marshal(map[string]interface{}{
+			"version":        "1.0",
+			"documentErrors": []interface{}{map[mdoc.DocType]mdoc.ErrorCode{DocTypeMDL: 0}},
+			"status":         0,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		envelope, err := EncryptApple(resp, merchantID, teamID, p.nonce, p.recipient.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = apple_hpke.Parse(envelope, merchantID, teamID, apple_hpke.RecipientKeys{p.recipient}, p.nonce)
+		var noDocs *mdoc.NoDocumentsError
+		if !errors.As(err, &noDocs) {
+			t.Fatalf("expected NoDocumentsError, got %v", err)
+		}
+		if _, ok := noDocs.DocumentErrors[DocTypeMDL]; !ok {
+			t.Fatalf("unexpected document errors: %v", noDocs.DocumentErrors)
+		}
+	})
+
+	tests := []struct {
+		name   string
+		tamper func(*mdoc.Document)
+		opts   mdoc.VerifyOptions
+	}{
+		{
+			name: "TamperedElement",
+			tamper: func(doc *mdoc.Document) {
+				items := doc.IssuerSigned.NameSpaces[NameSpaceMDL]
+				original, err := items[0].IssuerSignedItem()
+				if err != nil {
+					t.Fatal(err)
+				}
+				forged, err := issuerSignedItem(original.DigestID, original.ElementIdentifier, "Forged")
+				if err != nil {
+					t.Fatal(err)
+				}
+				doc.IssuerSigned.NameSpaces = mdoc.IssuerNameSpaces{
+					NameSpaceMDL: append([]mdoc.IssuerSignedItemBytes{forged}, items[1:]...),
+				}
+			},
+		},
+		{
+			name: "TamperedIssuerAuth",
+			tamper: func(doc *mdoc.Document) {
+				sig := append([]byte{}, doc.IssuerSigned.IssuerAuth.Signature...)
+				sig[0] ^= 0xff
+				doc.IssuerSigned.IssuerAuth.Signature = sig
+			},
+		},
+		{
+			name: "TamperedDeviceSignature",
+			tamper: func(doc *mdoc.Document) {
+				sig := append([]byte{}, doc.DeviceSigned.DeviceAuth.DeviceSignature.Signature...)
+				sig[0] ^= 0xff
+				doc.DeviceSigned.DeviceAuth.DeviceSignature.Signature = sig
+			},
+		},
+		{
+			name: "OtherSession",
+			tamper: func(doc *mdoc.Document) {
+				other, err := p.credential.Present([]byte{0x80})
+				if err != nil {
+					t.Fatal(err)
+				}
+				doc.DeviceSigned = other.DeviceSigned
+			},
+		},
+		{
+			// x5chain is unprotected, so it can be rearranged without breaking the signature.
+			name: "X5ChainReordered",
+			tamper: func(doc *mdoc.Document) {
+				doc.IssuerSigned.IssuerAuth.Headers.Unprotected[cose.HeaderLabelX5Chain] = [][]byte{p.issuer.Root.Raw, p.issuer.Signer.Raw}
+			},
+		},
+		{
+			name: "X5ChainExtraCert",
+			tamper: func(doc *mdoc.Document) {
+				other, err := NewIssuer(p.now)
+				if err != nil {
+					t.Fatal(err)
+				}
+				doc.IssuerSigned.IssuerAuth.Headers.Unprotected[cose.HeaderLabelX5Chain] = [][]byte{p.issuer.Signer.Raw, other.Signer.Raw}
+			},
+		},
+		{
+			name: "Expired",
+			opts: mdoc.VerifyOptions{Clock: func() time.Time { return p.now.Add(60 * 24 * time.Hour) }},
+		},
+		{
+			name: "UntrustedRoot",
+			opts: mdoc.VerifyOptions{Roots: func() *x509.CertPool {
+				other, err := NewIssuer(p.now)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return other.Roots()
+			}()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := p.verify(t, p.present(t, tt.tamper), tt.opts); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestVerifier(t *testing.T) {
+	p := newPresentment(t)
+	result, err := apple_hpke.Parse(p.present(t, nil), merchantID, teamID, apple_hpke.RecipientKeys{p.recipient}, p.nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := result.DeviceResponse.Documents[0]
+
+	v := mdoc.NewVerifier(nil)
+	if _, err := v.Verify(context.Background(), doc, result.SessionTranscript); err == nil {
+		t.Fatal("verified without trust anchors")
+	}
+
+	if err := v.AddTrustAnchor(p.issuer.Signer); !errors.Is(err, mdoc.ErrNotTrustAnchor) {
+		t.Fatalf("expected ErrNotTrustAnchor, got %v", err)
+	}
+	if err := v.AddTrustAnchor(p.issuer.Root); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	report, err := v.Verify(context.Background(), doc, result.SessionTranscript)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !report.DocumentSigner.Equal(p.issuer.Signer) {
+		t.Errorf("unexpected document signer: %v", report.DocumentSigner.Subject)
+	}
+	if chain := report.CertificateChain; len(chain) != 2 || !chain[0].Equal(p.issuer.Signer) || !chain[1].Equal(p.issuer.Root) {
+		t.Errorf("unexpected certificate chain: %v", chain)
+	}
+
+	other, err := NewIssuer(p.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.SetRootCertificates(other.Roots())
+	if _, err := v.Verify(context.Background(), doc, result.SessionTranscript); err == nil {
+		t.Fatal("verified after the roots were replaced")
+	}
+
+	t.Run("Options", func(t *testing.T) {
+		later := mdoc.WithClock(func() time.Time { return p.now.Add(60 * 24 * time.Hour) })
+		if _, err := mdoc.NewVerifier(p.issuer.Roots(), later).Verify(context.Background(), doc, result.SessionTranscript); !errors.Is(err, mdoc.ErrExpired) {
+			t.Fatalf("expected ErrExpired, got %v", err)
+		}
+		report, err := mdoc.NewVerifier(p.issuer.Roots(), later, mdoc.RejectExpired(false)).Verify(context.Background(), doc, result.SessionTranscript)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(report.Warnings) != 1 || !errors.Is(report.Warnings[0], mdoc.ErrExpired) {
+			t.Fatalf("unexpected warnings: %v", report.Warnings)
+		}
+
+		if _, err := mdoc.NewVerifier(p.issuer.Roots()).Verify(context.Background(), doc, []byte{0x80}); err == nil {
+			t.Fatal("verified for another session")
+		}
+		if _, err := mdoc.NewVerifier(p.issuer.Roots(), mdoc.RequireDeviceAuth(false)).Verify(context.Background(), doc, []byte{0x80}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestAlgorithms(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		curve       elliptic.Curve
+		deviceCurve elliptic.Curve
+		alg         cose.Algorithm
+	}{
+		{"ES384", elliptic.P384(), elliptic.P384(), cose.AlgorithmES384},
+		{"ES512", elliptic.P521(), elliptic.P521(), cose.AlgorithmES512},
+		{"ES384IssuerES256Device", elliptic.P384(), elliptic.P256(), cose.AlgorithmES384},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPresentment(t)
+			issuer, err := NewIssuerCurve(p.now, tt.curve)
+			if err != nil {
+				t.Fatal(err)
+			}
+			issuer.DeviceCurve = tt.deviceCurve
+			p.issuer = issuer
+			if p.credential, err = issuer.Issue(DocTypeMDL, MDL(), Validity(p.now.Add(-time.Hour), 30*24*time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if alg, err := p.credential.IssuerSigned.IssuerAuth.Headers.Protected.Algorithm(); err != nil || alg != tt.alg {
+				t.Fatalf("unexpected algorithm: %v, %v", alg, err)
+			}
+
+			if _, err := p.verify(t, p.present(t, nil), mdoc.VerifyOptions{}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, err := p.verify(t, p.present(t, func(doc *mdoc.Document) {
+				doc.IssuerSigned.IssuerAuth.Signature[0] ^= 0xff
+			}), mdoc.VerifyOptions{}); err == nil {
+				t.Fatal("verified a forged issuer signature")
+			}
+		})
+	}
+}
+
+func TestDigestAlgorithms(t *testing.T) {
+	for _, alg := range []protocol.DigestAlgorithm{protocol.SHA256, protocol.SHA384, protocol.SHA512} {
+		t.Run(string(alg), func(t *testing.T) {
+			p := newPresentment(t)
+			p.issuer.DigestAlgorithm = alg
+			var err error
+			if p.credential, err = p.issuer.Issue(DocTypeMDL, MDL(), Validity(p.now.Add(-time.Hour), 30*24*time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := p.verify(t, p.present(t, nil), mdoc.VerifyOptions{}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestDeviceSigned(t *testing.T) {
+	p := newPresentment(t)
+	p.issuer.AuthorizedNameSpaces = []mdoc.NameSpace{"org.example.device"}
+	var err error
+	if p.credential, err = p.issuer.Issue(DocTypeMDL, MDL(), Validity(p.now.Add(-time.Hour), 30*24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	nickname := mdoc.Element{Namespace: "org.example.device", Name: "nickname"}
+
+	t.Run("Authorized", func(t *testing.T) {
+		p.credential.DeviceNameSpaces = map[mdoc.NameSpace]Elements{"org.example.device": {"nickname": "Eri"}}
+		report, err := p.verify(t, p.present(t, nil), mdoc.VerifyOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if v := report.DeviceSigned[nickname]; v != "Eri" {
+			t.Fatalf("unexpected device-signed elements: %v", report.DeviceSigned)
+		}
+		if _, ok := report.DeviceSigned[mdoc.GivenName]; ok {
+			t.Fatal("issuer-signed element reported as device-signed")
+		}
+	})
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		p.credential.DeviceNameSpaces = map[mdoc.NameSpace]Elements{NameSpaceMDL: {"given_name": "Eri"}}
+		if _, err := p.verify(t, p.present(t, nil), mdoc.VerifyOptions{}); !errors.Is(err, mdoc.ErrUnauthorizedDeviceElement) {
+			t.Fatalf("expected ErrUnauthorizedDeviceElement, got %v", err)
+		}
+	})
+}
+
+func TestRequest(t *testing.T) {
+	p := newPresentment(t)
+	credential, err := p.credential.Disclose(NameSpaceMDL, "family_name", "age_over_21")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.credential = credential
+	envelope := p.present(t, nil)
+
+	t.Run("Requested", func(t *testing.T) {
+		req := mdoc.NewDeviceRequest().Add(DocTypeMDL, NameSpaceMDL, false, "family_name", "given_name", "age_over_21")
+		report, err := p.verify(t, envelope, mdoc.VerifyOptions{Request: req, RejectUnrequested: true})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if report.ItemsRequest == nil || report.ItemsRequest.DocType != DocTypeMDL || len(report.UnrequestedElements) != 0 {
+			t.Fatalf("unexpected report: %+v", report)
+		}
+	})
+
+	t.Run("UnrequestedElement", func(t *testing.T) {
+		req := mdoc.NewDeviceRequest().Add(DocTypeMDL, NameSpaceMDL, false, "age_over_21")
+		report, err := p.verify(t, envelope, mdoc.VerifyOptions{Request: req})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(report.UnrequestedElements) != 1 || report.UnrequestedElements[0] != mdoc.FamilyName {
+			t.Fatalf("unexpected unrequested elements: %v", report.UnrequestedElements)
+		}
+		if _, err := p.verify(t, envelope, mdoc.VerifyOptions{Request: req, RejectUnrequested: true}); !errors.Is(err, mdoc.ErrNotRequested) {
+			t.Fatalf("expected ErrNotRequested, got %v", err)
+		}
+	})
+
+	t.Run("UnrequestedDocument", func(t *testing.T) {
+		req := mdoc.NewDeviceRequest().Add(mdoc.DocTypePID, mdoc.NameSpacePID, false, "family_name")
+		if _, err := p.verify(t, envelope, mdoc.VerifyOptions{Request: req, RejectUnrequested: true}); !errors.Is(err, mdoc.ErrNotRequested) {
+			t.Fatalf("expected ErrNotRequested, got %v", err)
+		}
+	})
+}
+
+func TestMultipleDocuments(t *testing.T) {
+	p := newPresentment(t)
+	pid, err := p.issuer.Issue(mdoc.DocTypePID, map[mdoc.NameSpace]Elements{
+		mdoc.NameSpacePID: {"family_name": "Mustermann", "age_over_18": true},
+	}, Validity(p.now.Add(-time.Hour), 24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessTrans, err := AppleSessionTranscript(merchantID, teamID, p.nonce, p.recipient.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mdl, err := p.credential.Present(sessTrans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pidDoc, err := pid.Present(sessTrans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The PID is presented for another session, so only the mDL verifies.
+	other, err := pid.Present([]byte{0x80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pidDoc.DeviceSigned = other.DeviceSigned
+
+	resp, err := EncodeDeviceResponse(mdl, pidDoc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := EncryptApple(resp, merchantID, teamID, p.nonce, p.recipient.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := apple_hpke.Parse(envelope, merchantID, teamID, apple_hpke.RecipientKeys{p.recipient}, p.nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if doc, ok := result.DeviceResponse.Document(mdoc.DocTypePID); !ok || doc.DocType != mdoc.DocTypePID {
+		t.Fatalf("PID not found")
+	}
+	if _, ok := result.DeviceResponse.Document("org.iso.23220.photoid.1"); ok {
+		t.Fatalf("unexpected photo ID")
+	}
+
+	results := mdoc.VerifyDeviceResponse(context.Background(), result.DeviceResponse, result.SessionTranscript, mdoc.VerifyOptions{
+		Roots: p.issuer.Roots(),
+		Clock: func() time.Time { return p.now },
+	})
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	if results[0].DocType != DocTypeMDL || results[0].Err != nil || results[0].Report == nil {
+		t.Fatalf("unexpected mDL result: %+v", results[0])
+	}
+	if results[1].DocType != mdoc.DocTypePID || results[1].Err == nil {
+		t.Fatalf("unexpected PID result: %+v", results[1])
+	}
+
+	t.Run("DocumentErrors", func(t *testing.T) {
+		resp := *result.DeviceResponse
+		resp.Documents = []mdoc.Document{resp.Documents[0]}
+		resp.Documents[0].Errors = mdoc.Errors{NameSpaceMDL: {"portrait": mdoc.ErrorCodeDataNotReturned}}
+		resp.DocumentErrors = []mdoc.DocumentError{{mdoc.DocTypePID: mdoc.ErrorCodeDataNotReturned}}
+
+		results := mdoc.VerifyDeviceResponse(context.Background(), &resp, result.SessionTranscript, mdoc.VerifyOptions{
+			Roots: p.issuer.Roots(),
+			Clock: func() time.Time { return p.now },
+		})
+		if len(results) != 2 || results[0].Err != nil {
+			t.Fatalf("unexpected results: %+v", results)
+		}
+		if code, ok := results[0].Report.ElementErrors[NameSpaceMDL]["portrait"]; !ok || code != mdoc.ErrorCodeDataNotReturned {
+			t.Fatalf("unexpected element errors: %v", results[0].Report.ElementErrors)
+		}
+
+		var notReturned *mdoc.DocumentNotReturnedError
+		if !errors.As(results[1].Err, &notReturned) || !errors.Is(results[1].Err, mdoc.ErrDocumentNotReturned) {
+			t.Fatalf("unexpected error: %v", results[1].Err)
+		}
+		if results[1].DocType != mdoc.DocTypePID || notReturned.DocType != mdoc.DocTypePID || results[1].Report != nil {
+			t.Fatalf("unexpected PID result: %+v", results[1])
+		}
+	})
+}
+
+func TestInspectDocument(t *testing.T) {
+	p := newPresentment(t)
+
+	inspect := func(t *testing.T, tamper func(*mdoc.Document), opts mdoc.VerifyOptions) *mdoc.VerificationResult {
+		result, err := apple_hpke.Parse(p.present(t, tamper), merchantID, teamID, apple_hpke.RecipientKeys{p.recipient}, p.nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.Roots = p.issuer.Roots()
+		if opts.Clock == nil {
+			opts.Clock = func() time.Time { return p.now }
+		}
+		return mdoc.InspectDocument(context.Background(), result.DeviceResponse.Documents[0], result.SessionTranscript, opts)
+	}
+	outcome := func(result *mdoc.VerificationResult, name mdoc.CheckName) mdoc.CheckOutcome {
+		c, ok := result.Check(name)
+		if !ok {
+			t.Fatalf("check %s did not run", name)
+		}
+		return c.Outcome
+	}
+
+	t.Run("Clean", func(t *testing.T) {
+		result := inspect(t, nil, mdoc.VerifyOptions{})
+		if !result.OK() || result.Report == nil {
+			t.Fatalf("unexpected failure: %v", result.Err())
+		}
+		if outcome(result, mdoc.CheckRevocation) != mdoc.CheckSkipped || outcome(result, mdoc.CheckTokenStatus) != mdoc.CheckSkipped {
+			t.Fatalf("unexpected checks: %+v", result.Checks)
+		}
+	})
+
+	t.Run("SeveralFailures", func(t *testing.T) {
+		result := inspect(t, func(doc *mdoc.Document) {
+			items := doc.IssuerSigned.NameSpaces[NameSpaceMDL]
+			original, err := items[0].IssuerSignedItem()
+			if err != nil {
+				t.Fatal(err)
+			}
+			forged, err := issuerSignedItem(original.DigestID, original.ElementIdentifier, "Forged")
+			if err != nil {
+				t.Fatal(err)
+			}
+			items[0] = forged
+		}, mdoc.VerifyOptions{Clock: func() time.Time { return p.now.Add(60 * 24 * time.Hour) }})
+
+		if result.OK() || result.Report != nil {
+			t.Fatalf("expected failure: %+v", result)
+		}
+		// The forged item is not covered by DeviceAuth, which is over the DeviceNameSpaces.
+		if outcome(result, mdoc.CheckDeviceAuth) != mdoc.CheckPassed || outcome(result, mdoc.CheckIssuerSignature) != mdoc.CheckPassed {
+			t.Fatalf("unexpected checks: %+v", result.Checks)
+		}
+		if outcome(result, mdoc.CheckDigests) != mdoc.CheckFailed || outcome(result, mdoc.CheckValidity) != mdoc.CheckFailed {
+			t.Fatalf("unexpected checks: %+v", result.Checks)
+		}
+	})
+
+	t.Run("GracePeriod", func(t *testing.T) {
+		result := inspect(t, nil, mdoc.VerifyOptions{
+			Clock:              func() time.Time { return p.now.Add(60 * 24 * time.Hour) },
+			ExpiredGracePeriod: 365 * 24 * time.Hour,
+		})
+		if outcome(result, mdoc.CheckValidity) != mdoc.CheckWarned {
+			t.Fatalf("unexpected checks: %+v", result.Checks)
+		}
+	})
+}
+
+func TestRevocationUnavailable(t *testing.T) {
+	now := time.Now()
+	issuer, err := NewIssuer(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reissue the document signer with an OCSP responder that is down.
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	tmpl := *issuer.Signer
+	tmpl.OCSPServer = []string{srv.URL}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, issuer.Root, &issuer.SignerKey.PublicKey, issuer.RootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issuer.Signer, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+
+	cred, err := issuer.Issue(mdoc.DocTypeMDL, MDL(), Validity(now, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionTranscript := []byte{0x83, 0xf6, 0xf6, 0xf6}
+	doc, err := cred.Present(sessionTranscript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := func() mdoc.VerifyOptions {
+		return mdoc.VerifyOptions{
+			Roots:             issuer.Roots(),
+			CheckRevocation:   true,
+			RevocationChecker: mdoc.NewRevocationChecker(time.Minute),
+		}
+	}
+
+	t.Run("Inspect", func(t *testing.T) {
+		atomic.StoreInt32(&calls, 0)
+		result := mdoc.InspectDocument(context.Background(), doc, sessionTranscript, opts())
+		c, ok := result.Check(mdoc.CheckRevocation)
+		if !ok || c.Outcome != mdoc.CheckWarned || !errors.Is(c.Err, mdoc.ErrRevocationUnavailable) {
+			t.Fatalf("unexpected checks: %+v", result.Checks)
+		}
+		if calls := atomic.LoadInt32(&calls); calls != 1 {
+			t.Fatalf("revocation checked %d times", calls)
+		}
+	})
+
+	t.Run("Verify", func(t *testing.T) {
+		report, err := mdoc.VerifyDocument(context.Background(), doc, sessionTranscript, opts())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(report.Warnings) != 1 || !errors.Is(report.Warnings[0], mdoc.ErrRevocationUnavailable) {
+			t.Fatalf("unexpected warnings: %v", report.Warnings)
+		}
+
+		hard := opts()
+		hard.RevocationHardFail = true
+		if _, err := mdoc.VerifyDocument(context.Background(), doc, sessionTranscript, hard); !errors.Is(err, mdoc.ErrRevocationUnavailable) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package mdoc
+
+import "time"
+
+// Mobile vehicle registration certificate, ISO/IEC 7367.
+
+const (
+	DocTypeMVRC   DocType   = "org.iso.7367.1.mVRC"
+	NameSpaceMVRC NameSpace = "org.iso.7367.1"
+)
+
+var (
+	MVRCRegistrationNumber      = Element{Namespace: "org.iso.7367.1", Name: "registration_number"}
+	MVRCDateOfRegistration      = Element{Namespace: "org.iso.7367.1", Name: "date_of_registration"}
+	MVRCDateOfFirstRegistration = Element{Namespace: "org.iso.7367.1", Name: "date_of_first_registration"}
+	MVRCVehicleIdentification   = Element{Namespace: "org.iso.7367.1", Name: "vehicle_identification_number"}
+	MVRCVehicleHolder           = Element{Namespace: "org.iso.7367.1", Name: "vehicle_holder"}
+	MVRCBasicVehicleInfo        = Element{Namespace: "org.iso.7367.1", Name: "basic_vehicle_info"}
+	MVRCIssueDate               = Element{Namespace: "org.iso.7367.1", Name: "issue_date"}
+	MVRCExpiryDate              = Element{Namespace: "org.iso.7367.1", Name: "expiry_date"}
+	MVRCIssuingCountry          = Element{Namespace: "org.iso.7367.1", Name: "issuing_country"}
+	MVRCIssuingAuthority        = Element{Namespace: "org.iso.7367.1", Name: "issuing_authority_unicode"}
+	MVRCDocumentNumber          = Element{Namespace: "org.iso.7367.1", Name: "document_number"}
+)
+
+// MVRCSchema is the org.iso.7367.1 namespace. vehicle_holder and basic_vehicle_info are
+// maps, MVRC decodes them into structs.
+var MVRCSchema = NameSpaceSchema{
+	"registration_number":           TypeString,
+	"date_of_registration":          TypeFullDate,
+	"date_of_first_registration":    TypeFullDate,
+	"vehicle_identification_number": TypeString,
+	"vehicle_holder":                TypeAny,
+	"basic_vehicle_info":            TypeAny,
+	"issue_date":                    TypeFullDate,
+	"expiry_date":                   TypeFullDate,
+	"issuing_country":               TypeString,
+	"issuing_authority_unicode":     TypeString,
+	"document_number":               TypeString,
+	"un_distinguishing_sign":        TypeString,
+}
+
+// VehicleHolder is the holder of the registration.
+type VehicleHolder struct {
+	Name    string `cbor:"holder_name_unicode,omitempty"`
+	Address string `cbor:"holder_address_unicode,omitempty"`
+}
+
+// BasicVehicleInfo identifies the vehicle.
+type BasicVehicleInfo struct {
+	Make  string `cbor:"vehicle_make,omitempty"`
+	Model string `cbor:"vehicle_model,omitempty"`
+	Type  string `cbor:"vehicle_type,omitempty"`
+}
+
+// MVRC holds the commonly used elements of an mVRC. Undisclosed elements are left zero.
+type MVRC struct {
+	RegistrationNumber      string
+	DateOfRegistration      time.Time
+	DateOfFirstRegistration time.Time
+	VehicleIdentification   string
+	VehicleHolder           VehicleHolder
+	BasicVehicleInfo        BasicVehicleInfo
+	IssueDate               time.Time
+	ExpiryDate              time.Time
+	IssuingCountry          string
+	IssuingAuthority        string
+	DocumentNumber          string
+}
+
+// MVRC returns the commonly used elements of an mVRC document.
+func (d *Document) MVRC() (*MVRC, error) {
+	var m MVRC
+	var err error
+	for elem, dst := range map[Element]*string{
+		MVRCRegistrationNumber:    &m.RegistrationNumber,
+		MVRCVehicleIdentification: &m.VehicleIdentification,
+		MVRCIssuingCountry:        &m.IssuingCountry,
+		MVRCIssuingAuthority:      &m.IssuingAuthority,
+		MVRCDocumentNumber:        &m.DocumentNumber,
+	} {
+		if *dst, err = disclosed(GetElement[string](d, elem)); err != nil {
+			return nil, err
+		}
+	}
+	for elem, dst := range map[Element]*time.Time{
+		MVRCDateOfRegistration:      &m.DateOfRegistration,
+		MVRCDateOfFirstRegistration: &m.DateOfFirstRegistration,
+		MVRCIssueDate:               &m.IssueDate,
+		MVRCExpiryDate:              &m.ExpiryDate,
+	} {
+		if *dst, err = disclosed(GetElement[time.Time](d, elem)); err != nil {
+			return nil, err
+		}
+	}
+	if m.VehicleHolder, err = disclosed(GetElement[VehicleHolder](d, MVRCVehicleHolder)); err != nil {
+		return nil, err
+	}
+	if m.BasicVehicleInfo, err = disclosed(GetElement[BasicVehicleInfo](d, MVRCBasicVehicleInfo)); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
@@ -0,0 +1,126 @@
+package mdoc
+
+import (
+	"errors"
+	"time"
+)
+
+// Photo ID, ISO/IEC TS 23220-4. The common elements of ISO/IEC 23220-2 are in
+// org.iso.23220.1, the ones specific to a photo ID in org.iso.23220.photoid.1.
+
+const (
+	DocTypePhotoID   DocType   = "org.iso.23220.photoid.1"
+	NameSpace23220   NameSpace = "org.iso.23220.1"
+	NameSpacePhotoID NameSpace = "org.iso.23220.photoid.1"
+)
+
+var (
+	PhotoIDFamilyName       = Element{Namespace: "org.iso.23220.1", Name: "family_name_unicode"}
+	PhotoIDGivenName        = Element{Namespace: "org.iso.23220.1", Name: "given_name_unicode"}
+	PhotoIDBirthDate        = Element{Namespace: "org.iso.23220.1", Name: "birth_date"}
+	PhotoIDPortrait         = Element{Namespace: "org.iso.23220.1", Name: "portrait"}
+	PhotoIDIssueDate        = Element{Namespace: "org.iso.23220.1", Name: "issue_date"}
+	PhotoIDExpiryDate       = Element{Namespace: "org.iso.23220.1", Name: "expiry_date"}
+	PhotoIDIssuingAuthority = Element{Namespace: "org.iso.23220.1", Name: "issuing_authority_unicode"}
+	PhotoIDIssuingCountry   = Element{Namespace: "org.iso.23220.1", Name: "issuing_country"}
+	PhotoIDAgeOver18        = Element{Namespace: "org.iso.23220.1", Name: "age_over_18"}
+	PhotoIDDocumentNumber   = Element{Namespace: "org.iso.23220.1", Name: "document_number"}
+	PhotoIDNationality      = Element{Namespace: "org.iso.23220.1", Name: "nationality"}
+	PhotoIDPersonID         = Element{Namespace: "org.iso.23220.photoid.1", Name: "person_id"}
+)
+
+// Schema23220 is the org.iso.23220.1 namespace, ISO/IEC 23220-2.
+var Schema23220 = NameSpaceSchema{
+	"family_name_unicode":       TypeString,
+	"given_name_unicode":        TypeString,
+	"family_name_latin1":        TypeString,
+	"given_name_latin1":         TypeString,
+	"birth_date":                TypeFullDate,
+	"portrait":                  TypeBytes,
+	"enrolment_portrait_image":  TypeBytes,
+	"issue_date":                TypeFullDate,
+	"expiry_date":               TypeFullDate,
+	"issuing_authority_unicode": TypeString,
+	"issuing_country":           TypeString,
+	"issuing_subdivision":       TypeString,
+	"age_in_years":              TypeUint,
+	"age_birth_year":            TypeUint,
+	"age_over_18":               TypeBool,
+	"sex":                       TypeUint,
+	"nationality":               TypeString,
+	"document_number":           TypeString,
+	"birthplace":                TypeString,
+	"resident_address_unicode":  TypeString,
+	"resident_city_unicode":     TypeString,
+	"resident_postal_code":      TypeString,
+	"resident_country":          TypeString,
+	"name_suffix":               TypeString,
+}
+
+// PhotoIDSchema is the org.iso.23220.photoid.1 namespace, ISO/IEC TS 23220-4.
+var PhotoIDSchema = NameSpaceSchema{
+	"person_id":              TypeString,
+	"birth_country":          TypeString,
+	"birth_state":            TypeString,
+	"birth_city":             TypeString,
+	"administrative_number":  TypeString,
+	"resident_street":        TypeString,
+	"resident_house_number":  TypeString,
+	"travel_document_number": TypeString,
+	"resident_state":         TypeString,
+}
+
+// PhotoID holds the commonly used elements of a photo ID. Undisclosed elements are left
+// zero, AgeOver18 nil.
+type PhotoID struct {
+	FamilyName       string
+	GivenName        string
+	BirthDate        time.Time
+	Portrait         []byte
+	IssueDate        time.Time
+	ExpiryDate       time.Time
+	IssuingAuthority string
+	IssuingCountry   string
+	AgeOver18        *bool
+	DocumentNumber   string
+	Nationality      string
+	PersonID         string
+}
+
+// PhotoID returns the commonly used elements of a photo ID document.
+func (d *Document) PhotoID() (*PhotoID, error) {
+	var p PhotoID
+	var err error
+	for elem, dst := range map[Element]*string{
+		PhotoIDFamilyName:       &p.FamilyName,
+		PhotoIDGivenName:        &p.GivenName,
+		PhotoIDIssuingAuthority: &p.IssuingAuthority,
+		PhotoIDIssuingCountry:   &p.IssuingCountry,
+		PhotoIDDocumentNumber:   &p.DocumentNumber,
+		PhotoIDNationality:      &p.Nationality,
+		PhotoIDPersonID:         &p.PersonID,
+	} {
+		if *dst, err = disclosed(GetElement[string](d, elem)); err != nil {
+			return nil, err
+		}
+	}
+	for elem, dst := range map[Element]*time.Time{
+		PhotoIDBirthDate:  &p.BirthDate,
+		PhotoIDIssueDate:  &p.IssueDate,
+		PhotoIDExpiryDate: &p.ExpiryDate,
+	} {
+		if *dst, err = disclosed(GetElement[time.Time](d, elem)); err != nil {
+			return nil, err
+		}
+	}
+	if p.Portrait, err = disclosed(GetElement[[]byte](d, PhotoIDPortrait)); err != nil {
+		return nil, err
+	}
+	ageOver18, err := GetElement[bool](d, PhotoIDAgeOver18)
+	if err == nil {
+		p.AgeOver18 = &ageOver18
+	} else if !errors.Is(err, ErrElementNotFound) {
+		return nil, err
+	}
+	return &p, nil
+}
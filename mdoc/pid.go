@@ -0,0 +1,143 @@
+package mdoc
+
+import (
+	"errors"
+	"time"
+)
+
+// EU Digital Identity Wallet PID in mdoc encoding, ARF PID Rulebook.
+
+const (
+	DocTypePID   DocType   = "eu.europa.ec.eudi.pid.1"
+	NameSpacePID NameSpace = "eu.europa.ec.eudi.pid.1"
+)
+
+// The mandatory PID attributes.
+var (
+	PIDFamilyName = Element{
+		Namespace: "eu.europa.ec.eudi.pid.1",
+		Name:      "family_name",
+	}
+
+	PIDGivenName = Element{
+		Namespace: "eu.europa.ec.eudi.pid.1",
+		Name:      "given_name",
+	}
+
+	PIDBirthDate = Element{
+		Namespace: "eu.europa.ec.eudi.pid.1",
+		Name:      "birth_date",
+	}
+
+	PIDAgeOver18 = Element{
+		Namespace: "eu.europa.ec.eudi.pid.1",
+		Name:      "age_over_18",
+	}
+
+	PIDIssuanceDate = Element{
+		Namespace: "eu.europa.ec.eudi.pid.1",
+		Name:      "issuance_date",
+	}
+
+	PIDExpiryDate = Element{
+		Namespace: "eu.europa.ec.eudi.pid.1",
+		Name:      "expiry_date",
+	}
+
+	PIDIssuingAuthority = Element{
+		Namespace: "eu.europa.ec.eudi.pid.1",
+		Name:      "issuing_authority",
+	}
+
+	PIDIssuingCountry = Element{
+		Namespace: "eu.europa.ec.eudi.pid.1",
+		Name:      "issuing_country",
+	}
+)
+
+// PIDSchema is the eu.europa.ec.eudi.pid.1 namespace.
+var PIDSchema = NameSpaceSchema{
+	"family_name":           TypeString,
+	"given_name":            TypeString,
+	"birth_date":            TypeFullDate,
+	"age_over_18":           TypeBool,
+	"issuance_date":         TypeDate,
+	"expiry_date":           TypeDate,
+	"issuing_authority":     TypeString,
+	"issuing_country":       TypeString,
+	"age_in_years":          TypeUint,
+	"age_birth_year":        TypeUint,
+	"family_name_birth":     TypeString,
+	"given_name_birth":      TypeString,
+	"birth_place":           TypeString,
+	"birth_country":         TypeString,
+	"birth_state":           TypeString,
+	"birth_city":            TypeString,
+	"resident_address":      TypeString,
+	"resident_country":      TypeString,
+	"resident_state":        TypeString,
+	"resident_city":         TypeString,
+	"resident_postal_code":  TypeString,
+	"resident_street":       TypeString,
+	"resident_house_number": TypeString,
+	"gender":                TypeUint,
+	"nationality":           TypeString,
+	"document_number":       TypeString,
+	"administrative_number": TypeString,
+	"issuing_jurisdiction":  TypeString,
+}
+
+// PID holds the mandatory PID attributes. The holder may disclose only some of them,
+// the others are left zero, AgeOver18 nil.
+type PID struct {
+	FamilyName       string
+	GivenName        string
+	BirthDate        time.Time
+	AgeOver18        *bool
+	IssuanceDate     time.Time
+	ExpiryDate       time.Time
+	IssuingAuthority string
+	IssuingCountry   string
+}
+
+// PID returns the mandatory attributes of a PID document.
+func (d *Document) PID() (*PID, error) {
+	var pid PID
+	var err error
+	if pid.FamilyName, err = disclosed(GetElement[string](d, PIDFamilyName)); err != nil {
+		return nil, err
+	}
+	if pid.GivenName, err = disclosed(GetElement[string](d, PIDGivenName)); err != nil {
+		return nil, err
+	}
+	if pid.BirthDate, err = disclosed(GetElement[time.Time](d, PIDBirthDate)); err != nil {
+		return nil, err
+	}
+	ageOver18, err := GetElement[bool](d, PIDAgeOver18)
+	if err == nil {
+		pid.AgeOver18 = &ageOver18
+	} else if !errors.Is(err, ErrElementNotFound) {
+		return nil, err
+	}
+	if pid.IssuanceDate, err = disclosed(GetElement[time.Time](d, PIDIssuanceDate)); err != nil {
+		return nil, err
+	}
+	if pid.ExpiryDate, err = disclosed(GetElement[time.Time](d, PIDExpiryDate)); err != nil {
+		return nil, err
+	}
+	if pid.IssuingAuthority, err = disclosed(GetElement[string](d, PIDIssuingAuthority)); err != nil {
+		return nil, err
+	}
+	if pid.IssuingCountry, err = disclosed(GetElement[string](d, PIDIssuingCountry)); err != nil {
+		return nil, err
+	}
+	return &pid, nil
+}
+
+// disclosed turns ErrElementNotFound of a GetElement into the zero value.
+func disclosed[T any](v T, err error) (T, error) {
+	if errors.Is(err, ErrElementNotFound) {
+		return v, nil
+	}
+	return v, err
+}
@@ -0,0 +1,91 @@
+package mdoc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// PolicyRule is a deployment specific acceptance check on a cryptographically verified document.
+// A rule returns nil when it passes or does not apply to the document.
+type PolicyRule func(*Document) error
+
+// IssuingCountryMatchesSigner requires a disclosed issuing_country to equal the
+// country of the document signer certificate.
+func IssuingCountryMatchesSigner(doc *Document) error {
+	country, ok, err := stringElement(doc, IssuingCountry)
+	if err != nil || !ok {
+		return err
+	}
+
+	cert, err := doc.IssuerSigned.Certificate()
+	if err != nil {
+		return err
+	}
+	if len(cert.Subject.Country) == 0 {
+		return fmt.Errorf("issuing_country %q, document signer has no country", country)
+	}
+	if !strings.EqualFold(cert.Subject.Country[0], country) {
+		return fmt.Errorf("issuing_country %q does not match document signer country %q", country, cert.Subject.Country[0])
+	}
+	return nil
+}
+
+// IssuingJurisdictionMatchesCountry requires a disclosed issuing_jurisdiction, an ISO 3166-2
+// subdivision code, to be within the disclosed issuing_country.
+func IssuingJurisdictionMatchesCountry(doc *Document) error {
+	jurisdiction, ok, err := stringElement(doc, IssuingJurisdiction)
+	if err != nil || !ok || jurisdiction == "" {
+		return err
+	}
+	country, ok, err := stringElement(doc, IssuingCountry)
+	if err != nil || !ok {
+		return err
+	}
+	if !strings.HasPrefix(jurisdiction, country+"-") {
+		return fmt.Errorf("issuing_jurisdiction %q is not in issuing_country %q", jurisdiction, country)
+	}
+	return nil
+}
+
+// RequireDocumentNumber requires an mDL to disclose a non-empty document_number.
+func RequireDocumentNumber(doc *Document) error {
+	if doc.DocType != DocTypeMDL {
+		return nil
+	}
+	number, ok, err := stringElement(doc, DocumentNumber)
+	if err != nil {
+		return err
+	}
+	if !ok || number == "" {
+		return fmt.Errorf("document_number is missing")
+	}
+	return nil
+}
+
+// stringElement returns a disclosed text element, ok is false when it was not disclosed.
+func stringElement(doc *Document, elem Element) (string, bool, error) {
+	value, err := doc.TypedElement(elem)
+	if errors.Is(err, ErrElementNotFound) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", false, fmt.Errorf("%w: %s is %T", ErrUnexpectedType, elem.Name, value)
+	}
+	return s, true, nil
+}
+
+// checkPolicies runs every rule, a failing rule does not stop the others.
+func checkPolicies(doc *Document, rules []PolicyRule) []error {
+	var errs []error
+	for _, rule := range rules {
+		if err := rule(doc); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
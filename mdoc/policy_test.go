@@ -0,0 +1,46 @@
+package mdoc
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPolicies(t *testing.T) {
+	devResp, _, err := getDeviceResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := devResp.Documents[0]
+
+	t.Run("RequireDocumentNumber", func(t *testing.T) {
+		if err := RequireDocumentNumber(&doc); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("IssuingJurisdictionMatchesCountry", func(t *testing.T) {
+		// The fixture discloses an empty issuing_jurisdiction, there is nothing to check.
+		if err := IssuingJurisdictionMatchesCountry(&doc); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("IssuingCountryMatchesSigner", func(t *testing.T) {
+		// The Apple test signer has no country.
+		if err := IssuingCountryMatchesSigner(&doc); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	t.Run("AllRulesRun", func(t *testing.T) {
+		errA, errB := errors.New("a"), errors.New("b")
+		errs := checkPolicies(&doc, []PolicyRule{
+			func(*Document) error { return errA },
+			RequireDocumentNumber,
+			func(*Document) error { return errB },
+		})
+		if len(errs) != 2 || errs[0] != errA || errs[1] != errB {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+	})
+}
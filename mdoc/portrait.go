@@ -0,0 +1,59 @@
+package mdoc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+)
+
+// MIME types of the image formats ISO/IEC 18013-5 7.2.2 allows for portrait.
+const (
+	MIMETypeJPEG     = "image/jpeg"
+	MIMETypeJPEG2000 = "image/jp2"
+)
+
+var ErrUnsupportedImage = errors.New("unsupported image format")
+
+// ImageMIMEType detects JPEG and JPEG 2000, as codestream or JP2 file, from the magic bytes.
+// It returns "" for anything else.
+func ImageMIMEType(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, []byte{0xff, 0xd8, 0xff}):
+		return MIMETypeJPEG
+	case bytes.HasPrefix(b, []byte{0x00, 0x00, 0x00, 0x0c, 0x6a, 0x50}), bytes.HasPrefix(b, []byte{0xff, 0x4f, 0xff, 0x51}):
+		return MIMETypeJPEG2000
+	}
+	return ""
+}
+
+// Portrait returns the portrait element and its MIME type.
+func (d *Document) Portrait() ([]byte, string, error) {
+	b, err := GetElement[[]byte](d, Portrait)
+	if err != nil {
+		return nil, "", err
+	}
+	mimeType := ImageMIMEType(b)
+	if mimeType == "" {
+		return nil, "", fmt.Errorf("%w: portrait", ErrUnsupportedImage)
+	}
+	return b, mimeType, nil
+}
+
+// PortraitImage decodes the portrait element. The standard library has no JPEG 2000
+// decoder, so such a portrait fails with ErrUnsupportedImage; use Portrait for the bytes.
+func (d *Document) PortraitImage() (image.Image, error) {
+	b, mimeType, err := d.Portrait()
+	if err != nil {
+		return nil, err
+	}
+	if mimeType != MIMETypeJPEG {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedImage, mimeType)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode portrait: %w", err)
+	}
+	return img, nil
+}
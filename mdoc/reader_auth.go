@@ -0,0 +1,139 @@
+package mdoc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+	"github.com/veraison/go-cose"
+)
+
+var ErrNoReaderCertificate = errors.New("reader authentication requires a certificate")
+
+// Bytes returns the ItemsRequest as encoded in ItemsRequestBytes, the content of the tag 24.
+func (r *ItemsRequest) Bytes() ([]byte, error) {
+	b, err := protocol.EncMode.Marshal(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal ItemsRequest: %v", err)
+	}
+	return b, nil
+}
+
+// ReaderAuthenticationBytes returns the detached payload of readerAuth, ISO/IEC 18013-5 9.1.4.
+func ReaderAuthenticationBytes(sessionTranscript, itemsRequestBytes []byte) ([]byte, error) {
+	readerAuthentication, err := protocol.EncMode.Marshal([]interface{}{
+		"ReaderAuthentication",
+		cbor.RawMessage(sessionTranscript),
+		cbor.Tag{Number: 24, Content: itemsRequestBytes},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal ReaderAuthentication: %v", err)
+	}
+	return protocol.TagEncodedCBOR(readerAuthentication)
+}
+
+// SignReaderAuth sets the readerAuth of every DocRequest, signed with key for
+// sessionTranscript. chain starts with the reader certificate of key and goes into x5chain.
+func (r *DeviceRequest) SignReaderAuth(sessionTranscript []byte, key crypto.Signer, chain []*x509.Certificate) error {
+	if len(chain) == 0 {
+		return ErrNoReaderCertificate
+	}
+	alg, err := keyAlgorithm(key.Public())
+	if err != nil {
+		return err
+	}
+	signer, err := cose.NewSigner(alg, key)
+	if err != nil {
+		return err
+	}
+
+	// A single certificate is a bstr, more are an array, ISO/IEC 18013-5 9.1.4.
+	var x5chain interface{} = chain[0].Raw
+	if len(chain) > 1 {
+		certs := make([][]byte, len(chain))
+		for i, cert := range chain {
+			certs[i] = cert.Raw
+		}
+		x5chain = certs
+	}
+
+	for i := range r.DocRequests {
+		itemsRequestBytes, err := r.DocRequests[i].ItemsRequest.Bytes()
+		if err != nil {
+			return err
+		}
+		payload, err := ReaderAuthenticationBytes(sessionTranscript, itemsRequestBytes)
+		if err != nil {
+			return err
+		}
+
+		msg := cose.Sign1Message{
+			Headers: cose.Headers{
+				Protected:   cose.ProtectedHeader{cose.HeaderLabelAlgorithm: alg},
+				Unprotected: cose.UnprotectedHeader{cose.HeaderLabelX5Chain: x5chain},
+			},
+			Payload: payload,
+		}
+		if err := msg.Sign(rand.Reader, nil, signer); err != nil {
+			return fmt.Errorf("failed to sign ReaderAuthentication: %v", err)
+		}
+		msg.Payload = nil
+		untagged := cose.UntaggedSign1Message(msg)
+		readerAuth, err := untagged.MarshalCBOR()
+		if err != nil {
+			return err
+		}
+		r.DocRequests[i].ReaderAuth = readerAuth
+	}
+	return nil
+}
+
+// MarshalCBOR encodes the DeviceRequest as sent to the mdoc, with every ItemsRequest
+// wrapped in ItemsRequestBytes as SignReaderAuth signed it.
+func (r DeviceRequest) MarshalCBOR() ([]byte, error) {
+	type docRequest struct {
+		ItemsRequest cbor.Tag        `cbor:"itemsRequest"`
+		ReaderAuth   cbor.RawMessage `cbor:"readerAuth,omitempty"`
+	}
+	wire := struct {
+		Version     string       `cbor:"version"`
+		DocRequests []docRequest `cbor:"docRequests"`
+	}{Version: r.Version}
+
+	for _, docReq := range r.DocRequests {
+		itemsRequestBytes, err := docReq.ItemsRequest.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		wire.DocRequests = append(wire.DocRequests, docRequest{
+			ItemsRequest: cbor.Tag{Number: 24, Content: itemsRequestBytes},
+			ReaderAuth:   docReq.ReaderAuth,
+		})
+	}
+	return protocol.EncMode.Marshal(wire)
+}
+
+func keyAlgorithm(pub crypto.PublicKey) (cose.Algorithm, error) {
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return cose.AlgorithmES256, nil
+		case elliptic.P384():
+			return cose.AlgorithmES384, nil
+		case elliptic.P521():
+			return cose.AlgorithmES512, nil
+		}
+		return 0, fmt.Errorf("unsupported curve: %s", key.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return cose.AlgorithmEd25519, nil
+	}
+	return 0, fmt.Errorf("unsupported key type: %T", pub)
+}
@@ -0,0 +1,203 @@
+package mdoc
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// ISO_IEC_18013-5_2021(en).pdf 8.3.2.1.2.1 Device retrieval mdoc request
+
+type DeviceRequest struct {
+	Version     string       `json:"version"`
+	DocRequests []DocRequest `json:"docRequests"`
+}
+
+type DocRequest struct {
+	ItemsRequest ItemsRequest `json:"itemsRequest"`
+	// ReaderAuth is the untagged COSE_Sign1 set by SignReaderAuth, if any.
+	ReaderAuth cbor.RawMessage `json:"readerAuth,omitempty"`
+}
+
+type ItemsRequest struct {
+	DocType    DocType                    `json:"docType"`
+	NameSpaces map[NameSpace]DataElements `json:"nameSpaces"`
+}
+
+// DataElements maps each requested element to its IntentToRetain flag.
+type DataElements map[DataElementIdentifier]bool
+
+// NewDeviceRequest returns an empty version 1.0 DeviceRequest to fill with Add.
+func NewDeviceRequest() *DeviceRequest {
+	return &DeviceRequest{Version: "1.0"}
+}
+
+// Add requests the elements ids of ns in docType, with intentToRetain for all of them.
+// Elements of a docType that is already requested are merged into its ItemsRequest.
+func (r *DeviceRequest) Add(docType DocType, ns NameSpace, intentToRetain bool, ids ...DataElementIdentifier) *DeviceRequest {
+	itemsRequest, ok := r.ItemsRequest(docType)
+	if !ok {
+		r.DocRequests = append(r.DocRequests, DocRequest{ItemsRequest: ItemsRequest{DocType: docType}})
+		itemsRequest = &r.DocRequests[len(r.DocRequests)-1].ItemsRequest
+	}
+	if itemsRequest.NameSpaces == nil {
+		itemsRequest.NameSpaces = map[NameSpace]DataElements{}
+	}
+	if itemsRequest.NameSpaces[ns] == nil {
+		itemsRequest.NameSpaces[ns] = DataElements{}
+	}
+	for _, id := range ids {
+		itemsRequest.NameSpaces[ns][id] = intentToRetain
+	}
+	return r
+}
+
+// AddElements requests elements, e.g. the Element variables of this package, in docType.
+func (r *DeviceRequest) AddElements(docType DocType, intentToRetain bool, elements ...Element) *DeviceRequest {
+	for _, elem := range elements {
+		r.Add(docType, NameSpace(elem.Namespace), intentToRetain, DataElementIdentifier(elem.Name))
+	}
+	return r
+}
+
+// ItemsRequest returns the request for docType, if any.
+func (r *DeviceRequest) ItemsRequest(docType DocType) (*ItemsRequest, bool) {
+	for i := range r.DocRequests {
+		if r.DocRequests[i].ItemsRequest.DocType == docType {
+			return &r.DocRequests[i].ItemsRequest, true
+		}
+	}
+	return nil, false
+}
+
+// UnexpectedElements returns the elements disclosed in doc that req did not ask for.
+// This is a data minimization violation on the wallet side, not a verification failure.
+func UnexpectedElements(req *DeviceRequest, doc Document) ([]Element, error) {
+	elements, err := doc.DisclosedElements()
+	if err != nil {
+		return nil, err
+	}
+
+	itemsRequest, ok := req.ItemsRequest(doc.DocType)
+
+	var unexpected []Element
+	for _, elem := range elements {
+		if ok {
+			if _, requested := itemsRequest.NameSpaces[elem.NameSpace][elem.Identifier]; requested {
+				continue
+			}
+		}
+		unexpected = append(unexpected, Element{
+			Namespace: string(elem.NameSpace),
+			Name:      string(elem.Identifier),
+		})
+	}
+	sortElements(unexpected)
+	return unexpected, nil
+}
+
+// checkRequest returns the request for the docType of doc and the elements disclosed
+// without being requested. The error wraps ErrNotRequested when there are any.
+func checkRequest(req *DeviceRequest, doc Document) (*ItemsRequest, []Element, error) {
+	unrequested, err := UnexpectedElements(req, doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	itemsRequest, ok := req.ItemsRequest(doc.DocType)
+	if !ok {
+		return nil, unrequested, fmt.Errorf("%w: document %s", ErrNotRequested, doc.DocType)
+	}
+	if len(unrequested) > 0 {
+		return itemsRequest, unrequested, fmt.Errorf("%w: %s %v", ErrNotRequested, doc.DocType, unrequested)
+	}
+	return itemsRequest, nil, nil
+}
+
+// Retention is what the verifier declared for a disclosed element.
+type Retention struct {
+	IntentToRetain bool
+	// Requested is false for elements disclosed without being requested, see UnexpectedElements.
+	// Those were never declared, so they must not be retained either.
+	Requested bool
+}
+
+// IntentToRetain maps every element disclosed in doc to the intentToRetain flag req declared for it.
+func IntentToRetain(req *DeviceRequest, doc Document) (map[Element]Retention, error) {
+	elements, err := doc.DisclosedElements()
+	if err != nil {
+		return nil, err
+	}
+
+	itemsRequest, ok := req.ItemsRequest(doc.DocType)
+
+	retention := map[Element]Retention{}
+	for _, elem := range elements {
+		var r Retention
+		if ok {
+			r.IntentToRetain, r.Requested = itemsRequest.NameSpaces[elem.NameSpace][elem.Identifier]
+		}
+		retention[Element{Namespace: string(elem.NameSpace), Name: string(elem.Identifier)}] = r
+	}
+	return retention, nil
+}
+
+// MissingElement is a requested element the holder did not disclose.
+type MissingElement struct {
+	Element
+	// Declined is set when the holder reported the element in the document's errors,
+	// ErrorCode then holds the reported code. Otherwise it was silently left out.
+	Declined  bool
+	ErrorCode ErrorCode
+}
+
+// MissingElements returns the elements req asked for that are not disclosed in doc.
+func MissingElements(req *DeviceRequest, doc Document) ([]MissingElement, error) {
+	itemsRequest, ok := req.ItemsRequest(doc.DocType)
+	if !ok {
+		return nil, nil
+	}
+
+	elements, err := doc.DisclosedElements()
+	if err != nil {
+		return nil, err
+	}
+	disclosed := map[NameSpace]map[DataElementIdentifier]bool{}
+	for _, elem := range elements {
+		if disclosed[elem.NameSpace] == nil {
+			disclosed[elem.NameSpace] = map[DataElementIdentifier]bool{}
+		}
+		disclosed[elem.NameSpace][elem.Identifier] = true
+	}
+
+	var missing []MissingElement
+	for ns, dataElements := range itemsRequest.NameSpaces {
+		for id := range dataElements {
+			if disclosed[ns][id] {
+				continue
+			}
+			code, declined := doc.Errors[ns][id]
+			missing = append(missing, MissingElement{
+				Element:   Element{Namespace: string(ns), Name: string(id)},
+				Declined:  declined,
+				ErrorCode: code,
+			})
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		if missing[i].Namespace != missing[j].Namespace {
+			return missing[i].Namespace < missing[j].Namespace
+		}
+		return missing[i].Name < missing[j].Name
+	})
+	return missing, nil
+}
+
+func sortElements(elements []Element) {
+	sort.Slice(elements, func(i, j int) bool {
+		if elements[i].Namespace != elements[j].Namespace {
+			return elements[i].Namespace < elements[j].Namespace
+		}
+		return elements[i].Name < elements[j].Name
+	})
+}
@@ -0,0 +1,192 @@
+package mdoc
+
+import (
+	"crypto/x509"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+)
+
+func TestUnexpectedElements(t *testing.T) {
+	devResp, _, err := getDeviceResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := devResp.Documents[0]
+
+	req := &DeviceRequest{
+		Version: "1.0",
+		DocRequests: []DocRequest{{
+			ItemsRequest: ItemsRequest{
+				DocType: "org.iso.18013.5.1.mDL",
+				NameSpaces: map[NameSpace]DataElements{
+					"org.iso.18013.5.1": {"family_name": false, "given_name": false},
+				},
+			},
+		}},
+	}
+
+	unexpected, err := UnexpectedElements(req, doc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	found := map[Element]bool{}
+	for _, elem := range unexpected {
+		found[elem] = true
+	}
+	if found[FamilyName] || found[GivenName] {
+		t.Fatalf("requested element reported as unexpected: %v", unexpected)
+	}
+	if !found[BirthDate] || !found[Portrait] {
+		t.Fatalf("unrequested element not reported: %v", unexpected)
+	}
+	if !found[Element{Namespace: "org.iso.18013.5.1.aamva", Name: "aka_family_name"}] {
+		t.Fatalf("unrequested namespace not reported: %v", unexpected)
+	}
+}
+
+func TestMissingElements(t *testing.T) {
+	devResp, _, err := getDeviceResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := devResp.Documents[0]
+	doc.Errors = Errors{
+		"org.iso.18013.5.1": {"sex": 0},
+	}
+
+	req := &DeviceRequest{
+		Version: "1.0",
+		DocRequests: []DocRequest{{
+			ItemsRequest: ItemsRequest{
+				DocType: "org.iso.18013.5.1.mDL",
+				NameSpaces: map[NameSpace]DataElements{
+					"org.iso.18013.5.1": {"family_name": false, "sex": false, "nationality": false},
+				},
+			},
+		}},
+	}
+
+	missing, err := MissingElements(req, doc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []MissingElement{
+		{Element: Element{Namespace: "org.iso.18013.5.1", Name: "nationality"}},
+		{Element: Element{Namespace: "org.iso.18013.5.1", Name: "sex"}, Declined: true},
+	}
+	if len(missing) != len(want) {
+		t.Fatalf("unexpected missing elements: %v", missing)
+	}
+	for i := range want {
+		if missing[i] != want[i] {
+			t.Fatalf("unexpected missing element: got %v, want %v", missing[i], want[i])
+		}
+	}
+}
+
+func TestIntentToRetain(t *testing.T) {
+	devResp, _, err := getDeviceResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &DeviceRequest{
+		Version: "1.0",
+		DocRequests: []DocRequest{{
+			ItemsRequest: ItemsRequest{
+				DocType: "org.iso.18013.5.1.mDL",
+				NameSpaces: map[NameSpace]DataElements{
+					"org.iso.18013.5.1": {"family_name": true, "given_name": false},
+				},
+			},
+		}},
+	}
+
+	retention, err := IntentToRetain(req, devResp.Documents[0])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for elem, want := range map[Element]Retention{
+		FamilyName: {IntentToRetain: true, Requested: true},
+		GivenName:  {IntentToRetain: false, Requested: true},
+		BirthDate:  {IntentToRetain: false, Requested: false},
+	} {
+		got, ok := retention[elem]
+		if !ok {
+			t.Fatalf("%v not in retention map", elem)
+		}
+		if got != want {
+			t.Fatalf("%v: got %+v, want %+v", elem, got, want)
+		}
+	}
+}
+
+func TestDeviceRequestBuilder(t *testing.T) {
+	req := NewDeviceRequest().
+		AddElements(DocTypeMDL, false, FamilyName, GivenName).
+		Add(DocTypeMDL, "org.iso.18013.5.1", true, "portrait").
+		Add(DocTypePID, NameSpacePID, false, "age_over_18")
+
+	if len(req.DocRequests) != 2 {
+		t.Fatalf("expected 2 DocRequests, got %d", len(req.DocRequests))
+	}
+	mdl, ok := req.ItemsRequest(DocTypeMDL)
+	if !ok {
+		t.Fatal("mDL not requested")
+	}
+	if retain, ok := mdl.NameSpaces["org.iso.18013.5.1"]["portrait"]; !ok || !retain {
+		t.Fatalf("unexpected portrait request: %v", mdl.NameSpaces)
+	}
+	if retain, ok := mdl.NameSpaces["org.iso.18013.5.1"]["family_name"]; !ok || retain {
+		t.Fatalf("unexpected family_name request: %v", mdl.NameSpaces)
+	}
+
+	t.Run("ReaderAuth", func(t *testing.T) {
+		_, readerCert, readerKey := createRevocationCerts(t, "", "")
+		sessionTranscript, _ := cbor.Marshal([]interface{}{nil, nil, "handover"})
+
+		if err := req.SignReaderAuth(sessionTranscript, readerKey, nil); err == nil {
+			t.Fatal("expected an error without certificate")
+		}
+		if err := req.SignReaderAuth(sessionTranscript, readerKey, []*x509.Certificate{readerCert}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		encoded, err := cbor.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wire struct {
+			Version     string `cbor:"version"`
+			DocRequests []struct {
+				ItemsRequest cbor.Tag        `cbor:"itemsRequest"`
+				ReaderAuth   cbor.RawMessage `cbor:"readerAuth"`
+			} `cbor:"docRequests"`
+		}
+		if err := cbor.Unmarshal(encoded, &wire); err != nil {
+			t.Fatal(err)
+		}
+		if wire.Version != "1.0" || len(wire.DocRequests) != 2 {
+			t.Fatalf("unexpected DeviceRequest: %+v", wire)
+		}
+
+		for _, docReq := range wire.DocRequests {
+			itemsRequestBytes, ok := docReq.ItemsRequest.Content.([]byte)
+			if docReq.ItemsRequest.Number != 24 || !ok {
+				t.Fatalf("itemsRequest is not ItemsRequestBytes: %v", docReq.ItemsRequest)
+			}
+			payload, err := ReaderAuthenticationBytes(sessionTranscript, itemsRequestBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := protocol.VerifyCOSESign1(docReq.ReaderAuth, payload, readerCert.PublicKey); err != nil {
+				t.Fatalf("readerAuth does not verify: %v", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,429 @@
+package mdoc
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CheckName identifies one step of the verification of a document.
+type CheckName string
+
+const (
+	// CheckMSO is decoding the MobileSecurityObject, which most other checks need.
+	CheckMSO CheckName = "mso"
+	// CheckDeviceAuth is the deviceSignature or deviceMac over the DeviceAuthentication,
+	// which binds the document to the deviceKey and to this session's SessionTranscript.
+	CheckDeviceAuth        CheckName = "device_auth"
+	CheckCertificateChain  CheckName = "certificate_chain"
+	CheckRevocation        CheckName = "revocation"
+	CheckIssuerSignature   CheckName = "issuer_signature"
+	CheckDigests           CheckName = "digests"
+	CheckCanonicalEncoding CheckName = "canonical_encoding"
+	CheckDocType           CheckName = "doc_type"
+	// CheckSignedDate is the MSO signed date being within the document signer's validity.
+	CheckSignedDate  CheckName = "signed_date"
+	CheckValidity    CheckName = "validity"
+	CheckTokenStatus CheckName = "status"
+	// CheckRequest is the document and its elements having been asked for by VerifyOptions.Request.
+	CheckRequest  CheckName = "request"
+	CheckPolicies CheckName = "policies"
+)
+
+// CheckOutcome is how a check ended.
+type CheckOutcome int
+
+const (
+	CheckPassed CheckOutcome = iota
+	CheckFailed
+	// CheckSkipped is a check that was not asked for or could not run because one it
+	// depends on failed.
+	CheckSkipped
+	// CheckWarned is a problem that VerifyOptions tolerate, VerifyDocument would pass.
+	CheckWarned
+)
+
+func (o CheckOutcome) String() string {
+	switch o {
+	case CheckPassed:
+		return "pass"
+	case CheckFailed:
+		return "fail"
+	case CheckSkipped:
+		return "skip"
+	case CheckWarned:
+		return "warn"
+	}
+	return fmt.Sprintf("CheckOutcome(%d)", int(o))
+}
+
+// CheckResult is the outcome of one check. Err is set for failed and warned checks and
+// Detail says why a check was skipped.
+type CheckResult struct {
+	Name    CheckName
+	Outcome CheckOutcome
+	Err     error
+	Detail  string
+}
+
+// VerificationResult lists every check performed on a document, in the order they ran.
+type VerificationResult struct {
+	DocType DocType
+	Checks  []CheckResult
+	// Report is set when no check failed.
+	Report *VerificationReport
+}
+
+// OK reports whether no check failed.
+func (r *VerificationResult) OK() bool {
+	return r.Err() == nil
+}
+
+// Err returns the failed checks as one error, nil if there are none.
+func (r *VerificationResult) Err() error {
+	var failed []string
+	var first error
+	for _, c := range r.Checks {
+		if c.Outcome != CheckFailed {
+			continue
+		}
+		if first == nil {
+			first = c.Err
+		}
+		failed = append(failed, fmt.Sprintf("%s: %v", c.Name, c.Err))
+	}
+	if first == nil {
+		return nil
+	}
+	if len(failed) == 1 {
+		return fmt.Errorf("%s: %w", r.DocType, first)
+	}
+	return fmt.Errorf("%s: %w (and %s)", r.DocType, first, strings.Join(failed[1:], "; "))
+}
+
+// Check returns the result of the check name, if it ran.
+func (r *VerificationResult) Check(name CheckName) (CheckResult, bool) {
+	for _, c := range r.Checks {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return CheckResult{}, false
+}
+
+func (r *VerificationResult) add(name CheckName, err error) bool {
+	outcome := CheckPassed
+	if err != nil {
+		outcome = CheckFailed
+	}
+	r.Checks = append(r.Checks, CheckResult{Name: name, Outcome: outcome, Err: err})
+	return err == nil
+}
+
+func (r *VerificationResult) warn(name CheckName, err error) {
+	r.Checks = append(r.Checks, CheckResult{Name: name, Outcome: CheckWarned, Err: err})
+}
+
+func (r *VerificationResult) skip(name CheckName, detail string) {
+	r.Checks = append(r.Checks, CheckResult{Name: name, Outcome: CheckSkipped, Detail: detail})
+}
+
+// InspectDocument runs the checks of VerifyDocument but goes on after a failure, as far as
+// the remaining checks do not depend on the failed one, and reports each of them. It
+// neither reads nor fills VerifyOptions.Cache.
+func InspectDocument(ctx context.Context, doc Document, sessTrans []byte, opts VerifyOptions) *VerificationResult {
+	return runChecks(ctx, doc, sessTrans, opts, false)
+}
+
+// runChecks is the one check sequence of VerifyDocument and InspectDocument. With
+// failFast it stops at the first failure and answers the issuer checks from opts.Cache.
+func runChecks(ctx context.Context, doc Document, sessTrans []byte, opts VerifyOptions, failFast bool) *VerificationResult {
+	now := opts.now()
+	logger := opts.logger()
+	result := &VerificationResult{DocType: doc.DocType}
+	stop := func() bool { return failFast && !result.OK() }
+
+	mso, err := doc.IssuerSigned.MobileSecurityObject()
+	if err != nil {
+		logger.Warn("mso parse failed", "docType", doc.DocType, "error", err)
+		mso = nil
+	}
+	if !result.add(CheckMSO, err) && failFast {
+		return result
+	}
+
+	// 9.3.1 step 4, the DocType in the MSO matches the DocType of the Document. The issuer
+	// checks are cached by IssuerSigned alone, so this is not one of them.
+	if mso == nil {
+		result.skip(CheckDocType, "no MSO")
+	} else if doc.DocType != mso.DocType {
+		logger.Warn("docType mismatch", "docType", doc.DocType, "msoDocType", mso.DocType)
+		result.add(CheckDocType, fmt.Errorf("docType %s does not match the MSO docType %s", doc.DocType, mso.DocType))
+	} else {
+		result.add(CheckDocType, nil)
+	}
+	if stop() {
+		return result
+	}
+
+	// 9.1.3 mdoc authentication. DeviceAuth is bound to this session, so it is never cached.
+	var deviceSigned map[Element]interface{}
+	switch {
+	case opts.SkipDeviceAuth:
+		logger.Warn("device auth skipped", "docType", doc.DocType)
+		result.skip(CheckDeviceAuth, "not requested")
+	case mso == nil:
+		result.skip(CheckDeviceAuth, "no MSO")
+	default:
+		if len(doc.DeviceSigned.DeviceAuth.DeviceMac) > 0 && doc.DeviceSigned.DeviceAuth.DeviceSignature.Signature == nil {
+			err = VerifyDeviceMac(mso, doc, sessTrans, opts.ReaderKey)
+		} else {
+			err = VerifyDeviceSigned(mso, doc, sessTrans)
+		}
+		if err == nil {
+			deviceSigned, err = doc.DeviceTypedElements()
+		}
+		if err != nil {
+			logger.Warn("device auth failed", "docType", doc.DocType, "error", err)
+		} else {
+			logger.Debug("device auth ok", "docType", doc.DocType)
+		}
+		result.add(CheckDeviceAuth, err)
+	}
+	if stop() {
+		return result
+	}
+
+	var chain []*x509.Certificate
+	var cached bool
+	var cacheKey string
+	if failFast && opts.Cache != nil {
+		if cacheKey, err = issuerCacheKey(doc.IssuerSigned); err != nil {
+			logger.Warn("issuer cache key failed", "docType", doc.DocType, "error", err)
+		} else if report, checks, ok := opts.Cache.get(cacheKey, now); ok {
+			logger.Debug("issuer checks cached", "docType", doc.DocType)
+			result.Checks = append(result.Checks, checks...)
+			chain, cached = report.CertificateChain, true
+		}
+	}
+	if !cached {
+		first := len(result.Checks)
+		chain = runIssuerChecks(ctx, doc, mso, now, opts, result, stop)
+		if stop() {
+			return result
+		}
+		if cacheKey != "" && result.OK() {
+			opts.Cache.add(cacheKey, &VerificationReport{CertificateChain: chain}, result.Checks[first:], now)
+		}
+	}
+
+	if mso == nil {
+		result.skip(CheckValidity, "no MSO")
+		result.skip(CheckTokenStatus, "no MSO")
+		result.skip(CheckRequest, "no MSO")
+		result.skip(CheckPolicies, "no MSO")
+		return result
+	}
+
+	// The validity window depends on the time, so it is checked on every presentation.
+	if err := checkValidity(mso.ValidityInfo, now, opts); expiredTolerated(err, mso.ValidityInfo, now, opts) {
+		logger.Warn("expired document within grace period", "docType", doc.DocType, "signed", mso.ValidityInfo.Signed, "validUntil", mso.ValidityInfo.ValidUntil)
+		result.warn(CheckValidity, err)
+	} else {
+		if err != nil {
+			logger.Warn("validity failed", "docType", doc.DocType, "validFrom", mso.ValidityInfo.ValidFrom, "validUntil", mso.ValidityInfo.ValidUntil)
+		}
+		result.add(CheckValidity, err)
+	}
+	if stop() {
+		return result
+	}
+
+	// The status changes over time as well, so it is never cached either.
+	switch {
+	case !opts.CheckStatus:
+		result.skip(CheckTokenStatus, "not requested")
+	case mso.Status == nil || mso.Status.StatusList == nil:
+		result.skip(CheckTokenStatus, "no status claim")
+	default:
+		checker := opts.StatusListChecker
+		if checker == nil {
+			checker = DefaultStatusListChecker
+		}
+		if err := checker.Check(ctx, *mso.Status.StatusList, opts.Roots, now); errors.Is(err, ErrStatusListUnavailable) && !opts.RevocationHardFail {
+			logger.Warn("status unavailable, continuing", "docType", doc.DocType, "error", err)
+			result.warn(CheckTokenStatus, err)
+		} else {
+			if err != nil {
+				logger.Warn("status failed", "docType", doc.DocType, "error", err)
+			}
+			result.add(CheckTokenStatus, err)
+		}
+	}
+	if stop() {
+		return result
+	}
+
+	var itemsRequest *ItemsRequest
+	var unrequested []Element
+	if opts.Request == nil {
+		result.skip(CheckRequest, "no request")
+	} else {
+		itemsRequest, unrequested, err = checkRequest(opts.Request, doc)
+		if len(unrequested) > 0 {
+			logger.Warn("holder disclosed elements that were not requested", "docType", doc.DocType, "elements", unrequested)
+		}
+		if errors.Is(err, ErrNotRequested) && !opts.RejectUnrequested {
+			result.warn(CheckRequest, err)
+		} else {
+			if err != nil {
+				logger.Warn("request mismatch", "docType", doc.DocType, "error", err)
+			}
+			result.add(CheckRequest, err)
+		}
+	}
+	if stop() {
+		return result
+	}
+
+	// Policies are judged on verified data only, and never fail verification.
+	var policyErrors []error
+	switch {
+	case len(opts.Policies) == 0:
+		result.skip(CheckPolicies, "no policies")
+	case !result.OK():
+		result.skip(CheckPolicies, "verification failed")
+	default:
+		if policyErrors = checkPolicies(&doc, opts.Policies); len(policyErrors) > 0 {
+			logger.Warn("policy failed", "docType", doc.DocType, "errors", policyErrors)
+			result.warn(CheckPolicies, fmt.Errorf("%d of %d policies failed: %v", len(policyErrors), len(opts.Policies), policyErrors))
+		} else {
+			result.add(CheckPolicies, nil)
+		}
+	}
+
+	if result.OK() {
+		result.Report = &VerificationReport{
+			DocType:             doc.DocType,
+			DocumentSigner:      chain[0],
+			CertificateChain:    chain,
+			ValidityInfo:        mso.ValidityInfo,
+			Cached:              cached,
+			PolicyErrors:        policyErrors,
+			ElementErrors:       doc.Errors,
+			DeviceSigned:        deviceSigned,
+			ItemsRequest:        itemsRequest,
+			UnrequestedElements: unrequested,
+		}
+		for _, c := range result.Checks {
+			if c.Outcome == CheckWarned && c.Name != CheckPolicies && c.Name != CheckRequest {
+				result.Report.Warnings = append(result.Report.Warnings, c.Err)
+			}
+		}
+		logger.Info("verified", "docType", doc.DocType)
+	}
+	return result
+}
+
+// runIssuerChecks runs the issuer data authentication of 9.3.1, which only depends on
+// IssuerSigned and so is what VerifyOptions.Cache keeps. It returns the verified chain.
+func runIssuerChecks(ctx context.Context, doc Document, mso *MobileSecurityObject, now time.Time, opts VerifyOptions, result *VerificationResult, stop func() bool) []*x509.Certificate {
+	logger := opts.logger()
+
+	// 1. Validate the certificate included in the MSO header according to 9.3.3.
+	chains, err := verifyCertificateChains(doc.IssuerSigned, opts.Roots, opts.AllowSelfCert, now)
+	var chain []*x509.Certificate
+	if err != nil {
+		logger.Warn("certificate chain failed", "docType", doc.DocType, "error", err)
+	} else {
+		chain = chains[0]
+		logger.Debug("certificate chain ok", "docType", doc.DocType, "subject", chain[0].Subject.String(),
+			"issuer", chain[0].Issuer.String(), "serial", chain[0].SerialNumber.String(), "aki", fmt.Sprintf("%x", chain[0].AuthorityKeyId))
+	}
+	if result.add(CheckCertificateChain, err); stop() {
+		return nil
+	}
+
+	switch {
+	case !opts.CheckRevocation:
+		result.skip(CheckRevocation, "not requested")
+	case chain == nil:
+		result.skip(CheckRevocation, "no certificate chain")
+	default:
+		// The status of every certificate is fetched once, an unavailable one only warns
+		// unless RevocationHardFail, and the rest of the chain may still be revoked.
+		unavailable, err := checkRevocation(ctx, chains, now, opts)
+		switch {
+		case err != nil:
+			logger.Warn("revocation check failed", "docType", doc.DocType, "error", err)
+			result.add(CheckRevocation, err)
+		case unavailable != nil:
+			result.warn(CheckRevocation, unavailable)
+		default:
+			result.add(CheckRevocation, nil)
+		}
+	}
+	if stop() {
+		return nil
+	}
+
+	// 2. Verify the digital signature of the IssuerAuth structure (see 9.1.2.4) using the
+	//    working_public_key of the certificate validation procedure of step 1.
+	if err := VerifyIssuerAuth(doc.IssuerSigned); err != nil {
+		logger.Warn("issuer auth failed", "docType", doc.DocType, "error", err)
+		result.add(CheckIssuerSignature, err)
+	} else {
+		logger.Debug("issuer auth ok", "docType", doc.DocType)
+		result.add(CheckIssuerSignature, nil)
+	}
+	if stop() {
+		return nil
+	}
+
+	// 3. Calculate the digest of every IssuerSignedItem returned and compare it with the
+	//    digest in the MSO, 9.1.2.5.
+	if mso == nil {
+		result.skip(CheckDigests, "no MSO")
+	} else if err := VerifyDigests(doc.IssuerSigned, mso); err != nil {
+		logger.Warn("digests failed", "docType", doc.DocType, "error", err)
+		result.add(CheckDigests, err)
+	} else {
+		logger.Debug("digests ok", "docType", doc.DocType)
+		result.add(CheckDigests, nil)
+	}
+	if stop() {
+		return nil
+	}
+
+	// The digests are over the transmitted bytes, so a non-canonical item still matches.
+	// It is a spec violation though, and breaks anything that re-encodes for hashing.
+	if err := checkCanonicalItems(doc.IssuerSigned); err != nil {
+		logger.Warn("non-canonical IssuerSignedItem", "docType", doc.DocType, "error", err)
+		if !opts.RequireCanonicalCBOR {
+			result.warn(CheckCanonicalEncoding, err)
+		} else {
+			result.add(CheckCanonicalEncoding, err)
+		}
+	} else {
+		result.add(CheckCanonicalEncoding, nil)
+	}
+	if stop() {
+		return nil
+	}
+
+	// 5. The 'signed' date is within the validity period of the document signer.
+	switch {
+	case mso == nil:
+		result.skip(CheckSignedDate, "no MSO")
+	case chain == nil:
+		result.skip(CheckSignedDate, "no certificate chain")
+	case mso.ValidityInfo.Signed.Before(chain[0].NotBefore) || mso.ValidityInfo.Signed.After(chain[0].NotAfter):
+		result.add(CheckSignedDate, fmt.Errorf("signed %v outside of %v - %v", mso.ValidityInfo.Signed, chain[0].NotBefore, chain[0].NotAfter))
+	default:
+		result.add(CheckSignedDate, nil)
+	}
+	return chain
+}
@@ -0,0 +1,261 @@
+package mdoc
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+var (
+	// ErrCertificateRevoked is a hard failure: the issuer says the certificate is revoked.
+	ErrCertificateRevoked = errors.New("certificate revoked")
+	// ErrRevocationUnavailable is a soft failure: the status could not be determined.
+	ErrRevocationUnavailable = errors.New("revocation status unavailable")
+
+	DefaultRevocationChecker = NewRevocationChecker(time.Hour)
+)
+
+// maxRevocationResponseSize bounds OCSP responses and CRLs fetched from the network.
+const maxRevocationResponseSize = 10 << 20
+
+// RevocationChecker checks certificates against their OCSP responder or CRL distribution point.
+// Definitive results are cached per issuer and serial number for TTL. CRLs are cached per
+// distribution point for TTL or until their nextUpdate, whichever comes first, so the
+// document signers of one IACA share a download. Expired entries are dropped whenever an
+// entry is added.
+type RevocationChecker struct {
+	Client *http.Client
+	TTL    time.Duration
+
+	mu    sync.Mutex
+	cache map[string]revocationEntry
+	crls  map[string]crlEntry
+}
+
+type revocationEntry struct {
+	err     error
+	expires time.Time
+}
+
+type crlEntry struct {
+	crl     *x509.RevocationList
+	expires time.Time
+}
+
+func NewRevocationChecker(ttl time.Duration) *RevocationChecker {
+	return &RevocationChecker{
+		Client: &http.Client{Timeout: 10 * time.Second},
+		TTL:    ttl,
+		cache:  map[string]revocationEntry{},
+		crls:   map[string]crlEntry{},
+	}
+}
+
+// Check returns nil when cert is known to be good, an error wrapping ErrCertificateRevoked when
+// it is revoked and one wrapping ErrRevocationUnavailable when neither could be established.
+func (r *RevocationChecker) Check(ctx context.Context, cert, issuer *x509.Certificate) error {
+	return r.CheckAt(ctx, cert, issuer, time.Now())
+}
+
+// CheckAt is Check with now as the current time for cache expiry and CRL freshness.
+func (r *RevocationChecker) CheckAt(ctx context.Context, cert, issuer *x509.Certificate, now time.Time) error {
+	key := fmt.Sprintf("%x/%s", issuer.RawSubject, cert.SerialNumber)
+
+	r.mu.Lock()
+	entry, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.err
+	}
+
+	err := r.check(ctx, cert, issuer, now)
+
+	// A soft failure is not cached, the responder may be back on the next request.
+	if err == nil || errors.Is(err, ErrCertificateRevoked) {
+		r.mu.Lock()
+		r.prune(now)
+		r.cache[key] = revocationEntry{err: err, expires: now.Add(r.TTL)}
+		r.mu.Unlock()
+	}
+	return err
+}
+
+func (r *RevocationChecker) check(ctx context.Context, cert, issuer *x509.Certificate, now time.Time) error {
+	var errs []error
+	for _, server := range cert.OCSPServer {
+		err := r.checkOCSP(ctx, server, cert, issuer, now)
+		if err == nil || errors.Is(err, ErrCertificateRevoked) {
+			return err
+		}
+		errs = append(errs, err)
+	}
+	// ISO 18013-5 B.1 puts the CRL distribution point on the IACA certificate. The document
+	// signer usually carries it too, but not always.
+	for _, dp := range distributionPoints(cert, issuer) {
+		err := r.checkCRL(ctx, dp, cert, issuer, now)
+		if err == nil || errors.Is(err, ErrCertificateRevoked) {
+			return err
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("%w: no OCSP responder or CRL distribution point", ErrRevocationUnavailable)
+	}
+	return fmt.Errorf("%w: %v", ErrRevocationUnavailable, errs)
+}
+
+func (r *RevocationChecker) checkOCSP(ctx context.Context, server string, cert, issuer *x509.Certificate, now time.Time) error {
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create OCSP request: %v", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewReader(req))
+	if err != nil {
+		return fmt.Errorf("failed to create OCSP request: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/ocsp-request")
+
+	body, err := r.fetch(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to query OCSP responder %s: %v", server, err)
+	}
+
+	return ocspStatus(body, cert, issuer, now)
+}
+
+// CheckStapled is CheckAt with an OCSP response for cert that was obtained by someone else,
+// e.g. stapled by the holder. A response that does not verify or is outside its
+// thisUpdate/nextUpdate window is ignored and the status looked up as usual.
+func (r *RevocationChecker) CheckStapled(ctx context.Context, cert, issuer *x509.Certificate, response []byte, now time.Time) error {
+	if err := ocspStatus(response, cert, issuer, now); err == nil || errors.Is(err, ErrCertificateRevoked) {
+		return err
+	}
+	return r.CheckAt(ctx, cert, issuer, now)
+}
+
+// ocspStatus returns the status of cert in an OCSP response signed for issuer. A response
+// outside its thisUpdate/nextUpdate window at now tells nothing, whether it was fetched or
+// stapled: a cache or proxy may replay an old "good".
+func ocspStatus(body []byte, cert, issuer *x509.Certificate, now time.Time) error {
+	resp, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return fmt.Errorf("failed to parse OCSP response: %v", err)
+	}
+	if now.Before(resp.ThisUpdate) || (!resp.NextUpdate.IsZero() && !now.Before(resp.NextUpdate)) {
+		return fmt.Errorf("OCSP response is not current, thisUpdate %v, nextUpdate %v", resp.ThisUpdate, resp.NextUpdate)
+	}
+
+	switch resp.Status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return fmt.Errorf("%w: serial %s at %v", ErrCertificateRevoked, cert.SerialNumber, resp.RevokedAt)
+	}
+	return fmt.Errorf("OCSP status unknown for serial %s", cert.SerialNumber)
+}
+
+func distributionPoints(cert, issuer *x509.Certificate) []string {
+	var dps []string
+	seen := map[string]bool{}
+	for _, dp := range append(append([]string{}, cert.CRLDistributionPoints...), issuer.CRLDistributionPoints...) {
+		if !seen[dp] {
+			seen[dp] = true
+			dps = append(dps, dp)
+		}
+	}
+	return dps
+}
+
+func (r *RevocationChecker) checkCRL(ctx context.Context, dp string, cert, issuer *x509.Certificate, now time.Time) error {
+	crl, err := r.crl(ctx, dp, issuer, now)
+	if err != nil {
+		return err
+	}
+
+	for _, revoked := range crl.RevokedCertificateEntries {
+		if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return fmt.Errorf("%w: serial %s at %v", ErrCertificateRevoked, cert.SerialNumber, revoked.RevocationTime)
+		}
+	}
+	return nil
+}
+
+// crl returns the CRL at dp signed by issuer, from the cache while it is fresh.
+func (r *RevocationChecker) crl(ctx context.Context, dp string, issuer *x509.Certificate, now time.Time) (*x509.RevocationList, error) {
+	key := fmt.Sprintf("%x/%s", issuer.RawSubject, dp)
+
+	r.mu.Lock()
+	entry, ok := r.crls[key]
+	r.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.crl, nil
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, dp, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CRL request: %v", err)
+	}
+
+	body, err := r.fetch(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch CRL %s: %v", dp, err)
+	}
+
+	crl, err := x509.ParseRevocationList(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CRL: %v", err)
+	}
+	if err := crl.CheckSignatureFrom(issuer); err != nil {
+		return nil, fmt.Errorf("failed to verify CRL signature: %v", err)
+	}
+	if !crl.NextUpdate.IsZero() && now.After(crl.NextUpdate) {
+		return nil, fmt.Errorf("CRL is stale, nextUpdate %v", crl.NextUpdate)
+	}
+
+	expires := now.Add(r.TTL)
+	if !crl.NextUpdate.IsZero() && crl.NextUpdate.Before(expires) {
+		expires = crl.NextUpdate
+	}
+	r.mu.Lock()
+	r.prune(now)
+	r.crls[key] = crlEntry{crl: crl, expires: expires}
+	r.mu.Unlock()
+	return crl, nil
+}
+
+// prune drops the expired entries. Distribution points come from the certificates, so
+// the caches would otherwise grow with every issuer ever seen. r.mu must be held.
+func (r *RevocationChecker) prune(now time.Time) {
+	for key, entry := range r.cache {
+		if !now.Before(entry.expires) {
+			delete(r.cache, key)
+		}
+	}
+	for key, entry := range r.crls {
+		if !now.Before(entry.expires) {
+			delete(r.crls, key)
+		}
+	}
+}
+
+func (r *RevocationChecker) fetch(req *http.Request) ([]byte, error) {
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxRevocationResponseSize))
+}
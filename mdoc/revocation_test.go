@@ -0,0 +1,355 @@
+package mdoc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+type testIssuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func createRevocationCerts(t *testing.T, ocspURL, crlURL string) (*x509.Certificate, *x509.Certificate, *ecdsa.PrivateKey) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test IACA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	dsKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Test DS"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if ocspURL != "" {
+		dsTmpl.OCSPServer = []string{ocspURL}
+	}
+	if crlURL != "" {
+		dsTmpl.CRLDistributionPoints = []string{crlURL}
+	}
+	dsDER, err := x509.CreateCertificate(rand.Reader, dsTmpl, ca, &dsKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, _ := x509.ParseCertificate(dsDER)
+	return ds, ca, caKey
+}
+
+// issueTestDS issues a document signer certificate with serial from ca.
+func issueTestDS(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, serial int64) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "Test DS"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+// crlServer serves the CRL of ca revoking serials, counting downloads in calls.
+func crlServer(t *testing.T, calls *int32, ca **x509.Certificate, caKey **ecdsa.PrivateKey, serials ...int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		var entries []x509.RevocationListEntry
+		for _, serial := range serials {
+			entries = append(entries, x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: time.Now().Add(-time.Minute)})
+		}
+		crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:                    big.NewInt(1),
+			ThisUpdate:                time.Now().Add(-time.Minute),
+			NextUpdate:                time.Now().Add(time.Hour),
+			RevokedCertificateEntries: entries,
+		}, *ca, *caKey)
+		if err != nil {
+			t.Errorf("failed to create CRL: %v", err)
+			return
+		}
+		w.Write(crl)
+	}))
+}
+
+// ocspResponder answers with status, signed by issuer which is filled in once the certificates exist.
+func ocspResponder(t *testing.T, status int, calls *int32, issuer *testIssuer) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			t.Errorf("failed to parse OCSP request: %v", err)
+			return
+		}
+		resp, err := ocsp.CreateResponse(issuer.cert, issuer.cert, ocsp.Response{
+			Status:       status,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+			RevokedAt:    time.Now().Add(-time.Minute),
+		}, crypto.Signer(issuer.key))
+		if err != nil {
+			t.Errorf("failed to create OCSP response: %v", err)
+			return
+		}
+		w.Write(resp)
+	}))
+}
+
+func TestRevocationChecker(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("OCSPGood", func(t *testing.T) {
+		var calls int32
+		issuer := &testIssuer{}
+		srv := ocspResponder(t, ocsp.Good, &calls, issuer)
+		defer srv.Close()
+
+		ds, ca, caKey := createRevocationCerts(t, srv.URL, "")
+		issuer.cert, issuer.key = ca, caKey
+
+		checker := NewRevocationChecker(time.Minute)
+		for i := 0; i < 2; i++ {
+			if err := checker.Check(ctx, ds, ca); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if calls := atomic.LoadInt32(&calls); calls != 1 {
+			t.Fatalf("result not cached: %d OCSP calls", calls)
+		}
+	})
+
+	t.Run("CacheExpiry", func(t *testing.T) {
+		var calls int32
+		issuer := &testIssuer{}
+		srv := ocspResponder(t, ocsp.Good, &calls, issuer)
+		defer srv.Close()
+
+		ds, ca, caKey := createRevocationCerts(t, srv.URL, "")
+		issuer.cert, issuer.key = ca, caKey
+
+		checker := NewRevocationChecker(time.Minute)
+		now := time.Now()
+		for _, at := range []time.Time{now, now.Add(30 * time.Second), now.Add(2 * time.Minute)} {
+			if err := checker.CheckAt(ctx, ds, ca, at); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if calls := atomic.LoadInt32(&calls); calls != 2 {
+			t.Fatalf("cache did not expire with the clock: %d OCSP calls", calls)
+		}
+	})
+
+	t.Run("Prune", func(t *testing.T) {
+		var calls int32
+		issuer := &testIssuer{}
+		srv := ocspResponder(t, ocsp.Good, &calls, issuer)
+		defer srv.Close()
+
+		ds, ca, caKey := createRevocationCerts(t, srv.URL, "")
+		issuer.cert, issuer.key = ca, caKey
+		other := issueTestDS(t, ca, caKey, 3)
+		other.OCSPServer = ds.OCSPServer
+
+		checker := NewRevocationChecker(time.Minute)
+		now := time.Now()
+		if err := checker.CheckAt(ctx, ds, ca, now); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := checker.CheckAt(ctx, other, ca, now.Add(2*time.Minute)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if n := len(checker.cache); n != 1 {
+			t.Fatalf("expired entry kept: %d entries", n)
+		}
+	})
+
+	t.Run("OCSPStale", func(t *testing.T) {
+		var calls int32
+		issuer := &testIssuer{}
+		srv := ocspResponder(t, ocsp.Good, &calls, issuer)
+		defer srv.Close()
+
+		ds, ca, caKey := createRevocationCerts(t, srv.URL, "")
+		issuer.cert, issuer.key = ca, caKey
+
+		// The responder's nextUpdate is an hour away, a replayed response would be this old.
+		err := NewRevocationChecker(time.Minute).CheckAt(ctx, ds, ca, time.Now().Add(2*time.Hour))
+		if !errors.Is(err, ErrRevocationUnavailable) {
+			t.Fatalf("expected ErrRevocationUnavailable, got %v", err)
+		}
+	})
+
+	t.Run("OCSPRevoked", func(t *testing.T) {
+		var calls int32
+		issuer := &testIssuer{}
+		srv := ocspResponder(t, ocsp.Revoked, &calls, issuer)
+		defer srv.Close()
+
+		ds, ca, caKey := createRevocationCerts(t, srv.URL, "")
+		issuer.cert, issuer.key = ca, caKey
+
+		if err := NewRevocationChecker(time.Minute).Check(ctx, ds, ca); !errors.Is(err, ErrCertificateRevoked) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("CRLRevoked", func(t *testing.T) {
+		var crl []byte
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(crl)
+		}))
+		defer srv.Close()
+
+		ds, ca, caKey := createRevocationCerts(t, "", srv.URL)
+		var err error
+		crl, err = x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:     big.NewInt(1),
+			ThisUpdate: time.Now().Add(-time.Minute),
+			NextUpdate: time.Now().Add(time.Hour),
+			RevokedCertificateEntries: []x509.RevocationListEntry{
+				{SerialNumber: ds.SerialNumber, RevocationTime: time.Now().Add(-time.Minute)},
+			},
+		}, ca, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := NewRevocationChecker(time.Minute).Check(ctx, ds, ca); !errors.Is(err, ErrCertificateRevoked) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("CRLCached", func(t *testing.T) {
+		var calls int32
+		var ca *x509.Certificate
+		var caKey *ecdsa.PrivateKey
+		srv := crlServer(t, &calls, &ca, &caKey, 3)
+		defer srv.Close()
+
+		ds, issuer, key := createRevocationCerts(t, "", srv.URL)
+		ca, caKey = issuer, key
+		revoked := issueTestDS(t, ca, caKey, 3)
+		revoked.CRLDistributionPoints = []string{srv.URL}
+
+		checker := NewRevocationChecker(time.Minute)
+		if err := checker.Check(ctx, ds, ca); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := checker.Check(ctx, revoked, ca); !errors.Is(err, ErrCertificateRevoked) {
+			t.Fatalf("expected ErrCertificateRevoked, got %v", err)
+		}
+		if calls := atomic.LoadInt32(&calls); calls != 1 {
+			t.Fatalf("CRL not cached: %d downloads", calls)
+		}
+	})
+
+	t.Run("IACADistributionPoint", func(t *testing.T) {
+		var calls int32
+		var ca *x509.Certificate
+		var caKey *ecdsa.PrivateKey
+		srv := crlServer(t, &calls, &ca, &caKey, 4)
+		defer srv.Close()
+
+		_, issuer, key := createRevocationCerts(t, "", "")
+		ca, caKey = issuer, key
+		ca.CRLDistributionPoints = []string{srv.URL}
+		ds := issueTestDS(t, ca, caKey, 4)
+
+		if err := NewRevocationChecker(time.Minute).Check(ctx, ds, ca); !errors.Is(err, ErrCertificateRevoked) {
+			t.Fatalf("expected ErrCertificateRevoked, got %v", err)
+		}
+	})
+
+	t.Run("Stapled", func(t *testing.T) {
+		ds, ca, caKey := createRevocationCerts(t, "", "")
+		staple := func(status int, thisUpdate time.Time) []byte {
+			resp, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+				Status:       status,
+				SerialNumber: ds.SerialNumber,
+				ThisUpdate:   thisUpdate,
+				NextUpdate:   thisUpdate.Add(time.Hour),
+				RevokedAt:    thisUpdate,
+			}, crypto.Signer(caKey))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return resp
+		}
+		now := time.Now()
+
+		if err := NewRevocationChecker(time.Minute).CheckStapled(ctx, ds, ca, staple(ocsp.Good, now.Add(-time.Minute)), now); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := NewRevocationChecker(time.Minute).CheckStapled(ctx, ds, ca, staple(ocsp.Revoked, now.Add(-time.Minute)), now); !errors.Is(err, ErrCertificateRevoked) {
+			t.Fatalf("expected ErrCertificateRevoked, got %v", err)
+		}
+		// A stale response is ignored, and ds has nowhere else to ask.
+		if err := NewRevocationChecker(time.Minute).CheckStapled(ctx, ds, ca, staple(ocsp.Good, now.Add(-2*time.Hour)), now); !errors.Is(err, ErrRevocationUnavailable) {
+			t.Fatalf("expected ErrRevocationUnavailable, got %v", err)
+		}
+	})
+
+	t.Run("Unreachable", func(t *testing.T) {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		ds, ca, _ := createRevocationCerts(t, srv.URL, "")
+		srv.Close()
+
+		if err := NewRevocationChecker(time.Minute).Check(ctx, ds, ca); !errors.Is(err, ErrRevocationUnavailable) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		defer srv.Close()
+		ds, ca, _ := createRevocationCerts(t, srv.URL, "")
+
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		if err := NewRevocationChecker(time.Minute).Check(cancelled, ds, ca); !errors.Is(err, ErrRevocationUnavailable) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
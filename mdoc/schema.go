@@ -0,0 +1,291 @@
+package mdoc
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+)
+
+// ElementType is the CBOR type a data element must be encoded as.
+type ElementType int
+
+const (
+	TypeAny      ElementType = iota // not checked, decoded as DataElementValue
+	TypeString                      // tstr, decoded as string
+	TypeUint                        // uint, decoded as uint64
+	TypeBool                        // bool
+	TypeBytes                       // bstr, decoded as []byte
+	TypeArray                       // array, decoded as []interface{}
+	TypeFullDate                    // tag 1004 full-date, decoded as time.Time
+	TypeTDate                       // tag 0 tdate, decoded as time.Time
+	TypeDate                        // full-date or tdate, decoded as time.Time
+)
+
+var ErrUnexpectedType = errors.New("unexpected element type")
+
+// NameSpaceSchema maps the elements of a namespace to their types.
+type NameSpaceSchema map[DataElementIdentifier]ElementType
+
+var (
+	schemasMu sync.RWMutex
+	schemas   = map[NameSpace]NameSpaceSchema{
+		"org.iso.18013.5.1":       MDLSchema,
+		"eu.europa.ec.eudi.pid.1": PIDSchema,
+		"org.iso.23220.1":         Schema23220,
+		"org.iso.23220.photoid.1": PhotoIDSchema,
+		"org.iso.7367.1":          MVRCSchema,
+	}
+)
+
+// RegisterSchema enables typed extraction for ns, replacing any schema registered before.
+// Elements not in the schema are still returned, untyped.
+func RegisterSchema(ns NameSpace, schema NameSpaceSchema) {
+	schemasMu.Lock()
+	defer schemasMu.Unlock()
+	schemas[ns] = schema
+}
+
+func lookupSchema(ns NameSpace) (NameSpaceSchema, bool) {
+	schemasMu.RLock()
+	defer schemasMu.RUnlock()
+	schema, ok := schemas[ns]
+	return schema, ok
+}
+
+// TypedElement returns the issuer-signed value of elem decoded by the schema of its namespace.
+func (d *Document) TypedElement(elem Element) (interface{}, error) {
+	raw, err := d.RawElementValue(elem)
+	if err != nil {
+		return nil, err
+	}
+	schema, _ := lookupSchema(NameSpace(elem.Namespace))
+	return decodeElement(d.decoder(), elem, schema[DataElementIdentifier(elem.Name)], raw)
+}
+
+// GetElementValue is TypedElement by namespace and element identifier.
+func (d *Document) GetElementValue(namespace, element string) (interface{}, error) {
+	return d.TypedElement(Element{Namespace: namespace, Name: element})
+}
+
+// GetElement returns the issuer-signed value of elem as a T. The schema decoded value is
+// used when it is a T, otherwise the value is decoded into T, e.g. a uint into an int or a
+// map into a struct.
+func GetElement[T any](d *Document, elem Element) (T, error) {
+	var zero T
+	v, err := d.TypedElement(elem)
+	if err != nil {
+		return zero, err
+	}
+	if t, ok := v.(T); ok {
+		return t, nil
+	}
+
+	raw, err := d.RawElementValue(elem)
+	if err != nil {
+		return zero, err
+	}
+	var t T
+	if err := d.decoder().Unmarshal(raw, &t); err != nil {
+		return zero, fmt.Errorf("%w: %s %s is not %T: %v", ErrUnexpectedType, elem.Namespace, elem.Name, zero, err)
+	}
+	return t, nil
+}
+
+// TypedElements returns every issuer-signed element decoded by the schema of its namespace.
+// It fails on the first element whose encoding does not match its schema.
+func (d *Document) TypedElements() (map[Element]interface{}, error) {
+	dm := d.decoder()
+	elements := map[Element]interface{}{}
+	for ns, itemsBytes := range d.IssuerSigned.NameSpaces {
+		schema, _ := lookupSchema(ns)
+		for _, itemBytes := range itemsBytes {
+			var item rawIssuerSignedItem
+			if err := dm.Unmarshal(itemBytes, &item); err != nil {
+				return nil, err
+			}
+			elem := Element{Namespace: string(ns), Name: string(item.ElementIdentifier)}
+			v, err := decodeElement(dm, elem, schema[item.ElementIdentifier], item.ElementValue)
+			if err != nil {
+				return nil, err
+			}
+			elements[elem] = v
+		}
+	}
+	return elements, nil
+}
+
+// RawDeviceElementValue returns the device-signed value of elem as it was encoded.
+func (d *Document) RawDeviceElementValue(elem Element) (cbor.RawMessage, error) {
+	nameSpaces, err := d.DeviceSigned.rawDeviceNameSpaces(d.decoder())
+	if err != nil {
+		return nil, err
+	}
+	raw, ok := nameSpaces[NameSpace(elem.Namespace)][DataElementIdentifier(elem.Name)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s %s", ErrElementNotFound, elem.Namespace, elem.Name)
+	}
+	return raw, nil
+}
+
+// DeviceTypedElement is TypedElement for the device-signed value of elem. Only the
+// deviceKey vouches for it, never use it where an issuer-signed value is required.
+func (d *Document) DeviceTypedElement(elem Element) (interface{}, error) {
+	raw, err := d.RawDeviceElementValue(elem)
+	if err != nil {
+		return nil, err
+	}
+	schema, _ := lookupSchema(NameSpace(elem.Namespace))
+	return decodeElement(d.decoder(), elem, schema[DataElementIdentifier(elem.Name)], raw)
+}
+
+// GetDeviceElement is GetElement for the device-signed value of elem.
+func GetDeviceElement[T any](d *Document, elem Element) (T, error) {
+	var zero T
+	v, err := d.DeviceTypedElement(elem)
+	if err != nil {
+		return zero, err
+	}
+	if t, ok := v.(T); ok {
+		return t, nil
+	}
+
+	raw, err := d.RawDeviceElementValue(elem)
+	if err != nil {
+		return zero, err
+	}
+	var t T
+	if err := d.decoder().Unmarshal(raw, &t); err != nil {
+		return zero, fmt.Errorf("%w: %s %s is not %T: %v", ErrUnexpectedType, elem.Namespace, elem.Name, zero, err)
+	}
+	return t, nil
+}
+
+// DeviceTypedElements is TypedElements for the device-signed elements.
+func (d *Document) DeviceTypedElements() (map[Element]interface{}, error) {
+	dm := d.decoder()
+	nameSpaces, err := d.DeviceSigned.rawDeviceNameSpaces(dm)
+	if err != nil {
+		return nil, err
+	}
+	elements := map[Element]interface{}{}
+	for ns, items := range nameSpaces {
+		schema, _ := lookupSchema(ns)
+		for id, raw := range items {
+			elem := Element{Namespace: string(ns), Name: string(id)}
+			v, err := decodeElement(dm, elem, schema[id], raw)
+			if err != nil {
+				return nil, err
+			}
+			elements[elem] = v
+		}
+	}
+	return elements, nil
+}
+
+// decodeElement decodes untyped values and arrays with dm, the other types are checked and
+// decoded the same way whatever tags dm knows.
+func decodeElement(dm cbor.DecMode, elem Element, typ ElementType, raw cbor.RawMessage) (interface{}, error) {
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("%w: %s %s is empty", ErrUnexpectedType, elem.Namespace, elem.Name)
+	}
+
+	// The major type is checked first, so a tag or a byte string never passes as a text string.
+	major := raw[0] >> 5
+	mismatch := func(want string) error {
+		return fmt.Errorf("%w: %s %s is not %s", ErrUnexpectedType, elem.Namespace, elem.Name, want)
+	}
+
+	switch typ {
+	case TypeString:
+		if major != 3 {
+			return nil, mismatch("tstr")
+		}
+		var v string
+		return v, protocol.DecMode.Unmarshal(raw, &v)
+	case TypeUint:
+		if major != 0 {
+			return nil, mismatch("uint")
+		}
+		var v uint64
+		return v, protocol.DecMode.Unmarshal(raw, &v)
+	case TypeBool:
+		if raw[0] != 0xf4 && raw[0] != 0xf5 {
+			return nil, mismatch("bool")
+		}
+		return raw[0] == 0xf5, nil
+	case TypeBytes:
+		if major != 2 {
+			return nil, mismatch("bstr")
+		}
+		var v []byte
+		return v, protocol.DecMode.Unmarshal(raw, &v)
+	case TypeArray:
+		if major != 4 {
+			return nil, mismatch("array")
+		}
+		var v []interface{}
+		if err := dm.Unmarshal(raw, &v); err != nil {
+			return nil, err
+		}
+		return decodeDates(v)
+	case TypeFullDate:
+		return DecodeFullDate(raw)
+	case TypeTDate:
+		return DecodeTDate(raw)
+	case TypeDate:
+		if v, err := DecodeFullDate(raw); err == nil {
+			return v, nil
+		}
+		return DecodeTDate(raw)
+	}
+
+	var v DataElementValue
+	if err := dm.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	return decodeDates(v)
+}
+
+// MDLSchema is the org.iso.18013.5.1 namespace, ISO/IEC 18013-5 7.2.1 Table 5.
+var MDLSchema = func() NameSpaceSchema {
+	schema := NameSpaceSchema{
+		"family_name":                    TypeString,
+		"given_name":                     TypeString,
+		"birth_date":                     TypeFullDate,
+		"issue_date":                     TypeDate,
+		"expiry_date":                    TypeDate,
+		"issuing_country":                TypeString,
+		"issuing_authority":              TypeString,
+		"document_number":                TypeString,
+		"portrait":                       TypeBytes,
+		"driving_privileges":             TypeArray,
+		"un_distinguishing_sign":         TypeString,
+		"administrative_number":          TypeString,
+		"sex":                            TypeUint,
+		"height":                         TypeUint,
+		"weight":                         TypeUint,
+		"eye_colour":                     TypeString,
+		"hair_colour":                    TypeString,
+		"birth_place":                    TypeString,
+		"resident_address":               TypeString,
+		"portrait_capture_date":          TypeTDate,
+		"age_in_years":                   TypeUint,
+		"age_birth_year":                 TypeUint,
+		"issuing_jurisdiction":           TypeString,
+		"nationality":                    TypeString,
+		"resident_city":                  TypeString,
+		"resident_state":                 TypeString,
+		"resident_postal_code":           TypeString,
+		"resident_country":               TypeString,
+		"family_name_national_character": TypeString,
+		"given_name_national_character":  TypeString,
+		"signature_usual_mark":           TypeBytes,
+	}
+	for age := 0; age < 100; age++ {
+		schema[DataElementIdentifier(fmt.Sprintf("age_over_%02d", age))] = TypeBool
+	}
+	return schema
+}()
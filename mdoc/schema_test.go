@@ -0,0 +1,481 @@
+package mdoc
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+)
+
+func TestTypedElements(t *testing.T) {
+	devResp, _, err := getDeviceResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := devResp.Documents[0]
+
+	t.Run("MDL", func(t *testing.T) {
+		elements, err := doc.TypedElements()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, ok := elements[FamilyName].(string); !ok {
+			t.Fatalf("unexpected family_name: %T", elements[FamilyName])
+		}
+		if _, ok := elements[BirthDate].(time.Time); !ok {
+			t.Fatalf("unexpected birth_date: %T", elements[BirthDate])
+		}
+		if _, ok := elements[Portrait].([]byte); !ok {
+			t.Fatalf("unexpected portrait: %T", elements[Portrait])
+		}
+	})
+
+	t.Run("Registered", func(t *testing.T) {
+		const pid = "eu.europa.ec.eudi.pid.1"
+		RegisterSchema(pid, NameSpaceSchema{
+			"family_name": TypeString,
+			"birth_date":  TypeFullDate,
+			"age_over_18": TypeBool,
+		})
+		defer RegisterSchema(pid, PIDSchema)
+
+		for name, tc := range map[string]struct {
+			elem    DataElementIdentifier
+			value   interface{}
+			wantErr bool
+		}{
+			"String":        {"family_name", "Mustermann", false},
+			"StringAsBytes": {"family_name", []byte("Mustermann"), true},
+			"FullDate":      {"birth_date", cbor.Tag{Number: 1004, Content: "1984-01-26"}, false},
+			"UntaggedDate":  {"birth_date", "1984-01-26", true},
+			"Bool":          {"age_over_18", true, false},
+			"BoolAsUint":    {"age_over_18", 1, true},
+			"Unknown":       {"nationality", "DE", false},
+		} {
+			t.Run(name, func(t *testing.T) {
+				doc := Document{
+					DocType: pid,
+					IssuerSigned: IssuerSigned{
+						NameSpaces: IssuerNameSpaces{pid: {issuerSignedItemBytes(t, tc.elem, tc.value)}},
+					},
+				}
+				_, err := doc.TypedElement(Element{Namespace: pid, Name: string(tc.elem)})
+				if tc.wantErr != (err != nil) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if err != nil && !errors.Is(err, ErrUnexpectedType) && !errors.Is(err, ErrUnexpectedTag) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			})
+		}
+	})
+}
+
+func TestGetElement(t *testing.T) {
+	devResp, _, err := getDeviceResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := devResp.Documents[0]
+
+	t.Run("GetElementValue", func(t *testing.T) {
+		v, err := doc.GetElementValue(FamilyName.Namespace, FamilyName.Name)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, ok := v.(string); !ok {
+			t.Fatalf("unexpected family_name: %T", v)
+		}
+	})
+
+	t.Run("Typed", func(t *testing.T) {
+		if _, err := GetElement[string](&doc, FamilyName); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		birthDate, err := GetElement[time.Time](&doc, BirthDate)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if birthDate.IsZero() {
+			t.Fatal("zero birth_date")
+		}
+	})
+
+	t.Run("Converted", func(t *testing.T) {
+		const ns = "com.example.vendor.1"
+		doc := Document{IssuerSigned: IssuerSigned{NameSpaces: IssuerNameSpaces{ns: {
+			issuerSignedItemBytes(t, "height", 180),
+			issuerSignedItemBytes(t, "address", map[int]string{1: "Heidestraße 17", 2: "Köln"}),
+		}}}}
+		height, err := GetElement[int](&doc, Element{Namespace: ns, Name: "height"})
+		if err != nil || height != 180 {
+			t.Fatalf("unexpected height: %v, %v", height, err)
+		}
+		address, err := GetElement[vendorAddress](&doc, Element{Namespace: ns, Name: "address"})
+		if err != nil || address.City != "Köln" {
+			t.Fatalf("unexpected address: %v, %v", address, err)
+		}
+	})
+
+	t.Run("WrongType", func(t *testing.T) {
+		if _, err := GetElement[bool](&doc, FamilyName); !errors.Is(err, ErrUnexpectedType) {
+			t.Fatalf("expected ErrUnexpectedType, got %v", err)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		if _, err := GetElement[string](&doc, Element{Namespace: FamilyName.Namespace, Name: "nickname"}); !errors.Is(err, ErrElementNotFound) {
+			t.Fatalf("expected ErrElementNotFound, got %v", err)
+		}
+	})
+}
+
+type vendorAddress struct {
+	Street string `cbor:"1,keyasint"`
+	City   string `cbor:"2,keyasint"`
+}
+
+func TestCustomTags(t *testing.T) {
+	const ns = "com.example.vendor.1"
+	const tagAddress = 65000
+	address := cbor.Tag{Number: tagAddress, Content: map[int]string{1: "Heidestraße 17", 2: "Köln"}}
+
+	dm, err := protocol.NewDecMode(protocol.WithTag(tagAddress, reflect.TypeOf(vendorAddress{}), cbor.TagOptions{DecTag: cbor.DecTagRequired}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	devResp := DeviceResponse{Documents: []Document{{
+		DocType: "com.example.vendor.doc",
+		IssuerSigned: IssuerSigned{
+			NameSpaces: IssuerNameSpaces{ns: {
+				issuerSignedItemBytes(t, "address", address),
+				issuerSignedItemBytes(t, "birth_date", cbor.Tag{Number: 1004, Content: "1984-01-26"}),
+			}},
+		},
+	}}}
+	elem := Element{Namespace: ns, Name: "address"}
+	want := vendorAddress{Street: "Heidestraße 17", City: "Köln"}
+
+	t.Run("Default", func(t *testing.T) {
+		doc := devResp.Documents[0]
+		v, err := doc.TypedElement(elem)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, ok := v.(cbor.Tag); !ok {
+			t.Fatalf("unexpected address: %T", v)
+		}
+	})
+
+	t.Run("Registered", func(t *testing.T) {
+		devResp.SetDecMode(dm)
+		doc := devResp.Documents[0]
+
+		v, err := doc.TypedElement(elem)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if v != want {
+			t.Fatalf("unexpected address: %#v", v)
+		}
+
+		elements, err := doc.DisclosedElements()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, e := range elements {
+			if e.Identifier == "address" && e.Value != want {
+				t.Fatalf("unexpected disclosed address: %#v", e.Value)
+			}
+		}
+
+		// Built-in tags keep their meaning.
+		if _, err := doc.FullDate(Element{Namespace: ns, Name: "birth_date"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestDecodeDates(t *testing.T) {
+	devResp, _, err := getDeviceResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := devResp.Documents[0]
+
+	t.Run("DisclosedElements", func(t *testing.T) {
+		elements, err := doc.DisclosedElements()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range elements {
+			switch e.Identifier {
+			case "birth_date":
+				if v, ok := e.Value.(time.Time); !ok || !v.Equal(time.Date(1976, 4, 1, 0, 0, 0, 0, time.UTC)) {
+					t.Fatalf("unexpected birth_date: %#v", e.Value)
+				}
+			case "driving_privileges":
+				privilege := e.Value.([]interface{})[0].(map[interface{}]interface{})
+				if _, ok := privilege["issue_date"].(time.Time); !ok {
+					t.Fatalf("unexpected issue_date: %#v", privilege["issue_date"])
+				}
+			}
+		}
+	})
+
+	t.Run("Untyped", func(t *testing.T) {
+		ns := NameSpace("org.example.dates")
+		tagged := map[string]interface{}{
+			"since": cbor.Tag{Number: 0, Content: "2024-01-02T03:04:05Z"},
+			"dates": []interface{}{cbor.Tag{Number: 1004, Content: "2024-01-02"}},
+		}
+		doc := Document{IssuerSigned: IssuerSigned{NameSpaces: IssuerNameSpaces{
+			ns: {
+				issuerSignedItemBytes(t, "tagged", tagged),
+				issuerSignedItemBytes(t, "invalid", cbor.Tag{Number: 1004, Content: "2024-13-01"}),
+			},
+		}}}
+
+		v, err := doc.TypedElement(Element{Namespace: string(ns), Name: "tagged"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := v.(map[interface{}]interface{})
+		if since, ok := m["since"].(time.Time); !ok || !since.Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)) {
+			t.Fatalf("unexpected tdate: %#v", m["since"])
+		}
+		if date, ok := m["dates"].([]interface{})[0].(time.Time); !ok || !date.Equal(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)) {
+			t.Fatalf("unexpected full-date: %#v", m["dates"])
+		}
+
+		if _, err := doc.TypedElement(Element{Namespace: string(ns), Name: "invalid"}); err == nil {
+			t.Fatal("decoded an invalid full-date")
+		}
+	})
+}
+
+func issuerSignedItemBytes(t *testing.T, id DataElementIdentifier, value interface{}) IssuerSignedItemBytes {
+	data, err := cbor.Marshal(map[string]interface{}{
+		"digestID":          0,
+		"random":            []byte{0},
+		"elementIdentifier": id,
+		"elementValue":      value,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return IssuerSignedItemBytes(data)
+}
+
+func TestPID(t *testing.T) {
+	ns := NameSpacePID
+	doc := Document{
+		DocType: DocTypePID,
+		IssuerSigned: IssuerSigned{NameSpaces: IssuerNameSpaces{ns: {
+			issuerSignedItemBytes(t, "family_name", "Mustermann"),
+			issuerSignedItemBytes(t, "birth_date", cbor.Tag{Number: 1004, Content: "1984-01-26"}),
+			issuerSignedItemBytes(t, "age_over_18", true),
+			issuerSignedItemBytes(t, "expiry_date", cbor.Tag{Number: 0, Content: "2030-01-01T00:00:00Z"}),
+			issuerSignedItemBytes(t, "issuing_country", "DE"),
+		}}},
+	}
+
+	pid, err := doc.PID()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pid.FamilyName != "Mustermann" || pid.IssuingCountry != "DE" || pid.BirthDate.Year() != 1984 || pid.ExpiryDate.Year() != 2030 {
+		t.Fatalf("unexpected PID: %+v", pid)
+	}
+	if pid.AgeOver18 == nil || !*pid.AgeOver18 {
+		t.Fatalf("unexpected age_over_18: %v", pid.AgeOver18)
+	}
+	if pid.GivenName != "" || !pid.IssuanceDate.IsZero() {
+		t.Fatalf("undisclosed attributes set: %+v", pid)
+	}
+
+	doc.IssuerSigned.NameSpaces[ns] = []IssuerSignedItemBytes{issuerSignedItemBytes(t, "birth_date", "1984-01-26")}
+	if _, err := doc.PID(); !errors.Is(err, ErrUnexpectedTag) && !errors.Is(err, ErrUnexpectedType) {
+		t.Fatalf("expected a type error, got %v", err)
+	}
+}
+
+func TestPhotoID(t *testing.T) {
+	doc := Document{
+		DocType: DocTypePhotoID,
+		IssuerSigned: IssuerSigned{NameSpaces: IssuerNameSpaces{
+			NameSpace23220: {
+				issuerSignedItemBytes(t, "family_name_unicode", "Mustermann"),
+				issuerSignedItemBytes(t, "birth_date", cbor.Tag{Number: 1004, Content: "1984-01-26"}),
+				issuerSignedItemBytes(t, "portrait", []byte{0xff, 0xd8, 0xff}),
+				issuerSignedItemBytes(t, "age_over_18", false),
+			},
+			NameSpacePhotoID: {
+				issuerSignedItemBytes(t, "person_id", "1234"),
+			},
+		}},
+	}
+
+	p, err := doc.PhotoID()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.FamilyName != "Mustermann" || p.BirthDate.Year() != 1984 || len(p.Portrait) != 3 || p.PersonID != "1234" {
+		t.Fatalf("unexpected photo ID: %+v", p)
+	}
+	if p.AgeOver18 == nil || *p.AgeOver18 {
+		t.Fatalf("unexpected age_over_18: %v", p.AgeOver18)
+	}
+	if p.GivenName != "" || !p.ExpiryDate.IsZero() {
+		t.Fatalf("undisclosed elements set: %+v", p)
+	}
+
+	doc.IssuerSigned.NameSpaces[NameSpace23220] = []IssuerSignedItemBytes{issuerSignedItemBytes(t, "birth_date", "1984-01-26")}
+	if _, err := doc.PhotoID(); !errors.Is(err, ErrUnexpectedTag) {
+		t.Fatalf("expected ErrUnexpectedTag, got %v", err)
+	}
+}
+
+func TestMVRC(t *testing.T) {
+	doc := Document{
+		DocType: DocTypeMVRC,
+		IssuerSigned: IssuerSigned{NameSpaces: IssuerNameSpaces{NameSpaceMVRC: {
+			issuerSignedItemBytes(t, "registration_number", "B-MU 1234"),
+			issuerSignedItemBytes(t, "date_of_registration", cbor.Tag{Number: 1004, Content: "2020-05-01"}),
+			issuerSignedItemBytes(t, "vehicle_holder", map[string]interface{}{"holder_name_unicode": "Erika Mustermann"}),
+			issuerSignedItemBytes(t, "basic_vehicle_info", map[string]interface{}{"vehicle_make": "VW", "vehicle_model": "ID.3"}),
+		}}},
+	}
+
+	m, err := doc.MVRC()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.RegistrationNumber != "B-MU 1234" || m.DateOfRegistration.Year() != 2020 || m.VehicleHolder.Name != "Erika Mustermann" || m.BasicVehicleInfo.Model != "ID.3" {
+		t.Fatalf("unexpected mVRC: %+v", m)
+	}
+	if m.VehicleIdentification != "" || !m.ExpiryDate.IsZero() {
+		t.Fatalf("undisclosed elements set: %+v", m)
+	}
+
+	doc.IssuerSigned.NameSpaces[NameSpaceMVRC] = []IssuerSignedItemBytes{issuerSignedItemBytes(t, "vehicle_holder", "Erika Mustermann")}
+	if _, err := doc.MVRC(); !errors.Is(err, ErrUnexpectedType) {
+		t.Fatalf("expected ErrUnexpectedType, got %v", err)
+	}
+}
+
+func TestMDL(t *testing.T) {
+	devResp, _, err := getDeviceResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := devResp.Documents[0]
+
+	mdl, err := doc.MDL()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mdl.FamilyName != "Doe" || mdl.GivenName != "Jane" || mdl.DocumentNumber != "TEST1234567" {
+		t.Fatalf("unexpected MDL: %+v", mdl)
+	}
+	if mdl.BirthDate.Format("2006-01-02") != "1976-04-01" || mdl.AgeInYears != 42 || len(mdl.Portrait) == 0 {
+		t.Fatalf("unexpected MDL: %+v", mdl)
+	}
+	if len(mdl.DrivingPrivileges) == 0 {
+		t.Fatal("no driving privileges")
+	}
+	for _, p := range mdl.DrivingPrivileges {
+		if p.VehicleCategoryCode == "" || p.IssueDate.IsZero() || p.ExpiryDate.IsZero() {
+			t.Fatalf("unexpected driving privilege: %+v", p)
+		}
+	}
+
+	t.Run("InvalidDrivingPrivilege", func(t *testing.T) {
+		doc := Document{
+			DocType: DocTypeMDL,
+			IssuerSigned: IssuerSigned{NameSpaces: IssuerNameSpaces{"org.iso.18013.5.1": {
+				issuerSignedItemBytes(t, "driving_privileges", []interface{}{map[string]interface{}{"issue_date": "2020-01-01"}}),
+			}}},
+		}
+		if _, err := doc.MDL(); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
+
+func TestAgeOver(t *testing.T) {
+	ns := NameSpace("org.iso.18013.5.1")
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	birthDate := issuerSignedItemBytes(t, "birth_date", cbor.Tag{Number: 1004, Content: "2006-06-01"})
+
+	tests := []struct {
+		name     string
+		items    []IssuerSignedItemBytes
+		n        int
+		expected bool
+		err      error
+	}{
+		{"Exact", []IssuerSignedItemBytes{issuerSignedItemBytes(t, "age_over_21", false)}, 21, false, nil},
+		{"HigherTrue", []IssuerSignedItemBytes{issuerSignedItemBytes(t, "age_over_21", true)}, 18, true, nil},
+		{"LowerFalse", []IssuerSignedItemBytes{issuerSignedItemBytes(t, "age_over_18", false)}, 21, false, nil},
+		{"BirthDate", []IssuerSignedItemBytes{issuerSignedItemBytes(t, "age_over_16", true), birthDate}, 18, true, nil},
+		{"BirthDateDayBefore", []IssuerSignedItemBytes{issuerSignedItemBytes(t, "birth_date", cbor.Tag{Number: 1004, Content: "2006-06-02"})}, 18, false, nil},
+		{"NotDisclosed", []IssuerSignedItemBytes{issuerSignedItemBytes(t, "age_over_16", true)}, 18, false, ErrElementNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := Document{DocType: DocTypeMDL, IssuerSigned: IssuerSigned{NameSpaces: IssuerNameSpaces{ns: tt.items}}}
+			got, err := doc.AgeOverAt(tt.n, now)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("expected %v, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.expected {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestPortrait(t *testing.T) {
+	devResp, _, err := getDeviceResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := devResp.Documents[0]
+
+	_, mimeType, err := doc.Portrait()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mimeType != MIMETypeJPEG {
+		t.Fatalf("unexpected MIME type: %s", mimeType)
+	}
+	img, err := doc.PortraitImage()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if img.Bounds().Empty() {
+		t.Fatal("empty portrait")
+	}
+
+	t.Run("JPEG2000", func(t *testing.T) {
+		doc := Document{DocType: DocTypeMDL, IssuerSigned: IssuerSigned{NameSpaces: IssuerNameSpaces{"org.iso.18013.5.1": {
+			issuerSignedItemBytes(t, "portrait", []byte{0xff, 0x4f, 0xff, 0x51, 0x00}),
+		}}}}
+		if _, mimeType, err := doc.Portrait(); err != nil || mimeType != MIMETypeJPEG2000 {
+			t.Fatalf("unexpected result: %s, %v", mimeType, err)
+		}
+		if _, err := doc.PortraitImage(); !errors.Is(err, ErrUnsupportedImage) {
+			t.Fatalf("expected ErrUnsupportedImage, got %v", err)
+		}
+	})
+}
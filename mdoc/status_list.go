@@ -0,0 +1,237 @@
+package mdoc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Token status values, draft-ietf-oauth-status-list 7.1.
+const (
+	TokenStatusValid     = 0x00
+	TokenStatusInvalid   = 0x01
+	TokenStatusSuspended = 0x02
+)
+
+var (
+	// ErrTokenInvalid is a hard failure: the issuer revoked the document.
+	ErrTokenInvalid = errors.New("document status invalid")
+	// ErrTokenSuspended is a hard failure, but unlike ErrTokenInvalid it may be lifted.
+	ErrTokenSuspended = errors.New("document status suspended")
+	// ErrStatusListUnavailable is a soft failure: the status list could not be obtained.
+	ErrStatusListUnavailable = errors.New("status list unavailable")
+
+	DefaultStatusListChecker = NewStatusListChecker(time.Hour)
+)
+
+// MSOStatus is the status of a MobileSecurityObject.
+type MSOStatus struct {
+	StatusList *StatusListReference `json:"status_list,omitempty"`
+}
+
+// StatusListReference locates the status of a document: entry Idx of the list at URI.
+type StatusListReference struct {
+	Idx uint64 `json:"idx"`
+	URI string `json:"uri"`
+}
+
+// StatusList is a decompressed Token Status List.
+type StatusList struct {
+	Bits int
+	Lst  []byte
+}
+
+type rawStatusList struct {
+	Bits int    `cbor:"bits"`
+	Lst  []byte `cbor:"lst"`
+}
+
+// Status returns the status of entry idx.
+func (l *StatusList) Status(idx uint64) (byte, error) {
+	perByte := uint64(8 / l.Bits)
+	if idx/perByte >= uint64(len(l.Lst)) {
+		return 0, fmt.Errorf("index %d out of range of %d entries", idx, uint64(len(l.Lst))*perByte)
+	}
+	shift := (idx % perByte) * uint64(l.Bits)
+	return (l.Lst[idx/perByte] >> shift) & (1<<l.Bits - 1), nil
+}
+
+// ParseStatusListToken verifies a CWT Status List Token for uri, whose x5chain must lead to
+// one of roots at now, and returns the list with the time it should be fetched again.
+func ParseStatusListToken(data []byte, uri string, roots *x509.CertPool, now time.Time) (*StatusList, time.Time, error) {
+	msg, err := verifyX5ChainSign1(data, roots, now)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to verify status list token: %v", err)
+	}
+
+	// CWT claims sub, exp, ttl and status_list, draft-ietf-oauth-status-list 5.2.
+	var claims struct {
+		Sub        string        `cbor:"2,keyasint"`
+		Exp        int64         `cbor:"4,keyasint"`
+		TTL        int64         `cbor:"65534,keyasint"`
+		StatusList rawStatusList `cbor:"65533,keyasint"`
+	}
+	if err := msoDecMode.Unmarshal(msg.Payload, &claims); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to parse status list token: %v", err)
+	}
+	// The token of another list must not be accepted for this one.
+	if claims.Sub != uri {
+		return nil, time.Time{}, fmt.Errorf("status list token is for %q, not %q", claims.Sub, uri)
+	}
+	if claims.Exp != 0 && !now.Before(time.Unix(claims.Exp, 0)) {
+		return nil, time.Time{}, fmt.Errorf("status list token expired at %v", time.Unix(claims.Exp, 0))
+	}
+	switch claims.StatusList.Bits {
+	case 1, 2, 4, 8:
+	default:
+		return nil, time.Time{}, fmt.Errorf("unsupported status list bits: %d", claims.StatusList.Bits)
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(claims.StatusList.Lst))
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to decompress status list: %v", err)
+	}
+	lst, err := io.ReadAll(io.LimitReader(zr, maxRevocationResponseSize))
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to decompress status list: %v", err)
+	}
+
+	var refresh time.Time
+	if claims.TTL > 0 {
+		refresh = now.Add(time.Duration(claims.TTL) * time.Second)
+	}
+	if claims.Exp != 0 && (refresh.IsZero() || time.Unix(claims.Exp, 0).Before(refresh)) {
+		refresh = time.Unix(claims.Exp, 0)
+	}
+	return &StatusList{Bits: claims.StatusList.Bits, Lst: lst}, refresh, nil
+}
+
+// maxStatusLists bounds the lists a StatusListChecker caches. The URIs come from the MSOs.
+const maxStatusLists = 1000
+
+// StatusListChecker looks up document status in Token Status Lists. Lists are cached per URI
+// and trust store for TTL, or shorter when the token asks for it with exp or ttl. Expired
+// lists are dropped when a list is added, and at most maxStatusLists are kept.
+type StatusListChecker struct {
+	Client *http.Client
+	TTL    time.Duration
+
+	mu    sync.Mutex
+	lists map[statusListKey]statusListEntry
+}
+
+// statusListKey keeps a list verified against one roots pool from being served to a caller
+// with another.
+type statusListKey struct {
+	uri   string
+	roots *x509.CertPool
+}
+
+type statusListEntry struct {
+	list    *StatusList
+	expires time.Time
+}
+
+func NewStatusListChecker(ttl time.Duration) *StatusListChecker {
+	return &StatusListChecker{
+		Client: &http.Client{Timeout: 10 * time.Second},
+		TTL:    ttl,
+		lists:  map[statusListKey]statusListEntry{},
+	}
+}
+
+// Check returns nil when the referenced entry is valid, an error wrapping ErrTokenInvalid or
+// ErrTokenSuspended when it is not and one wrapping ErrStatusListUnavailable when the list
+// could not be obtained. The list token must be signed by a certificate leading to roots.
+func (c *StatusListChecker) Check(ctx context.Context, ref StatusListReference, roots *x509.CertPool, now time.Time) error {
+	list, err := c.list(ctx, ref.URI, roots, now)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrStatusListUnavailable, err)
+	}
+	status, err := list.Status(ref.Idx)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrStatusListUnavailable, err)
+	}
+
+	switch status {
+	case TokenStatusValid:
+		return nil
+	case TokenStatusInvalid:
+		return fmt.Errorf("%w: %s index %d", ErrTokenInvalid, ref.URI, ref.Idx)
+	case TokenStatusSuspended:
+		return fmt.Errorf("%w: %s index %d", ErrTokenSuspended, ref.URI, ref.Idx)
+	}
+	// Other values are application specific, none of them says the document is good.
+	return fmt.Errorf("%w: %s index %d has status %#x", ErrTokenInvalid, ref.URI, ref.Idx, status)
+}
+
+func (c *StatusListChecker) list(ctx context.Context, uri string, roots *x509.CertPool, now time.Time) (*StatusList, error) {
+	key := statusListKey{uri: uri, roots: roots}
+	c.mu.Lock()
+	entry, ok := c.lists[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.list, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create status list request: %v", err)
+	}
+	req.Header.Set("Accept", "application/statuslist+cwt")
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch status list %s: %v", uri, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch status list %s: unexpected status: %s", uri, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRevocationResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch status list %s: %v", uri, err)
+	}
+
+	list, refresh, err := ParseStatusListToken(body, uri, roots, now)
+	if err != nil {
+		return nil, err
+	}
+
+	expires := now.Add(c.TTL)
+	if !refresh.IsZero() && refresh.Before(expires) {
+		expires = refresh
+	}
+	c.mu.Lock()
+	c.prune(now)
+	c.lists[key] = statusListEntry{list: list, expires: expires}
+	c.mu.Unlock()
+	return list, nil
+}
+
+// prune drops the expired lists and, while the cache is full, the one expiring first.
+// c.mu must be held.
+func (c *StatusListChecker) prune(now time.Time) {
+	for key, entry := range c.lists {
+		if !now.Before(entry.expires) {
+			delete(c.lists, key)
+		}
+	}
+	for len(c.lists) >= maxStatusLists {
+		var oldest statusListKey
+		var oldestExpires time.Time
+		for key, entry := range c.lists {
+			if oldestExpires.IsZero() || entry.expires.Before(oldestExpires) {
+				oldest, oldestExpires = key, entry.expires
+			}
+		}
+		delete(c.lists, oldest)
+	}
+}
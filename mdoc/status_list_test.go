@@ -0,0 +1,156 @@
+package mdoc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/veraison/go-cose"
+)
+
+func signStatusList(t *testing.T, signer *x509.Certificate, key *ecdsa.PrivateKey, sub string, bits int, lst []byte) []byte {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(lst)
+	zw.Close()
+
+	payload, err := cbor.Marshal(map[int]interface{}{
+		2:     sub,
+		6:     time.Now().Unix(),
+		65533: map[string]interface{}{"bits": bits, "lst": compressed.Bytes()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := cose.NewSigner(cose.AlgorithmES256, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := cose.Sign1Message{
+		Headers: cose.Headers{
+			Protected:   cose.ProtectedHeader{cose.HeaderLabelAlgorithm: cose.AlgorithmES256},
+			Unprotected: cose.UnprotectedHeader{cose.HeaderLabelX5Chain: signer.Raw},
+		},
+		Payload: payload,
+	}
+	if err := msg.Sign(rand.Reader, nil, s); err != nil {
+		t.Fatal(err)
+	}
+	data, err := msg.MarshalCBOR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestStatusList(t *testing.T) {
+	// Entries 0..3 are valid, invalid, suspended and valid, least significant bits first.
+	list := &StatusList{Bits: 2, Lst: []byte{0b00_10_01_00}}
+	for idx, expected := range []byte{TokenStatusValid, TokenStatusInvalid, TokenStatusSuspended, TokenStatusValid} {
+		if status, err := list.Status(uint64(idx)); err != nil || status != expected {
+			t.Fatalf("entry %d: expected %d, got %d, %v", idx, expected, status, err)
+		}
+	}
+	if _, err := list.Status(4); err == nil {
+		t.Fatal("expected an out of range error")
+	}
+
+	_, signer, key := createRevocationCerts(t, "", "")
+	roots := x509.NewCertPool()
+	roots.AddCert(signer)
+
+	var calls int32
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		// Every path serves the token of /list.
+		w.Write(signStatusList(t, signer, key, srv.URL+"/list", 2, list.Lst))
+	}))
+	defer srv.Close()
+	now := time.Now()
+
+	t.Run("Status", func(t *testing.T) {
+		checker := NewStatusListChecker(time.Hour)
+		ref := StatusListReference{URI: srv.URL + "/list"}
+
+		if err := checker.Check(context.Background(), ref, roots, now); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		ref.Idx = 1
+		if err := checker.Check(context.Background(), ref, roots, now); !errors.Is(err, ErrTokenInvalid) {
+			t.Fatalf("expected ErrTokenInvalid, got %v", err)
+		}
+		ref.Idx = 2
+		if err := checker.Check(context.Background(), ref, roots, now); !errors.Is(err, ErrTokenSuspended) {
+			t.Fatalf("expected ErrTokenSuspended, got %v", err)
+		}
+		if n := atomic.LoadInt32(&calls); n != 1 {
+			t.Fatalf("expected the list to be fetched once, got %d", n)
+		}
+	})
+
+	t.Run("OtherList", func(t *testing.T) {
+		checker := NewStatusListChecker(time.Hour)
+		ref := StatusListReference{URI: srv.URL + "/other"}
+		if err := checker.Check(context.Background(), ref, roots, now); !errors.Is(err, ErrStatusListUnavailable) {
+			t.Fatalf("expected ErrStatusListUnavailable, got %v", err)
+		}
+	})
+
+	t.Run("UntrustedSigner", func(t *testing.T) {
+		checker := NewStatusListChecker(time.Hour)
+		ref := StatusListReference{URI: srv.URL + "/list"}
+		if err := checker.Check(context.Background(), ref, x509.NewCertPool(), now); !errors.Is(err, ErrStatusListUnavailable) {
+			t.Fatalf("expected ErrStatusListUnavailable, got %v", err)
+		}
+	})
+
+	t.Run("OtherRoots", func(t *testing.T) {
+		// A list cached for roots is not served to a caller that does not trust its signer.
+		checker := NewStatusListChecker(time.Hour)
+		ref := StatusListReference{URI: srv.URL + "/list"}
+		if err := checker.Check(context.Background(), ref, roots, now); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := checker.Check(context.Background(), ref, x509.NewCertPool(), now); !errors.Is(err, ErrStatusListUnavailable) {
+			t.Fatalf("expected ErrStatusListUnavailable, got %v", err)
+		}
+	})
+
+	t.Run("Prune", func(t *testing.T) {
+		checker := NewStatusListChecker(time.Minute)
+		ref := StatusListReference{URI: srv.URL + "/list"}
+		if err := checker.Check(context.Background(), ref, roots, now); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		other := x509.NewCertPool()
+		other.AddCert(signer)
+		if err := checker.Check(context.Background(), ref, other, now.Add(2*time.Minute)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if n := len(checker.lists); n != 1 {
+			t.Fatalf("expired list kept: %d lists", n)
+		}
+
+		for i := 0; i < maxStatusLists+1; i++ {
+			checker.mu.Lock()
+			checker.prune(now)
+			checker.lists[statusListKey{uri: fmt.Sprint(i)}] = statusListEntry{expires: now.Add(time.Duration(i+1) * time.Second)}
+			checker.mu.Unlock()
+		}
+		if n := len(checker.lists); n != maxStatusLists {
+			t.Fatalf("got %d lists, want %d", n, maxStatusLists)
+		}
+	})
+}
@@ -0,0 +1,153 @@
+package mdoc
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrNotTrustAnchor = errors.New("not a CA certificate")
+
+// Verifier verifies documents against the IACA roots it holds. The roots can be changed
+// while verifications run, each verification uses the set at its start.
+type Verifier struct {
+	mu    sync.RWMutex
+	roots *x509.CertPool
+	opts  VerifyOptions
+}
+
+// VerifierOption configures the checks of a Verifier.
+type VerifierOption func(*VerifyOptions)
+
+// NewVerifier returns a Verifier trusting roots, which may be nil to start empty.
+// Without options every check of VerifyDocument is required.
+func NewVerifier(roots *x509.CertPool, opts ...VerifierOption) *Verifier {
+	v := &Verifier{}
+	for _, opt := range opts {
+		opt(&v.opts)
+	}
+	v.SetRootCertificates(roots)
+	return v
+}
+
+// AllowSelfSignedIACA accepts a document signer certificate that is self-signed instead of
+// issued by a trust anchor. For development only.
+func AllowSelfSignedIACA() VerifierOption {
+	return func(o *VerifyOptions) { o.AllowSelfCert = true }
+}
+
+// RequireDeviceAuth(false) skips the DeviceAuth check, see VerifyOptions.SkipDeviceAuth.
+func RequireDeviceAuth(require bool) VerifierOption {
+	return func(o *VerifyOptions) { o.SkipDeviceAuth = !require }
+}
+
+// RejectExpired(false) accepts documents past validUntil with a warning, see VerifyOptions.AllowExpired.
+func RejectExpired(reject bool) VerifierOption {
+	return func(o *VerifyOptions) { o.AllowExpired = !reject }
+}
+
+// WithRevocation checks the certificates for revocation, failing on an unavailable
+// status only with hardFail.
+func WithRevocation(hardFail bool) VerifierOption {
+	return func(o *VerifyOptions) {
+		o.CheckRevocation = true
+		o.RevocationHardFail = hardFail
+	}
+}
+
+// WithTokenStatus checks the MSO status claim, see VerifyOptions.CheckStatus.
+func WithTokenStatus() VerifierOption {
+	return func(o *VerifyOptions) { o.CheckStatus = true }
+}
+
+// WithClock sets VerifyOptions.Clock.
+func WithClock(clock func() time.Time) VerifierOption {
+	return func(o *VerifyOptions) { o.Clock = clock }
+}
+
+// WithClockSkew sets VerifyOptions.ClockSkew.
+func WithClockSkew(skew time.Duration) VerifierOption {
+	return func(o *VerifyOptions) { o.ClockSkew = skew }
+}
+
+// WithRequest checks documents against req, see VerifyOptions.Request and RejectUnrequested.
+func WithRequest(req *DeviceRequest, rejectUnrequested bool) VerifierOption {
+	return func(o *VerifyOptions) {
+		o.Request = req
+		o.RejectUnrequested = rejectUnrequested
+	}
+}
+
+// WithPolicies adds policy rules, see VerifyOptions.Policies.
+func WithPolicies(rules ...PolicyRule) VerifierOption {
+	return func(o *VerifyOptions) { o.Policies = append(o.Policies, rules...) }
+}
+
+// WithCache sets VerifyOptions.Cache. The cache must not be shared with other Verifiers.
+func WithCache(cache *IssuerCache) VerifierOption {
+	return func(o *VerifyOptions) { o.Cache = cache }
+}
+
+// WithVerifyOptions replaces the options wholesale, for settings without a VerifierOption.
+// Roots is ignored, the trust anchors of the Verifier are used.
+func WithVerifyOptions(opts VerifyOptions) VerifierOption {
+	return func(o *VerifyOptions) { *o = opts }
+}
+
+// SetRootCertificates replaces the trust anchors. roots must not be modified afterwards.
+func (v *Verifier) SetRootCertificates(roots *x509.CertPool) {
+	if roots == nil {
+		roots = x509.NewCertPool()
+	}
+	v.mu.Lock()
+	v.roots = roots
+	v.mu.Unlock()
+}
+
+// AddTrustAnchor adds an IACA root certificate to the trust anchors.
+func (v *Verifier) AddTrustAnchor(cert *x509.Certificate) error {
+	if !cert.BasicConstraintsValid || !cert.IsCA {
+		return fmt.Errorf("%w: %s", ErrNotTrustAnchor, cert.Subject)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	// Copy on write, verifications in flight keep the pool they started with.
+	roots := v.roots.Clone()
+	roots.AddCert(cert)
+	v.roots = roots
+	return nil
+}
+
+// RootCertificates returns the current trust anchors. The pool must not be modified.
+func (v *Verifier) RootCertificates() *x509.CertPool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.roots
+}
+
+// Verify runs VerifyDocument with the trust anchors of v. The x5chain is used as
+// intermediates to build a path from the document signer to one of the roots, and every
+// certificate on it must be valid at the verification time.
+func (v *Verifier) Verify(ctx context.Context, doc Document, sessTrans []byte) (*VerificationReport, error) {
+	return VerifyDocument(ctx, doc, sessTrans, v.options())
+}
+
+// VerifyResponse is VerifyDeviceResponse with the trust anchors of v.
+func (v *Verifier) VerifyResponse(ctx context.Context, resp *DeviceResponse, sessTrans []byte) []DocumentResult {
+	return VerifyDeviceResponse(ctx, resp, sessTrans, v.options())
+}
+
+// Inspect is InspectDocument with the trust anchors of v.
+func (v *Verifier) Inspect(ctx context.Context, doc Document, sessTrans []byte) *VerificationResult {
+	return InspectDocument(ctx, doc, sessTrans, v.options())
+}
+
+func (v *Verifier) options() VerifyOptions {
+	opts := v.opts
+	opts.Roots = v.RootCertificates()
+	return opts
+}
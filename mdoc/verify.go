@@ -2,79 +2,259 @@ package mdoc
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdh"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"sort"
 	"time"
 
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
 	"github.com/veraison/go-cose"
 )
 
 var (
-	Now = time.Now()
+	ErrDeviceKeyMismatch = errors.New("device key mismatch")
+	ErrDuplicateDigestID = errors.New("duplicate digestID")
+	ErrDuplicateElement  = errors.New("duplicate element")
+	ErrInvalidX5Chain    = errors.New("invalid x5chain")
+	ErrNotYetValid       = errors.New("document not yet valid")
+	ErrExpired           = errors.New("document expired")
+	ErrNoReaderKey       = errors.New("deviceMac requires the reader key")
+	// ErrUnauthorizedDeviceElement is a device-signed element the MSO keyAuthorizations do not allow.
+	ErrUnauthorizedDeviceElement = errors.New("device-signed element not authorized")
+	// ErrNotRequested is a document or element disclosed without being in VerifyOptions.Request.
+	ErrNotRequested = errors.New("not requested")
+	// ErrDocumentNotReturned is the holder declining a document, see DocumentNotReturnedError.
+	ErrDocumentNotReturned = errors.New("document not returned")
 )
 
-// ISO/IEC 18013-5
-func Verify(doc Document, sessTrans []byte, roots *x509.CertPool, allowSelfCert bool) error {
+// VerifyOptions configures VerifyWithOptions.
+type VerifyOptions struct {
+	Roots         *x509.CertPool
+	AllowSelfCert bool
+
+	// CheckRevocation queries the OCSP responder or CRL of the document signer certificate.
+	// A revoked certificate always fails verification. When the status cannot be determined
+	// verification only fails if RevocationHardFail is set.
+	CheckRevocation    bool
+	RevocationHardFail bool
+	// RevocationChecker defaults to DefaultRevocationChecker.
+	RevocationChecker *RevocationChecker
+	// CheckStatus looks up the status claim of the MSO, if any, in its Token Status List,
+	// which must be signed under Roots. An invalid or suspended document always fails
+	// verification, an unavailable list only if RevocationHardFail is set.
+	CheckStatus bool
+	// StatusListChecker defaults to DefaultStatusListChecker.
+	StatusListChecker *StatusListChecker
+	// StapledOCSP is an OCSP response for the document signer certificate obtained
+	// out of band. It is used instead of querying the responder while it is current.
+	StapledOCSP []byte
+
+	// Request is the DeviceRequest issued for this presentation. When set, documents and
+	// elements disclosed without being requested are reported in
+	// VerificationReport.UnrequestedElements, and fail verification with ErrNotRequested if
+	// RejectUnrequested is set.
+	Request           *DeviceRequest
+	RejectUnrequested bool
+
+	// Clock returns the current time for validity, certificate and revocation checks.
+	// Defaults to time.Now.
+	Clock func() time.Time
+
+	// ClockSkew widens the MSO validity window on both ends, for wallets and issuers
+	// whose clocks are a little off.
+	ClockSkew time.Duration
+
+	// ExpiredGracePeriod accepts a document past validUntil if the MSO was signed no longer
+	// than this ago. It is reported in VerificationReport.Warnings instead of failing.
+	ExpiredGracePeriod time.Duration
+	// AllowExpired accepts any document past validUntil, reported as with ExpiredGracePeriod.
+	AllowExpired bool
+
+	// SkipDeviceAuth does not verify the DeviceAuth, so nothing binds the document to this
+	// session or to the device. Only for documents whose DeviceAuth is checked separately,
+	// e.g. by apple_hpke.Result.VerifyDeviceAuth, or for debugging.
+	SkipDeviceAuth bool
+
+	// ReaderKey is the EReaderKey of the session. It is only needed for documents
+	// authenticated with deviceMac instead of deviceSignature.
+	ReaderKey *ecdh.PrivateKey
+
+	// Logger receives an event per verification step. Defaults to protocol.Log.
+	Logger protocol.Logger
+
+	// Cache, when set, remembers documents whose issuer-side checks passed.
+	// It must only be shared between calls with the same Roots, revocation and
+	// RequireCanonicalCBOR settings.
+	Cache *IssuerCache
+
+	// RequireCanonicalCBOR fails verification when an IssuerSignedItem is not canonical CBOR,
+	// as ISO 18013-5 requires. Off by default because wallets in the field do not all comply,
+	// otherwise it is only logged. Recommended on where the wallets allow it.
+	RequireCanonicalCBOR bool
+
+	// Policies are evaluated after the cryptographic checks passed. Their failures are
+	// reported in VerificationReport.PolicyErrors and do not fail verification.
+	Policies []PolicyRule
+}
 
-	mso, err := doc.IssuerSigned.MobileSecurityObject()
-	if err != nil {
-		return fmt.Errorf("failed to get MobileSecurityObject")
+func (o VerifyOptions) logger() protocol.Logger {
+	if o.Logger != nil {
+		return o.Logger
 	}
+	return protocol.Log
+}
 
-	// 9.1.3 mdoc authentication
-	if err := VerifyDeviceSigned(mso, doc, sessTrans); err != nil {
-		return fmt.Errorf("failed to VerifyDeviceSigned: %v", err)
+func (o VerifyOptions) now() time.Time {
+	if o.Clock != nil {
+		return o.Clock()
 	}
+	return time.Now()
+}
 
-	// 9.3.1 Inspection procedure for issuer data authentication
-	// 1. Validate the certificate included in the MSO header according to 9.3.3.
-	if err := VerifyCertificate(doc.IssuerSigned, roots, allowSelfCert); err != nil {
-		return fmt.Errorf("failed to VerifyCertificate: %v", err)
-	}
+// ISO/IEC 18013-5
+func Verify(doc Document, sessTrans []byte, roots *x509.CertPool, allowSelfCert bool) error {
+	return VerifyWithOptions(context.Background(), doc, sessTrans, VerifyOptions{
+		Roots:         roots,
+		AllowSelfCert: allowSelfCert,
+	})
+}
 
-	// 2. Verify the digital signature of the IssuerAuth structure (see 9.1.2.4) using the working_public_
-	//    key, working_public_key_parameters, and working_public_key_algorithm from the certificate
-	//    validation procedure of step 1.
-	if err := VerifyIssuerAuth(doc.IssuerSigned); err != nil {
-		return fmt.Errorf("failed to VerifyIssuerAuth: %v", err)
-	}
+func VerifyWithOptions(ctx context.Context, doc Document, sessTrans []byte, opts VerifyOptions) error {
+	_, err := VerifyDocument(ctx, doc, sessTrans, opts)
+	return err
+}
 
-	// 3. Calculate the digest value for every IssuerSignedItem returned in the DeviceResponse structure
-	//    according to 9.1.2.5 and verify that these calculated digests equal the corresponding digest values
-	//    in the MSO.
-	if err := VerifyDigests(doc.IssuerSigned, mso); err != nil {
-		return fmt.Errorf("failed to VerifyDigests: %v", err)
+// VerificationReport describes a document that passed verification.
+type VerificationReport struct {
+	DocType        DocType
+	DocumentSigner *x509.Certificate
+	// CertificateChain is the verified chain, from DocumentSigner to the trust anchor.
+	CertificateChain []*x509.Certificate
+	ValidityInfo     ValidityInfo
+	// Cached is set when the issuer-side checks were answered from VerifyOptions.Cache.
+	Cached bool
+	// PolicyErrors holds the failures of VerifyOptions.Policies, it is empty when all passed.
+	PolicyErrors []error
+	// Warnings holds problems that were tolerated because of VerifyOptions, e.g. ErrExpired
+	// within ExpiredGracePeriod.
+	Warnings []error
+	// ElementErrors holds the elements the holder reported as not returned, with their code.
+	ElementErrors Errors
+	// ItemsRequest is what VerifyOptions.Request asked of this docType, nil when it asked for
+	// nothing or there was no Request.
+	ItemsRequest *ItemsRequest
+	// UnrequestedElements are the disclosed elements VerifyOptions.Request did not ask for.
+	UnrequestedElements []Element
+	// DeviceSigned holds the device-signed elements, decoded like TypedElements. DeviceAuth
+	// covers them but the issuer does not, so they are claims of the holder only. It is nil
+	// when device authentication was skipped.
+	DeviceSigned map[Element]interface{}
+}
+
+// DocumentResult is the outcome of verifying one document of a DeviceResponse.
+// Exactly one of Report and Err is set. For a document the holder did not return Err is a
+// *DocumentNotReturnedError.
+type DocumentResult struct {
+	DocType DocType
+	Report  *VerificationReport
+	Err     error
+}
+
+// DocumentNotReturnedError is a document the holder reported in documentErrors, i.e. the
+// wallet declined it rather than sent something malformed.
+type DocumentNotReturnedError struct {
+	DocType DocType
+	Code    ErrorCode
+}
+
+func (e *DocumentNotReturnedError) Error() string {
+	return fmt.Sprintf("%v: %s, error code %d", ErrDocumentNotReturned, e.DocType, e.Code)
+}
+
+func (e *DocumentNotReturnedError) Unwrap() error {
+	return ErrDocumentNotReturned
+}
+
+// VerifyDeviceResponse verifies every document of resp on its own, in the order received,
+// e.g. an mDL and a PID presented together. A failing document does not stop the others.
+// The results of the documents in documentErrors follow, sorted by docType.
+func VerifyDeviceResponse(ctx context.Context, resp *DeviceResponse, sessTrans []byte, opts VerifyOptions) []DocumentResult {
+	results := make([]DocumentResult, 0, len(resp.Documents))
+	for _, doc := range resp.Documents {
+		report, err := VerifyDocument(ctx, doc, sessTrans, opts)
+		results = append(results, DocumentResult{DocType: doc.DocType, Report: report, Err: err})
 	}
 
-	// 4. Verify that the DocType in the MSO matches the relevant DocType in the Documents structure.
-	if doc.DocType != mso.DocType {
-		return fmt.Errorf("docType unmatche ")
+	var notReturned []DocumentResult
+	for _, docErr := range resp.DocumentErrors {
+		for docType, code := range docErr {
+			notReturned = append(notReturned, DocumentResult{
+				DocType: docType,
+				Err:     &DocumentNotReturnedError{DocType: docType, Code: code},
+			})
+		}
 	}
+	sort.Slice(notReturned, func(i, j int) bool { return notReturned[i].DocType < notReturned[j].DocType })
+	return append(results, notReturned...)
+}
 
-	// 5. Validate the elements in the ValidityInfo structure, i.e. verify that:
-	// — the 'signed' date is within the validity period of the certificate in the MSO header,
-	// — the current timestamp shall be equal or later than the ‘validFrom’ element,
-	// — the 'validUntil' element shall be equal or later than the current timestamp.
-	certificate, err := doc.IssuerSigned.Certificate()
-	if err != nil {
-		return fmt.Errorf("failed to get certificate: %v", err)
+// VerifyDocument is VerifyWithOptions returning a report of the verified document. It runs
+// the checks of InspectDocument, stops at the first failure and returns it.
+func VerifyDocument(ctx context.Context, doc Document, sessTrans []byte, opts VerifyOptions) (*VerificationReport, error) {
+	result := runChecks(ctx, doc, sessTrans, opts, true)
+	for _, c := range result.Checks {
+		if c.Outcome == CheckFailed {
+			return nil, fmt.Errorf("failed to check %s: %w", c.Name, c.Err)
+		}
 	}
-	if mso.ValidityInfo.Signed.Before(certificate.NotBefore) || mso.ValidityInfo.Signed.After(certificate.NotAfter) {
-		return fmt.Errorf("failed to veirfy signed date: %v", mso.ValidityInfo)
+	return result.Report, nil
+}
+
+// checkValidity checks now against the MSO validity window, widened by opts.ClockSkew.
+// — the current timestamp shall be equal or later than the ‘validFrom’ element,
+// — the 'validUntil' element shall be equal or later than the current timestamp.
+func checkValidity(v ValidityInfo, now time.Time, opts VerifyOptions) error {
+	if now.Before(v.ValidFrom.Add(-opts.ClockSkew)) {
+		return fmt.Errorf("%w: validFrom %v", ErrNotYetValid, v.ValidFrom)
 	}
-	if Now.Before(mso.ValidityInfo.ValidFrom) || Now.After(mso.ValidityInfo.ValidUntil) {
-		return fmt.Errorf("failed to check validity: %v", mso.ValidityInfo)
+	if now.After(v.ValidUntil.Add(opts.ClockSkew)) {
+		return fmt.Errorf("%w: validUntil %v", ErrExpired, v.ValidUntil)
 	}
-
 	return nil
 }
 
+// expiredTolerated reports whether err of checkValidity is an expiry opts accept.
+func expiredTolerated(err error, v ValidityInfo, now time.Time, opts VerifyOptions) bool {
+	if !errors.Is(err, ErrExpired) {
+		return false
+	}
+	return opts.AllowExpired || (opts.ExpiredGracePeriod > 0 && now.Sub(v.Signed) <= opts.ExpiredGracePeriod)
+}
+
 func VerifyDeviceSigned(mso *MobileSecurityObject, doc Document, sessionTranscript []byte) error {
+	// The self-attested elements are only trustworthy as far as DeviceAuth covers them,
+	// so they have to be well formed before they go into DeviceAuthentication.
+	nameSpaces, err := doc.DeviceSigned.DeviceNameSpaces()
+	if err != nil {
+		return err
+	}
+	if err := checkKeyAuthorizations(mso.DeviceKeyInfo.KeyAuthorizations, nameSpaces); err != nil {
+		return err
+	}
+
 	deviceAuthenticationByte, err := doc.DeviceSigned.DeviceAuthenticationBytes(doc.DocType, sessionTranscript)
 	if err != nil {
 		return fmt.Errorf("failed to Marshal cbor %w", err)
 	}
 
+	if err := protocol.CheckCOSEHeaders(doc.DeviceSigned.DeviceAuth.DeviceSignature.Headers); err != nil {
+		return err
+	}
+
 	alg, err := doc.DeviceSigned.Alg()
 	if err != nil {
 		return fmt.Errorf("failed to get alg %w", err)
@@ -85,6 +265,10 @@ func VerifyDeviceSigned(mso *MobileSecurityObject, doc Document, sessionTranscri
 		return fmt.Errorf("failed to get alg %w", err)
 	}
 
+	if err := checkDeviceKeyBinding(alg, pubKey, mso, doc.DeviceSigned.DeviceAuth.DeviceSignature, deviceAuthenticationByte); err != nil {
+		return err
+	}
+
 	verifier, err := cose.NewVerifier(alg, pubKey)
 	if err != nil {
 		return fmt.Errorf("Failed to create NewVerifier: %v", err)
@@ -95,7 +279,102 @@ func VerifyDeviceSigned(mso *MobileSecurityObject, doc Document, sessionTranscri
 	return doc.DeviceSigned.DeviceAuth.DeviceSignature.Verify(nil, verifier)
 }
 
+// VerifyDeviceMac verifies the deviceMac with the EMacKey agreed between readerKey and the
+// deviceKey in the MSO (ISO 18013-5 9.1.3.5).
+func VerifyDeviceMac(mso *MobileSecurityObject, doc Document, sessionTranscript []byte, readerKey *ecdh.PrivateKey) error {
+	if readerKey == nil {
+		return ErrNoReaderKey
+	}
+	nameSpaces, err := doc.DeviceSigned.DeviceNameSpaces()
+	if err != nil {
+		return err
+	}
+	if err := checkKeyAuthorizations(mso.DeviceKeyInfo.KeyAuthorizations, nameSpaces); err != nil {
+		return err
+	}
+
+	deviceAuthenticationByte, err := doc.DeviceSigned.DeviceAuthenticationBytes(doc.DocType, sessionTranscript)
+	if err != nil {
+		return fmt.Errorf("failed to Marshal cbor %w", err)
+	}
+
+	deviceKey, err := mso.DeviceKeyECDH()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDeviceKeyMismatch, err)
+	}
+
+	eMacKey, err := protocol.DeriveEMacKey(readerKey, deviceKey, sessionTranscript)
+	if err != nil {
+		return err
+	}
+	return protocol.VerifyCOSEMac0(doc.DeviceSigned.DeviceAuth.DeviceMac, deviceAuthenticationByte, eMacKey)
+}
+
+// checkKeyAuthorizations fails for the first device-signed element the deviceKey is not
+// authorized to sign, ISO 18013-5 9.1.2.4.
+func checkKeyAuthorizations(auth KeyAuthorizations, nameSpaces DeviceNameSpaces) error {
+	for ns, items := range nameSpaces {
+		for id := range items {
+			if !auth.Authorized(ns, id) {
+				return fmt.Errorf("%w: %s %s", ErrUnauthorizedDeviceElement, ns, id)
+			}
+		}
+	}
+	return nil
+}
+
+// checkDeviceKeyBinding makes sure the DeviceSignature can only have been produced by
+// the single deviceKey in the MSO, over the DeviceAuthentication we rebuilt ourselves.
+func checkDeviceKeyBinding(alg cose.Algorithm, pubKey crypto.PublicKey, mso *MobileSecurityObject, sig cose.UntaggedSign1Message, deviceAuthenticationByte []byte) error {
+	if err := protocol.CheckKeyAlg(alg, pubKey); err != nil {
+		return fmt.Errorf("%w: %v", ErrDeviceKeyMismatch, err)
+	}
+
+	// A kid on the signature must name the deviceKey, not some other key. The signature
+	// verified under the deviceKey already, so without a kid in the MSO there is nothing to compare.
+	if kid := mso.DeviceKeyInfo.DeviceKey.Kid; len(kid) > 0 {
+		for _, h := range []map[interface{}]interface{}{sig.Headers.Protected, sig.Headers.Unprotected} {
+			sigKid, ok := h[cose.HeaderLabelKeyID]
+			if !ok {
+				continue
+			}
+			kidBytes, ok := sigKid.([]byte)
+			if !ok || !bytes.Equal(kidBytes, kid) {
+				return fmt.Errorf("%w: kid does not match deviceKey", ErrDeviceKeyMismatch)
+			}
+		}
+	}
+
+	// DeviceAuthentication is detached. If the holder sent one anyway it must be ours.
+	if sig.Payload != nil && !bytes.Equal(sig.Payload, deviceAuthenticationByte) {
+		return fmt.Errorf("%w: transmitted DeviceAuthentication differs from session", ErrDeviceKeyMismatch)
+	}
+	return nil
+}
+
+// checkCanonicalItems reports the first IssuerSignedItem that is not canonical CBOR.
+func checkCanonicalItems(issuerSigned IssuerSigned) error {
+	for ns, itemBytes := range issuerSigned.NameSpaces {
+		for i, item := range itemBytes {
+			if err := protocol.CheckCanonical(item); err != nil {
+				return fmt.Errorf("%s item %d: %w", ns, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// VerifyDigests checks every disclosed item against its digest in the MSO.
+// The holder chooses what to disclose, so the MSO may hold digests for many more
+// elements, e.g. a presentation of nothing but age_over_21.
 func VerifyDigests(issuerSigned IssuerSigned, mso *MobileSecurityObject) error {
+	if err := issuerSigned.ValidateItems(); err != nil {
+		return err
+	}
+	// Reject an unsupported algorithm even when nothing was disclosed.
+	if err := protocol.CheckDigestAlgorithm(mso.DigestAlgorithm); err != nil {
+		return fmt.Errorf("MSO digestAlgorithm: %w", err)
+	}
 	for ns, itembytes := range issuerSigned.NameSpaces {
 		digestIDs, ok := mso.ValueDigests[ns]
 		if !ok {
@@ -118,8 +397,8 @@ func VerifyDigests(issuerSigned IssuerSigned, mso *MobileSecurityObject) error {
 				return err
 			}
 
-			if !bytes.Equal(digest, calc) {
-				return fmt.Errorf("digest unmatched digestID:%v", item.DigestID)
+			if !protocol.Equal(digest, calc) {
+				return fmt.Errorf("%w: digestID %v of %s", protocol.ErrDigestMismatch, item.DigestID, ns)
 			}
 		}
 
@@ -127,7 +406,13 @@ func VerifyDigests(issuerSigned IssuerSigned, mso *MobileSecurityObject) error {
 	return nil
 }
 
+// VerifyIssuerAuth verifies the IssuerAuth signature with the key of the first x5chain
+// certificate only, the one verifyCertificateChains checks against the trust anchors.
 func VerifyIssuerAuth(issuerSigned IssuerSigned) error {
+	if err := protocol.CheckCOSEHeaders(issuerSigned.IssuerAuth.Headers); err != nil {
+		return err
+	}
+
 	alg, err := issuerSigned.Alg()
 	if err != nil {
 		return fmt.Errorf("failed to get alg %w", err)
@@ -138,6 +423,10 @@ func VerifyIssuerAuth(issuerSigned IssuerSigned) error {
 		return fmt.Errorf("Failed to parseCertificates: %v", err)
 	}
 
+	if err := protocol.CheckKeyAlg(alg, documentSigningKey); err != nil {
+		return fmt.Errorf("alg does not match document signing key: %v", err)
+	}
+
 	verifier, err := cose.NewVerifier(alg, documentSigningKey)
 	if err != nil {
 		return fmt.Errorf("Failed to create NewVerifier: %v", err)
@@ -147,12 +436,38 @@ func VerifyIssuerAuth(issuerSigned IssuerSigned) error {
 }
 
 func VerifyCertificate(issuerSigned IssuerSigned, roots *x509.CertPool, allowSelfCert bool) error {
+	_, err := verifyCertificateChains(issuerSigned, roots, allowSelfCert, time.Now())
+	return err
+}
+
+func verifyCertificateChains(issuerSigned IssuerSigned, roots *x509.CertPool, allowSelfCert bool, now time.Time) ([][]*x509.Certificate, error) {
 	certs, err := issuerSigned.X5CertificateChain()
 	if err != nil {
-		return fmt.Errorf("Failed to get X5CertificateChain: %v", err)
+		return nil, fmt.Errorf("Failed to get X5CertificateChain: %v", err)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("x5chain is empty")
+	}
+
+	// RFC 9360: the first certificate holds the signing key, anything else leaves open which
+	// certificate IssuerAuth was made with. Some issuers send the intermediates in any order,
+	// so those are only a pool to build the chain from.
+	leaf := certs[0]
+	if leaf.BasicConstraintsValid && leaf.IsCA {
+		return nil, fmt.Errorf("%w: first x5chain certificate is a CA", ErrInvalidX5Chain)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
 	}
 
 	if allowSelfCert {
+		// Work on a copy, the caller's pool may be shared with other verifications.
+		if roots == nil {
+			roots = x509.NewCertPool()
+		} else {
+			roots = roots.Clone()
+		}
 		for _, cert := range certs {
 			roots.AddCert(cert)
 		}
@@ -160,13 +475,68 @@ func VerifyCertificate(issuerSigned IssuerSigned, roots *x509.CertPool, allowSel
 
 	// veirfy
 	opts := x509.VerifyOptions{
-		Roots:     roots,
-		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		CurrentTime:   now,
 	}
 
 	// Perform the verification
-	if _, err := certs[0].Verify(opts); err != nil {
-		return fmt.Errorf("failed to verify certificate chain: %v", err)
+	chains, err := leaf.Verify(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify certificate chain: %v", err)
 	}
-	return nil
+
+	// Out of order is fine, unrelated certificates are not.
+	for i, cert := range certs[1:] {
+		if !inChains(chains, cert) {
+			return nil, fmt.Errorf("%w: certificate %d is not part of the chain", ErrInvalidX5Chain, i+1)
+		}
+	}
+	return chains, nil
+}
+
+func inChains(chains [][]*x509.Certificate, cert *x509.Certificate) bool {
+	for _, chain := range chains {
+		for _, c := range chain {
+			if c.Equal(cert) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkRevocation checks the document signer and any intermediate certificate against
+// their issuer in the verified chain. The root is a trust anchor and is not checked.
+// Unless opts.RevocationHardFail, a status that cannot be fetched is returned as
+// unavailable and the rest of the chain is still checked.
+func checkRevocation(ctx context.Context, chains [][]*x509.Certificate, now time.Time, opts VerifyOptions) (unavailable, err error) {
+	chain := chains[0]
+
+	checker := opts.RevocationChecker
+	if checker == nil {
+		checker = DefaultRevocationChecker
+	}
+
+	// A self-signed document signer has nobody to revoke it, the loop does not run.
+	for i := 0; i+1 < len(chain); i++ {
+		var err error
+		if i == 0 && len(opts.StapledOCSP) > 0 {
+			err = checker.CheckStapled(ctx, chain[i], chain[i+1], opts.StapledOCSP, now)
+		} else {
+			err = checker.CheckAt(ctx, chain[i], chain[i+1], now)
+		}
+		if errors.Is(err, ErrRevocationUnavailable) && !opts.RevocationHardFail {
+			opts.logger().Warn("revocation status unavailable, continuing", "subject", chain[i].Subject.String(), "error", err)
+			if unavailable == nil {
+				unavailable = err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return unavailable, nil
 }
@@ -0,0 +1,118 @@
+package mdoc
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+var ErrInvalidVICAL = errors.New("invalid VICAL")
+
+// VICAL is a Verified Issuer Certificate Authority List, ISO/IEC 18013-5 Annex C.
+type VICAL struct {
+	Version          string
+	VICALProvider    string
+	Date             time.Time
+	VICALIssueID     uint
+	NextUpdate       time.Time // zero when not given
+	CertificateInfos []CertificateInfo
+}
+
+// CertificateInfo is one IACA entry of a VICAL.
+type CertificateInfo struct {
+	Certificate      []byte    `cbor:"certificate"`
+	SerialNumber     big.Int   `cbor:"serialNumber"`
+	SKI              []byte    `cbor:"ski"`
+	DocType          []DocType `cbor:"docType"`
+	IssuingAuthority string    `cbor:"issuingAuthority,omitempty"`
+	IssuingCountry   string    `cbor:"issuingCountry,omitempty"`
+}
+
+type rawVICAL struct {
+	Version          string            `cbor:"version"`
+	VICALProvider    string            `cbor:"vicalProvider"`
+	Date             cbor.Tag          `cbor:"date"`
+	VICALIssueID     uint              `cbor:"vicalIssueID"`
+	NextUpdate       *cbor.Tag         `cbor:"nextUpdate"`
+	CertificateInfos []CertificateInfo `cbor:"certificateInfos"`
+}
+
+// ParseVICAL verifies the COSE_Sign1 of a VICAL, whose x5chain must lead to one of roots
+// at now, and returns its content.
+func ParseVICAL(data []byte, roots *x509.CertPool, now time.Time) (*VICAL, error) {
+	msg, err := verifyX5ChainSign1(data, roots, now)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidVICAL, err)
+	}
+
+	var raw rawVICAL
+	if err := msoDecMode.Unmarshal(msg.Payload, &raw); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidVICAL, err)
+	}
+	vical := &VICAL{
+		Version:          raw.Version,
+		VICALProvider:    raw.VICALProvider,
+		VICALIssueID:     raw.VICALIssueID,
+		CertificateInfos: raw.CertificateInfos,
+	}
+	if vical.Date, err = parseTDate("date", raw.Date); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidVICAL, err)
+	}
+	if raw.NextUpdate != nil {
+		if vical.NextUpdate, err = parseTDate("nextUpdate", *raw.NextUpdate); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidVICAL, err)
+		}
+	}
+	return vical, nil
+}
+
+// Certificates returns the IACA certificates listed for docType, or all of them for an
+// empty docType. An entry whose certificate does not match its serialNumber and ski, or is
+// not a CA, fails the whole list.
+func (v *VICAL) Certificates(docType DocType) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for i, info := range v.CertificateInfos {
+		if docType != "" && !containsDocType(info.DocType, docType) {
+			continue
+		}
+		cert, err := x509.ParseCertificate(info.Certificate)
+		if err != nil {
+			return nil, fmt.Errorf("%w: certificate %d: %v", ErrInvalidVICAL, i, err)
+		}
+		if cert.SerialNumber.Cmp(&info.SerialNumber) != 0 || !bytes.Equal(cert.SubjectKeyId, info.SKI) {
+			return nil, fmt.Errorf("%w: certificate %d does not match its serialNumber and ski", ErrInvalidVICAL, i)
+		}
+		if !cert.BasicConstraintsValid || !cert.IsCA {
+			return nil, fmt.Errorf("%w: certificate %d is not a CA", ErrInvalidVICAL, i)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// CertPool returns the IACA certificates for docType as trust anchors, e.g. for VerifyOptions.Roots.
+func (v *VICAL) CertPool(docType DocType) (*x509.CertPool, error) {
+	certs, err := v.Certificates(docType)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return pool, nil
+}
+
+func containsDocType(docTypes []DocType, docType DocType) bool {
+	for _, d := range docTypes {
+		if d == docType {
+			return true
+		}
+	}
+	return false
+}
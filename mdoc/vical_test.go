@@ -0,0 +1,125 @@
+package mdoc
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/veraison/go-cose"
+)
+
+func signVICAL(t *testing.T, signer *x509.Certificate, key *ecdsa.PrivateKey, infos []map[string]interface{}) []byte {
+	payload, err := cbor.Marshal(map[string]interface{}{
+		"version":          "1.0",
+		"vicalProvider":    "Test VICAL Provider",
+		"date":             cbor.Tag{Number: 0, Content: "2024-01-01T00:00:00Z"},
+		"vicalIssueID":     7,
+		"certificateInfos": infos,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := cose.NewSigner(cose.AlgorithmES256, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := cose.Sign1Message{
+		Headers: cose.Headers{
+			Protected:   cose.ProtectedHeader{cose.HeaderLabelAlgorithm: cose.AlgorithmES256},
+			Unprotected: cose.UnprotectedHeader{cose.HeaderLabelX5Chain: signer.Raw},
+		},
+		Payload: payload,
+	}
+	if err := msg.Sign(rand.Reader, nil, s); err != nil {
+		t.Fatal(err)
+	}
+	data, err := msg.MarshalCBOR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func certificateInfo(cert *x509.Certificate, docTypes ...DocType) map[string]interface{} {
+	return map[string]interface{}{
+		"certificate":  cert.Raw,
+		"serialNumber": cert.SerialNumber,
+		"ski":          cert.SubjectKeyId,
+		"docType":      docTypes,
+	}
+}
+
+func TestVICAL(t *testing.T) {
+	_, provider, providerKey := createRevocationCerts(t, "", "")
+	_, iaca, _ := createRevocationCerts(t, "", "")
+	ds, otherIACA, _ := createRevocationCerts(t, "", "")
+	roots := x509.NewCertPool()
+	roots.AddCert(provider)
+	now := time.Now()
+
+	data := signVICAL(t, provider, providerKey, []map[string]interface{}{
+		certificateInfo(iaca, DocTypeMDL),
+		certificateInfo(otherIACA, "org.iso.23220.photoid.1"),
+	})
+
+	t.Run("Parse", func(t *testing.T) {
+		vical, err := ParseVICAL(data, roots, now)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if vical.VICALProvider != "Test VICAL Provider" || vical.VICALIssueID != 7 || vical.Date.Year() != 2024 {
+			t.Fatalf("unexpected VICAL: %+v", vical)
+		}
+
+		certs, err := vical.Certificates(DocTypeMDL)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(certs) != 1 || !certs[0].Equal(iaca) {
+			t.Fatalf("unexpected certificates: %v", certs)
+		}
+		if all, _ := vical.Certificates(""); len(all) != 2 {
+			t.Fatalf("expected 2 certificates, got %d", len(all))
+		}
+	})
+
+	t.Run("UntrustedProvider", func(t *testing.T) {
+		if _, err := ParseVICAL(data, x509.NewCertPool(), now); !errors.Is(err, ErrInvalidVICAL) {
+			t.Fatalf("expected ErrInvalidVICAL, got %v", err)
+		}
+	})
+
+	t.Run("TamperedSignature", func(t *testing.T) {
+		tampered := append([]byte{}, data...)
+		tampered[len(tampered)-1] ^= 0xff
+		if _, err := ParseVICAL(tampered, roots, now); !errors.Is(err, ErrInvalidVICAL) {
+			t.Fatalf("expected ErrInvalidVICAL, got %v", err)
+		}
+	})
+
+	t.Run("SerialMismatch", func(t *testing.T) {
+		info := certificateInfo(iaca, DocTypeMDL)
+		info["serialNumber"] = 99
+		vical, err := ParseVICAL(signVICAL(t, provider, providerKey, []map[string]interface{}{info}), roots, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := vical.CertPool(DocTypeMDL); !errors.Is(err, ErrInvalidVICAL) {
+			t.Fatalf("expected ErrInvalidVICAL, got %v", err)
+		}
+	})
+
+	t.Run("NotCA", func(t *testing.T) {
+		vical, err := ParseVICAL(signVICAL(t, provider, providerKey, []map[string]interface{}{certificateInfo(ds, DocTypeMDL)}), roots, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := vical.CertPool(DocTypeMDL); !errors.Is(err, ErrInvalidVICAL) {
+			t.Fatalf("expected ErrInvalidVICAL, got %v", err)
+		}
+	})
+}
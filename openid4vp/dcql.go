@@ -0,0 +1,365 @@
+package openid4vp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/kokukuma/identity-credential-api-demo/mdoc"
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+)
+
+// https://openid.net/specs/openid-4-verifiable-presentations-1_0.html#name-digital-credentials-query-l
+
+var (
+	ErrInvalidDCQL     = errors.New("invalid DCQL query")
+	ErrDCQLUnsatisfied = errors.New("response does not satisfy the DCQL query")
+)
+
+const FormatMsoMdoc = "mso_mdoc"
+
+// DCQLQuery is the dcql_query of an authorization request.
+type DCQLQuery struct {
+	Credentials    []CredentialQuery    `json:"credentials"`
+	CredentialSets []CredentialSetQuery `json:"credential_sets,omitempty"`
+}
+
+type CredentialQuery struct {
+	ID     string          `json:"id"`
+	Format string          `json:"format"`
+	Meta   *CredentialMeta `json:"meta,omitempty"`
+	Claims []ClaimsQuery   `json:"claims,omitempty"`
+	// ClaimSets lists alternative sets of claim ids, in order of preference.
+	ClaimSets [][]string `json:"claim_sets,omitempty"`
+}
+
+type CredentialMeta struct {
+	DoctypeValue mdoc.DocType `json:"doctype_value"`
+}
+
+// ClaimsQuery requests an element, Path is its namespace and identifier. With Values, the
+// element only matches when its value is one of them.
+type ClaimsQuery struct {
+	ID             string        `json:"id,omitempty"`
+	Path           []string      `json:"path"`
+	Values         []interface{} `json:"values,omitempty"`
+	IntentToRetain bool          `json:"intent_to_retain,omitempty"`
+}
+
+// CredentialSetQuery is satisfied by any of Options, each a list of credential ids.
+type CredentialSetQuery struct {
+	Options [][]string `json:"options"`
+	// Required defaults to true.
+	Required *bool `json:"required,omitempty"`
+}
+
+// Element returns the element the claim requests.
+func (c ClaimsQuery) Element() (mdoc.Element, error) {
+	if len(c.Path) != 2 {
+		return mdoc.Element{}, fmt.Errorf("%w: mso_mdoc claim path %v is not [namespace, identifier]", ErrInvalidDCQL, c.Path)
+	}
+	return mdoc.Element{Namespace: c.Path[0], Name: c.Path[1]}, nil
+}
+
+// NewDCQLQuery builds a query with a credential per document of req. The credential ids
+// are derived from the docTypes, claims are sorted by namespace and identifier.
+func NewDCQLQuery(req *mdoc.DeviceRequest) (*DCQLQuery, error) {
+	query := &DCQLQuery{Credentials: []CredentialQuery{}}
+	for _, docRequest := range req.DocRequests {
+		itemsRequest := docRequest.ItemsRequest
+		credential := CredentialQuery{
+			ID:     credentialID(itemsRequest.DocType),
+			Format: FormatMsoMdoc,
+			Meta:   &CredentialMeta{DoctypeValue: itemsRequest.DocType},
+		}
+		for ns, ids := range itemsRequest.NameSpaces {
+			for id, intentToRetain := range ids {
+				credential.Claims = append(credential.Claims, ClaimsQuery{
+					Path:           []string{string(ns), string(id)},
+					IntentToRetain: intentToRetain,
+				})
+			}
+		}
+		if len(credential.Claims) == 0 {
+			return nil, fmt.Errorf("%s: %w", itemsRequest.DocType, ErrEmptyRequest)
+		}
+		sort.Slice(credential.Claims, func(i, j int) bool {
+			a, b := credential.Claims[i].Path, credential.Claims[j].Path
+			if a[0] != b[0] {
+				return a[0] < b[0]
+			}
+			return a[1] < b[1]
+		})
+		query.Credentials = append(query.Credentials, credential)
+	}
+	if len(query.Credentials) == 0 {
+		return nil, ErrEmptyRequest
+	}
+	return query, query.Validate()
+}
+
+var (
+	credentialIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	invalidIDChars      = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+)
+
+// credentialID makes an id of docType, e.g. org_iso_18013_5_1_mDL.
+func credentialID(docType mdoc.DocType) string {
+	return invalidIDChars.ReplaceAllString(string(docType), "_")
+}
+
+// Validate checks the ids and references of the query and that every credential is an mdoc.
+func (q *DCQLQuery) Validate() error {
+	if len(q.Credentials) == 0 {
+		return fmt.Errorf("%w: no credentials", ErrInvalidDCQL)
+	}
+	ids := map[string]bool{}
+	for _, c := range q.Credentials {
+		if !credentialIDPattern.MatchString(c.ID) {
+			return fmt.Errorf("%w: credential id %q", ErrInvalidDCQL, c.ID)
+		}
+		if ids[c.ID] {
+			return fmt.Errorf("%w: duplicate credential id %q", ErrInvalidDCQL, c.ID)
+		}
+		ids[c.ID] = true
+		if c.Format != FormatMsoMdoc || c.Meta == nil || c.Meta.DoctypeValue == "" {
+			return fmt.Errorf("%w: credential %q is not an mso_mdoc with a doctype_value", ErrInvalidDCQL, c.ID)
+		}
+
+		claimIDs := map[string]bool{}
+		for _, claim := range c.Claims {
+			if _, err := claim.Element(); err != nil {
+				return fmt.Errorf("credential %q: %w", c.ID, err)
+			}
+			// Values are strings, integers or booleans, DCQL section 6.4.
+			for _, v := range claim.Values {
+				if _, ok := claimValue(v); !ok {
+					return fmt.Errorf("%w: credential %q: claim %v: value %v is not a string, number or boolean", ErrInvalidDCQL, c.ID, claim.Path, v)
+				}
+			}
+			// claim_sets refer to the claims by id, so every claim needs one, DCQL section 6.3.
+			if claim.ID == "" && len(c.ClaimSets) > 0 {
+				return fmt.Errorf("%w: credential %q: claim %v has no id but claim_sets is present", ErrInvalidDCQL, c.ID, claim.Path)
+			}
+			if claim.ID != "" {
+				if claimIDs[claim.ID] {
+					return fmt.Errorf("%w: credential %q: duplicate claim id %q", ErrInvalidDCQL, c.ID, claim.ID)
+				}
+				claimIDs[claim.ID] = true
+			}
+		}
+		for _, set := range c.ClaimSets {
+			for _, id := range set {
+				if !claimIDs[id] {
+					return fmt.Errorf("%w: credential %q: claim_sets names unknown claim %q", ErrInvalidDCQL, c.ID, id)
+				}
+			}
+		}
+	}
+	for _, set := range q.CredentialSets {
+		if len(set.Options) == 0 {
+			return fmt.Errorf("%w: credential set without options", ErrInvalidDCQL)
+		}
+		for _, option := range set.Options {
+			for _, id := range option {
+				if !ids[id] {
+					return fmt.Errorf("%w: credential_sets names unknown credential %q", ErrInvalidDCQL, id)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// DeviceRequest returns what q requests as a DeviceRequest, e.g. for mdoc.WithRequest.
+func (q *DCQLQuery) DeviceRequest() (*mdoc.DeviceRequest, error) {
+	req := mdoc.NewDeviceRequest()
+	for _, c := range q.Credentials {
+		for _, claim := range c.Claims {
+			elem, err := claim.Element()
+			if err != nil {
+				return nil, err
+			}
+			req.AddElements(c.Meta.DoctypeValue, claim.IntentToRetain, elem)
+		}
+	}
+	return req, nil
+}
+
+// ParseDCQLDeviceResponses decodes a DCQL vp_token into the DeviceResponse of each credential id.
+func ParseDCQLDeviceResponses(vpToken json.RawMessage) (map[string]*mdoc.DeviceResponse, error) {
+	byQuery, err := protocol.ParseDCQLVPToken(vpToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse vp_token: %w", err)
+	}
+	responses := make(map[string]*mdoc.DeviceResponse, len(byQuery))
+	for id, tokens := range byQuery {
+		resp, err := decodeDeviceResponses(tokens)
+		if err != nil {
+			return nil, fmt.Errorf("credential %q: %w", id, err)
+		}
+		responses[id] = resp
+	}
+	return responses, nil
+}
+
+// CheckResponse checks responses, by credential id, against q: every credential answers
+// a credential of q with its doctype and discloses only the claims of q, all of them or
+// all of a claim set, and the required credentials or credential sets are present.
+// q is validated first, it may have been decoded from JSON.
+func (q *DCQLQuery) CheckResponse(responses map[string]*mdoc.DeviceResponse) error {
+	if err := q.Validate(); err != nil {
+		return err
+	}
+	credentials := map[string]CredentialQuery{}
+	for _, c := range q.Credentials {
+		credentials[c.ID] = c
+	}
+
+	for id, resp := range responses {
+		c, ok := credentials[id]
+		if !ok {
+			return fmt.Errorf("%w: credential %q was not requested", ErrDCQLUnsatisfied, id)
+		}
+		if len(resp.Documents) == 0 {
+			return fmt.Errorf("%w: credential %q: no documents", ErrDCQLUnsatisfied, id)
+		}
+		for _, doc := range resp.Documents {
+			if err := c.checkDocument(doc); err != nil {
+				return fmt.Errorf("credential %q: %w", id, err)
+			}
+		}
+	}
+
+	present := func(option []string) bool {
+		for _, id := range option {
+			if _, ok := responses[id]; !ok {
+				return false
+			}
+		}
+		return true
+	}
+	if len(q.CredentialSets) == 0 {
+		for _, c := range q.Credentials {
+			if !present([]string{c.ID}) {
+				return fmt.Errorf("%w: credential %q is missing", ErrDCQLUnsatisfied, c.ID)
+			}
+		}
+		return nil
+	}
+	for i, set := range q.CredentialSets {
+		if set.Required != nil && !*set.Required {
+			continue
+		}
+		satisfied := false
+		for _, option := range set.Options {
+			if present(option) {
+				satisfied = true
+				break
+			}
+		}
+		if !satisfied {
+			return fmt.Errorf("%w: no option of credential set %d is present", ErrDCQLUnsatisfied, i)
+		}
+	}
+	return nil
+}
+
+// checkDocument checks the docType and the disclosed elements of doc against c.
+func (c CredentialQuery) checkDocument(doc mdoc.Document) error {
+	if doc.DocType != c.Meta.DoctypeValue {
+		return fmt.Errorf("%w: docType %s, want %s", ErrDCQLUnsatisfied, doc.DocType, c.Meta.DoctypeValue)
+	}
+	// Without claims, the whole credential is requested.
+	if len(c.Claims) == 0 {
+		return nil
+	}
+
+	disclosed, err := doc.DisclosedElements()
+	if err != nil {
+		return err
+	}
+	got := map[mdoc.Element]bool{}
+	values := map[mdoc.Element]interface{}{}
+	for _, elem := range disclosed {
+		e := mdoc.Element{Namespace: string(elem.NameSpace), Name: string(elem.Identifier)}
+		got[e] = true
+		values[e] = elem.Value
+	}
+
+	requested := map[mdoc.Element]bool{}
+	byID := map[string]mdoc.Element{}
+	for _, claim := range c.Claims {
+		elem, err := claim.Element()
+		if err != nil {
+			return err
+		}
+		requested[elem] = true
+		if claim.ID != "" {
+			byID[claim.ID] = elem
+		}
+		// A disclosed element with a value the query does not allow is as good as missing.
+		if got[elem] && len(claim.Values) > 0 && !matchesValue(values[elem], claim.Values) {
+			return fmt.Errorf("%w: %s %s has a value that was not requested", ErrDCQLUnsatisfied, elem.Namespace, elem.Name)
+		}
+	}
+	for elem := range got {
+		if !requested[elem] {
+			return fmt.Errorf("%w: %s %s was not requested", ErrDCQLUnsatisfied, elem.Namespace, elem.Name)
+		}
+	}
+
+	if len(c.ClaimSets) == 0 {
+		for elem := range requested {
+			if !got[elem] {
+				return fmt.Errorf("%w: %s %s is missing", ErrDCQLUnsatisfied, elem.Namespace, elem.Name)
+			}
+		}
+		return nil
+	}
+	for _, set := range c.ClaimSets {
+		complete := true
+		for _, id := range set {
+			if !got[byID[id]] {
+				complete = false
+				break
+			}
+		}
+		if complete {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: no claim set is complete", ErrDCQLUnsatisfied)
+}
+
+// claimValue normalizes a DCQL value or a decoded element value for comparison, numbers
+// to float64. It reports false for any other type.
+func claimValue(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case string, bool, float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return nil, false
+}
+
+// matchesValue reports whether the disclosed value is one of values.
+func matchesValue(value interface{}, values []interface{}) bool {
+	v, ok := claimValue(value)
+	if !ok {
+		return false
+	}
+	for _, want := range values {
+		if w, ok := claimValue(want); ok && w == v {
+			return true
+		}
+	}
+	return false
+}
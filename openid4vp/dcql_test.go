@@ -0,0 +1,174 @@
+package openid4vp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kokukuma/identity-credential-api-demo/mdoc"
+	"github.com/kokukuma/identity-credential-api-demo/mdoc/mdoctest"
+)
+
+func TestNewDCQLQuery(t *testing.T) {
+	req := mdoc.NewDeviceRequest().
+		AddElements(mdoc.DocTypeMDL, false, mdoc.GivenName, mdoc.FamilyName).
+		AddElements(mdoc.DocTypeMDL, true, mdoc.BirthDate)
+
+	idReq, _, err := BeginIdentityRequest("example.com", req, WithDCQL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idReq.PresentationDefinition != nil {
+		t.Fatal("presentation_definition sent with dcql_query")
+	}
+	data, err := json.Marshal(idReq.DCQLQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"credentials":[{"id":"org_iso_18013_5_1_mDL","format":"mso_mdoc","meta":{"doctype_value":"org.iso.18013.5.1.mDL"},"claims":[` +
+		`{"path":["org.iso.18013.5.1","birth_date"],"intent_to_retain":true},` +
+		`{"path":["org.iso.18013.5.1","family_name"]},` +
+		`{"path":["org.iso.18013.5.1","given_name"]}]}]}`
+	if string(data) != want {
+		t.Fatalf("got %s, want %s", data, want)
+	}
+
+	for name, query := range map[string]string{
+		"CredentialID":  `{"credentials":[{"id":"a.b","format":"mso_mdoc","meta":{"doctype_value":"x"}}]}`,
+		"Duplicate":     `{"credentials":[{"id":"a","format":"mso_mdoc","meta":{"doctype_value":"x"}},{"id":"a","format":"mso_mdoc","meta":{"doctype_value":"x"}}]}`,
+		"Format":        `{"credentials":[{"id":"a","format":"dc+sd-jwt","meta":{"doctype_value":"x"}}]}`,
+		"Path":          `{"credentials":[{"id":"a","format":"mso_mdoc","meta":{"doctype_value":"x"},"claims":[{"path":["ns"]}]}]}`,
+		"ClaimSet":      `{"credentials":[{"id":"a","format":"mso_mdoc","meta":{"doctype_value":"x"},"claims":[{"id":"c","path":["ns","e"]}],"claim_sets":[["d"]]}]}`,
+		"ClaimSetNoID":  `{"credentials":[{"id":"a","format":"mso_mdoc","meta":{"doctype_value":"x"},"claims":[{"id":"c","path":["ns","e"]},{"path":["ns","f"]}],"claim_sets":[["c"]]}]}`,
+		"CredentialSet": `{"credentials":[{"id":"a","format":"mso_mdoc","meta":{"doctype_value":"x"}}],"credential_sets":[{"options":[["b"]]}]}`,
+		"NoCredentials": `{"credentials":[]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			var q DCQLQuery
+			if err := json.Unmarshal([]byte(query), &q); err != nil {
+				t.Fatal(err)
+			}
+			if err := q.Validate(); !errors.Is(err, ErrInvalidDCQL) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestDCQLCheckResponse(t *testing.T) {
+	issuer, err := mdoctest.NewIssuer(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cred, err := issuer.Issue(mdoc.DocTypeMDL, mdoctest.MDL(), mdoctest.Validity(time.Now(), time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vpToken := func(t *testing.T, ids ...mdoc.DataElementIdentifier) json.RawMessage {
+		disclosed, err := cred.Disclose(mdoctest.NameSpaceMDL, ids...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err := disclosed.Present([]byte{0x80})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := mdoctest.EncodeDeviceResponse(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, _ := json.Marshal(map[string]string{"org_iso_18013_5_1_mDL": base64.RawURLEncoding.EncodeToString(resp)})
+		return token
+	}
+
+	query, err := NewDCQLQuery(mdoc.NewDeviceRequest().AddElements(mdoc.DocTypeMDL, false, mdoc.GivenName, mdoc.FamilyName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(t *testing.T, query *DCQLQuery, vpToken json.RawMessage) error {
+		responses, err := ParseDCQLDeviceResponses(vpToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return query.CheckResponse(responses)
+	}
+
+	if err := check(t, query, vpToken(t, "given_name", "family_name")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for name, ids := range map[string][]mdoc.DataElementIdentifier{
+		"Missing":     {"given_name"},
+		"Unrequested": {"given_name", "family_name", "birth_date"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := check(t, query, vpToken(t, ids...)); !errors.Is(err, ErrDCQLUnsatisfied) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+
+	t.Run("ClaimSets", func(t *testing.T) {
+		q := *query
+		q.Credentials = []CredentialQuery{query.Credentials[0]}
+		q.Credentials[0].Claims = []ClaimsQuery{
+			{ID: "family", Path: []string{"org.iso.18013.5.1", "family_name"}},
+			{ID: "given", Path: []string{"org.iso.18013.5.1", "given_name"}},
+		}
+		q.Credentials[0].ClaimSets = [][]string{{"family", "given"}, {"given"}}
+		if err := check(t, &q, vpToken(t, "given_name")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("CredentialSets", func(t *testing.T) {
+		q := *query
+		q.Credentials = append([]CredentialQuery{}, query.Credentials...)
+		q.Credentials = append(q.Credentials, CredentialQuery{ID: "pid", Format: FormatMsoMdoc, Meta: &CredentialMeta{DoctypeValue: "eu.europa.ec.eudi.pid.1"}})
+		if err := check(t, &q, vpToken(t, "given_name", "family_name")); !errors.Is(err, ErrDCQLUnsatisfied) {
+			t.Fatalf("missing credential: unexpected error: %v", err)
+		}
+		q.CredentialSets = []CredentialSetQuery{{Options: [][]string{{"pid"}, {"org_iso_18013_5_1_mDL"}}}}
+		if err := check(t, &q, vpToken(t, "given_name", "family_name")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Values", func(t *testing.T) {
+		q := *query
+		q.Credentials = []CredentialQuery{query.Credentials[0]}
+		q.Credentials[0].Claims = []ClaimsQuery{
+			{Path: []string{"org.iso.18013.5.1", "given_name"}, Values: []interface{}{"Erika", "Max"}},
+			{Path: []string{"org.iso.18013.5.1", "age_over_18"}, Values: []interface{}{true}},
+		}
+		if err := check(t, &q, vpToken(t, "given_name", "age_over_18")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		q.Credentials[0].Claims[0].Values = []interface{}{"Max"}
+		if err := check(t, &q, vpToken(t, "given_name", "age_over_18")); !errors.Is(err, ErrDCQLUnsatisfied) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		q.Credentials[0].Claims[0].Values = []interface{}{[]string{"Erika"}}
+		if err := q.Validate(); !errors.Is(err, ErrInvalidDCQL) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("NoMeta", func(t *testing.T) {
+		var q DCQLQuery
+		if err := json.Unmarshal([]byte(`{"credentials":[{"id":"org_iso_18013_5_1_mDL","format":"mso_mdoc"}]}`), &q); err != nil {
+			t.Fatal(err)
+		}
+		if err := check(t, &q, vpToken(t, "given_name", "family_name")); !errors.Is(err, ErrInvalidDCQL) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("UnknownCredential", func(t *testing.T) {
+		if err := query.CheckResponse(map[string]*mdoc.DeviceResponse{"other": {}}); !errors.Is(err, ErrDCQLUnsatisfied) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package openid4vp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+)
+
+// Responses posted to the response_uri, OpenID4VP section 8.2 and 8.3 (JARM).
+
+var ErrStateMismatch = errors.New("state mismatch")
+
+// WithState sets state, which the wallet returns with the response.
+func WithState(state string) RequestOption {
+	return func(r *IdentityRequestOpenID4VP) {
+		r.State = state
+	}
+}
+
+// WithResponseURI sets response_uri, where a direct_post or direct_post.jwt response goes.
+func WithResponseURI(uri string) RequestOption {
+	return func(r *IdentityRequestOpenID4VP) {
+		r.ResponseURI = uri
+	}
+}
+
+// PresentationSubmission maps the vp_token to the input descriptors of the request,
+// DIF Presentation Exchange 2.0 section 6.
+type PresentationSubmission struct {
+	ID            string       `json:"id"`
+	DefinitionID  string       `json:"definition_id"`
+	DescriptorMap []Descriptor `json:"descriptor_map"`
+}
+
+type Descriptor struct {
+	ID     string `json:"id"`
+	Format string `json:"format"`
+	Path   string `json:"path"`
+}
+
+// AuthorizationResponse is the payload of an encrypted response.
+type AuthorizationResponse struct {
+	VPToken                json.RawMessage         `json:"vp_token"`
+	PresentationSubmission *PresentationSubmission `json:"presentation_submission,omitempty"`
+	State                  string                  `json:"state,omitempty"`
+
+	// MdocGeneratedNonce is the apu of the JWE, for the OID4VPHandover.
+	MdocGeneratedNonce string `json:"-"`
+}
+
+// decryptAuthorizationResponse decrypts the JWE of a .jwt response mode with the key of session.
+func decryptAuthorizationResponse(response string, session *protocol.SessionData) (*AuthorizationResponse, error) {
+	plaintext, header, err := protocol.DecryptJWE(response, session.GetPrivateKey())
+	if err != nil {
+		return nil, err
+	}
+	var resp AuthorizationResponse
+	if err := json.Unmarshal(plaintext, &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse JWE payload: %v", err)
+	}
+	if len(resp.VPToken) == 0 {
+		return nil, fmt.Errorf("%w: missing", protocol.ErrInvalidVPToken)
+	}
+	if header.APU != "" {
+		apu, err := base64.RawURLEncoding.DecodeString(header.APU)
+		if err != nil {
+			return nil, fmt.Errorf("%w: apu is not base64url", protocol.ErrInvalidJWE)
+		}
+		resp.MdocGeneratedNonce = string(apu)
+	}
+	return &resp, nil
+}
+
+// ParseDirectPostJWT decodes the form a wallet posts to the response_uri of a
+// direct_post.jwt request: its response is decrypted with the session key of exp, must
+// return exp.State, and its vp_token must be bound to exp.ClientID, exp.ResponseURI and
+// the session nonce by the OID4VPHandover.
+func ParseDirectPostJWT(form url.Values, exp Expectation) (*AuthorizationResponse, *Result, error) {
+	response := form.Get("response")
+	if response == "" {
+		return nil, nil, fmt.Errorf("%w: no response parameter", protocol.ErrInvalidJWE)
+	}
+	resp, err := decryptAuthorizationResponse(response, exp.Session)
+	if err != nil {
+		return nil, nil, err
+	}
+	if exp.State != "" && resp.State == "" {
+		return nil, nil, fmt.Errorf("%w: the response has no state", ErrStateMismatch)
+	}
+	if !protocol.Equal([]byte(resp.State), []byte(exp.State)) {
+		return nil, nil, ErrStateMismatch
+	}
+	if resp.PresentationSubmission != nil && len(resp.PresentationSubmission.DescriptorMap) == 0 {
+		return nil, nil, fmt.Errorf("%w: empty presentation_submission", protocol.ErrInvalidVPToken)
+	}
+
+	exp.Handover = OID4VP_HANDOVER
+	result, err := exp.result(resp, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, result, nil
+}
+
+// DirectPostHandler serves a response_uri. The session is found by the state query
+// parameter, which the response_uri carries since the state in the JWE is only readable
+// with the session key. lookup returns the Expectation of a request made WithState,
+// including that state, which the state in the JWE must match. handle gets every response
+// ParseDirectPostJWT accepts, the wallet gets the error of lookup, ParseDirectPostJWT or
+// handle as a public message.
+func DirectPostHandler(
+	lookup func(state string) (Expectation, error),
+	handle func(r *http.Request, resp *AuthorizationResponse, result *Result) error,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			writeDirectPostError(w, err)
+			return
+		}
+		state := r.URL.Query().Get("state")
+		if state == "" {
+			writeDirectPostError(w, fmt.Errorf("%w: no state parameter", ErrStateMismatch))
+			return
+		}
+		exp, err := lookup(state)
+		if err != nil {
+			writeDirectPostError(w, err)
+			return
+		}
+		if exp.State == "" {
+			writeDirectPostError(w, fmt.Errorf("%w: the request has no state", ErrStateMismatch))
+			return
+		}
+
+		resp, result, err := ParseDirectPostJWT(r.PostForm, exp)
+		if err == nil {
+			err = handle(r, resp, result)
+		}
+		if err != nil {
+			writeDirectPostError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}
+}
+
+func writeDirectPostError(w http.ResponseWriter, err error) {
+	protocol.Log.Warn("direct_post.jwt response rejected", "error", err.Error())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{"invalid_request", protocol.PublicMessage(err)})
+}
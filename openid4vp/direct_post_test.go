@@ -0,0 +1,170 @@
+package openid4vp
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kokukuma/identity-credential-api-demo/mdoc"
+	"github.com/kokukuma/identity-credential-api-demo/mdoc/mdoctest"
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+)
+
+func TestParseDirectPostJWT(t *testing.T) {
+	ctx := context.Background()
+	clientID, responseURI, state := "x509_san_dns:verifier.example.com", "https://verifier.example.com/direct_post?state=abc", "abc"
+
+	issuer, err := mdoctest.NewIssuer(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cred, err := issuer.Issue(mdoc.DocTypeMDL, mdoctest.MDL(), mdoctest.Validity(time.Now(), time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred, err = cred.Disclose(mdoctest.NameSpaceMDL, "given_name"); err != nil {
+		t.Fatal(err)
+	}
+	verifier := mdoc.NewVerifier(issuer.Roots())
+
+	req := mdoc.NewDeviceRequest().AddElements(mdoc.DocTypeMDL, false, mdoc.GivenName)
+	idReq, session, err := BeginIdentityRequest(clientID, req,
+		WithResponseMode(ResponseModeDirectPostJWT), WithResponseURI(responseURI), WithState(state))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idReq.ClientMetadata == nil || idReq.State != state || idReq.ResponseURI != responseURI {
+		t.Fatalf("unexpected request %+v", idReq)
+	}
+	exp := Expectation{ClientID: clientID, ResponseURI: responseURI, State: state, Session: session}
+
+	// post is the wallet side: it presents cred for the OID4VPHandover of nonce and
+	// encrypts the response with mdocGeneratedNonce as apu.
+	post := func(t *testing.T, nonce, responseState string) url.Values {
+		mdocGeneratedNonce := "mdoc-generated-nonce"
+		sessionTranscript, err := GenerateOID4VPSessionTranscript(clientID, responseURI, nonce, mdocGeneratedNonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err := cred.Present(sessionTranscript)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deviceResponse, err := mdoctest.EncodeDeviceResponse(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := json.Marshal(AuthorizationResponse{
+			VPToken: json.RawMessage(`"` + base64.RawURLEncoding.EncodeToString(deviceResponse) + `"`),
+			PresentationSubmission: &PresentationSubmission{
+				ID:            "submission",
+				DefinitionID:  "mDL-request-demo",
+				DescriptorMap: []Descriptor{{ID: string(mdoc.DocTypeMDL), Format: FormatMsoMdoc, Path: "$"}},
+			},
+			State: responseState,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		jwe, err := protocol.EncryptJWE(payload, session.PrivateKey.PublicKey(), "ECDH-ES", "A128GCM", []byte(mdocGeneratedNonce), []byte(nonce))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return url.Values{"response": {jwe}}
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		resp, result, err := ParseDirectPostJWT(post(t, idReq.Nonce, state), exp)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if resp.PresentationSubmission.DefinitionID != "mDL-request-demo" || !result.Encrypted {
+			t.Fatalf("unexpected response %+v", resp)
+		}
+		for _, r := range verifier.VerifyResponse(ctx, result.DeviceResponse, result.SessionTranscript) {
+			if r.Err != nil {
+				t.Fatalf("unexpected error: %v", r.Err)
+			}
+		}
+	})
+
+	t.Run("StateMismatch", func(t *testing.T) {
+		if _, _, err := ParseDirectPostJWT(post(t, idReq.Nonce, "other"), exp); !errors.Is(err, ErrStateMismatch) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("NoState", func(t *testing.T) {
+		if _, _, err := ParseDirectPostJWT(post(t, idReq.Nonce, ""), exp); !errors.Is(err, ErrStateMismatch) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("NonceMismatch", func(t *testing.T) {
+		_, result, err := ParseDirectPostJWT(post(t, "other-nonce", state), exp)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		results := verifier.VerifyResponse(ctx, result.DeviceResponse, result.SessionTranscript)
+		if len(results) != 1 || results[0].Err == nil {
+			t.Fatal("verified a response bound to another nonce")
+		}
+	})
+
+	t.Run("NoResponse", func(t *testing.T) {
+		if _, _, err := ParseDirectPostJWT(url.Values{"vp_token": {"x"}}, exp); !errors.Is(err, protocol.ErrInvalidJWE) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Handler", func(t *testing.T) {
+		var handled bool
+		handler := DirectPostHandler(
+			func(s string) (Expectation, error) {
+				switch s {
+				case state:
+					return exp, nil
+				case "stateless":
+					noState := exp
+					noState.State = ""
+					return noState, nil
+				}
+				return Expectation{}, errors.New("session not found")
+			},
+			func(r *http.Request, resp *AuthorizationResponse, result *Result) error {
+				handled = true
+				return nil
+			},
+		)
+
+		for name, tc := range map[string]struct {
+			state string
+			form  url.Values
+			code  int
+		}{
+			"Valid":         {state, post(t, idReq.Nonce, state), http.StatusOK},
+			"UnknownState":  {"unknown", post(t, idReq.Nonce, state), http.StatusBadRequest},
+			"Tampered":      {state, url.Values{"response": {"a.b.c.d.e"}}, http.StatusBadRequest},
+			"NoState":       {"", post(t, idReq.Nonce, ""), http.StatusBadRequest},
+			"NoStoredState": {"stateless", post(t, idReq.Nonce, ""), http.StatusBadRequest},
+		} {
+			t.Run(name, func(t *testing.T) {
+				handled = false
+				r := httptest.NewRequest(http.MethodPost, "/direct_post?state="+tc.state, strings.NewReader(tc.form.Encode()))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				w := httptest.NewRecorder()
+				handler(w, r)
+				if w.Code != tc.code || handled != (tc.code == http.StatusOK) {
+					t.Fatalf("got %d %s, handled %v", w.Code, w.Body, handled)
+				}
+			})
+		}
+	})
+}
@@ -1,27 +1,39 @@
 package openid4vp
 
 import (
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 
-	"github.com/fxamacker/cbor/v2"
 	"github.com/kokukuma/identity-credential-api-demo/mdoc"
 	"github.com/kokukuma/identity-credential-api-demo/protocol"
 )
 
-var (
-	b64 = base64.URLEncoding.WithPadding(base64.StdPadding)
-)
-
 // https://openid.net/specs/openid-4-verifiable-presentations-1_0.html
 
 type IdentityRequestOpenID4VP struct {
-	ClientID               string                 `json:"client_id"`
-	ClientIDScheme         string                 `json:"client_id_scheme"`
-	ResponseType           string                 `json:"resopnse_type"`
-	Nonce                  string                 `json:"nonce"`
-	PresentationDefinition PresentationDefinition `json:"presentation_definition"`
+	ClientID               string                  `json:"client_id"`
+	ClientIDScheme         string                  `json:"client_id_scheme"`
+	ResponseType           string                  `json:"response_type"`
+	ResponseMode           string                  `json:"response_mode,omitempty"`
+	ResponseURI            string                  `json:"response_uri,omitempty"`
+	State                  string                  `json:"state,omitempty"`
+	WalletNonce            string                  `json:"wallet_nonce,omitempty"`
+	Nonce                  string                  `json:"nonce"`
+	PresentationDefinition *PresentationDefinition `json:"presentation_definition,omitempty"`
+	DCQLQuery              *DCQLQuery              `json:"dcql_query,omitempty"`
+	ClientMetadata         *ClientMetadata         `json:"client_metadata,omitempty"`
+
+	// dcql requests with DCQLQuery instead of PresentationDefinition, see WithDCQL.
+	dcql bool
+	// algs are the mso_mdoc alg values of the input descriptors, see WithAlgorithms.
+	algs []string
+}
+
+// ClientMetadata carries the key an encrypted response is sent to.
+type ClientMetadata struct {
+	JWKS                              protocol.JWKS `json:"jwks"`
+	AuthorizationEncryptedResponseAlg string        `json:"authorization_encrypted_response_alg"`
+	AuthorizationEncryptedResponseEnc string        `json:"authorization_encrypted_response_enc"`
 }
 
 type PresentationDefinition struct {
@@ -54,32 +66,93 @@ type MsoMdoc struct {
 }
 
 type OpenID4VPData struct {
-	VPToken string `json:"vp_token"`
+	// VPToken is a string, an array or a DCQL map, see protocol.ParseVPToken.
+	VPToken json.RawMessage `json:"vp_token"`
 }
 
 func ParseDeviceResponse(
 	data, origin, clientID string,
 	nonceByte []byte,
 ) (*mdoc.DeviceResponse, []byte, error) {
-	var msg OpenID4VPData
-	if err := json.Unmarshal([]byte(data), &msg); err != nil {
-		return nil, nil, fmt.Errorf("failed to parse data as JSON")
+	claims, err := parseVPToken(data)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	decoded, err := b64.DecodeString(msg.VPToken)
+	sessTrans, err := generateBrowserSessionTranscript(nonceByte, origin, protocol.DigestSHA256([]byte(clientID)))
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to decode base64")
+		return nil, nil, fmt.Errorf("failed to create aad: %v", err)
 	}
 
-	var claims mdoc.DeviceResponse
-	if err := cbor.Unmarshal(decoded, &claims); err != nil {
-		return nil, nil, fmt.Errorf("failed to parse data as JSON")
+	return claims, sessTrans, nil
+}
+
+// ParseDCAPIDeviceResponse is ParseDeviceResponse for wallets that bind the response with the
+// OpenID4VPDCAPIHandover, see GenerateDCAPISessionTranscript. jwkThumbprint is nil unless
+// the response was encrypted.
+func ParseDCAPIDeviceResponse(
+	data, origin string,
+	nonceByte, jwkThumbprint []byte,
+) (*mdoc.DeviceResponse, []byte, error) {
+	claims, err := parseVPToken(data)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	sessTrans, err := generateBrowserSessionTranscript(nonceByte, origin, protocol.Digest([]byte(clientID), "SHA-256"))
+	// The wallet hashes the nonce as sent in the request.
+	sessTrans, err := GenerateDCAPISessionTranscript(origin, protocol.Nonce(nonceByte).String(), jwkThumbprint)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create aad: %v", err)
 	}
 
-	return &claims, sessTrans, nil
+	return claims, sessTrans, nil
+}
+
+func parseVPToken(data string) (*mdoc.DeviceResponse, error) {
+	var msg OpenID4VPData
+	if err := json.Unmarshal([]byte(data), &msg); err != nil {
+		return nil, fmt.Errorf("failed to parse data as JSON")
+	}
+
+	tokens, err := protocol.ParseVPToken(msg.VPToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse vp_token: %w", err)
+	}
+	return decodeDeviceResponses(tokens)
+}
+
+// decodeDeviceResponses merges the DeviceResponses of a vp_token, see mergeDeviceResponses.
+func decodeDeviceResponses(tokens [][]byte) (*mdoc.DeviceResponse, error) {
+	responses := make([]*mdoc.DeviceResponse, 0, len(tokens))
+	for _, decoded := range tokens {
+		var resp mdoc.DeviceResponse
+		if err := protocol.DecMode.Unmarshal(decoded, &resp); err != nil {
+			return nil, protocol.DiagnosticError(fmt.Errorf("failed to parse data as CBOR: %v", err), decoded)
+		}
+		responses = append(responses, &resp)
+	}
+
+	claims := mergeDeviceResponses(responses)
+	if err := claims.CheckDocuments(); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// mergeDeviceResponses merges DeviceResponses bound to the same session, so that their
+// documents are verified together. The first version and the first non-zero status are
+// kept, a later OK response must not hide the error status of another.
+func mergeDeviceResponses(responses []*mdoc.DeviceResponse) *mdoc.DeviceResponse {
+	merged := &mdoc.DeviceResponse{}
+	for _, resp := range responses {
+		if merged.Version == "" {
+			merged.Version = resp.Version
+		}
+		if merged.Status == 0 {
+			merged.Status = resp.Status
+		}
+		merged.Documents = append(merged.Documents, resp.Documents...)
+		merged.DocumentErrors = append(merged.DocumentErrors, resp.DocumentErrors...)
+	}
+	return merged
 }
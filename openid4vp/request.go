@@ -2,51 +2,157 @@ package openid4vp
 
 import (
 	"crypto/ecdh"
-	"crypto/rand"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/kokukuma/identity-credential-api-demo/mdoc"
 	"github.com/kokukuma/identity-credential-api-demo/protocol"
 )
 
-func BeginIdentityRequest(clientID string) (*IdentityRequestOpenID4VP, *protocol.SessionData, error) {
-	nonce, err := protocol.CreateNonce()
-	if err != nil {
-		return nil, nil, err
+var ErrEmptyRequest = errors.New("no elements requested")
+
+// Response modes, OpenID4VP section 7 and Appendix A.
+const (
+	ResponseModeDirectPost    = "direct_post"
+	ResponseModeDirectPostJWT = "direct_post.jwt"
+	ResponseModeDCAPI         = "dc_api"
+	ResponseModeDCAPIJWT      = "dc_api.jwt"
+)
+
+// RequestOption sets an optional parameter of the authorization request.
+type RequestOption func(*IdentityRequestOpenID4VP)
+
+// WithResponseMode sets response_mode. With a .jwt mode, BeginIdentityRequest publishes
+// the session key in client_metadata for the wallet to encrypt the response to.
+func WithResponseMode(mode string) RequestOption {
+	return func(r *IdentityRequestOpenID4VP) {
+		r.ResponseMode = mode
 	}
+}
 
-	curve := ecdh.P256()
+// WithClientIDScheme replaces the default "web-origin".
+func WithClientIDScheme(scheme string) RequestOption {
+	return func(r *IdentityRequestOpenID4VP) {
+		r.ClientIDScheme = scheme
+	}
+}
 
-	privKey, err := curve.GenerateKey(rand.Reader)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to generateKey: %v", err)
+// WithDCQL requests with a dcql_query, see NewDCQLQuery, instead of a presentation_definition.
+func WithDCQL() RequestOption {
+	return func(r *IdentityRequestOpenID4VP) {
+		r.dcql = true
 	}
+}
 
+// WithAlgorithms sets the signature algorithms of the mso_mdoc format of every input
+// descriptor, ES256 by default.
+func WithAlgorithms(algs ...string) RequestOption {
+	return func(r *IdentityRequestOpenID4VP) {
+		r.algs = algs
+	}
+}
+
+// NewIdentityRequest builds the authorization request of req for clientID, an input
+// descriptor per document with limit_disclosure required, or a DCQL query with WithDCQL.
+// Documents keep the order of req, fields are sorted by namespace and identifier.
+// A client_id prefixed with "x509_san_dns:" sets its client_id_scheme, see SignRequestObject.
+func NewIdentityRequest(clientID string, nonce protocol.Nonce, req *mdoc.DeviceRequest, opts ...RequestOption) (*IdentityRequestOpenID4VP, error) {
 	idReq := &IdentityRequestOpenID4VP{
 		ClientID:       clientID,
 		ClientIDScheme: "web-origin",
 		ResponseType:   "vp_token",
 		Nonce:          nonce.String(),
-		PresentationDefinition: PresentationDefinition{
-			ID: "mDL-request-demo",
-			InputDescriptors: []InputDescriptor{
-				{
-					ID: "org.iso.18013.5.1.mDL",
-					Format: Format{
-						MsoMdoc: MsoMdoc{
-							Alg: []string{"ES256"},
-						},
-					},
-					Constraints: Constraints{
-						LimitDisclosure: "required",
-						Fields: convPathField(
-							mdoc.FamilyName,
-							mdoc.GivenName,
-						),
-					},
+		algs:           []string{"ES256"},
+	}
+	if strings.HasPrefix(clientID, ClientIDSchemeX509SANDNS+":") {
+		idReq.ClientIDScheme = ClientIDSchemeX509SANDNS
+	}
+	for _, opt := range opts {
+		opt(idReq)
+	}
+	if idReq.dcql {
+		query, err := NewDCQLQuery(req)
+		if err != nil {
+			return nil, err
+		}
+		idReq.DCQLQuery = query
+		return idReq, nil
+	}
+
+	idReq.PresentationDefinition = &PresentationDefinition{
+		ID:               "mDL-request-demo",
+		InputDescriptors: []InputDescriptor{},
+	}
+
+	for _, docRequest := range req.DocRequests {
+		itemsRequest := docRequest.ItemsRequest
+		var elements []mdoc.Element
+		intentToRetain := map[mdoc.Element]bool{}
+		for ns, ids := range itemsRequest.NameSpaces {
+			for id, retain := range ids {
+				elem := mdoc.Element{Namespace: string(ns), Name: string(id)}
+				elements = append(elements, elem)
+				intentToRetain[elem] = retain
+			}
+		}
+		if len(elements) == 0 {
+			return nil, fmt.Errorf("%s: %w", itemsRequest.DocType, ErrEmptyRequest)
+		}
+		sort.Slice(elements, func(i, j int) bool {
+			if elements[i].Namespace != elements[j].Namespace {
+				return elements[i].Namespace < elements[j].Namespace
+			}
+			return elements[i].Name < elements[j].Name
+		})
+
+		fields := convPathField(elements...)
+		for i, elem := range elements {
+			fields[i].IntentToRetain = intentToRetain[elem]
+		}
+		idReq.PresentationDefinition.InputDescriptors = append(idReq.PresentationDefinition.InputDescriptors, InputDescriptor{
+			ID: string(itemsRequest.DocType),
+			Format: Format{
+				MsoMdoc: MsoMdoc{
+					Alg: idReq.algs,
 				},
 			},
-		},
+			Constraints: Constraints{
+				LimitDisclosure: "required",
+				Fields:          fields,
+			},
+		})
+	}
+	if len(idReq.PresentationDefinition.InputDescriptors) == 0 {
+		return nil, ErrEmptyRequest
+	}
+	return idReq, nil
+}
+
+// BeginIdentityRequest creates the nonce and ephemeral key of a new session and the
+// authorization request of req.
+func BeginIdentityRequest(clientID string, req *mdoc.DeviceRequest, opts ...RequestOption) (*IdentityRequestOpenID4VP, *protocol.SessionData, error) {
+	nonce, err := protocol.CreateNonce()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	privKey, jwk, err := protocol.GenerateEphemeralKey(ecdh.P256())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	idReq, err := NewIdentityRequest(clientID, nonce, req, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if strings.HasSuffix(idReq.ResponseMode, ".jwt") {
+		idReq.ClientMetadata = &ClientMetadata{
+			JWKS:                              protocol.JWKS{Keys: []protocol.JWK{jwk}},
+			AuthorizationEncryptedResponseAlg: "ECDH-ES",
+			AuthorizationEncryptedResponseEnc: "A128GCM",
+		}
 	}
 
 	return idReq, &protocol.SessionData{
@@ -0,0 +1,249 @@
+package openid4vp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Signed request objects, RFC 9101 (JAR) and OpenID4VP section 5.9.
+
+var (
+	ErrInvalidRequestObject = errors.New("invalid request object")
+	ErrClientIDMismatch     = errors.New("client_id does not match the certificate")
+)
+
+const (
+	// ClientIDSchemeX509SANDNS binds client_id to a DNS name of the x5c leaf certificate.
+	ClientIDSchemeX509SANDNS = "x509_san_dns"
+
+	RequestObjectType = "oauth-authz-req+jwt"
+	// SelfIssuedAudience is the aud of a request object for any wallet.
+	SelfIssuedAudience = "https://self-issued.me/v2"
+)
+
+type requestObjectHeader struct {
+	Alg string   `json:"alg"`
+	Typ string   `json:"typ"`
+	X5c []string `json:"x5c"`
+}
+
+type requestObject struct {
+	*IdentityRequestOpenID4VP
+	Aud string `json:"aud"`
+	Iat int64  `json:"iat"`
+}
+
+// SignRequestObject signs r as a compact JWS with key. chain starts with the certificate
+// of key and goes into x5c; a DNS name of that certificate must be the client_id, either
+// prefixed with "x509_san_dns:" or with ClientIDSchemeX509SANDNS as client_id_scheme.
+func (r *IdentityRequestOpenID4VP) SignRequestObject(key crypto.Signer, chain []*x509.Certificate) (string, error) {
+	if len(chain) == 0 {
+		return "", fmt.Errorf("%w: no certificate", ErrInvalidRequestObject)
+	}
+	if err := r.checkClientID(chain[0]); err != nil {
+		return "", err
+	}
+	if pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(chain[0].PublicKey) {
+		return "", fmt.Errorf("%w: key does not match the certificate", ErrInvalidRequestObject)
+	}
+	alg, hash, err := jwsAlgorithm(key.Public())
+	if err != nil {
+		return "", err
+	}
+
+	header := requestObjectHeader{Alg: alg, Typ: RequestObjectType}
+	for _, cert := range chain {
+		// x5c is standard base64, not base64url, RFC 7515 section 4.1.6.
+		header.X5c = append(header.X5c, base64.StdEncoding.EncodeToString(cert.Raw))
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(requestObject{
+		IdentityRequestOpenID4VP: r,
+		Aud:                      SelfIssuedAudience,
+		Iat:                      time.Now().Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := []byte(signingInput)
+	if hash != 0 {
+		h := hash.New()
+		h.Write(digest)
+		digest = h.Sum(nil)
+	}
+	sig, err := key.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign request object: %v", err)
+	}
+	if pub, ok := key.Public().(*ecdsa.PublicKey); ok {
+		// JWS wants r || s, not the ASN.1 signature of crypto.Signer, RFC 7518 section 3.4.
+		if sig, err = rawECDSASignature(sig, pub.Curve); err != nil {
+			return "", err
+		}
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// ParseRequestObject verifies a signed request object as a wallet does: the x5c chain
+// against roots at now, the signature with the leaf key, and the client_id against the
+// DNS names of the leaf.
+func ParseRequestObject(compact string, roots *x509.CertPool, now time.Time) (*IdentityRequestOpenID4VP, []*x509.Certificate, error) {
+	parts := strings.Split(compact, ".")
+	if len(parts) != 3 {
+		return nil, nil, fmt.Errorf("%w: %d parts", ErrInvalidRequestObject, len(parts))
+	}
+	var header requestObjectHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, nil, fmt.Errorf("%w: header: %v", ErrInvalidRequestObject, err)
+	}
+	if header.Typ != RequestObjectType {
+		return nil, nil, fmt.Errorf("%w: typ %q", ErrInvalidRequestObject, header.Typ)
+	}
+	if len(header.X5c) == 0 {
+		return nil, nil, fmt.Errorf("%w: no x5c", ErrInvalidRequestObject)
+	}
+
+	chain := make([]*x509.Certificate, len(header.X5c))
+	intermediates := x509.NewCertPool()
+	for i, c := range header.X5c {
+		der, err := base64.StdEncoding.DecodeString(c)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: x5c is not base64: %v", ErrInvalidRequestObject, err)
+		}
+		if chain[i], err = x509.ParseCertificate(der); err != nil {
+			return nil, nil, fmt.Errorf("%w: x5c: %v", ErrInvalidRequestObject, err)
+		}
+		if i > 0 {
+			intermediates.AddCert(chain[i])
+		}
+	}
+	if _, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, nil, fmt.Errorf("failed to verify certificate chain: %w", err)
+	}
+
+	alg, hash, err := jwsAlgorithm(chain[0].PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if header.Alg != alg {
+		return nil, nil, fmt.Errorf("%w: alg %q for a %s key", ErrInvalidRequestObject, header.Alg, alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: signature is not base64url: %v", ErrInvalidRequestObject, err)
+	}
+	if !verifyJWS(chain[0].PublicKey, hash, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, nil, fmt.Errorf("%w: signature verification failed", ErrInvalidRequestObject)
+	}
+
+	var r IdentityRequestOpenID4VP
+	if err := decodeSegment(parts[1], &r); err != nil {
+		return nil, nil, fmt.Errorf("%w: payload: %v", ErrInvalidRequestObject, err)
+	}
+	if err := r.checkClientID(chain[0]); err != nil {
+		return nil, nil, err
+	}
+	return &r, chain, nil
+}
+
+// checkClientID checks that the client_id of r is an x509_san_dns identifier of a DNS
+// name of leaf.
+func (r *IdentityRequestOpenID4VP) checkClientID(leaf *x509.Certificate) error {
+	dnsName := r.ClientID
+	if prefixed := strings.TrimPrefix(r.ClientID, ClientIDSchemeX509SANDNS+":"); prefixed != r.ClientID {
+		// The prefix and a legacy client_id_scheme must not disagree.
+		if r.ClientIDScheme != "" && r.ClientIDScheme != ClientIDSchemeX509SANDNS {
+			return fmt.Errorf("%w: client_id_scheme %q with client_id %q", ErrClientIDMismatch, r.ClientIDScheme, r.ClientID)
+		}
+		dnsName = prefixed
+	} else if r.ClientIDScheme != ClientIDSchemeX509SANDNS {
+		return fmt.Errorf("%w: client_id %q is not an %s identifier", ErrClientIDMismatch, r.ClientID, ClientIDSchemeX509SANDNS)
+	}
+	if dnsName == "" {
+		return fmt.Errorf("%w: empty client_id", ErrClientIDMismatch)
+	}
+	for _, name := range leaf.DNSNames {
+		if strings.EqualFold(name, dnsName) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q is not a dNSName of %s", ErrClientIDMismatch, dnsName, leaf.Subject)
+}
+
+func jwsAlgorithm(pub crypto.PublicKey) (string, crypto.Hash, error) {
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return "ES256", crypto.SHA256, nil
+		case elliptic.P384():
+			return "ES384", crypto.SHA384, nil
+		case elliptic.P521():
+			return "ES512", crypto.SHA512, nil
+		}
+		return "", 0, fmt.Errorf("unsupported curve: %s", key.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return "EdDSA", 0, nil
+	}
+	return "", 0, fmt.Errorf("unsupported key type: %T", pub)
+}
+
+func verifyJWS(pub crypto.PublicKey, hash crypto.Hash, signingInput, sig []byte) bool {
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		h := hash.New()
+		h.Write(signingInput)
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(key, h.Sum(nil), r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, signingInput, sig)
+	}
+	return false
+}
+
+// rawECDSASignature converts an ASN.1 ECDSA signature to fixed size r || s.
+func rawECDSASignature(der []byte, curve elliptic.Curve) ([]byte, error) {
+	var sig struct{ R, S *big.Int }
+	if rest, err := asn1.Unmarshal(der, &sig); err != nil || len(rest) != 0 {
+		return nil, fmt.Errorf("malformed ECDSA signature")
+	}
+	size := (curve.Params().BitSize + 7) / 8
+	raw := make([]byte, 2*size)
+	sig.R.FillBytes(raw[:size])
+	sig.S.FillBytes(raw[size:])
+	return raw, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,176 @@
+package openid4vp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kokukuma/identity-credential-api-demo/mdoc"
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+)
+
+// newVerifierCertificate issues a certificate for key with dnsNames from a new root.
+func newVerifierCertificate(t *testing.T, now time.Time, key crypto.Signer, dnsNames ...string) ([]*x509.Certificate, *x509.CertPool) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Verifier CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Test Verifier"},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	return []*x509.Certificate{leaf, ca}, roots
+}
+
+func TestSignRequestObject(t *testing.T) {
+	now := time.Now()
+	req := mdoc.NewDeviceRequest().AddElements(mdoc.DocTypeMDL, false, mdoc.GivenName)
+	nonce, err := protocol.CreateNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tc := range map[string]struct {
+		key      crypto.Signer
+		clientID string
+		opts     []RequestOption
+	}{
+		"Prefix":       {ecKey, "x509_san_dns:verifier.example.com", nil},
+		"LegacyScheme": {ecKey, "verifier.example.com", []RequestOption{WithClientIDScheme(ClientIDSchemeX509SANDNS)}},
+		"EdDSA":        {edKey, "x509_san_dns:verifier.example.com", nil},
+	} {
+		t.Run(name, func(t *testing.T) {
+			chain, roots := newVerifierCertificate(t, now, tc.key, "verifier.example.com")
+			idReq, err := NewIdentityRequest(tc.clientID, nonce, req, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			compact, err := idReq.SignRequestObject(tc.key, chain)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got, gotChain, err := ParseRequestObject(compact, roots, now)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.ClientID != tc.clientID || got.Nonce != nonce.String() || len(gotChain) != 2 {
+				t.Fatalf("unexpected request %+v", got)
+			}
+		})
+	}
+
+	t.Run("SANMismatch", func(t *testing.T) {
+		chain, _ := newVerifierCertificate(t, now, ecKey, "other.example.com")
+		idReq, err := NewIdentityRequest("x509_san_dns:verifier.example.com", nonce, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := idReq.SignRequestObject(ecKey, chain); !errors.Is(err, ErrClientIDMismatch) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("SchemeMismatch", func(t *testing.T) {
+		chain, _ := newVerifierCertificate(t, now, ecKey, "verifier.example.com")
+		idReq, err := NewIdentityRequest("verifier.example.com", nonce, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := idReq.SignRequestObject(ecKey, chain); !errors.Is(err, ErrClientIDMismatch) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("KeyMismatch", func(t *testing.T) {
+		chain, _ := newVerifierCertificate(t, now, edKey, "verifier.example.com")
+		idReq, err := NewIdentityRequest("x509_san_dns:verifier.example.com", nonce, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := idReq.SignRequestObject(ecKey, chain); !errors.Is(err, ErrInvalidRequestObject) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		chain, roots := newVerifierCertificate(t, now, ecKey, "verifier.example.com")
+		idReq, err := NewIdentityRequest("x509_san_dns:verifier.example.com", nonce, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compact, err := idReq.SignRequestObject(ecKey, chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts := strings.Split(compact, ".")
+		parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"client_id":"x509_san_dns:verifier.example.com","nonce":"forged"}`))
+		if _, _, err := ParseRequestObject(strings.Join(parts, "."), roots, now); !errors.Is(err, ErrInvalidRequestObject) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("UntrustedRoot", func(t *testing.T) {
+		chain, _ := newVerifierCertificate(t, now, ecKey, "verifier.example.com")
+		_, roots := newVerifierCertificate(t, now, ecKey, "verifier.example.com")
+		idReq, err := NewIdentityRequest("x509_san_dns:verifier.example.com", nonce, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compact, err := idReq.SignRequestObject(ecKey, chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := ParseRequestObject(compact, roots, now); err == nil {
+			t.Fatal("verified a request object from an untrusted root")
+		}
+	})
+}
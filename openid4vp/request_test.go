@@ -0,0 +1,101 @@
+package openid4vp
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/kokukuma/identity-credential-api-demo/mdoc"
+)
+
+func TestBeginIdentityRequest(t *testing.T) {
+	req := mdoc.NewDeviceRequest().
+		AddElements(mdoc.DocTypeMDL, false, mdoc.GivenName, mdoc.FamilyName).
+		AddElements(mdoc.DocTypeMDL, true, mdoc.BirthDate)
+
+	idReq, session, err := BeginIdentityRequest("example.com", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idReq.Nonce != session.Nonce.String() || session.PrivateKey == nil {
+		t.Fatalf("session does not match the request: %v", idReq.Nonce)
+	}
+
+	data, err := json.Marshal(idReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var request struct {
+		ClientID               string          `json:"client_id"`
+		ResponseType           string          `json:"response_type"`
+		ClientMetadata         json.RawMessage `json:"client_metadata"`
+		PresentationDefinition struct {
+			InputDescriptors []struct {
+				ID          string `json:"id"`
+				Constraints struct {
+					LimitDisclosure string `json:"limit_disclosure"`
+					Fields          []struct {
+						Path           []string `json:"path"`
+						IntentToRetain bool     `json:"intent_to_retain"`
+					} `json:"fields"`
+				} `json:"constraints"`
+			} `json:"input_descriptors"`
+		} `json:"presentation_definition"`
+	}
+	if err := json.Unmarshal(data, &request); err != nil {
+		t.Fatal(err)
+	}
+	if request.ClientID != "example.com" || request.ResponseType != "vp_token" || request.ClientMetadata != nil {
+		t.Fatalf("unexpected request: %s", data)
+	}
+	descriptors := request.PresentationDefinition.InputDescriptors
+	if len(descriptors) != 1 || descriptors[0].ID != string(mdoc.DocTypeMDL) || descriptors[0].Constraints.LimitDisclosure != "required" {
+		t.Fatalf("unexpected input descriptors: %s", data)
+	}
+	fields := descriptors[0].Constraints.Fields
+	if len(fields) != 3 {
+		t.Fatalf("unexpected fields: %s", data)
+	}
+	for i, want := range []string{
+		"$['org.iso.18013.5.1']['birth_date']",
+		"$['org.iso.18013.5.1']['family_name']",
+		"$['org.iso.18013.5.1']['given_name']",
+	} {
+		if fields[i].Path[0] != want || fields[i].IntentToRetain != (i == 0) {
+			t.Fatalf("field %d: got %v %v", i, fields[i].Path, fields[i].IntentToRetain)
+		}
+	}
+
+	t.Run("EncryptedResponse", func(t *testing.T) {
+		idReq, session, err := BeginIdentityRequest("example.com", req, WithResponseMode(ResponseModeDirectPostJWT))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if idReq.ResponseMode != ResponseModeDirectPostJWT || idReq.ClientMetadata == nil {
+			t.Fatalf("unexpected request: %+v", idReq)
+		}
+		pub, err := idReq.ClientMetadata.JWKS.Keys[0].PublicKey()
+		if err != nil || !pub.Equal(session.PrivateKey.PublicKey()) {
+			t.Fatalf("client_metadata does not carry the session key: %v", err)
+		}
+	})
+
+	t.Run("Algorithms", func(t *testing.T) {
+		if alg := idReq.PresentationDefinition.InputDescriptors[0].Format.MsoMdoc.Alg; len(alg) != 1 || alg[0] != "ES256" {
+			t.Fatalf("unexpected default alg %v", alg)
+		}
+		idReq, _, err := BeginIdentityRequest("example.com", req, WithAlgorithms("ES256", "EdDSA"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if alg := idReq.PresentationDefinition.InputDescriptors[0].Format.MsoMdoc.Alg; len(alg) != 2 || alg[1] != "EdDSA" {
+			t.Fatalf("unexpected alg %v", alg)
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		if _, _, err := BeginIdentityRequest("example.com", mdoc.NewDeviceRequest()); !errors.Is(err, ErrEmptyRequest) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,212 @@
+package openid4vp
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+)
+
+// Requests passed by reference, RFC 9101 section 5.2 and OpenID4VP section 5.10.
+
+var (
+	ErrRequestObjectNotFound = errors.New("request object not found")
+	ErrUnsupportedWallet     = errors.New("wallet does not support the request object")
+)
+
+// request_uri_method values. With post, the wallet sends its metadata and a wallet_nonce,
+// which goes into the request object it gets back.
+const (
+	RequestURIMethodGet  = "get"
+	RequestURIMethodPost = "post"
+)
+
+const RequestObjectContentType = "application/oauth-authz-req+jwt"
+
+// RequestByReference is the authorization request the wallet gets instead of the request
+// object, which it fetches from RequestURI.
+type RequestByReference struct {
+	ClientID         string `json:"client_id"`
+	RequestURI       string `json:"request_uri"`
+	RequestURIMethod string `json:"request_uri_method,omitempty"`
+}
+
+// WalletMetadata is the wallet_metadata a wallet posts to the request_uri. Only what the
+// request object depends on is decoded.
+type WalletMetadata struct {
+	RequestObjectSigningAlgValuesSupported []string `json:"request_object_signing_alg_values_supported,omitempty"`
+}
+
+// RequestObjects keeps the requests of open sessions until their wallet fetches them,
+// once, from the request_uri, and signs them with key and chain as SignRequestObject.
+type RequestObjects struct {
+	mu      sync.Mutex
+	key     crypto.Signer
+	chain   []*x509.Certificate
+	ttl     time.Duration
+	objects map[string]storedRequest
+	now     func() time.Time
+}
+
+type storedRequest struct {
+	request *IdentityRequestOpenID4VP
+	expiry  time.Time
+}
+
+func NewRequestObjects(key crypto.Signer, chain []*x509.Certificate, ttl time.Duration) *RequestObjects {
+	return &RequestObjects{
+		key:     key,
+		chain:   chain,
+		ttl:     ttl,
+		objects: map[string]storedRequest{},
+		now:     time.Now,
+	}
+}
+
+// Store keeps idReq for the store's ttl and returns the request referring to it, at
+// requestURI with an id query parameter added. method is RequestURIMethodGet or
+// RequestURIMethodPost.
+func (o *RequestObjects) Store(idReq *IdentityRequestOpenID4VP, requestURI, method string) (*RequestByReference, error) {
+	if method != RequestURIMethodGet && method != RequestURIMethodPost {
+		return nil, fmt.Errorf("unsupported request_uri_method: %q", method)
+	}
+	uri, err := url.Parse(requestURI)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request_uri: %v", err)
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	id := base64.RawURLEncoding.EncodeToString(b)
+	query := uri.Query()
+	query.Set("id", id)
+	uri.RawQuery = query.Encode()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := o.now()
+	// Requests that are never fetched would pile up otherwise.
+	for key, stored := range o.objects {
+		if !now.Before(stored.expiry) {
+			delete(o.objects, key)
+		}
+	}
+	o.objects[id] = storedRequest{request: idReq, expiry: now.Add(o.ttl)}
+
+	ref := &RequestByReference{ClientID: idReq.ClientID, RequestURI: uri.String()}
+	// get is the default, RFC 9101.
+	if method == RequestURIMethodPost {
+		ref.RequestURIMethod = method
+	}
+	return ref, nil
+}
+
+// take removes and returns the request of id, unless it expired.
+func (o *RequestObjects) take(id string) (storedRequest, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	stored, ok := o.objects[id]
+	if !ok {
+		return storedRequest{}, ErrRequestObjectNotFound
+	}
+	delete(o.objects, id)
+	if !o.now().Before(stored.expiry) {
+		return storedRequest{}, fmt.Errorf("%w: expired at %s", ErrRequestObjectNotFound, stored.expiry.Format(time.RFC3339))
+	}
+	return stored, nil
+}
+
+// restore puts back a request take returned, for the wallet to fetch it again.
+func (o *RequestObjects) restore(id string, stored storedRequest) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.objects[id] = stored
+}
+
+// ServeHTTP serves the request_uri: the signed request object of the id query parameter,
+// to a GET or to a POST of wallet_metadata and wallet_nonce.
+func (o *RequestObjects) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var walletNonce string
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			writeRequestURIError(w, http.StatusBadRequest, "invalid_request", err)
+			return
+		}
+		if err := o.checkWalletMetadata(r.PostForm.Get("wallet_metadata")); err != nil {
+			writeRequestURIError(w, http.StatusBadRequest, "invalid_request", err)
+			return
+		}
+		walletNonce = r.PostForm.Get("wallet_nonce")
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	stored, err := o.take(id)
+	if err != nil {
+		writeRequestURIError(w, http.StatusNotFound, "invalid_request_uri", err)
+		return
+	}
+	withNonce := *stored.request
+	withNonce.WalletNonce = walletNonce
+	requestObject, err := withNonce.SignRequestObject(o.key, o.chain)
+	if err != nil {
+		// The wallet has not got the request yet, it may try again.
+		o.restore(id, stored)
+		writeRequestURIError(w, http.StatusInternalServerError, "server_error", err)
+		return
+	}
+	w.Header().Set("Content-Type", RequestObjectContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(requestObject))
+}
+
+// checkWalletMetadata checks that the wallet verifies the signature of the request
+// object, if it lists the algorithms it does.
+func (o *RequestObjects) checkWalletMetadata(data string) error {
+	if data == "" {
+		return nil
+	}
+	var metadata WalletMetadata
+	if err := json.Unmarshal([]byte(data), &metadata); err != nil {
+		return fmt.Errorf("failed to parse wallet_metadata: %v", err)
+	}
+	if len(metadata.RequestObjectSigningAlgValuesSupported) == 0 {
+		return nil
+	}
+	alg, _, err := jwsAlgorithm(o.key.Public())
+	if err != nil {
+		return err
+	}
+	for _, supported := range metadata.RequestObjectSigningAlgValuesSupported {
+		if supported == alg {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s is not in request_object_signing_alg_values_supported", ErrUnsupportedWallet, alg)
+}
+
+func writeRequestURIError(w http.ResponseWriter, code int, errorCode string, err error) {
+	protocol.Log.Warn("request object not served", "error", err.Error())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{errorCode, protocol.PublicMessage(err)})
+}
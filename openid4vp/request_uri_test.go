@@ -0,0 +1,163 @@
+package openid4vp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kokukuma/identity-credential-api-demo/mdoc"
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+)
+
+func TestRequestObjects(t *testing.T) {
+	now := time.Now()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, roots := newVerifierCertificate(t, now, key, "verifier.example.com")
+	objects := NewRequestObjects(key, chain, time.Minute)
+
+	nonce, err := protocol.CreateNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := mdoc.NewDeviceRequest().AddElements(mdoc.DocTypeMDL, false, mdoc.GivenName)
+	idReq, err := NewIdentityRequest("x509_san_dns:verifier.example.com", nonce, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fetch sends the request of ref to objects as the wallet does.
+	fetch := func(t *testing.T, ref *RequestByReference, form url.Values) *httptest.ResponseRecorder {
+		var r *http.Request
+		if form == nil {
+			r = httptest.NewRequest(http.MethodGet, ref.RequestURI, nil)
+		} else {
+			r = httptest.NewRequest(http.MethodPost, ref.RequestURI, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		w := httptest.NewRecorder()
+		objects.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("Get", func(t *testing.T) {
+		ref, err := objects.Store(idReq, "https://verifier.example.com/request_object", RequestURIMethodGet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ref.ClientID != idReq.ClientID || ref.RequestURIMethod != "" {
+			t.Fatalf("unexpected reference %+v", ref)
+		}
+		w := fetch(t, ref, nil)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != RequestObjectContentType {
+			t.Fatalf("got %d %s", w.Code, w.Body)
+		}
+		got, _, err := ParseRequestObject(w.Body.String(), roots, now)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got.Nonce != idReq.Nonce || got.WalletNonce != "" {
+			t.Fatalf("unexpected request %+v", got)
+		}
+
+		// A request object is served once.
+		if w := fetch(t, ref, nil); w.Code != http.StatusNotFound {
+			t.Fatalf("got %d %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("Post", func(t *testing.T) {
+		ref, err := objects.Store(idReq, "https://verifier.example.com/request_object", RequestURIMethodPost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ref.RequestURIMethod != RequestURIMethodPost {
+			t.Fatalf("unexpected reference %+v", ref)
+		}
+		w := fetch(t, ref, url.Values{
+			"wallet_metadata": {`{"request_object_signing_alg_values_supported":["ES256","EdDSA"]}`},
+			"wallet_nonce":    {"wallet-nonce"},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d %s", w.Code, w.Body)
+		}
+		got, _, err := ParseRequestObject(w.Body.String(), roots, now)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got.WalletNonce != "wallet-nonce" || idReq.WalletNonce != "" {
+			t.Fatalf("unexpected wallet_nonce %q", got.WalletNonce)
+		}
+	})
+
+	t.Run("UnsupportedAlg", func(t *testing.T) {
+		ref, err := objects.Store(idReq, "https://verifier.example.com/request_object", RequestURIMethodPost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := fetch(t, ref, url.Values{"wallet_metadata": {`{"request_object_signing_alg_values_supported":["EdDSA"]}`}})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("got %d %s", w.Code, w.Body)
+		}
+		// The request is kept for a wallet that supports it.
+		if w := fetch(t, ref, nil); w.Code != http.StatusOK {
+			t.Fatalf("got %d %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		ref, err := objects.Store(idReq, "https://verifier.example.com/request_object", RequestURIMethodGet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+		defer func() { objects.now = time.Now }()
+		w := fetch(t, ref, nil)
+		body, _ := io.ReadAll(w.Body)
+		if w.Code != http.StatusNotFound || !strings.Contains(string(body), "invalid_request_uri") {
+			t.Fatalf("got %d %s", w.Code, body)
+		}
+	})
+
+	t.Run("SignFailure", func(t *testing.T) {
+		ref, err := objects.Store(idReq, "https://verifier.example.com/request_object", RequestURIMethodGet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects.key = failingSigner{key}
+		w := fetch(t, ref, nil)
+		objects.key = key
+		if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "HSM") {
+			t.Fatalf("got %d %s", w.Code, w.Body)
+		}
+		// The request is kept for the wallet to try again.
+		if w := fetch(t, ref, nil); w.Code != http.StatusOK {
+			t.Fatalf("got %d %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("UnsupportedMethod", func(t *testing.T) {
+		if _, err := objects.Store(idReq, "https://verifier.example.com/request_object", "put"); err == nil {
+			t.Fatal("stored a request with request_uri_method put")
+		}
+	})
+}
+
+type failingSigner struct {
+	crypto.Signer
+}
+
+func (s failingSigner) Sign(io.Reader, []byte, crypto.SignerOpts) ([]byte, error) {
+	return nil, errors.New("HSM unavailable")
+}
@@ -3,7 +3,7 @@ package openid4vp
 import (
 	"fmt"
 
-	"github.com/fxamacker/cbor/v2"
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
 )
 
 // TODO: session transcript: 9.1.5.1 Session transcript
@@ -21,6 +21,12 @@ type Details struct {
 }
 
 func generateBrowserSessionTranscript(nonce []byte, origin string, requesterIdHash []byte) ([]byte, error) {
+	// The browser hashes its own serialization of the origin, so ours has to match byte for byte.
+	origin, err := protocol.NormalizeOrigin(origin)
+	if err != nil {
+		return nil, err
+	}
+
 	originInfo := OriginInfo{
 		Cat:  1,
 		Type: 1,
@@ -28,7 +34,7 @@ func generateBrowserSessionTranscript(nonce []byte, origin string, requesterIdHa
 			BaseURL: origin,
 		},
 	}
-	originInfoBytes, err := cbor.Marshal(originInfo)
+	originInfoBytes, err := protocol.EncMode.Marshal(originInfo)
 	if err != nil {
 		return nil, fmt.Errorf("error encoding origin info: %v", err)
 	}
@@ -45,7 +51,80 @@ func generateBrowserSessionTranscript(nonce []byte, origin string, requesterIdHa
 		},
 	}
 
-	transcript, err := cbor.Marshal(browserHandover)
+	transcript, err := protocol.EncMode.Marshal(browserHandover)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding transcript: %v", err)
+	}
+
+	return transcript, nil
+}
+
+const DCAPI_HANDOVER = "OpenID4VPDCAPIHandover"
+
+// GenerateDCAPISessionTranscript returns the SessionTranscript of an mdoc presented with
+// OpenID4VP over the Digital Credentials API, OpenID4VP 1.0 B.2.6.2. The handover only
+// carries a hash of origin, nonce and jwkThumbprint, the JWK SHA-256 thumbprint of the
+// verifier's encryption key or nil when the response is not encrypted.
+func GenerateDCAPISessionTranscript(origin, nonce string, jwkThumbprint []byte) ([]byte, error) {
+	// The browser passes its own serialization of the origin to the wallet.
+	origin, err := protocol.NormalizeOrigin(origin)
+	if err != nil {
+		return nil, err
+	}
+
+	var thumbprint interface{}
+	if jwkThumbprint != nil {
+		thumbprint = jwkThumbprint
+	}
+	handoverInfo, err := protocol.EncMode.Marshal([]interface{}{origin, nonce, thumbprint})
+	if err != nil {
+		return nil, fmt.Errorf("error encoding handover info: %v", err)
+	}
+
+	dcapiHandover := []interface{}{
+		nil, // DeviceEngagementBytes
+		nil, // EReaderKeyBytes
+		[]interface{}{ // OpenID4VPDCAPIHandover
+			DCAPI_HANDOVER,
+			protocol.DigestSHA256(handoverInfo),
+		},
+	}
+
+	transcript, err := protocol.EncMode.Marshal(dcapiHandover)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding transcript: %v", err)
+	}
+
+	return transcript, nil
+}
+
+// OID4VP_HANDOVER selects the OID4VPHandover of GenerateOID4VPSessionTranscript in an Expectation.
+const OID4VP_HANDOVER = "OID4VPHandover"
+
+// GenerateOID4VPSessionTranscript returns the SessionTranscript of an mdoc presented over
+// redirect-based OpenID4VP, ISO/IEC 18013-7 Annex B.4.4. mdocGeneratedNonce is the apu of
+// the JWE carrying the response.
+func GenerateOID4VPSessionTranscript(clientID, responseURI, nonce, mdocGeneratedNonce string) ([]byte, error) {
+	clientIDToHash, err := protocol.EncMode.Marshal([]interface{}{clientID, mdocGeneratedNonce})
+	if err != nil {
+		return nil, fmt.Errorf("error encoding client id: %v", err)
+	}
+	responseURIToHash, err := protocol.EncMode.Marshal([]interface{}{responseURI, mdocGeneratedNonce})
+	if err != nil {
+		return nil, fmt.Errorf("error encoding response uri: %v", err)
+	}
+
+	oid4vpHandover := []interface{}{
+		nil, // DeviceEngagementBytes
+		nil, // EReaderKeyBytes
+		[]interface{}{ // OID4VPHandover
+			protocol.DigestSHA256(clientIDToHash),
+			protocol.DigestSHA256(responseURIToHash),
+			nonce,
+		},
+	}
+
+	transcript, err := protocol.EncMode.Marshal(oid4vpHandover)
 	if err != nil {
 		return nil, fmt.Errorf("error encoding transcript: %v", err)
 	}
@@ -0,0 +1,81 @@
+package openid4vp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestGenerateOID4VPSessionTranscript(t *testing.T) {
+	transcript, err := GenerateOID4VPSessionTranscript("example.com", "https://example.com/response", "nonce", "mdocnonce")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var decoded []interface{}
+	if err := cbor.Unmarshal(transcript, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 3 || decoded[0] != nil || decoded[1] != nil {
+		t.Fatalf("unexpected SessionTranscript: %v", decoded)
+	}
+	handover, ok := decoded[2].([]interface{})
+	if !ok || len(handover) != 3 {
+		t.Fatalf("unexpected OID4VPHandover: %v", decoded[2])
+	}
+
+	clientIDToHash, _ := cbor.Marshal([]interface{}{"example.com", "mdocnonce"})
+	clientIDHash := sha256.Sum256(clientIDToHash)
+	if !bytes.Equal(handover[0].([]byte), clientIDHash[:]) {
+		t.Fatalf("unexpected clientIdHash: %x", handover[0])
+	}
+	responseURIToHash, _ := cbor.Marshal([]interface{}{"https://example.com/response", "mdocnonce"})
+	responseURIHash := sha256.Sum256(responseURIToHash)
+	if !bytes.Equal(handover[1].([]byte), responseURIHash[:]) {
+		t.Fatalf("unexpected responseUriHash: %x", handover[1])
+	}
+	if handover[2] != "nonce" {
+		t.Fatalf("unexpected nonce: %v", handover[2])
+	}
+
+	other, err := GenerateOID4VPSessionTranscript("example.com", "https://example.com/response", "nonce", "othernonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(transcript, other) {
+		t.Fatal("mdocGeneratedNonce does not change the transcript")
+	}
+}
+
+func TestGenerateDCAPISessionTranscript(t *testing.T) {
+	transcript, err := GenerateDCAPISessionTranscript("https://example.com:443", "nonce", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var decoded []interface{}
+	if err := cbor.Unmarshal(transcript, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	handover, ok := decoded[2].([]interface{})
+	if len(decoded) != 3 || decoded[0] != nil || decoded[1] != nil || !ok || len(handover) != 2 || handover[0] != DCAPI_HANDOVER {
+		t.Fatalf("unexpected SessionTranscript: %v", decoded)
+	}
+
+	// The default port is dropped, as the browser serializes the origin.
+	info, _ := cbor.Marshal([]interface{}{"https://example.com", "nonce", nil})
+	infoHash := sha256.Sum256(info)
+	if !bytes.Equal(handover[1].([]byte), infoHash[:]) {
+		t.Fatalf("unexpected OpenID4VPDCAPIHandoverInfoHash: %x", handover[1])
+	}
+
+	encrypted, err := GenerateDCAPISessionTranscript("https://example.com", "nonce", []byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(transcript, encrypted) {
+		t.Fatal("jwkThumbprint does not change the transcript")
+	}
+}
@@ -0,0 +1,121 @@
+package openid4vp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/kokukuma/identity-credential-api-demo/mdoc"
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+)
+
+// Expectation is what a response must be bound to, taken from its request and session.
+type Expectation struct {
+	Origin string
+	// ClientID is hashed into the BrowserHandoverv1.
+	ClientID string
+	// Handover is BROWSER_HANDOVER_V1, DCAPI_HANDOVER or OID4VP_HANDOVER.
+	Handover string
+	Session  *protocol.SessionData
+	// State and ResponseURI are those of a direct_post.jwt request, see ParseDirectPostJWT.
+	State       string
+	ResponseURI string
+}
+
+// Result is a decoded OpenID4VP response, like apple_hpke.Result for the Apple flow.
+type Result struct {
+	DeviceResponse    *mdoc.DeviceResponse
+	SessionTranscript []byte
+	// Responses are the DeviceResponses by DCQL credential id, see DCQLQuery.CheckResponse.
+	// A vp_token that is not a map has its responses under "".
+	Responses map[string]*mdoc.DeviceResponse
+	// Encrypted is set for a response sent as a JWE, response_mode dc_api.jwt.
+	Encrypted bool
+}
+
+// encryptedResponse is the body of a dc_api.jwt response.
+type encryptedResponse struct {
+	Response string `json:"response"`
+}
+
+// Parse decodes a response to the request of exp.Session. An encrypted response is first
+// decrypted with the session key, whose JWK thumbprint then goes into the DCAPI handover.
+func Parse(data string, exp Expectation) (*Result, error) {
+	var encrypted encryptedResponse
+	if err := json.Unmarshal([]byte(data), &encrypted); err != nil {
+		return nil, fmt.Errorf("failed to parse data as JSON")
+	}
+	if encrypted.Response != "" {
+		resp, err := decryptAuthorizationResponse(encrypted.Response, exp.Session)
+		if err != nil {
+			return nil, err
+		}
+		return exp.result(resp, true)
+	}
+
+	var msg OpenID4VPData
+	if err := json.Unmarshal([]byte(data), &msg); err != nil {
+		return nil, fmt.Errorf("failed to parse data as JSON")
+	}
+	return exp.result(&AuthorizationResponse{VPToken: msg.VPToken}, false)
+}
+
+// result decodes the vp_token of resp and makes the SessionTranscript it must be bound to.
+func (exp Expectation) result(resp *AuthorizationResponse, encrypted bool) (*Result, error) {
+	result := Result{Encrypted: encrypted}
+
+	responses, err := ParseDCQLDeviceResponses(resp.VPToken)
+	if err != nil {
+		return nil, err
+	}
+	result.Responses = responses
+	// All responses are bound to the same session, so their documents are verified together,
+	// in credential id order as ParseVPToken returns them.
+	ids := make([]string, 0, len(responses))
+	for id := range responses {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	ordered := make([]*mdoc.DeviceResponse, 0, len(ids))
+	for _, id := range ids {
+		ordered = append(ordered, responses[id])
+	}
+	result.DeviceResponse = mergeDeviceResponses(ordered)
+
+	switch exp.Handover {
+	case BROWSER_HANDOVER_V1:
+		result.SessionTranscript, err = generateBrowserSessionTranscript(exp.Session.GetNonceByte(), exp.Origin, protocol.DigestSHA256([]byte(exp.ClientID)))
+	case DCAPI_HANDOVER:
+		var thumbprint []byte
+		if result.Encrypted {
+			jwk, err := protocol.NewJWK(exp.Session.GetPrivateKey().PublicKey())
+			if err != nil {
+				return nil, err
+			}
+			if thumbprint, err = jwk.Thumbprint(); err != nil {
+				return nil, err
+			}
+		}
+		// The wallet hashes the nonce as sent in the request.
+		result.SessionTranscript, err = GenerateDCAPISessionTranscript(exp.Origin, exp.Session.Nonce.String(), thumbprint)
+	case OID4VP_HANDOVER:
+		result.SessionTranscript, err = GenerateOID4VPSessionTranscript(exp.ClientID, exp.ResponseURI, exp.Session.Nonce.String(), resp.MdocGeneratedNonce)
+	default:
+		return nil, fmt.Errorf("unsupported handover: %q", exp.Handover)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aad: %v", err)
+	}
+	return &result, nil
+}
+
+// Verify parses data and verifies every document with verifier against the SessionTranscript,
+// returning the same per-document results as the Apple flow.
+func Verify(ctx context.Context, verifier *mdoc.Verifier, data string, exp Expectation) (*Result, []mdoc.DocumentResult, error) {
+	result, err := Parse(data, exp)
+	if err != nil {
+		return nil, nil, err
+	}
+	return result, verifier.VerifyResponse(ctx, result.DeviceResponse, result.SessionTranscript), nil
+}
@@ -0,0 +1,124 @@
+package openid4vp
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/kokukuma/identity-credential-api-demo/mdoc"
+	"github.com/kokukuma/identity-credential-api-demo/mdoc/mdoctest"
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+)
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	origin := "https://verifier.example"
+
+	issuer, err := mdoctest.NewIssuer(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cred, err := issuer.Issue(mdoc.DocTypeMDL, mdoctest.MDL(), mdoctest.Validity(time.Now(), time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred, err = cred.Disclose(mdoctest.NameSpaceMDL, "given_name", "family_name"); err != nil {
+		t.Fatal(err)
+	}
+	verifier := mdoc.NewVerifier(issuer.Roots())
+
+	// vpToken presents cred for sessionTranscript under the DCQL credential id of the mDL.
+	vpToken := func(t *testing.T, sessionTranscript []byte) []byte {
+		doc, err := cred.Present(sessionTranscript)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := mdoctest.EncodeDeviceResponse(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(map[string]interface{}{
+			"vp_token": map[string]string{"org_iso_18013_5_1_mDL": base64.RawURLEncoding.EncodeToString(resp)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	req := mdoc.NewDeviceRequest().AddElements(mdoc.DocTypeMDL, false, mdoc.GivenName, mdoc.FamilyName)
+
+	t.Run("Encrypted", func(t *testing.T) {
+		idReq, session, err := BeginIdentityRequest("example.com", req, WithDCQL(), WithResponseMode(ResponseModeDCAPIJWT))
+		if err != nil {
+			t.Fatal(err)
+		}
+		thumbprint, err := idReq.ClientMetadata.JWKS.Keys[0].Thumbprint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessionTranscript, err := GenerateDCAPISessionTranscript(origin, idReq.Nonce, thumbprint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jwe, err := protocol.EncryptJWE(vpToken(t, sessionTranscript), session.PrivateKey.PublicKey(), "ECDH-ES", "A128GCM", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := json.Marshal(map[string]string{"response": jwe})
+
+		exp := Expectation{Origin: origin, Handover: DCAPI_HANDOVER, Session: session}
+		result, results, err := Verify(ctx, verifier, string(data), exp)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !result.Encrypted || len(results) != 1 || results[0].Err != nil {
+			t.Fatalf("unexpected results: %+v", results)
+		}
+		if err := idReq.DCQLQuery.CheckResponse(result.Responses); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// Bound to another origin, the device signature does not verify.
+		exp.Origin = "https://attacker.example"
+		if _, results, err := Verify(ctx, verifier, string(data), exp); err != nil || results[0].Err == nil {
+			t.Fatalf("verified for another origin: %v", err)
+		}
+	})
+
+	t.Run("BrowserHandover", func(t *testing.T) {
+		_, session, err := BeginIdentityRequest("example.com", req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessionTranscript, err := generateBrowserSessionTranscript(session.GetNonceByte(), origin, protocol.DigestSHA256([]byte("example.com")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exp := Expectation{Origin: origin, ClientID: "example.com", Handover: BROWSER_HANDOVER_V1, Session: session}
+		result, results, err := Verify(ctx, verifier, string(vpToken(t, sessionTranscript)), exp)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if result.Encrypted || len(results) != 1 || results[0].Err != nil {
+			t.Fatalf("unexpected results: %+v", results)
+		}
+	})
+}
+
+func TestMergeDeviceResponses(t *testing.T) {
+	merged := mergeDeviceResponses([]*mdoc.DeviceResponse{
+		{Version: "1.0", Documents: []mdoc.Document{{DocType: mdoc.DocTypeMDL}}},
+		{Version: "1.0", Status: 20, DocumentErrors: []mdoc.DocumentError{{mdoc.DocTypeMDL: 0}}},
+		{Version: "1.1", Documents: []mdoc.Document{{DocType: mdoc.DocTypeMDL}}},
+	})
+	if merged.Version != "1.0" || merged.Status != 20 {
+		t.Fatalf("got version %s, status %d", merged.Version, merged.Status)
+	}
+	if len(merged.Documents) != 2 || len(merged.DocumentErrors) != 1 {
+		t.Fatalf("unexpected response %+v", merged)
+	}
+}
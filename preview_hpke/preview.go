@@ -6,7 +6,6 @@ import (
 	"encoding/json"
 	"fmt"
 
-	"github.com/fxamacker/cbor/v2"
 	"github.com/kokukuma/identity-credential-api-demo/mdoc"
 	"github.com/kokukuma/identity-credential-api-demo/protocol"
 )
@@ -58,36 +57,65 @@ func ParseDeviceResponse(
 	data, origin string,
 	privateKey *ecdh.PrivateKey,
 	nonceByte []byte) (*mdoc.DeviceResponse, []byte, error) {
+	result, err := Parse(data, origin, privateKey, nonceByte)
+	if err != nil {
+		return nil, nil, err
+	}
+	return result.DeviceResponse, result.SessionTranscript, nil
+}
+
+// Result is a decrypted response together with how it was decrypted.
+type Result struct {
+	DeviceResponse    *mdoc.DeviceResponse
+	SessionTranscript []byte
+	HPKE              protocol.HPKEInfo
+}
+
+// Parse decrypts a preview response and reports the HPKE suite and recipient key used.
+func Parse(
+	data, origin string,
+	privateKey *ecdh.PrivateKey,
+	nonceByte []byte) (*Result, error) {
 	var msg PreviewData
 	if err := json.Unmarshal([]byte(data), &msg); err != nil {
-		return nil, nil, fmt.Errorf("failed to parse data as JSON")
+		return nil, fmt.Errorf("failed to parse data as JSON")
 	}
 
 	decoded, err := b64.DecodeString(msg.Token)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Error decoding Base64URL string: %v", err)
+		return nil, fmt.Errorf("Error decoding Base64URL string: %v", err)
 	}
 
 	var claims AndroidHPKEV1
-	if err := cbor.Unmarshal(decoded, &claims); err != nil {
-		return nil, nil, fmt.Errorf("Error unmarshal cbor string: %v", err)
+	if err := protocol.DecMode.Unmarshal(decoded, &claims); err != nil {
+		return nil, fmt.Errorf("Error unmarshal cbor string: %v", err)
 	}
 
 	// Decrypt the ciphertext
-	sessionTranscript, err := generateBrowserSessionTranscript(nonceByte, origin, protocol.Digest(privateKey.PublicKey().Bytes(), "SHA-256"))
+	sessionTranscript, err := generateBrowserSessionTranscript(nonceByte, origin, protocol.DigestSHA256(privateKey.PublicKey().Bytes()))
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create aad: %v", err)
+		return nil, fmt.Errorf("failed to create aad: %v", err)
 	}
 
-	plaintext, err := protocol.DecryptHPKE(claims.CipherText, claims.EncryptionParameters.PKEM, sessionTranscript, privateKey)
+	suite := protocol.DefaultHPKESuite
+	// The ciphertext was copied out of the envelope while decoding, it is ours to overwrite.
+	plaintext, err := protocol.DecryptHPKEInPlace(suite, claims.CipherText, claims.EncryptionParameters.PKEM, sessionTranscript, privateKey)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Error decryptAndroidHPKEV1: %v", err)
+		return nil, fmt.Errorf("Error decryptAndroidHPKEV1: %v", err)
 	}
 
 	var deviceResp mdoc.DeviceResponse
-	if err := cbor.Unmarshal(plaintext, &deviceResp); err != nil {
-		return nil, nil, fmt.Errorf("Error unmarshal cbor string: %v", err)
+	if err := protocol.DecMode.Unmarshal(plaintext, &deviceResp); err != nil {
+		return nil, protocol.DiagnosticError(fmt.Errorf("Error unmarshal cbor string: %v", err), plaintext)
+	}
+
+	if err := deviceResp.CheckDocuments(); err != nil {
+		return nil, err
 	}
 
-	return &deviceResp, sessionTranscript, nil
+	return &Result{
+		DeviceResponse:    &deviceResp,
+		SessionTranscript: sessionTranscript,
+		HPKE:              protocol.NewHPKEInfo(suite, privateKey),
+	}, nil
 }
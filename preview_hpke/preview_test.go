@@ -1,5 +1,36 @@
 package preview_hpke
 
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
+)
+
 // ExampleConvertECDSAPublicKeyToECDH shows how to convert an ECDSA public key to an ECDH public key.
 // func ExampleConvertECDSAPublicKeyToECDH() {
 // }
+
+func TestBrowserSessionTranscript(t *testing.T) {
+	nonce := []byte("nonce")
+	requesterIdHash := protocol.DigestSHA256([]byte("key"))
+
+	want, err := generateBrowserSessionTranscript(nonce, "https://example.com", requesterIdHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, origin := range []string{"https://example.com:443", "https://example.com/", "HTTPS://EXAMPLE.COM"} {
+		got, err := generateBrowserSessionTranscript(nonce, origin, requesterIdHash)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", origin, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: handover differs from https://example.com", origin)
+		}
+	}
+
+	if _, err := generateBrowserSessionTranscript(nonce, "http://example.com", requesterIdHash); !errors.Is(err, protocol.ErrInsecureOrigin) {
+		t.Fatalf("expected ErrInsecureOrigin, got %v", err)
+	}
+}
@@ -3,7 +3,7 @@ package preview_hpke
 import (
 	"fmt"
 
-	"github.com/fxamacker/cbor/v2"
+	"github.com/kokukuma/identity-credential-api-demo/protocol"
 )
 
 const BROWSER_HANDOVER_V1 = "BrowserHandoverv1"
@@ -19,6 +19,12 @@ type Details struct {
 }
 
 func generateBrowserSessionTranscript(nonce []byte, origin string, requesterIdHash []byte) ([]byte, error) {
+	// The browser hashes its own serialization of the origin, so ours has to match byte for byte.
+	origin, err := protocol.NormalizeOrigin(origin)
+	if err != nil {
+		return nil, err
+	}
+
 	originInfo := OriginInfo{
 		Cat:  1,
 		Type: 1,
@@ -26,7 +32,7 @@ func generateBrowserSessionTranscript(nonce []byte, origin string, requesterIdHa
 			BaseURL: origin,
 		},
 	}
-	originInfoBytes, err := cbor.Marshal(originInfo)
+	originInfoBytes, err := protocol.EncMode.Marshal(originInfo)
 	if err != nil {
 		return nil, fmt.Errorf("error encoding origin info: %v", err)
 	}
@@ -43,7 +49,7 @@ func generateBrowserSessionTranscript(nonce []byte, origin string, requesterIdHa
 		},
 	}
 
-	transcript, err := cbor.Marshal(browserHandover)
+	transcript, err := protocol.EncMode.Marshal(browserHandover)
 	if err != nil {
 		return nil, fmt.Errorf("error encoding transcript: %v", err)
 	}
@@ -69,7 +75,7 @@ func generateAndroidSessionTranscript(nonce []byte, packageName string, requeste
 		androidHandover,
 	}
 
-	transcript, err := cbor.Marshal(sessionTranscript)
+	transcript, err := protocol.EncMode.Marshal(sessionTranscript)
 	if err != nil {
 		return nil, fmt.Errorf("error encoding transcript: %v", err)
 	}
@@ -0,0 +1,234 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// DecOptions bounds the structures a wallet can make us decode. A DeviceResponse has a
+// handful of documents with at most a few hundred elements, far below these limits.
+var DecOptions = cbor.DecOptions{
+	MaxNestedLevels:  24,
+	MaxArrayElements: 4096,
+	MaxMapPairs:      4096,
+}
+
+// DecMode decodes untrusted input with DecOptions.
+var DecMode, _ = NewDecMode()
+
+// BuiltinTags are the tags ISO 18013-5 gives a meaning to: tdate, encoded CBOR data item
+// and full-date. They are always decoded by this module and cannot be registered again.
+var BuiltinTags = []uint64{0, 24, 1004}
+
+var ErrBuiltinTag = errors.New("tag is built in")
+
+// DecModeOption adds to the tags of a decoder built by NewDecMode.
+type DecModeOption func(tags cbor.TagSet) error
+
+// WithTag decodes tag num, for instance a vendor extension in an element value, into
+// contentType instead of a cbor.Tag.
+func WithTag(num uint64, contentType reflect.Type, opts cbor.TagOptions) DecModeOption {
+	return func(tags cbor.TagSet) error {
+		for _, builtin := range BuiltinTags {
+			if num == builtin {
+				return fmt.Errorf("%w: %d", ErrBuiltinTag, num)
+			}
+		}
+		return tags.Add(opts, contentType, num)
+	}
+}
+
+// NewDecMode returns a decoder for untrusted input with DecOptions and the tags of opts.
+func NewDecMode(opts ...DecModeOption) (cbor.DecMode, error) {
+	tags := cbor.NewTagSet()
+	for _, opt := range opts {
+		if err := opt(tags); err != nil {
+			return nil, err
+		}
+	}
+	return DecOptions.DecModeWithTags(tags)
+}
+
+// EncMode encodes canonical CBOR (RFC 7049 3.9): shortest heads and floats, definite
+// lengths, map keys sorted length first. It is what ISO 18013-5 expects of anything hashed,
+// so encode with it rather than cbor.Marshal, which leaves map keys in iteration order.
+// This is the length-first ordering of RFC 8949 4.2.3, not the bytewise one of 4.2.1;
+// they differ only for maps mixing key types.
+var EncMode, _ = cbor.CanonicalEncOptions().EncMode()
+
+// TagEncodedCBOR wraps data, an encoded data item, as #6.24(bstr .cbor), the form
+// ISO 18013-5 signs and hashes. data is embedded as is, not re-encoded.
+func TagEncodedCBOR(data []byte) ([]byte, error) {
+	return EncMode.Marshal(cbor.Tag{Number: 24, Content: data})
+}
+
+// MarshalEncodedCBOR encodes v with EncMode and wraps it with TagEncodedCBOR.
+func MarshalEncodedCBOR(v interface{}) ([]byte, error) {
+	data, err := EncMode.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return TagEncodedCBOR(data)
+}
+
+var ErrNonCanonicalCBOR = errors.New("non-canonical CBOR")
+
+// CheckCanonical reports whether data is a single data item that EncMode would encode
+// to exactly the same bytes.
+func CheckCanonical(data []byte) error {
+	rest, err := checkCanonical(data, 0)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrNonCanonicalCBOR, len(rest))
+	}
+	return nil
+}
+
+// checkCanonical checks the data item at the start of data and returns what follows it.
+// Heads and map ordering are checked structurally, floats and simple values by re-encoding.
+func checkCanonical(data []byte, depth int) ([]byte, error) {
+	if depth > DecOptions.MaxNestedLevels {
+		return nil, fmt.Errorf("%w: nested too deep", ErrNonCanonicalCBOR)
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%w: truncated", ErrNonCanonicalCBOR)
+	}
+
+	major, ai := data[0]>>5, data[0]&0x1f
+	if major == 7 {
+		return checkCanonicalSimple(data, ai)
+	}
+
+	val, head, err := readHead(data, ai)
+	if err != nil {
+		return nil, err
+	}
+	rest := data[head:]
+
+	switch major {
+	case 0, 1: // integers
+		return rest, nil
+	case 2, 3: // byte and text strings
+		if val > uint64(len(rest)) {
+			return nil, fmt.Errorf("%w: truncated", ErrNonCanonicalCBOR)
+		}
+		return rest[val:], nil
+	case 4: // array
+		if val > uint64(len(rest)) {
+			return nil, fmt.Errorf("%w: truncated", ErrNonCanonicalCBOR)
+		}
+		for i := uint64(0); i < val; i++ {
+			if rest, err = checkCanonical(rest, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return rest, nil
+	case 5: // map
+		if val > uint64(len(rest)) {
+			return nil, fmt.Errorf("%w: truncated", ErrNonCanonicalCBOR)
+		}
+		var prevKey []byte
+		for i := uint64(0); i < val; i++ {
+			keyStart := rest
+			if rest, err = checkCanonical(rest, depth+1); err != nil {
+				return nil, err
+			}
+			key := keyStart[:len(keyStart)-len(rest)]
+			if prevKey != nil && !canonicalKeyLess(prevKey, key) {
+				return nil, fmt.Errorf("%w: map keys out of order or duplicated", ErrNonCanonicalCBOR)
+			}
+			prevKey = key
+			if rest, err = checkCanonical(rest, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return rest, nil
+	default: // tag
+		return checkCanonical(rest, depth+1)
+	}
+}
+
+// readHead returns the argument of a head and the length of the head.
+// The argument has to be in its shortest form, and indefinite lengths are not canonical.
+func readHead(data []byte, ai byte) (uint64, int, error) {
+	if ai < 24 {
+		return uint64(ai), 1, nil
+	}
+	if ai > 27 {
+		return 0, 0, fmt.Errorf("%w: indefinite length or reserved head 0x%02x", ErrNonCanonicalCBOR, data[0])
+	}
+
+	n := 1 << (ai - 24)
+	if len(data) < 1+n {
+		return 0, 0, fmt.Errorf("%w: truncated", ErrNonCanonicalCBOR)
+	}
+	var val uint64
+	for _, b := range data[1 : 1+n] {
+		val = val<<8 | uint64(b)
+	}
+
+	var min uint64
+	switch ai {
+	case 24:
+		min = 24
+	case 25:
+		min = 1 << 8
+	case 26:
+		min = 1 << 16
+	case 27:
+		min = 1 << 32
+	}
+	if val < min {
+		return 0, 0, fmt.Errorf("%w: %d not in its shortest form", ErrNonCanonicalCBOR, val)
+	}
+	return val, 1 + n, nil
+}
+
+func checkCanonicalSimple(data []byte, ai byte) ([]byte, error) {
+	switch {
+	case ai < 24:
+		return data[1:], nil
+	case ai == 24:
+		if len(data) < 2 {
+			return nil, fmt.Errorf("%w: truncated", ErrNonCanonicalCBOR)
+		}
+		if data[1] < 32 {
+			return nil, fmt.Errorf("%w: simple value %d not in its shortest form", ErrNonCanonicalCBOR, data[1])
+		}
+		return data[2:], nil
+	case ai > 27:
+		return nil, fmt.Errorf("%w: reserved or break head 0x%02x", ErrNonCanonicalCBOR, data[0])
+	}
+
+	// A float has to be the shortest one that keeps its value.
+	n := 1 + 1<<(ai-24)
+	if len(data) < n {
+		return nil, fmt.Errorf("%w: truncated", ErrNonCanonicalCBOR)
+	}
+	var f float64
+	if err := DecMode.Unmarshal(data[:n], &f); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNonCanonicalCBOR, err)
+	}
+	encoded, err := EncMode.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(encoded, data[:n]) {
+		return nil, fmt.Errorf("%w: float %x encodes as %x", ErrNonCanonicalCBOR, data[:n], encoded)
+	}
+	return data[n:], nil
+}
+
+// canonicalKeyLess orders encoded map keys shorter first, then bytewise.
+func canonicalKeyLess(a, b []byte) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return bytes.Compare(a, b) < 0
+}
@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestCheckCanonical(t *testing.T) {
+	for name, h := range map[string]string{
+		"Map":         "a2616101626262f5",   // {"a": 1, "bb": true}
+		"LengthFirst": "a26178016261610a",   // {"x": 1, "aa": 10}
+		"Tag24":       "d81843a10102",       // 24(<<{1: 2}>>)
+		"Float16":     "f93c00",             // 1.0
+		"Float64":     "fb3ff199999999999a", // 1.1
+		"Undefined":   "f7",
+		"Array":       "83011903e8a0", // [1, 1000, {}]
+	} {
+		data, _ := hex.DecodeString(h)
+		if err := CheckCanonical(data); err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+
+	for name, h := range map[string]string{
+		"UnsortedMap":    "a26262620161610a", // {"bb": 1, "a": 10}
+		"NotLengthFirst": "a262616101617802", // {"aa": 1, "x": 2}
+		"DuplicateKey":   "a2616101616102",
+		"LongInt":        "1817", // 23 in one extra byte
+		"LongLength":     "5801ff",
+		"Indefinite":     "9f01ff",
+		"WideFloat":      "fb3ff0000000000000", // 1.0 as float64
+		"Trailing":       "0101",
+		"Truncated":      "43aabb",
+		"NestedUnsorted": "81a26262620161610a",
+	} {
+		data, _ := hex.DecodeString(h)
+		if err := CheckCanonical(data); !errors.Is(err, ErrNonCanonicalCBOR) {
+			t.Errorf("%s: expected ErrNonCanonicalCBOR, got %v", name, err)
+		}
+	}
+}
+
+func TestNewDecMode(t *testing.T) {
+	type point struct {
+		X, Y int
+	}
+	typ := reflect.TypeOf(point{})
+
+	t.Run("CustomTag", func(t *testing.T) {
+		dm, err := NewDecMode(WithTag(65000, typ, cbor.TagOptions{DecTag: cbor.DecTagRequired}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := cbor.Marshal(cbor.Tag{Number: 65000, Content: point{1, 2}})
+		var v interface{}
+		if err := dm.Unmarshal(data, &v); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if v != (point{1, 2}) {
+			t.Fatalf("unexpected value: %#v", v)
+		}
+
+		// The limits of DecOptions still apply.
+		deep, _ := hex.DecodeString("8181818181818181818181818181818181818181818181818181818101")
+		if err := dm.Unmarshal(deep, &v); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	for _, num := range BuiltinTags {
+		if _, err := NewDecMode(WithTag(num, typ, cbor.TagOptions{})); !errors.Is(err, ErrBuiltinTag) {
+			t.Fatalf("tag %d: expected ErrBuiltinTag, got %v", num, err)
+		}
+	}
+}
+
+func TestMarshalEncodedCBOR(t *testing.T) {
+	// {"a": 1, "docType": "mdl", "version": "1.0"}, keys sorted however the map iterates.
+	v := map[string]interface{}{"version": "1.0", "docType": "mdl", "a": 1}
+	want := "d818581ca361610167646f6354797065636d646c6776657273696f6e63312e30"
+	for i := 0; i < 10; i++ {
+		data, err := MarshalEncodedCBOR(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(data); got != want {
+			t.Fatalf("got %s, want %s", got, want)
+		}
+	}
+
+	t.Run("TagEncodedCBOR", func(t *testing.T) {
+		// Already encoded data is embedded as is, even when not canonical.
+		data, err := TagEncodedCBOR([]byte{0x18, 0x01})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(data); got != "d818421801" {
+			t.Fatalf("got %s", got)
+		}
+	})
+}
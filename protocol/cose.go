@@ -0,0 +1,135 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"errors"
+	"fmt"
+
+	"github.com/veraison/go-cose"
+)
+
+var (
+	ErrMissingPayload       = errors.New("COSE_Sign1 has no payload")
+	ErrConflictingPayload   = errors.New("COSE_Sign1 payload differs from the external payload")
+	ErrUnknownCriticalParam = errors.New("unknown critical header parameter")
+	ErrUnprotectedAlgorithm = errors.New("alg in unprotected header")
+
+	// understoodHeaderParams are the header parameters the mdoc verification acts on,
+	// the only ones a crit header may name.
+	understoodHeaderParams = map[int64]bool{
+		cose.HeaderLabelAlgorithm: true,
+		cose.HeaderLabelKeyID:     true,
+		cose.HeaderLabelX5Chain:   true,
+	}
+)
+
+// CheckCOSEHeaders rejects headers a verifier must not ignore: a crit header naming a
+// parameter we do not process (RFC 9052 3.1), and an alg outside the protected header,
+// which could otherwise be read in place of the signed one.
+func CheckCOSEHeaders(h cose.Headers) error {
+	if _, ok := h.Unprotected[cose.HeaderLabelAlgorithm]; ok {
+		return ErrUnprotectedAlgorithm
+	}
+
+	crit, err := h.Protected.Critical()
+	if err != nil {
+		return fmt.Errorf("invalid crit header: %v", err)
+	}
+	for _, label := range crit {
+		var l int64
+		switch v := label.(type) {
+		case int64:
+			l = v
+		case int:
+			l = int64(v)
+		default:
+			return fmt.Errorf("%w: %v", ErrUnknownCriticalParam, label)
+		}
+		if !understoodHeaderParams[l] {
+			return fmt.Errorf("%w: %v", ErrUnknownCriticalParam, label)
+		}
+	}
+	return nil
+}
+
+// VerifyCOSESign1 verifies a tagged or untagged COSE_Sign1 with key.
+// A nil externalPayload verifies over the embedded payload, as for IssuerAuth.
+// Otherwise the signature is over externalPayload, as for a detached DeviceSignature,
+// and an embedded payload is only accepted if it is the same bytes.
+func VerifyCOSESign1(sign1 []byte, externalPayload []byte, key crypto.PublicKey) error {
+	var msg cose.Sign1Message
+	if len(sign1) > 0 && sign1[0] == 0xd2 { // tag 18
+		if err := msg.UnmarshalCBOR(sign1); err != nil {
+			return fmt.Errorf("failed to parse COSE_Sign1: %v", err)
+		}
+	} else {
+		var untagged cose.UntaggedSign1Message
+		if err := untagged.UnmarshalCBOR(sign1); err != nil {
+			return fmt.Errorf("failed to parse COSE_Sign1: %v", err)
+		}
+		msg = cose.Sign1Message(untagged)
+	}
+
+	if externalPayload != nil {
+		if msg.Payload != nil && !bytes.Equal(msg.Payload, externalPayload) {
+			return ErrConflictingPayload
+		}
+		// The Sig_structure covers the payload, not where it was carried, so a detached
+		// signature verifies once the external payload is put in place.
+		msg.Payload = externalPayload
+	}
+	if msg.Payload == nil {
+		return ErrMissingPayload
+	}
+
+	if err := CheckCOSEHeaders(msg.Headers); err != nil {
+		return err
+	}
+
+	alg, err := msg.Headers.Protected.Algorithm()
+	if err != nil {
+		return fmt.Errorf("failed to get alg: %v", err)
+	}
+	if err := CheckKeyAlg(alg, key); err != nil {
+		return err
+	}
+
+	verifier, err := cose.NewVerifier(alg, key)
+	if err != nil {
+		return fmt.Errorf("failed to create verifier: %v", err)
+	}
+	return msg.Verify(nil, verifier)
+}
+
+// CheckKeyAlg makes sure the alg in the protected header is one the key can actually produce,
+// so a signature can not be verified under a different algorithm than the key was made for.
+func CheckKeyAlg(alg cose.Algorithm, pubKey crypto.PublicKey) error {
+	switch key := pubKey.(type) {
+	case *ecdsa.PublicKey:
+		var curve elliptic.Curve
+		switch alg {
+		case cose.AlgorithmES256:
+			curve = elliptic.P256()
+		case cose.AlgorithmES384:
+			curve = elliptic.P384()
+		case cose.AlgorithmES512:
+			curve = elliptic.P521()
+		default:
+			return fmt.Errorf("%v signature with %s key", alg, key.Curve.Params().Name)
+		}
+		if key.Curve != curve {
+			return fmt.Errorf("%v signature with %s key", alg, key.Curve.Params().Name)
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != cose.AlgorithmEd25519 {
+			return fmt.Errorf("%v signature with Ed25519 key", alg)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type: %T", pubKey)
+}
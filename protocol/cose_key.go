@@ -0,0 +1,148 @@
+package protocol
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"fmt"
+	"math/big"
+)
+
+// RFC 9053 7.1 / 7.2
+const (
+	COSEKeyTypeOKP = 1
+	COSEKeyTypeEC2 = 2
+
+	COSECurveP256    = 1
+	COSECurveP384    = 2
+	COSECurveP521    = 3
+	COSECurveX25519  = 4
+	COSECurveEd25519 = 6
+)
+
+type coseKey struct {
+	Kty int    `cbor:"1,keyasint"`
+	Crv int    `cbor:"-1,keyasint"`
+	X   []byte `cbor:"-2,keyasint"`
+	Y   []byte `cbor:"-3,keyasint,omitempty"`
+}
+
+// ParseCOSEKey returns the public key of a COSE_Key, either an *ecdsa.PublicKey
+// for EC2 keys or an ed25519.PublicKey for OKP keys.
+func ParseCOSEKey(data []byte) (crypto.PublicKey, error) {
+	var key coseKey
+	if err := DecMode.Unmarshal(data, &key); err != nil {
+		return nil, fmt.Errorf("failed to parse COSE_Key: %v", err)
+	}
+
+	switch key.Kty {
+	case COSEKeyTypeOKP:
+		if key.Crv != COSECurveEd25519 {
+			return nil, fmt.Errorf("unsupported OKP curve: %v", key.Crv)
+		}
+		if len(key.X) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key length: %d", len(key.X))
+		}
+		return ed25519.PublicKey(key.X), nil
+
+	case COSEKeyTypeEC2:
+		var curve elliptic.Curve
+		var ecdhCurve ecdh.Curve
+		switch key.Crv {
+		case COSECurveP256:
+			curve, ecdhCurve = elliptic.P256(), ecdh.P256()
+		case COSECurveP384:
+			curve, ecdhCurve = elliptic.P384(), ecdh.P384()
+		case COSECurveP521:
+			curve, ecdhCurve = elliptic.P521(), ecdh.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %v", key.Crv)
+		}
+
+		// RFC 9053 7.1.1 keeps leading zeros, so anything but the full length is malformed.
+		byteLen := (curve.Params().BitSize + 7) / 8
+		if len(key.X) != byteLen || len(key.Y) != byteLen {
+			return nil, fmt.Errorf("invalid %s coordinate length: x %d, y %d", curve.Params().Name, len(key.X), len(key.Y))
+		}
+
+		// The point comes from the holder. Reject anything off the curve, including the
+		// point at infinity, before it gets near a scalar multiplication.
+		point := append(append([]byte{4}, key.X...), key.Y...)
+		if _, err := ecdhCurve.NewPublicKey(point); err != nil {
+			return nil, fmt.Errorf("point is not on curve %s: %v", curve.Params().Name, err)
+		}
+
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(key.X),
+			Y:     new(big.Int).SetBytes(key.Y),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type: %v", key.Kty)
+}
+
+// ParseCOSEKeyECDH is ParseCOSEKey for key agreement, e.g. with an EReaderKey or a
+// deviceKey used for deviceMac. It accepts EC2 and X25519 keys, not Ed25519 ones.
+func ParseCOSEKeyECDH(data []byte) (*ecdh.PublicKey, error) {
+	var key coseKey
+	if err := DecMode.Unmarshal(data, &key); err != nil {
+		return nil, fmt.Errorf("failed to parse COSE_Key: %v", err)
+	}
+	if key.Kty == COSEKeyTypeOKP && key.Crv == COSECurveX25519 {
+		pub, err := ecdh.X25519().NewPublicKey(key.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid X25519 key: %v", err)
+		}
+		return pub, nil
+	}
+
+	pub, err := ParseCOSEKey(data)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%T cannot be used for key agreement", pub)
+	}
+	return ecdsaPub.ECDH()
+}
+
+// MarshalCOSEKey encodes an *ecdsa.PublicKey, ed25519.PublicKey or *ecdh.PublicKey as a
+// COSE_Key, e.g. a deviceKey or the EReaderKey of a SessionEstablishment.
+func MarshalCOSEKey(pub crypto.PublicKey) ([]byte, error) {
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		return EncMode.Marshal(coseKey{Kty: COSEKeyTypeOKP, Crv: COSECurveEd25519, X: pub})
+	case *ecdsa.PublicKey:
+		ecdhPub, err := pub.ECDH()
+		if err != nil {
+			return nil, fmt.Errorf("unsupported key: %v", err)
+		}
+		return MarshalCOSEKey(ecdhPub)
+	case *ecdh.PublicKey:
+		var crv int
+		switch pub.Curve() {
+		case ecdh.X25519():
+			return EncMode.Marshal(coseKey{Kty: COSEKeyTypeOKP, Crv: COSECurveX25519, X: pub.Bytes()})
+		case ecdh.P256():
+			crv = COSECurveP256
+		case ecdh.P384():
+			crv = COSECurveP384
+		case ecdh.P521():
+			crv = COSECurveP521
+		default:
+			return nil, fmt.Errorf("unsupported curve: %v", pub.Curve())
+		}
+		// Uncompressed point, 0x04 || X || Y.
+		point := pub.Bytes()[1:]
+		return EncMode.Marshal(coseKey{
+			Kty: COSEKeyTypeEC2,
+			Crv: crv,
+			X:   point[:len(point)/2],
+			Y:   point[len(point)/2:],
+		})
+	}
+	return nil, fmt.Errorf("unsupported key type: %T", pub)
+}
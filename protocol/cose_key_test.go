@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestParseCOSEKey(t *testing.T) {
+	t.Run("Ed25519", func(t *testing.T) {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := cbor.Marshal(map[int]interface{}{1: COSEKeyTypeOKP, -1: COSECurveEd25519, -2: []byte(pub)})
+
+		key, err := ParseCOSEKey(data)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !pub.Equal(key) {
+			t.Fatalf("unexpected key: %v", key)
+		}
+	})
+
+	t.Run("P256", func(t *testing.T) {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := cbor.Marshal(map[int]interface{}{1: COSEKeyTypeEC2, -1: COSECurveP256, -2: priv.X.FillBytes(make([]byte, 32)), -3: priv.Y.FillBytes(make([]byte, 32))})
+
+		key, err := ParseCOSEKey(data)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !priv.PublicKey.Equal(key) {
+			t.Fatalf("unexpected key: %v", key)
+		}
+	})
+
+	t.Run("NotOnCurve", func(t *testing.T) {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		y := priv.Y.FillBytes(make([]byte, 32))
+		y[31] ^= 0x01
+		data, _ := cbor.Marshal(map[int]interface{}{1: COSEKeyTypeEC2, -1: COSECurveP256, -2: priv.X.FillBytes(make([]byte, 32)), -3: y})
+		if _, err := ParseCOSEKey(data); err == nil {
+			t.Fatal("accepted a point that is not on the curve")
+		}
+	})
+
+	t.Run("Infinity", func(t *testing.T) {
+		data, _ := cbor.Marshal(map[int]interface{}{1: COSEKeyTypeEC2, -1: COSECurveP256, -2: make([]byte, 32), -3: make([]byte, 32)})
+		if _, err := ParseCOSEKey(data); err == nil {
+			t.Fatal("accepted the point at infinity")
+		}
+	})
+
+	t.Run("ShortCoordinate", func(t *testing.T) {
+		data, _ := cbor.Marshal(map[int]interface{}{1: COSEKeyTypeEC2, -1: COSECurveP256, -2: []byte{1}, -3: []byte{2}})
+		if _, err := ParseCOSEKey(data); err == nil {
+			t.Fatal("accepted a truncated coordinate")
+		}
+	})
+
+	t.Run("UnsupportedOKPCurve", func(t *testing.T) {
+		// X25519 is a key agreement curve, not a signature one.
+		data, _ := cbor.Marshal(map[int]interface{}{1: COSEKeyTypeOKP, -1: 4, -2: make([]byte, 32)})
+		if _, err := ParseCOSEKey(data); err == nil {
+			t.Fatal("accepted an X25519 key")
+		}
+	})
+}
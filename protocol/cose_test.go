@@ -0,0 +1,211 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/veraison/go-cose"
+)
+
+func signCOSESign1(t *testing.T, key *ecdsa.PrivateKey, payload []byte, detached, tagged bool) []byte {
+	signer, err := cose.NewSigner(cose.AlgorithmES256, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := cose.Sign1Message{
+		Headers: cose.Headers{
+			Protected: cose.ProtectedHeader{cose.HeaderLabelAlgorithm: cose.AlgorithmES256},
+		},
+		Payload: payload,
+	}
+	if err := msg.Sign(rand.Reader, nil, signer); err != nil {
+		t.Fatal(err)
+	}
+	if detached {
+		msg.Payload = nil
+	}
+
+	var data []byte
+	if tagged {
+		data, err = msg.MarshalCBOR()
+	} else {
+		untagged := cose.UntaggedSign1Message(msg)
+		data, err = untagged.MarshalCBOR()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestVerifyCOSESign1(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte("DeviceAuthentication")
+
+	t.Run("Embedded", func(t *testing.T) {
+		for _, tagged := range []bool{false, true} {
+			sign1 := signCOSESign1(t, key, payload, false, tagged)
+			if err := VerifyCOSESign1(sign1, nil, &key.PublicKey); err != nil {
+				t.Fatalf("tagged %v: unexpected error: %v", tagged, err)
+			}
+		}
+	})
+
+	t.Run("Detached", func(t *testing.T) {
+		sign1 := signCOSESign1(t, key, payload, true, false)
+		if err := VerifyCOSESign1(sign1, payload, &key.PublicKey); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := VerifyCOSESign1(sign1, []byte("other"), &key.PublicKey); err == nil {
+			t.Fatal("expected error for a different external payload")
+		}
+		if err := VerifyCOSESign1(sign1, nil, &key.PublicKey); !errors.Is(err, ErrMissingPayload) {
+			t.Fatalf("expected ErrMissingPayload, got %v", err)
+		}
+	})
+
+	t.Run("ConflictingPayload", func(t *testing.T) {
+		sign1 := signCOSESign1(t, key, payload, false, false)
+		if err := VerifyCOSESign1(sign1, payload, &key.PublicKey); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := VerifyCOSESign1(sign1, []byte("other"), &key.PublicKey); !errors.Is(err, ErrConflictingPayload) {
+			t.Fatalf("expected ErrConflictingPayload, got %v", err)
+		}
+	})
+
+	t.Run("WrongKey", func(t *testing.T) {
+		other, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sign1 := signCOSESign1(t, key, payload, false, false)
+		if err := VerifyCOSESign1(sign1, nil, &other.PublicKey); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestCheckCOSEHeaders(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := cose.NewSigner(cose.AlgorithmES256, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte("MobileSecurityObject")
+
+	sign := func(t *testing.T, headers cose.Headers) []byte {
+		msg := cose.Sign1Message{Headers: headers, Payload: payload}
+		if err := msg.Sign(rand.Reader, nil, signer); err != nil {
+			t.Fatal(err)
+		}
+		untagged := cose.UntaggedSign1Message(msg)
+		data, err := untagged.MarshalCBOR()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	t.Run("KnownCritical", func(t *testing.T) {
+		sign1 := sign(t, cose.Headers{
+			Protected: cose.ProtectedHeader{
+				cose.HeaderLabelAlgorithm: cose.AlgorithmES256,
+				cose.HeaderLabelCritical:  []interface{}{cose.HeaderLabelKeyID},
+				cose.HeaderLabelKeyID:     []byte("kid"),
+			},
+		})
+		if err := VerifyCOSESign1(sign1, nil, &key.PublicKey); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("UnknownCritical", func(t *testing.T) {
+		sign1 := sign(t, cose.Headers{
+			Protected: cose.ProtectedHeader{
+				cose.HeaderLabelAlgorithm: cose.AlgorithmES256,
+				cose.HeaderLabelCritical:  []interface{}{int64(-70000)},
+				int64(-70000):             true,
+			},
+		})
+		if err := VerifyCOSESign1(sign1, nil, &key.PublicKey); !errors.Is(err, ErrUnknownCriticalParam) {
+			t.Fatalf("expected ErrUnknownCriticalParam, got %v", err)
+		}
+	})
+
+	t.Run("UnprotectedAlgorithm", func(t *testing.T) {
+		sign1 := sign(t, cose.Headers{
+			Protected:   cose.ProtectedHeader{cose.HeaderLabelAlgorithm: cose.AlgorithmES256},
+			Unprotected: cose.UnprotectedHeader{cose.HeaderLabelAlgorithm: cose.AlgorithmES384},
+		})
+		if err := VerifyCOSESign1(sign1, nil, &key.PublicKey); !errors.Is(err, ErrUnprotectedAlgorithm) {
+			t.Fatalf("expected ErrUnprotectedAlgorithm, got %v", err)
+		}
+	})
+}
+
+func TestVerifyCOSEMac0(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	payload := []byte("DeviceAuthenticationBytes")
+	mac0, err := CreateCOSEMac0(payload, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Detached", func(t *testing.T) {
+		if err := VerifyCOSEMac0(mac0, payload, key); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Tagged", func(t *testing.T) {
+		tagged := append([]byte{0xd1}, mac0...)
+		if err := VerifyCOSEMac0(tagged, payload, key); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("OtherKey", func(t *testing.T) {
+		if err := VerifyCOSEMac0(mac0, payload, bytes.Repeat([]byte{0x43}, 32)); !errors.Is(err, ErrMacMismatch) {
+			t.Fatalf("expected ErrMacMismatch, got %v", err)
+		}
+	})
+
+	t.Run("OtherPayload", func(t *testing.T) {
+		if err := VerifyCOSEMac0(mac0, []byte("other"), key); !errors.Is(err, ErrMacMismatch) {
+			t.Fatalf("expected ErrMacMismatch, got %v", err)
+		}
+	})
+
+	t.Run("MissingPayload", func(t *testing.T) {
+		if err := VerifyCOSEMac0(mac0, nil, key); !errors.Is(err, ErrMissingPayload) {
+			t.Fatalf("expected ErrMissingPayload, got %v", err)
+		}
+	})
+
+	t.Run("MacStructure", func(t *testing.T) {
+		// RFC 9052 6.3: ["MAC0", h'a10105', h'', payload]
+		toBeMaced, _ := hex.DecodeString("84644d41433043a1010540")
+		toBeMaced = append(append(toBeMaced, 0x58, byte(len(payload))), payload...)
+		mac := hmac.New(sha256.New, key)
+		mac.Write(toBeMaced)
+		// [h'a10105', {}, null, tag]
+		want := append([]byte{0x84, 0x43, 0xa1, 0x01, 0x05, 0xa0, 0xf6, 0x58, 0x20}, mac.Sum(nil)...)
+		if !bytes.Equal(mac0, want) {
+			t.Fatalf("got %x, want %x", mac0, want)
+		}
+	})
+}
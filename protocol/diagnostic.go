@@ -0,0 +1,36 @@
+package protocol
+
+import (
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+var (
+	// Debug makes parse failures carry the diagnostic notation of the offending payload.
+	// The payload may contain personal data, so keep it off outside of interop triage.
+	Debug = false
+
+	// Embedded CBOR (tag 24 contents) is left as h'...' since short byte strings
+	// such as random salts would otherwise be misread as CBOR sequences.
+	diagMode, _ = cbor.DiagOptions{
+		ByteStringEncoding: cbor.ByteStringBase16Encoding,
+	}.DiagMode()
+)
+
+// Diagnostic renders cborBytes in RFC 8949 diagnostic notation, e.g. {1: "foo", 2: h'0102'}.
+func Diagnostic(cborBytes []byte) (string, error) {
+	return diagMode.Diagnose(cborBytes)
+}
+
+// DiagnosticError appends the diagnostic notation of data to err when Debug is set.
+func DiagnosticError(err error, data []byte) error {
+	if !Debug || err == nil {
+		return err
+	}
+	diag, derr := Diagnostic(data)
+	if derr != nil {
+		return fmt.Errorf("%w (diagnostic unavailable: %v)", err, derr)
+	}
+	return fmt.Errorf("%w, payload: %s", err, diag)
+}
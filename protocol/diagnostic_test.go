@@ -0,0 +1,42 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDiagnostic(t *testing.T) {
+	// {1: "foo", 2: h'0102'}, spelled out since map iteration order would make cbor.Marshal unstable.
+	data, err := hex.DecodeString("a20163666f6f02420102")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Diagnostic", func(t *testing.T) {
+		diag, err := Diagnostic(data)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if diag != `{1: "foo", 2: h'0102'}` {
+			t.Fatalf("unexpected diagnostic: %s", diag)
+		}
+	})
+
+	t.Run("DiagnosticError", func(t *testing.T) {
+		parseErr := errors.New("failed to parse")
+
+		if err := DiagnosticError(parseErr, data); err != parseErr {
+			t.Fatalf("diagnostic added without Debug: %v", err)
+		}
+
+		Debug = true
+		defer func() { Debug = false }()
+
+		err := DiagnosticError(parseErr, data)
+		if !errors.Is(err, parseErr) || !strings.Contains(err.Error(), `"foo"`) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
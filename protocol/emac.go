@@ -0,0 +1,24 @@
+package protocol
+
+import (
+	"crypto/ecdh"
+	"fmt"
+)
+
+// DeriveEMacKey derives the deviceMac key of ISO 18013-5 9.1.3.5:
+//
+//	EMacKey = HKDF-SHA256(IKM = ECDH(EReaderKey.Priv, SDeviceKey.Pub),
+//	                      salt = SHA-256(SessionTranscriptBytes),
+//	                      info = "EMacKey", L = 32)
+//
+// sessionTranscript is the SessionTranscript array as used for DeviceAuthentication.
+// The salt hashes SessionTranscriptBytes, which is that array wrapped in tag 24, not the
+// bare array. Getting this wrong is the usual reason a deviceMac does not verify.
+func DeriveEMacKey(readerEphemeralPriv *ecdh.PrivateKey, devicePub *ecdh.PublicKey, sessionTranscript []byte) ([]byte, error) {
+	sharedSecret, err := readerEphemeralPriv.ECDH(devicePub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute shared secret: %v", err)
+	}
+
+	return deriveSessionKey(sharedSecret, sessionTranscript, "EMacKey")
+}
@@ -0,0 +1,142 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestDeriveEMacKey(t *testing.T) {
+	readerKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// [null, null, ["AndroidHandoverv1", h'01', h'02', h'03']]
+	sessionTranscript, _ := hex.DecodeString("83f6f68471416e64726f696448616e646f7665727631410141024103")
+
+	key, err := DeriveEMacKey(readerKey, deviceKey.PublicKey(), sessionTranscript)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	t.Run("Construction", func(t *testing.T) {
+		// RFC 5869 by hand: one block of expand is enough for 32 bytes.
+		zab, err := deviceKey.ECDH(readerKey.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tagged := append([]byte{0xd8, 0x18, 0x58, byte(len(sessionTranscript))}, sessionTranscript...)
+		salt := sha256.Sum256(tagged)
+
+		extract := hmac.New(sha256.New, salt[:])
+		extract.Write(zab)
+		prk := extract.Sum(nil)
+
+		expand := hmac.New(sha256.New, prk)
+		expand.Write([]byte("EMacKey"))
+		expand.Write([]byte{1})
+		want := expand.Sum(nil)
+
+		if !bytes.Equal(key, want) {
+			t.Fatalf("got %x, want %x", key, want)
+		}
+	})
+
+	t.Run("SaltIsTaggedTranscript", func(t *testing.T) {
+		// Hashing the bare SessionTranscript is the common mistake, it must give another key.
+		zab, _ := deviceKey.ECDH(readerKey.PublicKey())
+		salt := sha256.Sum256(sessionTranscript)
+		extract := hmac.New(sha256.New, salt[:])
+		extract.Write(zab)
+		expand := hmac.New(sha256.New, extract.Sum(nil))
+		expand.Write([]byte("EMacKey"))
+		expand.Write([]byte{1})
+		if bytes.Equal(key, expand.Sum(nil)) {
+			t.Fatal("salt was computed over the untagged transcript")
+		}
+	})
+
+	t.Run("Symmetric", func(t *testing.T) {
+		// The device derives the same key from its private key and EReaderKey.
+		readerPub := readerKey.PublicKey()
+		deviceSide, err := DeriveEMacKey(deviceKey, readerPub, sessionTranscript)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(key, deviceSide) {
+			t.Fatal("reader and device derived different keys")
+		}
+	})
+
+	t.Run("CurveMismatch", func(t *testing.T) {
+		other, err := ecdh.P384().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DeriveEMacKey(readerKey, other.PublicKey(), sessionTranscript); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestDeriveEMacKeyKnownAnswer(t *testing.T) {
+	decode := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	// EReaderKey is the one of ISO 18013-5 Annex D, SDeviceKey the P-256 key of RFC 6979
+	// A.2.5. EMacKey and the tag were computed with OpenSSL, not with this package.
+	readerKey, err := ecdh.P256().NewPrivateKey(decode("de3b4b9e5f72dd9b58406ae3091434da48a6f9fd010d88fcb0958e2cebec947c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(readerKey.PublicKey().Bytes()); got != "0460e3392385041f51403051f2415531cb56dd3f999c71687013aac6768bc8187e"+
+		"e58deb8fdbe907f7dd5368245551a34796f7d2215c440c339bb0f7b67beccdfa" {
+		t.Fatalf("unexpected EReaderKey %s", got)
+	}
+	deviceKey, err := ecdh.P256().NewPublicKey(decode("0460fed4ba255a9d31c961eb74c6356d68c049b8923b61fa6ce669622e60f29fb6" +
+		"7903fe1008b8bc99a41ae9e95628bc64f2f1b20c2d7e9f5177a3c294d4462299"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// [null, null, ["AndroidHandoverv1", h'01', h'02', h'03']]
+	sessionTranscript := decode("83f6f68471416e64726f696448616e646f7665727631410141024103")
+
+	key, err := DeriveEMacKey(readerKey, deviceKey, sessionTranscript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := decode("2218a86da4186aa8c63afa4ee0d90e0ed2a46e11f976ff9c5047fb1a1d2c9101"); !bytes.Equal(key, want) {
+		t.Fatalf("got EMacKey %x, want %x", key, want)
+	}
+
+	// DeviceAuthenticationBytes of an mDL with no device signed elements.
+	deviceAuthentication := decode("d818584c847444657669636541757468656e7469636174696f6e" +
+		"83f6f68471416e64726f696448616e646f7665727631410141024103" +
+		"756f72672e69736f2e31383031332e352e312e6d444cd81841a0")
+	deviceMac, err := CreateCOSEMac0(deviceAuthentication, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg coseMac0
+	if err := DecMode.Unmarshal(deviceMac, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if want := decode("957bde18e1c709a2530f9362bfb1012d623553b7bd0d4be77e7ecd2cd6effc95"); !bytes.Equal(msg.Tag, want) {
+		t.Fatalf("got deviceMac tag %x, want %x", msg.Tag, want)
+	}
+	if err := VerifyCOSEMac0(deviceMac, deviceAuthentication, key); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
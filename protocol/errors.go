@@ -0,0 +1,47 @@
+package protocol
+
+import (
+	"crypto/subtle"
+	"errors"
+)
+
+// Mismatches found while checking a response against its session. Errors wrapping them
+// carry no hash or nonce bytes, those go to Log, so they are safe to show to a user.
+var (
+	ErrInfoHashMismatch     = errors.New("info hash mismatch")
+	ErrRecipientKeyMismatch = errors.New("recipient key mismatch")
+	ErrDigestMismatch       = errors.New("digest mismatch")
+)
+
+// Equal compares two hashes, nonces or tags in constant time.
+func Equal(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
+// publicMessages are the user-facing messages of errors, most specific first.
+var publicMessages = []struct {
+	err     error
+	message string
+}{
+	{ErrInfoHashMismatch, "the response was made for another request"},
+	{ErrRecipientKeyMismatch, "the response was encrypted to another key"},
+	{ErrDigestMismatch, "the response was modified"},
+	{ErrMacMismatch, "the response could not be authenticated"},
+	{ErrUnsupportedHPKESuite, "the response uses an unsupported encryption"},
+	{ErrUnsupportedJWEAlg, "the response uses an unsupported encryption"},
+	{ErrJWEDecrypt, "the response could not be decrypted"},
+	{ErrInvalidJWE, "the response is malformed"},
+	{ErrInvalidVPToken, "the response is malformed"},
+	{ErrUnsupportedDigestAlgorithm, "the response uses an unsupported digest algorithm"},
+}
+
+// PublicMessage returns a message for err that reveals nothing about keys, hashes or
+// the internals of the check, for servers to return instead of err.Error().
+func PublicMessage(err error) string {
+	for _, m := range publicMessages {
+		if errors.Is(err, m.err) {
+			return m.message
+		}
+	}
+	return "the response could not be verified"
+}
@@ -0,0 +1,38 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPublicMessage(t *testing.T) {
+	for name, tt := range map[string]struct {
+		err  error
+		want string
+	}{
+		"InfoHash": {fmt.Errorf("apple: %w", ErrInfoHashMismatch), "the response was made for another request"},
+		"Digest":   {fmt.Errorf("%w: digestID 3", ErrDigestMismatch), "the response was modified"},
+		"Unknown":  {errors.New("pkRHash 0102"), "the response could not be verified"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got := PublicMessage(tt.err)
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+			if strings.Contains(got, "0102") {
+				t.Fatalf("message leaks the error: %q", got)
+			}
+		})
+	}
+}
+
+func TestEqual(t *testing.T) {
+	if !Equal([]byte{1, 2}, []byte{1, 2}) {
+		t.Fatal("equal slices differ")
+	}
+	if Equal([]byte{1, 2}, []byte{1, 3}) || Equal([]byte{1, 2}, []byte{1}) || Equal([]byte{1}, nil) {
+		t.Fatal("different slices are equal")
+	}
+}
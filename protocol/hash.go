@@ -3,19 +3,54 @@ package protocol
 import (
 	"crypto/sha256"
 	"crypto/sha512"
+	"errors"
+	"fmt"
 	"hash"
 )
 
-func Digest(message []byte, alg string) []byte {
-	var hasher hash.Hash
+var ErrUnsupportedDigestAlgorithm = errors.New("unsupported digest algorithm")
+
+// DigestAlgorithm is a digest algorithm by its ISO 18013-5 name, as in the MSO digestAlgorithm.
+type DigestAlgorithm string
+
+const (
+	SHA256 DigestAlgorithm = "SHA-256"
+	SHA384 DigestAlgorithm = "SHA-384"
+	SHA512 DigestAlgorithm = "SHA-512"
+)
+
+// New returns a hash of alg, or ErrUnsupportedDigestAlgorithm.
+func (alg DigestAlgorithm) New() (hash.Hash, error) {
 	switch alg {
-	case "SHA-256":
-		hasher = sha256.New()
-	// case "SHA-384":
-	// 	hasher = sha384.New()
-	case "SHA-512":
-		hasher = sha512.New()
+	case SHA256:
+		return sha256.New(), nil
+	case SHA384:
+		return sha512.New384(), nil
+	case SHA512:
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedDigestAlgorithm, string(alg))
+}
+
+// CheckDigestAlgorithm reports whether Digest supports alg, e.g. before hashing anything
+// with the algorithm of an untrusted MSO.
+func CheckDigestAlgorithm(alg DigestAlgorithm) error {
+	_, err := alg.New()
+	return err
+}
+
+// Digest hashes message with alg.
+func Digest(message []byte, alg DigestAlgorithm) ([]byte, error) {
+	hasher, err := alg.New()
+	if err != nil {
+		return nil, err
 	}
 	hasher.Write(message)
-	return hasher.Sum(nil)
+	return hasher.Sum(nil), nil
+}
+
+// DigestSHA256 is Digest with SHA-256, which cannot fail.
+func DigestSHA256(message []byte) []byte {
+	sum := sha256.Sum256(message)
+	return sum[:]
 }
@@ -0,0 +1,33 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestDigest(t *testing.T) {
+	for alg, size := range map[DigestAlgorithm]int{SHA256: 32, SHA384: 48, SHA512: 64} {
+		digest, err := Digest([]byte("abc"), alg)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", alg, err)
+		}
+		if len(digest) != size {
+			t.Fatalf("%s: unexpected length %d", alg, len(digest))
+		}
+	}
+
+	sha256, err := Digest([]byte("abc"), SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sha256, DigestSHA256([]byte("abc"))) {
+		t.Fatal("DigestSHA256 differs from Digest")
+	}
+
+	for _, alg := range []DigestAlgorithm{"SHA-1", "sha-256", "SHA256", ""} {
+		if _, err := Digest([]byte("abc"), alg); !errors.Is(err, ErrUnsupportedDigestAlgorithm) {
+			t.Fatalf("%q: unexpected error: %v", alg, err)
+		}
+	}
+}
@@ -2,40 +2,303 @@ package protocol
 
 import (
 	"crypto/ecdh"
-	"encoding/base64"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/cisco/go-hpke"
 )
 
+var (
+	// MaxPlaintextSize bounds the size of a decrypted response.
+	// A full mDL with a portrait is the large case, so leave some room.
+	MaxPlaintextSize = 4 << 20
+
+	ErrCiphertextTooShort     = errors.New("ciphertext too short")
+	ErrEnvelopeTooLarge       = errors.New("envelope too large")
+	ErrInvalidEncapsulatedKey = errors.New("invalid encapsulated key")
+	ErrUnsupportedHPKESuite   = errors.New("unsupported HPKE suite")
+	ErrHPKEKeyMismatch        = errors.New("key does not match the HPKE suite")
+)
+
+// HPKESuite identifies the KEM, KDF and AEAD of an HPKE exchange (RFC 9180).
+type HPKESuite struct {
+	KEM  hpke.KEMID
+	KDF  hpke.KDFID
+	AEAD hpke.AEADID
+}
+
+// DefaultHPKESuite is what both the Apple and the browser handovers use.
+var DefaultHPKESuite = HPKESuite{
+	KEM:  hpke.DHKEM_P256,
+	KDF:  hpke.KDF_HKDF_SHA256,
+	AEAD: hpke.AEAD_AESGCM128,
+}
+
+var (
+	kemNames = map[hpke.KEMID]string{
+		hpke.DHKEM_P256:   "P-256",
+		hpke.DHKEM_P521:   "P-521",
+		hpke.DHKEM_X25519: "X25519",
+		hpke.DHKEM_X448:   "X448",
+	}
+	kdfNames = map[hpke.KDFID]string{
+		hpke.KDF_HKDF_SHA256: "HKDF-SHA256",
+		hpke.KDF_HKDF_SHA384: "HKDF-SHA384",
+		hpke.KDF_HKDF_SHA512: "HKDF-SHA512",
+	}
+	aeadNames = map[hpke.AEADID]string{
+		hpke.AEAD_AESGCM128:        "AES-128-GCM",
+		hpke.AEAD_AESGCM256:        "AES-256-GCM",
+		hpke.AEAD_CHACHA20POLY1305: "ChaCha20Poly1305",
+		hpke.AEAD_EXPORT_ONLY:      "Export-only",
+	}
+)
+
+// String renders the suite as e.g. "P-256/HKDF-SHA256/AES-128-GCM".
+func (s HPKESuite) String() string {
+	name := func(n string, ok bool, id uint16) string {
+		if ok {
+			return n
+		}
+		return fmt.Sprintf("%#04x", id)
+	}
+	kem, kemOK := kemNames[s.KEM]
+	kdf, kdfOK := kdfNames[s.KDF]
+	aead, aeadOK := aeadNames[s.AEAD]
+	return name(kem, kemOK, uint16(s.KEM)) + "/" + name(kdf, kdfOK, uint16(s.KDF)) + "/" + name(aead, aeadOK, uint16(s.AEAD))
+}
+
+// HPKEInfo records how a response was decrypted, for audit logs and interop debugging.
+type HPKEInfo struct {
+	Suite          HPKESuite
+	RecipientCurve string
+}
+
+func NewHPKEInfo(s HPKESuite, key KeyAgreement) HPKEInfo {
+	return HPKEInfo{Suite: s, RecipientCurve: fmt.Sprint(key.PublicKey().Curve())}
+}
+
+var (
+	// hpkeSuites are the suites EncryptHPKE and the decrypt functions accept: the Apple and
+	// Android profile, and the X25519 and ChaCha20Poly1305 profiles of other wallets.
+	hpkeSuitesMu sync.RWMutex
+	hpkeSuites   = map[HPKESuite]bool{
+		DefaultHPKESuite: true,
+		{KEM: hpke.DHKEM_P256, KDF: hpke.KDF_HKDF_SHA256, AEAD: hpke.AEAD_AESGCM256}:          true,
+		{KEM: hpke.DHKEM_P256, KDF: hpke.KDF_HKDF_SHA256, AEAD: hpke.AEAD_CHACHA20POLY1305}:   true,
+		{KEM: hpke.DHKEM_P521, KDF: hpke.KDF_HKDF_SHA512, AEAD: hpke.AEAD_AESGCM256}:          true,
+		{KEM: hpke.DHKEM_X25519, KDF: hpke.KDF_HKDF_SHA256, AEAD: hpke.AEAD_AESGCM128}:        true,
+		{KEM: hpke.DHKEM_X25519, KDF: hpke.KDF_HKDF_SHA256, AEAD: hpke.AEAD_CHACHA20POLY1305}: true,
+	}
+)
+
+// RegisterHPKESuite accepts s in addition to the built-in suites.
+func RegisterHPKESuite(s HPKESuite) error {
+	if _, err := s.assemble(); err != nil {
+		return err
+	}
+	hpkeSuitesMu.Lock()
+	defer hpkeSuitesMu.Unlock()
+	hpkeSuites[s] = true
+	return nil
+}
+
+// LookupHPKESuite returns the suite of the given identifiers, as carried by e.g. an
+// HPKE profile, or ErrUnsupportedHPKESuite when it is not registered.
+func LookupHPKESuite(kem hpke.KEMID, kdf hpke.KDFID, aead hpke.AEADID) (HPKESuite, error) {
+	s := HPKESuite{KEM: kem, KDF: kdf, AEAD: aead}
+	hpkeSuitesMu.RLock()
+	defer hpkeSuitesMu.RUnlock()
+	if !hpkeSuites[s] {
+		return HPKESuite{}, fmt.Errorf("%w: %s", ErrUnsupportedHPKESuite, s)
+	}
+	return s, nil
+}
+
+func (s HPKESuite) cipherSuite() (hpke.CipherSuite, error) {
+	if _, err := LookupHPKESuite(s.KEM, s.KDF, s.AEAD); err != nil {
+		return hpke.CipherSuite{}, err
+	}
+	return s.assemble()
+}
+
+func (s HPKESuite) assemble() (hpke.CipherSuite, error) {
+	switch s.AEAD {
+	case hpke.AEAD_AESGCM128, hpke.AEAD_AESGCM256, hpke.AEAD_CHACHA20POLY1305:
+	default:
+		// Export-only has no AEAD to open a ciphertext with.
+		return hpke.CipherSuite{}, fmt.Errorf("%w: AEAD %#04x", ErrUnsupportedHPKESuite, uint16(s.AEAD))
+	}
+	if _, ok := kemCurves[s.KEM]; !ok {
+		// crypto/ecdh has no X448, so neither the keys nor KeyAgreement could work.
+		return hpke.CipherSuite{}, fmt.Errorf("%w: KEM %#04x", ErrUnsupportedHPKESuite, uint16(s.KEM))
+	}
+
+	suite, err := hpke.AssembleCipherSuite(s.KEM, s.KDF, s.AEAD)
+	if err != nil {
+		return hpke.CipherSuite{}, fmt.Errorf("%w: %v", ErrUnsupportedHPKESuite, err)
+	}
+	return suite, nil
+}
+
 // func DecryptHPKE(claims *HPKEEnvelope, recipientPrivKey, info []byte) ([]byte, error) {
-func DecryptHPKE(data, pkEM, info []byte, privKey *ecdh.PrivateKey) ([]byte, error) {
+func DecryptHPKE(data, pkEM, info []byte, privKey KeyAgreement) ([]byte, error) {
+	return DecryptHPKEWithSuite(DefaultHPKESuite, data, pkEM, info, privKey)
+}
+
+// DecryptHPKEWithSuite opens data sealed to privKey in base mode with the given suite.
+func DecryptHPKEWithSuite(s HPKESuite, data, pkEM, info []byte, privKey KeyAgreement) ([]byte, error) {
+	return decryptHPKE(s, nil, data, pkEM, info, nil, privKey)
+}
+
+// DecryptHPKEWithAAD is DecryptHPKEWithSuite for a message sealed with associated data aad,
+// see EncryptHPKEWithAAD.
+func DecryptHPKEWithAAD(s HPKESuite, data, pkEM, info, aad []byte, privKey KeyAgreement) ([]byte, error) {
+	return decryptHPKE(s, nil, data, pkEM, info, aad, privKey)
+}
+
+// DecryptHPKEInPlace is DecryptHPKEWithSuite reusing the storage of data for the plaintext,
+// so a large response is only held once. data is overwritten and must not be used afterwards.
+//
+// The envelopes carry a single AEAD message, so nothing can be released before its one tag
+// is checked. Decrypting in place is as far as the memory can be brought down.
+func DecryptHPKEInPlace(s HPKESuite, data, pkEM, info []byte, privKey KeyAgreement) ([]byte, error) {
+	return decryptHPKE(s, data[:0], data, pkEM, info, nil, privKey)
+}
+
+func decryptHPKE(s HPKESuite, dst, data, pkEM, info, aad []byte, privKey KeyAgreement) ([]byte, error) {
+
+	Log.Debug("decrypt start", "suite", s.String(), "ciphertext_size", len(data))
 
 	// Initialize the HPKE context
-	suite, err := hpke.AssembleCipherSuite(hpke.DHKEM_P256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AESGCM128)
+	suite, err := s.cipherSuite()
 	if err != nil {
-		return nil, fmt.Errorf("error assembling cipher suite: %v", err)
+		return nil, fmt.Errorf("error assembling cipher suite: %w", err)
+	}
+
+	if err := checkCiphertext(suite, data, pkEM); err != nil {
+		Log.Warn("decrypt rejected", "error", err)
+		return nil, err
 	}
 
-	// Deserialize the recipient's private key
-	skR, err := suite.KEM.DeserializePrivateKey(privKey.Bytes())
+	// A key on another curve cannot do the DH, report the mismatch instead of a failed exchange.
+	if err := s.CheckKey(privKey.PublicKey()); err != nil {
+		return nil, err
+	}
+
+	// The DH is left to privKey, so that it works for keys go-hpke cannot hold.
+	suite.KEM = agreementKEM{KEMScheme: suite.KEM, key: privKey}
+	ctxR, err := hpke.SetupBaseR(suite, nil, pkEM, info)
 	if err != nil {
-		return nil, fmt.Errorf("error deserializing private key: %v", err)
+		return nil, fmt.Errorf("error setting up receiver context: %w", err)
 	}
 
-	// Setup the HPKE receiver context using SetupBaseR
-	ctxR, err := hpke.SetupBaseR(suite, skR, pkEM, info)
+	// ReceiverContext.Open always allocates the plaintext. There is exactly one message,
+	// sequence number 0, so its nonce is the base nonce and the AEAD can be used directly.
+	aead, err := suite.AEAD.New(ctxR.Key)
 	if err != nil {
-		return nil, fmt.Errorf("error setting up receiver context: %v", err)
+		return nil, fmt.Errorf("error setting up AEAD: %v", err)
 	}
 
-	plainText, err := ctxR.Open(nil, data) // No associated data
+	plainText, err := aead.Open(dst, ctxR.BaseNonce, data, aad)
 	if err != nil {
-		return nil, fmt.Errorf("error decrypting ciphertext: %v", err)
+		Log.Warn("decrypt failed", "suite", s.String(), "error", err)
+		return nil, fmt.Errorf("error decrypting ciphertext with %s: %v", s, err)
 	}
 
-	// Print or process the decrypted plaintext as needed
-	fmt.Printf("Decrypted text: %s\n", base64.URLEncoding.EncodeToString(plainText))
+	Log.Debug("decrypt end", "plaintext_size", len(plainText))
 
 	return plainText, nil
 }
+
+// EncryptHPKE seals plaintext to pubKey in base mode and returns the ciphertext and the encapsulated key.
+func EncryptHPKE(s HPKESuite, plaintext, info []byte, pubKey *ecdh.PublicKey) ([]byte, []byte, error) {
+	return EncryptHPKEWithAAD(s, plaintext, info, nil, pubKey)
+}
+
+// EncryptHPKEWithAAD is EncryptHPKE authenticating aad along with plaintext. The envelopes
+// of the Apple and preview flows carry no associated data, aad is for other profiles.
+func EncryptHPKEWithAAD(s HPKESuite, plaintext, info, aad []byte, pubKey *ecdh.PublicKey) ([]byte, []byte, error) {
+	suite, err := s.cipherSuite()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error assembling cipher suite: %w", err)
+	}
+
+	if err := s.CheckKey(pubKey); err != nil {
+		return nil, nil, err
+	}
+
+	pkR, err := suite.KEM.DeserializePublicKey(pubKey.Bytes())
+	if err != nil {
+		return nil, nil, fmt.Errorf("error deserializing public key: %v", err)
+	}
+
+	pkEM, ctxS, err := hpke.SetupBaseS(suite, rand.Reader, pkR, info)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error setting up sender context: %v", err)
+	}
+
+	return ctxS.Seal(aad, plaintext), pkEM, nil
+}
+
+// checkCiphertext rejects inputs that can never decrypt before they reach the AEAD.
+func checkCiphertext(suite hpke.CipherSuite, data, pkEM []byte) error {
+	if len(pkEM) != suite.KEM.PublicKeySize() {
+		return fmt.Errorf("%w: got %d bytes, want %d", ErrInvalidEncapsulatedKey, len(pkEM), suite.KEM.PublicKeySize())
+	}
+
+	if err := validateEncapsulatedKey(suite.KEM.ID(), pkEM); err != nil {
+		return err
+	}
+
+	// The tag size comes from the AEAD itself, the nonce never travels with the ciphertext.
+	aead, err := suite.AEAD.New(make([]byte, suite.AEAD.KeySize()))
+	if err != nil {
+		return fmt.Errorf("error creating AEAD: %v", err)
+	}
+	overhead := aead.Overhead()
+	// A lone tag is the ciphertext of an empty plaintext. It is for the caller to reject
+	// that where a DeviceResponse is required.
+	if len(data) < overhead {
+		return fmt.Errorf("%w: %d bytes", ErrCiphertextTooShort, len(data))
+	}
+	if len(data)-overhead > MaxPlaintextSize {
+		return fmt.Errorf("%w: %d bytes exceeds %d", ErrEnvelopeTooLarge, len(data)-overhead, MaxPlaintextSize)
+	}
+	return nil
+}
+
+// kemCurves maps the KEMs crypto/ecdh can validate points for.
+var kemCurves = map[hpke.KEMID]ecdh.Curve{
+	hpke.DHKEM_P256:   ecdh.P256(),
+	hpke.DHKEM_P521:   ecdh.P521(),
+	hpke.DHKEM_X25519: ecdh.X25519(),
+}
+
+// CheckKey returns ErrHPKEKeyMismatch unless key is on the curve of the KEM of s.
+// go-hpke has no DHKEM(P-384), so no suite accepts a P-384 key.
+func (s HPKESuite) CheckKey(key *ecdh.PublicKey) error {
+	curve, ok := kemCurves[s.KEM]
+	if !ok {
+		return fmt.Errorf("%w: KEM %#04x", ErrUnsupportedHPKESuite, uint16(s.KEM))
+	}
+	if key.Curve() != curve {
+		return fmt.Errorf("%w: %v key for %s", ErrHPKEKeyMismatch, key.Curve(), s)
+	}
+	return nil
+}
+
+// validateEncapsulatedKey rejects an ephemeral key that is not a valid point on the KEM curve,
+// so an invalid-curve point never reaches the DH with our private key.
+func validateEncapsulatedKey(kem hpke.KEMID, pkEM []byte) error {
+	curve, ok := kemCurves[kem]
+	if !ok {
+		return nil
+	}
+	if _, err := curve.NewPublicKey(pkEM); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEncapsulatedKey, err)
+	}
+	return nil
+}
@@ -0,0 +1,429 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/cisco/go-hpke"
+)
+
+func TestDecryptHPKEBounds(t *testing.T) {
+	privKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkEM := privKey.PublicKey().Bytes()
+
+	t.Run("EmptyCiphertext", func(t *testing.T) {
+		if _, err := DecryptHPKE(nil, pkEM, nil, privKey); !errors.Is(err, ErrCiphertextTooShort) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ShorterThanTag", func(t *testing.T) {
+		if _, err := DecryptHPKE(make([]byte, 15), pkEM, nil, privKey); !errors.Is(err, ErrCiphertextTooShort) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("EmptyPlaintext", func(t *testing.T) {
+		ciphertext, pkEM, err := EncryptHPKE(DefaultHPKESuite, nil, nil, privKey.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ciphertext) != 16 {
+			t.Fatalf("got %d bytes of ciphertext", len(ciphertext))
+		}
+		got, err := DecryptHPKE(ciphertext, pkEM, nil, privKey)
+		if err != nil || len(got) != 0 {
+			t.Fatalf("got %x, %v", got, err)
+		}
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		if _, err := DecryptHPKE(make([]byte, MaxPlaintextSize+17), pkEM, nil, privKey); !errors.Is(err, ErrEnvelopeTooLarge) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("EncapsulatedKeyOffCurve", func(t *testing.T) {
+		offCurve := append([]byte{}, pkEM...)
+		offCurve[len(offCurve)-1] ^= 0x01
+		if _, err := DecryptHPKE(make([]byte, 32), offCurve, nil, privKey); !errors.Is(err, ErrInvalidEncapsulatedKey) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("EncapsulatedKeyLength", func(t *testing.T) {
+		if _, err := DecryptHPKE(make([]byte, 32), pkEM[:33], nil, privKey); !errors.Is(err, ErrInvalidEncapsulatedKey) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestHPKERoundTrip(t *testing.T) {
+	privKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte("device response")
+	info := []byte("session transcript")
+
+	for name, aead := range map[string]hpke.AEADID{
+		"AES-128-GCM":      hpke.AEAD_AESGCM128,
+		"AES-256-GCM":      hpke.AEAD_AESGCM256,
+		"ChaCha20Poly1305": hpke.AEAD_CHACHA20POLY1305,
+	} {
+		t.Run(name, func(t *testing.T) {
+			suite := HPKESuite{KEM: hpke.DHKEM_P256, KDF: hpke.KDF_HKDF_SHA256, AEAD: aead}
+
+			ciphertext, pkEM, err := EncryptHPKE(suite, plaintext, info, privKey.PublicKey())
+			if err != nil {
+				t.Fatalf("failed to encrypt: %v", err)
+			}
+			got, err := DecryptHPKEWithSuite(suite, ciphertext, pkEM, info, privKey)
+			if err != nil {
+				t.Fatalf("failed to decrypt: %v", err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Fatalf("unexpected plaintext: %q", got)
+			}
+		})
+	}
+
+	// X25519 with HKDF-SHA512 and AES-256-GCM is not a built-in suite.
+	x25519SHA512 := HPKESuite{KEM: hpke.DHKEM_X25519, KDF: hpke.KDF_HKDF_SHA512, AEAD: hpke.AEAD_AESGCM256}
+	if err := RegisterHPKESuite(x25519SHA512); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		hpkeSuitesMu.Lock()
+		delete(hpkeSuites, x25519SHA512)
+		hpkeSuitesMu.Unlock()
+	}()
+
+	for name, kem := range map[string]struct {
+		id    hpke.KEMID
+		curve ecdh.Curve
+	}{
+		"X25519": {hpke.DHKEM_X25519, ecdh.X25519()},
+		"P-521":  {hpke.DHKEM_P521, ecdh.P521()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			key, err := kem.curve.GenerateKey(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			suite := HPKESuite{KEM: kem.id, KDF: hpke.KDF_HKDF_SHA512, AEAD: hpke.AEAD_AESGCM256}
+
+			ciphertext, pkEM, err := EncryptHPKE(suite, plaintext, info, key.PublicKey())
+			if err != nil {
+				t.Fatalf("failed to encrypt: %v", err)
+			}
+			got, err := DecryptHPKEWithSuite(suite, ciphertext, pkEM, info, key)
+			if err != nil {
+				t.Fatalf("failed to decrypt: %v", err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Fatalf("unexpected plaintext: %q", got)
+			}
+		})
+	}
+
+	for _, suite := range []HPKESuite{
+		{KEM: hpke.DHKEM_X25519, KDF: hpke.KDF_HKDF_SHA256, AEAD: hpke.AEAD_AESGCM128},
+		{KEM: hpke.DHKEM_X25519, KDF: hpke.KDF_HKDF_SHA256, AEAD: hpke.AEAD_CHACHA20POLY1305},
+	} {
+		suite := suite
+		t.Run(suite.String(), func(t *testing.T) {
+			key, err := kemCurves[suite.KEM].GenerateKey(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ciphertext, pkEM, err := EncryptHPKE(suite, plaintext, info, key.PublicKey())
+			if err != nil {
+				t.Fatalf("failed to encrypt: %v", err)
+			}
+			got, err := DecryptHPKEWithSuite(suite, ciphertext, pkEM, info, key)
+			if err != nil {
+				t.Fatalf("failed to decrypt: %v", err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Fatalf("unexpected plaintext: %q", got)
+			}
+		})
+	}
+
+	t.Run("KeyMismatch", func(t *testing.T) {
+		x25519, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := EncryptHPKE(DefaultHPKESuite, plaintext, info, x25519.PublicKey()); !errors.Is(err, ErrHPKEKeyMismatch) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := DecryptHPKE(make([]byte, 32), x25519.PublicKey().Bytes(), info, x25519); !errors.Is(err, ErrInvalidEncapsulatedKey) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		ciphertext, pkEM, err := EncryptHPKE(DefaultHPKESuite, plaintext, info, privKey.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DecryptHPKE(ciphertext, pkEM, info, x25519); !errors.Is(err, ErrHPKEKeyMismatch) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("SuiteMismatch", func(t *testing.T) {
+		suite := HPKESuite{KEM: hpke.DHKEM_P256, KDF: hpke.KDF_HKDF_SHA256, AEAD: hpke.AEAD_CHACHA20POLY1305}
+		ciphertext, pkEM, err := EncryptHPKE(suite, plaintext, info, privKey.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DecryptHPKE(ciphertext, pkEM, info, privKey); err == nil {
+			t.Fatal("decrypted with the wrong AEAD")
+		}
+	})
+
+	t.Run("ExportOnly", func(t *testing.T) {
+		suite := HPKESuite{KEM: hpke.DHKEM_P256, KDF: hpke.KDF_HKDF_SHA256, AEAD: hpke.AEAD_EXPORT_ONLY}
+		if _, _, err := EncryptHPKE(suite, plaintext, info, privKey.PublicKey()); !errors.Is(err, ErrUnsupportedHPKESuite) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestHPKEWithAAD(t *testing.T) {
+	privKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, info, aad := []byte("device response"), []byte("session transcript"), []byte("associated data")
+
+	ciphertext, pkEM, err := EncryptHPKEWithAAD(DefaultHPKESuite, plaintext, info, aad, privKey.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		got, err := DecryptHPKEWithAAD(DefaultHPKESuite, ciphertext, pkEM, info, aad, privKey)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Fatalf("got %q, want %q", got, plaintext)
+		}
+	})
+
+	t.Run("WrongAAD", func(t *testing.T) {
+		if _, err := DecryptHPKEWithAAD(DefaultHPKESuite, ciphertext, pkEM, info, []byte("other data"), privKey); err == nil {
+			t.Fatal("opened with another aad")
+		}
+		if _, err := DecryptHPKEWithSuite(DefaultHPKESuite, ciphertext, pkEM, info, privKey); err == nil {
+			t.Fatal("opened without the aad")
+		}
+	})
+}
+
+func TestDecryptHPKEInPlace(t *testing.T) {
+	privKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := bytes.Repeat([]byte("portrait"), 1024)
+	info := []byte("session transcript")
+
+	ciphertext, pkEM, err := EncryptHPKE(DefaultHPKESuite, plaintext, info, privKey.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("InPlace", func(t *testing.T) {
+		data := append([]byte{}, ciphertext...)
+		got, err := DecryptHPKEInPlace(DefaultHPKESuite, data, pkEM, info, privKey)
+		if err != nil {
+			t.Fatalf("failed to decrypt: %v", err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Fatal("unexpected plaintext")
+		}
+		if &got[0] != &data[0] {
+			t.Fatal("plaintext was not decrypted in place")
+		}
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		data := append([]byte{}, ciphertext...)
+		data[0] ^= 0xff
+		if got, err := DecryptHPKEInPlace(DefaultHPKESuite, data, pkEM, info, privKey); err == nil || got != nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+// BenchmarkDecryptHPKE compares the allocations of decrypting a 1 MiB response into a new
+// buffer with decrypting it in place.
+func BenchmarkDecryptHPKE(b *testing.B) {
+	privKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	plaintext := make([]byte, 1<<20)
+	info := []byte("session transcript")
+	ciphertext, pkEM, err := EncryptHPKE(DefaultHPKESuite, plaintext, info, privKey.PublicKey())
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := make([]byte, len(ciphertext))
+
+	b.Run("Copy", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(plaintext)))
+		for i := 0; i < b.N; i++ {
+			copy(data, ciphertext)
+			if _, err := DecryptHPKEWithSuite(DefaultHPKESuite, data, pkEM, info, privKey); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("InPlace", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(plaintext)))
+		for i := 0; i < b.N; i++ {
+			copy(data, ciphertext)
+			if _, err := DecryptHPKEInPlace(DefaultHPKESuite, data, pkEM, info, privKey); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// remoteKey stands for a key in an HSM: it does the DH but never hands out the private key.
+type remoteKey struct {
+	key   *ecdh.PrivateKey
+	calls int
+}
+
+func (k *remoteKey) PublicKey() *ecdh.PublicKey {
+	return k.key.PublicKey()
+}
+
+func (k *remoteKey) ECDH(remote *ecdh.PublicKey) ([]byte, error) {
+	k.calls++
+	return k.key.ECDH(remote)
+}
+
+func TestKeyAgreement(t *testing.T) {
+	plaintext := []byte("device response")
+	info := []byte("session transcript")
+
+	for name, suite := range map[string]HPKESuite{
+		"P-256":  DefaultHPKESuite,
+		"P-521":  {KEM: hpke.DHKEM_P521, KDF: hpke.KDF_HKDF_SHA512, AEAD: hpke.AEAD_AESGCM256},
+		"X25519": {KEM: hpke.DHKEM_X25519, KDF: hpke.KDF_HKDF_SHA256, AEAD: hpke.AEAD_CHACHA20POLY1305},
+	} {
+		t.Run(name, func(t *testing.T) {
+			privKey, err := kemCurves[suite.KEM].GenerateKey(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := &remoteKey{key: privKey}
+
+			ciphertext, pkEM, err := EncryptHPKE(suite, plaintext, info, key.PublicKey())
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := DecryptHPKEWithSuite(suite, ciphertext, pkEM, info, key)
+			if err != nil {
+				t.Fatalf("failed to decrypt: %v", err)
+			}
+			if !bytes.Equal(got, plaintext) || key.calls != 1 {
+				t.Fatalf("unexpected plaintext %q after %d key agreements", got, key.calls)
+			}
+
+			if info := NewHPKEInfo(suite, key); info.RecipientCurve != name {
+				t.Fatalf("unexpected recipient curve: %s", info.RecipientCurve)
+			}
+		})
+	}
+
+	t.Run("Failure", func(t *testing.T) {
+		privKey, err := ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphertext, pkEM, err := EncryptHPKE(DefaultHPKESuite, plaintext, info, privKey.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DecryptHPKE(ciphertext, pkEM, info, failingKey{privKey.PublicKey()}); err == nil {
+			t.Fatal("decrypted without a key agreement")
+		}
+	})
+}
+
+type failingKey struct {
+	pub *ecdh.PublicKey
+}
+
+func (k failingKey) PublicKey() *ecdh.PublicKey {
+	return k.pub
+}
+
+func (k failingKey) ECDH(*ecdh.PublicKey) ([]byte, error) {
+	return nil, errors.New("HSM unavailable")
+}
+
+func TestHPKESuiteRegistry(t *testing.T) {
+	suite, err := LookupHPKESuite(hpke.DHKEM_X25519, hpke.KDF_HKDF_SHA256, hpke.AEAD_CHACHA20POLY1305)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if suite.String() != "X25519/HKDF-SHA256/ChaCha20Poly1305" {
+		t.Fatalf("unexpected suite: %s", suite)
+	}
+
+	unregistered := HPKESuite{KEM: hpke.DHKEM_X25519, KDF: hpke.KDF_HKDF_SHA384, AEAD: hpke.AEAD_AESGCM256}
+	if _, err := LookupHPKESuite(unregistered.KEM, unregistered.KDF, unregistered.AEAD); !errors.Is(err, ErrUnsupportedHPKESuite) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	privKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := EncryptHPKE(unregistered, []byte("device response"), nil, privKey.PublicKey()); !errors.Is(err, ErrUnsupportedHPKESuite) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := RegisterHPKESuite(unregistered); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		hpkeSuitesMu.Lock()
+		delete(hpkeSuites, unregistered)
+		hpkeSuitesMu.Unlock()
+	}()
+	ciphertext, pkEM, err := EncryptHPKE(unregistered, []byte("device response"), nil, privKey.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptHPKEWithSuite(unregistered, ciphertext, pkEM, nil, privKey); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	t.Run("Unimplemented", func(t *testing.T) {
+		for _, s := range []HPKESuite{
+			{KEM: hpke.DHKEM_X448, KDF: hpke.KDF_HKDF_SHA512, AEAD: hpke.AEAD_AESGCM256},
+			{KEM: hpke.DHKEM_P256, KDF: hpke.KDF_HKDF_SHA256, AEAD: hpke.AEAD_EXPORT_ONLY},
+		} {
+			if err := RegisterHPKESuite(s); !errors.Is(err, ErrUnsupportedHPKESuite) {
+				t.Fatalf("%s: unexpected error: %v", s, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,324 @@
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// https://www.rfc-editor.org/rfc/rfc7516 (JWE) and https://www.rfc-editor.org/rfc/rfc7518 (JWA)
+
+var (
+	ErrInvalidJWE        = errors.New("invalid JWE")
+	ErrUnsupportedJWEAlg = errors.New("unsupported JWE algorithm")
+	ErrJWEDecrypt        = errors.New("JWE decryption failed")
+)
+
+// jweKeySizes are the content encryption key sizes of the supported "enc" values.
+var jweKeySizes = map[string]int{
+	"A128GCM": 16,
+	"A192GCM": 24,
+	"A256GCM": 32,
+}
+
+// jweWrapKeySizes are the key encryption key sizes of the ECDH-ES key wrapping "alg" values.
+var jweWrapKeySizes = map[string]int{
+	"ECDH-ES+A128KW": 16,
+	"ECDH-ES+A192KW": 24,
+	"ECDH-ES+A256KW": 32,
+}
+
+// JWEHeader is the protected header of an ECDH-ES JWE.
+type JWEHeader struct {
+	Alg  string   `json:"alg"`
+	Enc  string   `json:"enc"`
+	Kid  string   `json:"kid,omitempty"`
+	EPK  JWK      `json:"epk"`
+	APU  string   `json:"apu,omitempty"`
+	APV  string   `json:"apv,omitempty"`
+	Zip  string   `json:"zip,omitempty"`
+	Crit []string `json:"crit,omitempty"`
+}
+
+// DecryptJWE decrypts a compact serialized JWE with alg ECDH-ES or ECDH-ES+A128KW,
+// A192KW or A256KW and enc A128GCM, A192GCM or A256GCM, as wallets send
+// OpenID4VP responses with response_mode direct_post.jwt. key is the ephemeral key
+// of the verifier whose public key went out in the request.
+func DecryptJWE(compact string, key KeyAgreement) ([]byte, *JWEHeader, error) {
+	parts := strings.Split(compact, ".")
+	if len(parts) != 5 {
+		return nil, nil, fmt.Errorf("%w: %d parts, want 5", ErrInvalidJWE, len(parts))
+	}
+	decoded := make([][]byte, len(parts))
+	for i, part := range parts {
+		b, err := base64.RawURLEncoding.DecodeString(part)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: part %d is not base64url: %v", ErrInvalidJWE, i, err)
+		}
+		decoded[i] = b
+	}
+	encryptedKey, iv, ciphertext, tag := decoded[1], decoded[2], decoded[3], decoded[4]
+
+	var header JWEHeader
+	if err := json.Unmarshal(decoded[0], &header); err != nil {
+		return nil, nil, fmt.Errorf("%w: header: %v", ErrInvalidJWE, err)
+	}
+	// Neither compression nor critical extensions are used by wallets.
+	if header.Zip != "" || len(header.Crit) > 0 {
+		return nil, nil, fmt.Errorf("%w: zip %q, crit %v", ErrUnsupportedJWEAlg, header.Zip, header.Crit)
+	}
+	cekSize, ok := jweKeySizes[header.Enc]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: enc %q", ErrUnsupportedJWEAlg, header.Enc)
+	}
+	if header.Alg != "ECDH-ES" && jweWrapKeySizes[header.Alg] == 0 {
+		return nil, nil, fmt.Errorf("%w: alg %q", ErrUnsupportedJWEAlg, header.Alg)
+	}
+
+	epk, err := header.EPK.PublicKey()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: epk: %v", ErrInvalidJWE, err)
+	}
+	if epk.Curve() != key.PublicKey().Curve() {
+		return nil, nil, fmt.Errorf("%w: epk on %s, key on %v", ErrInvalidJWE, header.EPK.Crv, key.PublicKey().Curve())
+	}
+	z, err := key.ECDH(epk)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to compute shared secret: %v", err)
+	}
+	apu, err := base64.RawURLEncoding.DecodeString(header.APU)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: apu is not base64url: %v", ErrInvalidJWE, err)
+	}
+	apv, err := base64.RawURLEncoding.DecodeString(header.APV)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: apv is not base64url: %v", ErrInvalidJWE, err)
+	}
+
+	var cek []byte
+	if header.Alg == "ECDH-ES" {
+		// Direct key agreement, RFC 7518 section 4.6.
+		if len(encryptedKey) != 0 {
+			return nil, nil, fmt.Errorf("%w: encrypted key with ECDH-ES", ErrInvalidJWE)
+		}
+		cek = concatKDF(z, header.Enc, apu, apv, cekSize)
+	} else {
+		kek := concatKDF(z, header.Alg, apu, apv, jweWrapKeySizes[header.Alg])
+		cek, err = aesKeyUnwrap(kek, encryptedKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrJWEDecrypt, err)
+		}
+		if len(cek) != cekSize {
+			return nil, nil, fmt.Errorf("%w: %d byte key for %s", ErrInvalidJWE, len(cek), header.Enc)
+		}
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(iv) != gcm.NonceSize() || len(tag) != gcm.Overhead() {
+		return nil, nil, fmt.Errorf("%w: %d byte iv, %d byte tag", ErrInvalidJWE, len(iv), len(tag))
+	}
+	// The AAD is the protected header as it was encoded, RFC 7516 section 5.2.
+	plaintext, err := gcm.Open(nil, iv, append(ciphertext, tag...), []byte(parts[0]))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrJWEDecrypt, err)
+	}
+	return plaintext, &header, nil
+}
+
+// DecryptVPTokenResponse decrypts the response parameter of a direct_post.jwt
+// response and returns its vp_token, see ParseVPToken.
+func DecryptVPTokenResponse(response string, key KeyAgreement) (json.RawMessage, error) {
+	plaintext, _, err := DecryptJWE(response, key)
+	if err != nil {
+		return nil, err
+	}
+	var payload struct {
+		VPToken json.RawMessage `json:"vp_token"`
+	}
+	if err := json.Unmarshal(plaintext, &payload); err != nil {
+		return nil, fmt.Errorf("failed to parse JWE payload: %v", err)
+	}
+	if len(payload.VPToken) == 0 {
+		return nil, fmt.Errorf("%w: missing", ErrInvalidVPToken)
+	}
+	return payload.VPToken, nil
+}
+
+// EncryptJWE is the wallet side of DecryptJWE, for tests and simulators. It encrypts
+// plaintext to recipient with a fresh ephemeral key, with apu and apv in the header.
+func EncryptJWE(plaintext []byte, recipient *ecdh.PublicKey, alg, enc string, apu, apv []byte) (string, error) {
+	cekSize, ok := jweKeySizes[enc]
+	if !ok {
+		return "", fmt.Errorf("%w: enc %q", ErrUnsupportedJWEAlg, enc)
+	}
+	if alg != "ECDH-ES" && jweWrapKeySizes[alg] == 0 {
+		return "", fmt.Errorf("%w: alg %q", ErrUnsupportedJWEAlg, alg)
+	}
+
+	ephemeral, err := recipient.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	epk, err := NewJWK(ephemeral.PublicKey())
+	if err != nil {
+		return "", err
+	}
+	epk.Kid = ""
+	header := JWEHeader{Alg: alg, Enc: enc, EPK: epk}
+	if apu != nil {
+		header.APU = base64.RawURLEncoding.EncodeToString(apu)
+	}
+	if apv != nil {
+		header.APV = base64.RawURLEncoding.EncodeToString(apv)
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	z, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute shared secret: %v", err)
+	}
+
+	var cek, encryptedKey []byte
+	if alg == "ECDH-ES" {
+		cek = concatKDF(z, enc, apu, apv, cekSize)
+	} else {
+		cek = make([]byte, cekSize)
+		if _, err := rand.Read(cek); err != nil {
+			return "", err
+		}
+		if encryptedKey, err = aesKeyWrap(concatKDF(z, alg, apu, apv, jweWrapKeySizes[alg]), cek); err != nil {
+			return "", err
+		}
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	protected := base64.RawURLEncoding.EncodeToString(headerJSON)
+	sealed := gcm.Seal(nil, iv, plaintext, []byte(protected))
+	ciphertext, tag := sealed[:len(plaintext)], sealed[len(plaintext):]
+
+	return strings.Join([]string{
+		protected,
+		base64.RawURLEncoding.EncodeToString(encryptedKey),
+		base64.RawURLEncoding.EncodeToString(iv),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, "."), nil
+}
+
+// concatKDF is the Concat KDF of NIST SP 800-56A with SHA-256, RFC 7518 section 4.6.2.
+func concatKDF(z []byte, algID string, apu, apv []byte, size int) []byte {
+	lengthPrefixed := func(b []byte) []byte {
+		l := make([]byte, 4)
+		binary.BigEndian.PutUint32(l, uint32(len(b)))
+		return append(l, b...)
+	}
+	otherInfo := lengthPrefixed([]byte(algID))
+	otherInfo = append(otherInfo, lengthPrefixed(apu)...)
+	otherInfo = append(otherInfo, lengthPrefixed(apv)...)
+	keyDataLen := make([]byte, 4)
+	binary.BigEndian.PutUint32(keyDataLen, uint32(size*8))
+	otherInfo = append(otherInfo, keyDataLen...)
+
+	var out []byte
+	for counter := uint32(1); len(out) < size; counter++ {
+		h := sha256.New()
+		c := make([]byte, 4)
+		binary.BigEndian.PutUint32(c, counter)
+		h.Write(c)
+		h.Write(z)
+		h.Write(otherInfo)
+		out = h.Sum(out)
+	}
+	return out[:size]
+}
+
+// aesKeyWrap is the AES Key Wrap of RFC 3394 section 2.2.1.
+func aesKeyWrap(kek, key []byte) ([]byte, error) {
+	if len(key) < 16 || len(key)%8 != 0 {
+		return nil, fmt.Errorf("invalid key length: %d", len(key))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(key) / 8
+	a := []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+	r := append([]byte{}, key...)
+	buf := make([]byte, 16)
+	for j := 0; j <= 5; j++ {
+		for i := 1; i <= n; i++ {
+			copy(buf, a)
+			copy(buf[8:], r[(i-1)*8:i*8])
+			block.Encrypt(buf, buf)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(buf[:8])^uint64(n*j+i))
+			copy(r[(i-1)*8:i*8], buf[8:])
+		}
+	}
+	return append(a, r...), nil
+}
+
+// aesKeyUnwrap is the AES Key Wrap unwrap of RFC 3394 section 2.2.2.
+func aesKeyUnwrap(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 24 || len(wrapped)%8 != 0 {
+		return nil, fmt.Errorf("invalid wrapped key length: %d", len(wrapped))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(wrapped)/8 - 1
+	a := make([]byte, 8)
+	copy(a, wrapped[:8])
+	r := make([]byte, n*8)
+	copy(r, wrapped[8:])
+
+	buf := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(buf[:8], binary.BigEndian.Uint64(a)^t)
+			copy(buf[8:], r[(i-1)*8:i*8])
+			block.Decrypt(buf, buf)
+			copy(a, buf[:8])
+			copy(r[(i-1)*8:i*8], buf[8:])
+		}
+	}
+
+	// The default initial value, RFC 3394 section 2.2.3.1.
+	iv := []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+	if subtle.ConstantTimeCompare(a, iv) != 1 {
+		return nil, errors.New("key unwrap integrity check failed")
+	}
+	return r, nil
+}
@@ -0,0 +1,203 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// sealJWE is the wallet side of DecryptJWE.
+func sealJWE(t *testing.T, alg, enc string, recipient *ecdh.PublicKey, plaintext []byte) string {
+	t.Helper()
+	ephemeral, err := recipient.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epk, err := NewJWK(ephemeral.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := json.Marshal(JWEHeader{Alg: alg, Enc: enc, EPK: epk, APV: base64.RawURLEncoding.EncodeToString([]byte("nonce"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cek, encryptedKey []byte
+	if alg == "ECDH-ES" {
+		cek = concatKDF(z, enc, nil, []byte("nonce"), jweKeySizes[enc])
+	} else {
+		cek = make([]byte, jweKeySizes[enc])
+		rand.Read(cek)
+		encryptedKey, err = aesKeyWrap(concatKDF(z, alg, nil, []byte("nonce"), jweWrapKeySizes[alg]), cek)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := make([]byte, gcm.NonceSize())
+	rand.Read(iv)
+	protected := base64.RawURLEncoding.EncodeToString(header)
+	sealed := gcm.Seal(nil, iv, plaintext, []byte(protected))
+	ciphertext, tag := sealed[:len(plaintext)], sealed[len(plaintext):]
+
+	return strings.Join([]string{
+		protected,
+		base64.RawURLEncoding.EncodeToString(encryptedKey),
+		base64.RawURLEncoding.EncodeToString(iv),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, ".")
+}
+
+func TestDecryptJWE(t *testing.T) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte(`{"vp_token":{"mdl":"o2dtZG9j"}}`)
+
+	for _, alg := range []string{"ECDH-ES", "ECDH-ES+A128KW", "ECDH-ES+A256KW"} {
+		for _, enc := range []string{"A128GCM", "A192GCM", "A256GCM"} {
+			t.Run(alg+"/"+enc, func(t *testing.T) {
+				plaintext, header, err := DecryptJWE(sealJWE(t, alg, enc, key.PublicKey(), payload), key)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if !bytes.Equal(plaintext, payload) || header.Alg != alg || header.Enc != enc {
+					t.Fatalf("unexpected plaintext %q, header %+v", plaintext, header)
+				}
+			})
+		}
+	}
+
+	t.Run("EncryptJWE", func(t *testing.T) {
+		compact, err := EncryptJWE(payload, key.PublicKey(), "ECDH-ES+A128KW", "A256GCM", []byte("apu"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, header, err := DecryptJWE(compact, key)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !bytes.Equal(plaintext, payload) || header.APU != "YXB1" {
+			t.Fatalf("unexpected plaintext %q, header %+v", plaintext, header)
+		}
+	})
+
+	t.Run("VPToken", func(t *testing.T) {
+		vpToken, err := DecryptVPTokenResponse(sealJWE(t, "ECDH-ES", "A128GCM", key.PublicKey(), payload), key)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		tokens, err := ParseVPToken(vpToken)
+		if err != nil || len(tokens) != 1 {
+			t.Fatalf("unexpected vp_token %s: %v", vpToken, err)
+		}
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		parts := strings.Split(sealJWE(t, "ECDH-ES+A128KW", "A128GCM", key.PublicKey(), payload), ".")
+		parts[3] = base64.RawURLEncoding.EncodeToString(make([]byte, len(payload)))
+		if _, _, err := DecryptJWE(strings.Join(parts, "."), key); !errors.Is(err, ErrJWEDecrypt) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("OtherKey", func(t *testing.T) {
+		other, err := ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := DecryptJWE(sealJWE(t, "ECDH-ES", "A256GCM", other.PublicKey(), payload), key); !errors.Is(err, ErrJWEDecrypt) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	for name, header := range map[string]string{
+		"Alg": `{"alg":"RSA-OAEP","enc":"A128GCM","epk":{"kty":"EC","crv":"P-256","x":"","y":""}}`,
+		"Enc": `{"alg":"ECDH-ES","enc":"A128CBC-HS256"}`,
+		"Zip": `{"alg":"ECDH-ES","enc":"A128GCM","zip":"DEF"}`,
+	} {
+		t.Run("Unsupported"+name, func(t *testing.T) {
+			compact := base64.RawURLEncoding.EncodeToString([]byte(header)) + "...."
+			if _, _, err := DecryptJWE(compact, key); !errors.Is(err, ErrUnsupportedJWEAlg) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestConcatKDF(t *testing.T) {
+	// RFC 7518 Appendix C.
+	bob := JWK{Kty: "EC", Crv: "P-256",
+		X: "weNJy2HscCSM6AEDTDg04biOvhFhyyWvOHQfeF_PxMQ",
+		Y: "e8lnCO-AlStT-NJVX-crhB7QRYhiix03illJOVAOyck",
+	}
+	alice, err := ecdh.P256().NewPrivateKey(mustDecodeBase64URL(t, "0_NxaRPUMQoAJt50Gz8YiTr8gRTwyEaCumd-MToTmIo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobPub, err := bob.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := alice.ECDH(bobPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := concatKDF(z, "A128GCM", []byte("Alice"), []byte("Bob"), 16)
+	if want := "VqqN6vgjbSBcIijNcacQGg"; base64.RawURLEncoding.EncodeToString(got) != want {
+		t.Fatalf("got %s, want %s", base64.RawURLEncoding.EncodeToString(got), want)
+	}
+}
+
+func TestAESKeyUnwrap(t *testing.T) {
+	// RFC 3394 section 4.1.
+	kek, _ := hex.DecodeString("000102030405060708090A0B0C0D0E0F")
+	wrapped, _ := hex.DecodeString("1FA68B0A8112B447AEF34BD8FB5A7B829D3E862371D2CFE5")
+	key, err := aesKeyUnwrap(kek, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "00112233445566778899aabbccddeeff"; hex.EncodeToString(key) != want {
+		t.Fatalf("got %x, want %s", key, want)
+	}
+	if rewrapped, err := aesKeyWrap(kek, key); err != nil || !bytes.Equal(rewrapped, wrapped) {
+		t.Fatalf("wrap: got %x: %v", rewrapped, err)
+	}
+
+	wrapped[0] ^= 1
+	if _, err := aesKeyUnwrap(kek, wrapped); err == nil {
+		t.Fatal("unwrapped a corrupted key")
+	}
+}
+
+func mustDecodeBase64URL(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -0,0 +1,141 @@
+package protocol
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// JWK is an EC or OKP public key, RFC 7517 and RFC 7518 section 6.2.
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+}
+
+// JWKS is a JWK Set, e.g. the jwks of OpenID4VP client_metadata.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+var jwkCurves = map[string]ecdh.Curve{
+	"P-256":  ecdh.P256(),
+	"P-384":  ecdh.P384(),
+	"P-521":  ecdh.P521(),
+	"X25519": ecdh.X25519(),
+}
+
+// NewJWK returns pub as a JWK with its RFC 7638 thumbprint as kid.
+func NewJWK(pub *ecdh.PublicKey) (JWK, error) {
+	var k JWK
+	for crv, curve := range jwkCurves {
+		if curve == pub.Curve() {
+			k.Crv = crv
+		}
+	}
+	switch k.Crv {
+	case "":
+		return JWK{}, fmt.Errorf("unsupported curve: %v", pub.Curve())
+	case "X25519":
+		k.Kty = "OKP"
+		k.X = base64.RawURLEncoding.EncodeToString(pub.Bytes())
+	default:
+		k.Kty = "EC"
+		// Uncompressed point, 0x04 || X || Y.
+		point := pub.Bytes()[1:]
+		k.X = base64.RawURLEncoding.EncodeToString(point[:len(point)/2])
+		k.Y = base64.RawURLEncoding.EncodeToString(point[len(point)/2:])
+	}
+
+	thumbprint, err := k.Thumbprint()
+	if err != nil {
+		return JWK{}, err
+	}
+	k.Kid = base64.RawURLEncoding.EncodeToString(thumbprint)
+	return k, nil
+}
+
+// PublicKey returns the key as an *ecdh.PublicKey.
+func (k JWK) PublicKey() (*ecdh.PublicKey, error) {
+	curve, ok := jwkCurves[k.Crv]
+	if !ok {
+		return nil, fmt.Errorf("unsupported curve: %q", k.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("x is not base64url: %v", err)
+	}
+	if k.Crv == "X25519" {
+		if k.Kty != "OKP" {
+			return nil, fmt.Errorf("unexpected kty %q for %s", k.Kty, k.Crv)
+		}
+		return curve.NewPublicKey(x)
+	}
+
+	if k.Kty != "EC" {
+		return nil, fmt.Errorf("unexpected kty %q for %s", k.Kty, k.Crv)
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, fmt.Errorf("y is not base64url: %v", err)
+	}
+	// The coordinates are fixed size, RFC 7518 section 6.2.1.2.
+	if len(x) != len(y) {
+		return nil, fmt.Errorf("coordinates of different lengths: %d and %d", len(x), len(y))
+	}
+	return curve.NewPublicKey(append(append([]byte{0x04}, x...), y...))
+}
+
+// Thumbprint is the SHA-256 JWK Thumbprint of RFC 7638, as the jwkThumbprint of
+// the OpenID4VPDCAPIHandover.
+func (k JWK) Thumbprint() ([]byte, error) {
+	// The required members only, in lexicographic order, RFC 7638 section 3.2.
+	var members interface{}
+	switch k.Kty {
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{k.Crv, k.Kty, k.X, k.Y}
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{k.Crv, k.Kty, k.X}
+	default:
+		return nil, fmt.Errorf("unsupported kty: %q", k.Kty)
+	}
+	data, err := json.Marshal(members)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	return sum[:], nil
+}
+
+// GenerateEphemeralKey generates a key for a single session and returns it with its
+// public JWK, marked for ECDH-ES encryption of the response. The key is kept with the
+// session, as in the SessionData of openid4vp.BeginIdentityRequest.
+func GenerateEphemeralKey(curve ecdh.Curve) (*ecdh.PrivateKey, JWK, error) {
+	key, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, JWK{}, fmt.Errorf("failed to generateKey: %v", err)
+	}
+	jwk, err := NewJWK(key.PublicKey())
+	if err != nil {
+		return nil, JWK{}, err
+	}
+	jwk.Use = "enc"
+	jwk.Alg = "ECDH-ES"
+	return key, jwk, nil
+}
@@ -0,0 +1,44 @@
+package protocol
+
+import (
+	"crypto/ecdh"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+func TestJWK(t *testing.T) {
+	for _, curve := range []ecdh.Curve{ecdh.P256(), ecdh.P384(), ecdh.P521(), ecdh.X25519()} {
+		key, jwk, err := GenerateEphemeralKey(curve)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(jwk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var parsed JWK
+		if err := json.Unmarshal(data, &parsed); err != nil {
+			t.Fatal(err)
+		}
+		pub, err := parsed.PublicKey()
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", curve, err)
+		}
+		if !pub.Equal(key.PublicKey()) || parsed.Use != "enc" || parsed.Alg != "ECDH-ES" {
+			t.Fatalf("%v: unexpected JWK %s", curve, data)
+		}
+	}
+
+	t.Run("Thumbprint", func(t *testing.T) {
+		// RFC 8037 Appendix A.3.
+		jwk := JWK{Kty: "OKP", Crv: "Ed25519", X: "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo", Kid: "ignored"}
+		thumbprint, err := jwk.Thumbprint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := base64.RawURLEncoding.EncodeToString(thumbprint), "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k"; got != want {
+			t.Fatalf("got %s, want %s", got, want)
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package protocol
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/cisco/go-hpke"
+	"golang.org/x/crypto/hkdf"
+
+	// The KEM hashes, see kemHashes.
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// KeyAgreement is the ECDH half of a recipient private key. The key itself can stay in
+// an HSM or a cloud KMS, only the shared secret of each exchange leaves it.
+// *ecdh.PrivateKey is the in-memory implementation.
+type KeyAgreement interface {
+	PublicKey() *ecdh.PublicKey
+	// ECDH returns the shared secret with remote, as crypto/ecdh does.
+	ECDH(remote *ecdh.PublicKey) ([]byte, error)
+}
+
+// kemHashes are the hashes of the HKDF inside each DHKEM, RFC 9180 section 7.1.
+var kemHashes = map[hpke.KEMID]crypto.Hash{
+	hpke.DHKEM_P256:   crypto.SHA256,
+	hpke.DHKEM_P521:   crypto.SHA512,
+	hpke.DHKEM_X25519: crypto.SHA256,
+}
+
+// agreementKEM is the KEM of a suite with Decap done by a KeyAgreement instead of a
+// private key go-hpke holds. Everything else is the embedded go-hpke KEM.
+type agreementKEM struct {
+	hpke.KEMScheme
+	key KeyAgreement
+}
+
+// Decap is DHKEM Decap, RFC 9180 section 4.1. skR is unused, the DH is done by k.key.
+func (k agreementKEM) Decap(enc []byte, skR hpke.KEMPrivateKey) ([]byte, error) {
+	curve, ok := kemCurves[k.ID()]
+	if !ok {
+		return nil, fmt.Errorf("%w: KEM %#04x", ErrUnsupportedHPKESuite, uint16(k.ID()))
+	}
+	pkE, err := curve.NewPublicKey(enc)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEncapsulatedKey, err)
+	}
+	dh, err := k.key.ECDH(pkE)
+	if err != nil {
+		return nil, fmt.Errorf("key agreement failed: %v", err)
+	}
+
+	kemContext := append(append([]byte{}, enc...), k.key.PublicKey().Bytes()...)
+
+	hash := kemHashes[k.ID()]
+	suiteID := []byte("KEM\x00\x00")
+	binary.BigEndian.PutUint16(suiteID[3:], uint16(k.ID()))
+
+	prk := hkdf.Extract(hash.New, labeled(suiteID, "eae_prk", dh), nil)
+	info := make([]byte, 2)
+	binary.BigEndian.PutUint16(info, uint16(hash.Size()))
+	sharedSecret := make([]byte, hash.Size())
+	if _, err := io.ReadFull(hkdf.Expand(hash.New, prk, append(info, labeled(suiteID, "shared_secret", kemContext)...)), sharedSecret); err != nil {
+		return nil, err
+	}
+	return sharedSecret, nil
+}
+
+// labeled is the "HPKE-v1" || suite_id || label || value of LabeledExtract and LabeledExpand.
+func labeled(suiteID []byte, label string, value []byte) []byte {
+	b := append([]byte("HPKE-v1"), suiteID...)
+	b = append(b, label...)
+	return append(b, value...)
+}
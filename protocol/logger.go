@@ -0,0 +1,22 @@
+package protocol
+
+// Logger receives structured events from the decryption and verification pipeline.
+// kv are alternating keys and values, so a *slog.Logger can be used as is.
+// Implementations never receive private keys or plaintext, only sizes, hashes and results.
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+
+// NopLogger discards every event.
+var NopLogger Logger = nopLogger{}
+
+// Log receives the events of the handover parsers and is the default logger of verification.
+var Log = NopLogger
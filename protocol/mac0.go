@@ -0,0 +1,108 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/veraison/go-cose"
+)
+
+// AlgorithmHMAC256 is HMAC 256/256 (RFC 9053 3.1), the only deviceMac algorithm of ISO 18013-5 9.1.3.5.
+const AlgorithmHMAC256 cose.Algorithm = 5
+
+var ErrMacMismatch = errors.New("COSE_Mac0 tag mismatch")
+
+type coseMac0 struct {
+	_           struct{} `cbor:",toarray"`
+	Protected   cbor.RawMessage
+	Unprotected cose.UnprotectedHeader
+	Payload     []byte
+	Tag         []byte
+}
+
+// VerifyCOSEMac0 verifies a tagged or untagged COSE_Mac0 made with HMAC 256/256 and key, e.g.
+// the EMacKey of DeriveEMacKey. externalPayload is handled as in VerifyCOSESign1.
+func VerifyCOSEMac0(mac0 []byte, externalPayload []byte, key []byte) error {
+	var msg coseMac0
+	if len(mac0) > 0 && mac0[0] == 0xd1 { // tag 17
+		var tag cbor.RawTag
+		if err := DecMode.Unmarshal(mac0, &tag); err != nil {
+			return fmt.Errorf("failed to parse COSE_Mac0: %v", err)
+		}
+		mac0 = tag.Content
+	}
+	if err := DecMode.Unmarshal(mac0, &msg); err != nil {
+		return fmt.Errorf("failed to parse COSE_Mac0: %v", err)
+	}
+
+	var protected cose.ProtectedHeader
+	if err := protected.UnmarshalCBOR(msg.Protected); err != nil {
+		return fmt.Errorf("failed to parse COSE_Mac0 protected header: %v", err)
+	}
+	if err := CheckCOSEHeaders(cose.Headers{Protected: protected, Unprotected: msg.Unprotected}); err != nil {
+		return err
+	}
+	alg, err := protected.Algorithm()
+	if err != nil {
+		return fmt.Errorf("failed to get alg: %v", err)
+	}
+	if alg != AlgorithmHMAC256 {
+		return fmt.Errorf("unsupported COSE_Mac0 alg: %v", alg)
+	}
+
+	payload := msg.Payload
+	if externalPayload != nil {
+		if payload != nil && !hmac.Equal(payload, externalPayload) {
+			return ErrConflictingPayload
+		}
+		payload = externalPayload
+	}
+	if payload == nil {
+		return ErrMissingPayload
+	}
+
+	expected, err := coseMac0Tag(msg.Protected, payload, key)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(expected, msg.Tag) {
+		return ErrMacMismatch
+	}
+	return nil
+}
+
+// coseMac0Tag computes the tag over MAC_structure (RFC 9052 6.3) with an empty external_aad.
+func coseMac0Tag(protected cbor.RawMessage, payload, key []byte) ([]byte, error) {
+	toBeMaced, err := EncMode.Marshal([]interface{}{"MAC0", protected, []byte{}, payload})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal MAC_structure: %v", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(toBeMaced)
+	return mac.Sum(nil), nil
+}
+
+// CreateCOSEMac0 returns an untagged COSE_Mac0 over payload with HMAC 256/256.
+// The payload is detached, as deviceMac is sent.
+func CreateCOSEMac0(payload, key []byte) ([]byte, error) {
+	protected, err := EncMode.Marshal(map[int64]interface{}{cose.HeaderLabelAlgorithm: int64(AlgorithmHMAC256)})
+	if err != nil {
+		return nil, err
+	}
+	protectedBytes, err := EncMode.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	tag, err := coseMac0Tag(protectedBytes, payload, key)
+	if err != nil {
+		return nil, err
+	}
+	return EncMode.Marshal(coseMac0{
+		Protected:   protectedBytes,
+		Unprotected: cose.UnprotectedHeader{},
+		Tag:         tag,
+	})
+}
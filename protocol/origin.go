@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+var (
+	ErrInvalidOrigin  = errors.New("invalid origin")
+	ErrInsecureOrigin = errors.New("origin is not https")
+	ErrOpaqueOrigin   = errors.New("opaque origin")
+)
+
+// NormalizeOrigin serializes raw the way browsers serialize an origin
+// (HTML "serialization of an origin"): lowercase scheme and host, no default port,
+// no path. The DC API handover hashes the origin, so anything else silently breaks it.
+//
+// Only https origins are accepted. A trailing "/" is tolerated, any other path,
+// query, fragment or userinfo is rejected rather than dropped.
+func NormalizeOrigin(raw string) (string, error) {
+	if raw == "null" {
+		return "", ErrOpaqueOrigin
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidOrigin, err)
+	}
+	if u.Opaque != "" || u.Host == "" {
+		return "", fmt.Errorf("%w: %q", ErrOpaqueOrigin, raw)
+	}
+	if scheme := strings.ToLower(u.Scheme); scheme != "https" {
+		return "", fmt.Errorf("%w: %q", ErrInsecureOrigin, raw)
+	}
+	if u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.ForceQuery {
+		return "", fmt.Errorf("%w: %q is not just scheme, host and port", ErrInvalidOrigin, raw)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return "", fmt.Errorf("%w: %q has no host", ErrInvalidOrigin, raw)
+	}
+	if port := u.Port(); port != "" && port != "443" {
+		return "https://" + net.JoinHostPort(host, port), nil
+	}
+	if strings.Contains(host, ":") {
+		return "https://[" + host + "]", nil
+	}
+	return "https://" + host, nil
+}
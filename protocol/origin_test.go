@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalizeOrigin(t *testing.T) {
+	for raw, want := range map[string]string{
+		"https://example.com":             "https://example.com",
+		"https://example.com:443":         "https://example.com",
+		"https://example.com/":            "https://example.com",
+		"HTTPS://Example.COM":             "https://example.com",
+		"https://example.com:8443":        "https://example.com:8443",
+		"https://[2001:db8::1]:443":       "https://[2001:db8::1]",
+		"https://[2001:db8::1]:8443/":     "https://[2001:db8::1]:8443",
+		"https://digital-credentials.dev": "https://digital-credentials.dev",
+	} {
+		got, err := NormalizeOrigin(raw)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", raw, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: got %s, want %s", raw, got, want)
+		}
+	}
+
+	for raw, want := range map[string]error{
+		"http://example.com":           ErrInsecureOrigin,
+		"null":                         ErrOpaqueOrigin,
+		"data:text/plain,hello":        ErrOpaqueOrigin,
+		"example.com":                  ErrOpaqueOrigin,
+		"https://example.com/path":     ErrInvalidOrigin,
+		"https://example.com/?q=1":     ErrInvalidOrigin,
+		"https://user@example.com":     ErrInvalidOrigin,
+		"https://example.com#fragment": ErrInvalidOrigin,
+	} {
+		if _, err := NormalizeOrigin(raw); !errors.Is(err, want) {
+			t.Errorf("%s: expected %v, got %v", raw, want, err)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/fxamacker/cbor/v2"
+	"golang.org/x/crypto/hkdf"
+)
+
+// SessionData status codes, ISO 18013-5 Table 20.
+const (
+	SessionStatusEncryptionError uint = 10
+	SessionStatusDecodingError   uint = 11
+	SessionStatusTermination     uint = 20
+)
+
+var (
+	ErrSessionDecrypt   = errors.New("session data decryption failed")
+	ErrSessionExhausted = errors.New("session message counter exhausted")
+)
+
+// SessionRole is the side of a proximity session a SessionEncryption acts for.
+type SessionRole int
+
+const (
+	RoleReader SessionRole = iota
+	RoleDevice
+)
+
+// SessionEstablishment is the first message of the reader, ISO 18013-5 9.1.1.4.
+type SessionEstablishment struct {
+	// EReaderKeyBytes is the COSE_Key of the reader ephemeral key wrapped in tag 24.
+	EReaderKeyBytes cbor.Tag `json:"eReaderKey"`
+	Data            []byte   `json:"data"`
+}
+
+// SessionDataMessage is every later message, ISO 18013-5 9.1.1.4. It is not the
+// SessionData of a web session.
+type SessionDataMessage struct {
+	Data   []byte `json:"data,omitempty"`
+	Status *uint  `json:"status,omitempty"`
+}
+
+// SessionEncryption encrypts the messages of one side of a session and decrypts the
+// messages of the other, ISO 18013-5 9.1.1.5. It is not safe for concurrent use.
+type SessionEncryption struct {
+	role       SessionRole
+	send, recv cipher.AEAD
+	// sendCounter and recvCounter are the message counters of the next messages, from 1.
+	sendCounter, recvCounter uint32
+}
+
+// NewSessionEncryption derives SKReader and SKDevice from the ECDH of key, the own
+// ephemeral key, and peer, the ephemeral key of the other side:
+//
+//	SK = HKDF-SHA256(IKM = ECDH, salt = SHA-256(SessionTranscriptBytes), info = "SKReader" or "SKDevice", L = 32)
+//
+// sessionTranscript is the bare SessionTranscript array, as for DeriveEMacKey.
+func NewSessionEncryption(role SessionRole, key KeyAgreement, peer *ecdh.PublicKey, sessionTranscript []byte) (*SessionEncryption, error) {
+	sharedSecret, err := key.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute shared secret: %v", err)
+	}
+	skReader, err := deriveSessionKey(sharedSecret, sessionTranscript, "SKReader")
+	if err != nil {
+		return nil, err
+	}
+	skDevice, err := deriveSessionKey(sharedSecret, sessionTranscript, "SKDevice")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SessionEncryption{role: role, sendCounter: 1, recvCounter: 1}
+	sendKey, recvKey := skReader, skDevice
+	if role == RoleDevice {
+		sendKey, recvKey = skDevice, skReader
+	}
+	if s.send, err = newSessionAEAD(sendKey); err != nil {
+		return nil, err
+	}
+	if s.recv, err = newSessionAEAD(recvKey); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func deriveSessionKey(sharedSecret, sessionTranscript []byte, info string) ([]byte, error) {
+	sessionTranscriptBytes, err := TagEncodedCBOR(sessionTranscript)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal SessionTranscriptBytes: %v", err)
+	}
+	salt := sha256.Sum256(sessionTranscriptBytes)
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, sharedSecret, salt[:], []byte(info)), key); err != nil {
+		return nil, fmt.Errorf("failed to derive %s: %v", info, err)
+	}
+	return key, nil
+}
+
+func newSessionAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sessionIV is identifier || counter, the identifier being 0 for the reader and 1 for the device.
+func sessionIV(role SessionRole, counter uint32) []byte {
+	iv := make([]byte, 12)
+	if role == RoleDevice {
+		iv[7] = 1
+	}
+	binary.BigEndian.PutUint32(iv[8:], counter)
+	return iv
+}
+
+func (s *SessionEncryption) peer() SessionRole {
+	if s.role == RoleReader {
+		return RoleDevice
+	}
+	return RoleReader
+}
+
+// Encrypt encrypts the next message of this side.
+func (s *SessionEncryption) Encrypt(plaintext []byte) ([]byte, error) {
+	if s.sendCounter == math.MaxUint32 {
+		return nil, ErrSessionExhausted
+	}
+	ciphertext := s.send.Seal(nil, sessionIV(s.role, s.sendCounter), plaintext, nil)
+	s.sendCounter++
+	return ciphertext, nil
+}
+
+// Decrypt decrypts the next message of the other side. Messages must arrive in order,
+// a replayed or dropped message fails to decrypt.
+func (s *SessionEncryption) Decrypt(ciphertext []byte) ([]byte, error) {
+	if s.recvCounter == math.MaxUint32 {
+		return nil, ErrSessionExhausted
+	}
+	plaintext, err := s.recv.Open(nil, sessionIV(s.peer(), s.recvCounter), ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: message %d: %v", ErrSessionDecrypt, s.recvCounter, err)
+	}
+	s.recvCounter++
+	return plaintext, nil
+}
+
+// SessionEstablishment encrypts the first request of the reader, typically a
+// DeviceRequest, together with the public key of eReaderKey.
+func (s *SessionEncryption) SessionEstablishment(eReaderKey *ecdh.PublicKey, request []byte) ([]byte, error) {
+	if s.role != RoleReader {
+		return nil, errors.New("only the reader establishes a session")
+	}
+	coseKey, err := MarshalCOSEKey(eReaderKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.Encrypt(request)
+	if err != nil {
+		return nil, err
+	}
+	return EncMode.Marshal(SessionEstablishment{
+		EReaderKeyBytes: cbor.Tag{Number: 24, Content: coseKey},
+		Data:            data,
+	})
+}
+
+// ParseSessionEstablishment returns the reader ephemeral key and the still encrypted
+// request of a SessionEstablishment, for the device to set up its SessionEncryption.
+func ParseSessionEstablishment(data []byte) (*ecdh.PublicKey, []byte, error) {
+	var msg SessionEstablishment
+	if err := DecMode.Unmarshal(data, &msg); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse SessionEstablishment: %v", err)
+	}
+	coseKey, ok := msg.EReaderKeyBytes.Content.([]byte)
+	if msg.EReaderKeyBytes.Number != 24 || !ok {
+		return nil, nil, errors.New("eReaderKey is not an encoded CBOR data item")
+	}
+	eReaderKey, err := ParseCOSEKeyECDH(coseKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid eReaderKey: %v", err)
+	}
+	return eReaderKey, msg.Data, nil
+}
+
+// Seal encrypts plaintext as the next SessionData of this side.
+func (s *SessionEncryption) Seal(plaintext []byte) ([]byte, error) {
+	data, err := s.Encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return EncMode.Marshal(SessionDataMessage{Data: data})
+}
+
+// Open decrypts the next SessionData of the other side. The status is 0 when absent.
+// A SessionData with only a status, e.g. SessionStatusTermination, has no plaintext.
+func (s *SessionEncryption) Open(sessionData []byte) ([]byte, uint, error) {
+	var msg SessionDataMessage
+	if err := DecMode.Unmarshal(sessionData, &msg); err != nil {
+		return nil, 0, fmt.Errorf("failed to parse SessionData: %v", err)
+	}
+	var status uint
+	if msg.Status != nil {
+		status = *msg.Status
+	}
+	if msg.Data == nil {
+		return nil, status, nil
+	}
+	plaintext, err := s.Decrypt(msg.Data)
+	if err != nil {
+		return nil, status, err
+	}
+	return plaintext, status, nil
+}
+
+// SessionStatus encodes a SessionData carrying only status, e.g. to end the session.
+func SessionStatus(status uint) ([]byte, error) {
+	return EncMode.Marshal(SessionDataMessage{Status: &status})
+}
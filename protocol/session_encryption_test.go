@@ -0,0 +1,240 @@
+package protocol
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestSessionEncryptionKnownAnswer(t *testing.T) {
+	decode := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	// The keys and transcript of TestDeriveEMacKeyKnownAnswer. SKReader and SKDevice were
+	// computed with OpenSSL, the ciphertexts with AES-256-GCM of the standard library.
+	eReaderKey, err := ecdh.P256().NewPrivateKey(decode("de3b4b9e5f72dd9b58406ae3091434da48a6f9fd010d88fcb0958e2cebec947c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	eDeviceKey, err := ecdh.P256().NewPrivateKey(decode("c9afa9d845ba75166b5c215767b1d6934e50c3db36e89b127b8a622b120f6721"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// [null, null, ["AndroidHandoverv1", h'01', h'02', h'03']]
+	sessionTranscript := decode("83f6f68471416e64726f696448616e646f7665727631410141024103")
+
+	zab, err := eReaderKey.ECDH(eDeviceKey.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for info, want := range map[string]string{
+		"SKReader": "ac18b0f7d65f2e507e8bfc5f8fb1563d4b3ec7ab6fe2bc41e923336533d03e4a",
+		"SKDevice": "ce76edda11a0847de449592c2c44af5103e3ee8b4bf4a0a2d0990547d76a4f37",
+	} {
+		key, err := deriveSessionKey(zab, sessionTranscript, info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(key) != want {
+			t.Fatalf("got %s %x, want %s", info, key, want)
+		}
+	}
+
+	// The first message of each side: identifier 0 or 1, counter 1.
+	for _, tc := range []struct {
+		role      SessionRole
+		key       *ecdh.PrivateKey
+		peer      *ecdh.PublicKey
+		plaintext string
+		want      string
+	}{
+		{RoleReader, eReaderKey, eDeviceKey.PublicKey(), "device request", "16b967a7e441e7ffc2e5ea9f3164646a8c620d84bb1caae3960227f72d25"},
+		{RoleDevice, eDeviceKey, eReaderKey.PublicKey(), "device response", "65134ae97ca98c453d155eed5faf491e1b4c74c5d236a95f32d4a03b17ae9a"},
+	} {
+		s, err := NewSessionEncryption(tc.role, tc.key, tc.peer, sessionTranscript)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphertext, err := s.Encrypt([]byte(tc.plaintext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(ciphertext) != tc.want {
+			t.Fatalf("got %x, want %s", ciphertext, tc.want)
+		}
+	}
+}
+
+func TestSessionEncryption(t *testing.T) {
+	eReaderKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eDeviceKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// [null, null, ["AndroidHandoverv1", h'01', h'02', h'03']]
+	sessionTranscript, _ := hex.DecodeString("83f6f68471416e64726f696448616e646f7665727631410141024103")
+
+	reader, err := NewSessionEncryption(RoleReader, eReaderKey, eDeviceKey.PublicKey(), sessionTranscript)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	establishment, err := reader.SessionEstablishment(eReaderKey.PublicKey(), []byte("device request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readerPub, encrypted, err := ParseSessionEstablishment(establishment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !readerPub.Equal(eReaderKey.PublicKey()) {
+		t.Fatal("unexpected eReaderKey")
+	}
+
+	device, err := NewSessionEncryption(RoleDevice, eDeviceKey, readerPub, sessionTranscript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := device.Decrypt(encrypted)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(request) != "device request" {
+		t.Fatalf("unexpected request: %q", request)
+	}
+
+	t.Run("SessionData", func(t *testing.T) {
+		for i, msg := range []string{"device response", "second response"} {
+			sessionData, err := device.Seal([]byte(msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			plaintext, status, err := reader.Open(sessionData)
+			if err != nil {
+				t.Fatalf("message %d: unexpected error: %v", i, err)
+			}
+			if string(plaintext) != msg || status != 0 {
+				t.Fatalf("message %d: unexpected plaintext %q, status %d", i, plaintext, status)
+			}
+		}
+
+		// The reader's next request is its second message.
+		sessionData, err := reader.Seal([]byte("next request"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plaintext, _, err := device.Open(sessionData); err != nil || string(plaintext) != "next request" {
+			t.Fatalf("unexpected plaintext %q: %v", plaintext, err)
+		}
+
+		// Replaying it fails, the counter has moved on.
+		if _, _, err := device.Open(sessionData); !errors.Is(err, ErrSessionDecrypt) {
+			t.Fatalf("replay: unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Direction", func(t *testing.T) {
+		// A message reflected back to its sender does not decrypt with the other key.
+		reader, err := NewSessionEncryption(RoleReader, eReaderKey, eDeviceKey.PublicKey(), sessionTranscript)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphertext, err := reader.Encrypt([]byte("request"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reader.Decrypt(ciphertext); !errors.Is(err, ErrSessionDecrypt) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Termination", func(t *testing.T) {
+		sessionData, err := SessionStatus(SessionStatusTermination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, status, err := reader.Open(sessionData)
+		if err != nil || plaintext != nil || status != SessionStatusTermination {
+			t.Fatalf("unexpected plaintext %q, status %d: %v", plaintext, status, err)
+		}
+	})
+
+	t.Run("Transcript", func(t *testing.T) {
+		other, err := NewSessionEncryption(RoleDevice, eDeviceKey, readerPub, []byte{0x80})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := other.Decrypt(encrypted); !errors.Is(err, ErrSessionDecrypt) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestMarshalCOSEKey(t *testing.T) {
+	for _, curve := range []ecdh.Curve{ecdh.P256(), ecdh.P384(), ecdh.P521(), ecdh.X25519()} {
+		key, err := curve.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := MarshalCOSEKey(key.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := ParseCOSEKeyECDH(data)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", curve, err)
+		}
+		if !pub.Equal(key.PublicKey()) {
+			t.Fatalf("%v: unexpected key", curve)
+		}
+	}
+
+	t.Run("ECDSA", func(t *testing.T) {
+		key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := MarshalCOSEKey(&key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := ParseCOSEKey(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !key.PublicKey.Equal(pub) {
+			t.Fatal("unexpected key")
+		}
+	})
+
+	t.Run("Ed25519", func(t *testing.T) {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := MarshalCOSEKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := ParseCOSEKey(data)
+		if err != nil || !pub.Equal(parsed) {
+			t.Fatalf("unexpected key %v: %v", parsed, err)
+		}
+		// Ed25519 is a signature key only.
+		if _, err := ParseCOSEKeyECDH(data); err == nil {
+			t.Fatal("used an Ed25519 key for key agreement")
+		}
+	})
+}
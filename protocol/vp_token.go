@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var ErrInvalidVPToken = errors.New("invalid vp_token")
+
+// ParseVPToken returns the base64url-decoded mdoc responses of an OpenID4VP vp_token,
+// which is a single string, an array of strings, or a DCQL map keyed by query id.
+// Responses of a DCQL map are returned in query id order, see ParseDCQLVPToken to keep the ids.
+func ParseVPToken(vpToken json.RawMessage) ([][]byte, error) {
+	byQuery, err := ParseDCQLVPToken(vpToken)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(byQuery))
+	for id := range byQuery {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var tokens [][]byte
+	for _, id := range ids {
+		tokens = append(tokens, byQuery[id]...)
+	}
+	return tokens, nil
+}
+
+// ParseDCQLVPToken is ParseVPToken keeping the DCQL query id of every response.
+// The responses of a vp_token that is not a map are returned under the id "".
+func ParseDCQLVPToken(vpToken json.RawMessage) (map[string][][]byte, error) {
+	var byQuery map[string]json.RawMessage
+	if err := json.Unmarshal(vpToken, &byQuery); err != nil {
+		tokens, err := parseVPTokenValue(vpToken)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][][]byte{"": tokens}, nil
+	}
+
+	if len(byQuery) == 0 {
+		return nil, fmt.Errorf("%w: empty", ErrInvalidVPToken)
+	}
+	parsed := make(map[string][][]byte, len(byQuery))
+	for id, value := range byQuery {
+		tokens, err := parseVPTokenValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("query %q: %w", id, err)
+		}
+		parsed[id] = tokens
+	}
+	return parsed, nil
+}
+
+// parseVPTokenValue decodes a string or an array of strings.
+func parseVPTokenValue(value json.RawMessage) ([][]byte, error) {
+	var encoded []string
+	var single string
+	if err := json.Unmarshal(value, &single); err == nil {
+		encoded = []string{single}
+	} else if err := json.Unmarshal(value, &encoded); err != nil {
+		return nil, fmt.Errorf("%w: not a string, array or map", ErrInvalidVPToken)
+	}
+	if len(encoded) == 0 {
+		return nil, fmt.Errorf("%w: empty", ErrInvalidVPToken)
+	}
+
+	tokens := make([][]byte, 0, len(encoded))
+	for i, s := range encoded {
+		// Wallets differ on padding, so accept both.
+		token, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+		if err != nil {
+			return nil, fmt.Errorf("%w: response %d is not base64url: %v", ErrInvalidVPToken, i, err)
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
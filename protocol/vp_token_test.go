@@ -0,0 +1,60 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseVPToken(t *testing.T) {
+	// "o2dtZG9j" and "oWR0ZXN0" are base64url without padding, "AQI=" is padded.
+	for name, tt := range map[string]struct {
+		vpToken string
+		want    [][]byte
+	}{
+		"String": {`"o2dtZG9j"`, [][]byte{{0xa3, 0x67, 0x6d, 0x64, 0x6f, 0x63}}},
+		"Padded": {`"AQI="`, [][]byte{{1, 2}}},
+		"Array":  {`["AQI=", "o2dtZG9j"]`, [][]byte{{1, 2}, {0xa3, 0x67, 0x6d, 0x64, 0x6f, 0x63}}},
+		"DCQL":   {`{"pid": ["o2dtZG9j"], "mdl": "AQI"}`, [][]byte{{1, 2}, {0xa3, 0x67, 0x6d, 0x64, 0x6f, 0x63}}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := ParseVPToken(json.RawMessage(tt.vpToken))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d responses, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if !bytes.Equal(got[i], tt.want[i]) {
+					t.Fatalf("response %d: got %x, want %x", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+
+	t.Run("QueryIDs", func(t *testing.T) {
+		byQuery, err := ParseDCQLVPToken(json.RawMessage(`{"mdl": ["AQI", "AQM"], "pid": "AQQ"}`))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(byQuery["mdl"]) != 2 || len(byQuery["pid"]) != 1 || !bytes.Equal(byQuery["pid"][0], []byte{1, 4}) {
+			t.Fatalf("unexpected responses: %v", byQuery)
+		}
+	})
+
+	for name, vpToken := range map[string]string{
+		"Number":      `1`,
+		"EmptyArray":  `[]`,
+		"EmptyMap":    `{}`,
+		"NotBase64":   `"!!!"`,
+		"NestedEmpty": `{"mdl": []}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseVPToken(json.RawMessage(vpToken)); !errors.Is(err, ErrInvalidVPToken) {
+				t.Fatalf("expected ErrInvalidVPToken, got %v", err)
+			}
+		})
+	}
+}